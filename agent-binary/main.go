@@ -0,0 +1,83 @@
+package main
+
+import (
+	"distributed-inmemory-cache/agent"
+	"distributed-inmemory-cache/logging"
+	"distributed-inmemory-cache/pki"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The node agent runs on every host that should carry nodes. The master
+// lists its url under service.nodes.agents and asks it to start and kill nodes.
+func main() {
+	wd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Error getting current working directory: %v", err)
+	}
+
+	listen := flag.String("listen", "localhost:4100", "address the agent listens on, host:port")
+	tlsCert := flag.String("tls-cert", "", "certificate of the cluster CA, the agent then serves https and only lets the master in")
+	tlsKey := flag.String("tls-key", "", "key of -tls-cert")
+	tlsCA := flag.String("tls-ca", "", "cluster CA certificate")
+	tokenFile := flag.String("token-file", "", "file holding the token the master authenticates with, defaults to $"+agent.TokenEnv)
+	binary := flag.String("binary", filepath.Join(wd, "node-binary", "node"), "path of the node binary")
+	logDir := flag.String("log-dir", "", "directory of agent.log, standard output only when empty")
+	logLevel := flag.String("log-level", "info", "debug, info, warn or error")
+	flag.Parse()
+
+	err = logging.Setup(logging.Options{Dir: *logDir, File: "agent.log", Level: *logLevel, Stdout: true})
+	if err != nil {
+		log.Fatalf("Error setting up logging: %v", err)
+	}
+
+	logger := logging.Component("agent")
+	token := os.Getenv(agent.TokenEnv)
+	if *tokenFile != "" {
+		content, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			log.Fatalf("Error reading the agent token: %v", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token == "" {
+		log.Fatalf("The agent needs a token, set %s or pass -token-file", agent.TokenEnv)
+	}
+
+	server := &http.Server{Addr: *listen, Handler: agent.NewServer(*binary, token).Handler()}
+	if *tlsCert == "" {
+		logger.Warn("serving without TLS, spawn requests and the token travel in the clear")
+		logger.Info("agent running", "listen", *listen, "binary", *binary)
+		err = server.ListenAndServe()
+	} else {
+		identity, loadErr := loadIdentity(*tlsCert, *tlsKey, *tlsCA)
+		if loadErr != nil {
+			log.Fatalf("Error loading the agent certificate: %v", loadErr)
+		}
+		server.TLSConfig = identity.ServerConfig()
+		server.Handler = pki.RequirePeer(pki.MasterName, server.Handler.ServeHTTP)
+		logger.Info("agent running with mTLS", "listen", *listen, "binary", *binary, "not_after", identity.Leaf().NotAfter)
+		err = server.ListenAndServeTLS("", "")
+	}
+	logger.Error("agent stopped", "error", err)
+	os.Exit(1)
+}
+
+func loadIdentity(certPath string, keyPath string, caPath string) (*pki.Identity, error) {
+	var bundle pki.Bundle
+	var err error
+	if bundle.CertPEM, err = os.ReadFile(certPath); err != nil {
+		return nil, err
+	}
+	if bundle.KeyPEM, err = os.ReadFile(keyPath); err != nil {
+		return nil, err
+	}
+	if bundle.CAPEM, err = os.ReadFile(caPath); err != nil {
+		return nil, err
+	}
+	return pki.NewIdentity(bundle)
+}
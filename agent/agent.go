@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TokenEnv is the variable the agent reads its token from. It is the one
+// CACHE_ variable the agent does not pass on to the nodes it spawns.
+const TokenEnv = "CACHE_AGENT_TOKEN"
+
+// EnvPrefix is the prefix of every variable a spawn request may set, the
+// variables the node binary reads. Others, like PATH or LD_PRELOAD, are refused.
+const EnvPrefix = "CACHE_"
+
+// Server is the node agent. It runs on every host that carries nodes and
+// spawns, kills and lists node processes when the master asks it to.
+type Server struct {
+	processes *Processes
+	token     string
+}
+
+// NewServer returns an agent that only answers requests carrying token as a
+// bearer token. An empty token refuses every request.
+func NewServer(binary string, token string) *Server {
+	return &Server{processes: NewProcesses(binary), token: token}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/spawn", s.spawnHandler)
+	mux.HandleFunc("/kill", s.killHandler)
+	mux.HandleFunc("/processes", s.processesHandler)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	return s.authorize(mux)
+}
+
+// authorize refuses requests without the agent's token on every endpoint.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or invalid agent token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AllowedEnv tells whether a spawn request may set the variable key.
+func AllowedEnv(key string) bool {
+	return strings.HasPrefix(key, EnvPrefix) && key != TokenEnv
+}
+
+func (s *Server) spawnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var request model.SpawnRequest
+	if err := json.Unmarshal(body, &request); err != nil || request.Port <= 0 || request.MasterAddress == "" {
+		http.Error(w, "Invalid spawn request", http.StatusBadRequest)
+		return
+	}
+	for key := range request.Env {
+		if !AllowedEnv(key) {
+			http.Error(w, fmt.Sprintf("Environment variable %s is not allowed, only %s variables are", key, EnvPrefix), http.StatusBadRequest)
+			return
+		}
+	}
+
+	info, err := s.processes.Spawn(request)
+	if errors.Is(err, ErrPortInUse) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not start node: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+func (s *Server) killHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil {
+		http.Error(w, "Invalid port", http.StatusBadRequest)
+		return
+	}
+	err = s.processes.Kill(port)
+	if errors.Is(err, ErrProcessNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) processesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(s.processes.List())
+}
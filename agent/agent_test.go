@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"distributed-inmemory-cache/model"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeNodeBinary writes a stand-in for the node binary that records its
+// arguments and runs until it is killed.
+func fakeNodeBinary(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	binary := filepath.Join(dir, "node")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\nexec sleep 30\n"
+	if err := os.WriteFile(binary, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return binary, argsFile
+}
+
+func TestAgentsOnLoopback(t *testing.T) {
+	binary, argsFile := fakeNodeBinary(t)
+
+	var clients []*Client
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(NewServer(binary, "agent-token").Handler())
+		defer server.Close()
+		clients = append(clients, NewClient(server.URL, "agent-token"))
+	}
+
+	for i, client := range clients {
+		if client.Host() != "127.0.0.1" {
+			t.Fatalf("expected the loopback host, got %s", client.Host())
+		}
+		port := 5001 + i
+		info, err := client.Spawn(model.SpawnRequest{MasterAddress: "10.0.0.1:3000", Port: port})
+		if err != nil {
+			t.Fatalf("spawn on agent %d: %v", i, err)
+		}
+		if info.Port != port || info.PID == 0 || !info.Running {
+			t.Fatalf("unexpected process info: %+v", info)
+		}
+		if _, err := client.Spawn(model.SpawnRequest{MasterAddress: "10.0.0.1:3000", Port: port}); err == nil {
+			t.Fatalf("expected a second node on port %d to be refused", port)
+		}
+	}
+
+	for i, client := range clients {
+		list, err := client.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Port != 5001+i || !list[0].Running {
+			t.Fatalf("agent %d lists %+v", i, list)
+		}
+	}
+
+	for i, client := range clients {
+		if err := client.Kill(5001 + i); err != nil {
+			t.Fatalf("kill on agent %d: %v", i, err)
+		}
+		list, _ := client.List()
+		if len(list) != 1 || list[0].Running {
+			t.Fatalf("expected the node on agent %d to be stopped, got %+v", i, list)
+		}
+		if err := client.Kill(5001 + i); err == nil {
+			t.Fatal("expected killing a stopped node to fail")
+		}
+	}
+
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(args), "10.0.0.1:3000 5001") || !strings.Contains(string(args), "10.0.0.1:3000 5002") {
+		t.Errorf("node binary started with unexpected arguments: %q", args)
+	}
+}
+
+func TestAgentRefusesRequestsWithoutItsToken(t *testing.T) {
+	binary, argsFile := fakeNodeBinary(t)
+	server := httptest.NewServer(NewServer(binary, "agent-token").Handler())
+	defer server.Close()
+
+	for _, token := range []string{"", "wrong"} {
+		client := NewClient(server.URL, token)
+		if _, err := client.List(); err == nil {
+			t.Errorf("expected the agent to refuse the token %q", token)
+		}
+		if _, err := client.Spawn(model.SpawnRequest{MasterAddress: "10.0.0.1:3000", Port: 5003}); err == nil {
+			t.Errorf("expected the agent to refuse a spawn with the token %q", token)
+		}
+	}
+	tokenless := httptest.NewServer(NewServer(binary, "").Handler())
+	defer tokenless.Close()
+	if _, err := NewClient(tokenless.URL, "").List(); err == nil {
+		t.Error("expected an agent without a token to refuse everything")
+	}
+
+	client := NewClient(server.URL, "agent-token")
+	for _, key := range []string{"LD_PRELOAD", "PATH", TokenEnv} {
+		request := model.SpawnRequest{MasterAddress: "10.0.0.1:3000", Port: 5003, Env: map[string]string{key: "x"}}
+		if _, err := client.Spawn(request); err == nil {
+			t.Errorf("expected a spawn setting %s to be refused", key)
+		}
+	}
+	if _, err := os.ReadFile(argsFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("no node should have been started, got %v", err)
+	}
+}
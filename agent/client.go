@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"bytes"
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is the master's side of a node agent.
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client of the agent at baseURL that authenticates
+// with token.
+func NewClient(baseURL string, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: killGracePeriod + 5*time.Second},
+	}
+}
+
+// Host is the host name the agent is reached on, which is also where the
+// nodes it spawns listen.
+func (c *Client) Host() string {
+	parsed, err := url.Parse(c.BaseURL)
+	if err != nil || parsed.Hostname() == "" {
+		return "localhost"
+	}
+	return parsed.Hostname()
+}
+
+func (c *Client) Spawn(request model.SpawnRequest) (model.ProcessInfo, error) {
+	var info model.ProcessInfo
+	body, err := json.Marshal(request)
+	if err != nil {
+		return info, err
+	}
+	resp, err := c.do(http.MethodPost, "/spawn", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return info, statusError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+func (c *Client) Kill(port int) error {
+	resp, err := c.do(http.MethodPost, "/kill?port="+strconv.Itoa(port), "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	return nil
+}
+
+func (c *Client) List() ([]model.ProcessInfo, error) {
+	resp, err := c.do(http.MethodGet, "/processes", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+	var list []model.ProcessInfo
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list, err
+}
+
+func (c *Client) do(method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	request.Header.Set("Authorization", "Bearer "+c.Token)
+	return c.HTTPClient.Do(request)
+}
+
+func statusError(resp *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("agent answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"distributed-inmemory-cache/logging"
+	"distributed-inmemory-cache/model"
+	"errors"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const killGracePeriod = 10 * time.Second
+
+var processLog = logging.Component("agent")
+
+var (
+	ErrPortInUse       = errors.New("a node is already running on this port")
+	ErrProcessNotFound = errors.New("no node process on this port")
+)
+
+// Processes starts node binaries on this host and keeps track of them. The
+// agent serves it over http, the master uses it directly for local nodes.
+type Processes struct {
+	binary    string
+	mu        sync.Mutex
+	processes map[int]*process
+}
+
+func NewProcesses(binary string) *Processes {
+	return &Processes{binary: binary, processes: make(map[int]*process)}
+}
+
+type process struct {
+	cmd  *exec.Cmd
+	info model.ProcessInfo
+	done chan struct{}
+}
+
+// Spawn starts the node binary as a daemon, detached in its own session so it
+// outlives the process that started it.
+func (p *Processes) Spawn(request model.SpawnRequest) (model.ProcessInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if existing, ok := p.processes[request.Port]; ok && existing.info.Running {
+		return existing.info, ErrPortInUse
+	}
+
+	cmd := exec.Command(p.binary, request.MasterAddress, strconv.Itoa(request.Port))
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+	// The agent's token stays with the agent
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, TokenEnv+"=") {
+			cmd.Env = append(cmd.Env, variable)
+		}
+	}
+	for key, value := range request.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return model.ProcessInfo{}, err
+	}
+
+	proc := &process{
+		cmd: cmd,
+		info: model.ProcessInfo{
+			Port:      request.Port,
+			PID:       cmd.Process.Pid,
+			StartedAt: time.Now().UnixMilli(),
+			Running:   true,
+		},
+		done: make(chan struct{}),
+	}
+	p.processes[request.Port] = proc
+	processLog.Info("started node", "port", request.Port, "pid", proc.info.PID)
+
+	go func() {
+		err := cmd.Wait()
+		p.mu.Lock()
+		proc.info.Running = false
+		if err != nil {
+			proc.info.ExitError = err.Error()
+		}
+		p.mu.Unlock()
+		close(proc.done)
+		processLog.Info("node exited", "port", request.Port, "error", err)
+	}()
+
+	return proc.info, nil
+}
+
+// Kill stops the node on port with SIGTERM, and SIGKILL if it is still
+// running after the grace period.
+func (p *Processes) Kill(port int) error {
+	p.mu.Lock()
+	proc, ok := p.processes[port]
+	running := ok && proc.info.Running
+	p.mu.Unlock()
+	if !running {
+		return ErrProcessNotFound
+	}
+
+	if err := proc.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	select {
+	case <-proc.done:
+		return nil
+	case <-time.After(killGracePeriod):
+		return proc.cmd.Process.Kill()
+	}
+}
+
+func (p *Processes) List() []model.ProcessInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]model.ProcessInfo, 0, len(p.processes))
+	for _, proc := range p.processes {
+		list = append(list, proc.info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+	return list
+}
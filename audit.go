@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"distributed-inmemory-cache/audit"
+	"distributed-inmemory-cache/logging"
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// auditLog records who changed the cluster or its data, nil when disabled.
+var auditLog *audit.Log
+
+const defaultAuditQueryLimit = 1000
+
+type auditEntryKey struct{}
+
+func setupAudit() error {
+	if !conf.Service.Audit.Enabled {
+		return nil
+	}
+	var err error
+	auditLog, err = audit.Open(conf.Service.Logs.Dir, conf.Service.Audit.MaxSizeMB, conf.Service.Audit.MaxFiles)
+	return err
+}
+
+// audited records every call of handler, including the ones authorized
+// denies. Calls with one of the reads methods are not recorded, endpoints
+// list the methods they only read with.
+func audited(handler http.HandlerFunc, reads ...string) http.HandlerFunc {
+	if auditLog == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(reads, r.Method) {
+			handler(w, r)
+			return
+		}
+		entry := &audit.Entry{
+			Time:      time.Now(),
+			Caller:    unrestricted.Name,
+			SourceIP:  r.RemoteAddr,
+			Method:    r.Method,
+			Endpoint:  r.URL.Path,
+			Query:     r.URL.RawQuery,
+			RequestID: logging.RequestID(r.Context()),
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			entry.SourceIP = host
+		}
+		if authenticator != nil {
+			entry.Caller = "unauthenticated"
+			if caller, err := authenticator.Authenticate(r); err == nil {
+				entry.Caller = caller.Name
+				entry.Role = caller.Role.String()
+			}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r.WithContext(context.WithValue(r.Context(), auditEntryKey{}, entry)))
+
+		entry.Status = recorder.status
+		switch {
+		case recorder.status == http.StatusUnauthorized || recorder.status == http.StatusForbidden:
+			entry.Outcome = audit.OutcomeDenied
+		case recorder.status == http.StatusTooManyRequests:
+			entry.Outcome = audit.OutcomeThrottled
+		case recorder.status >= http.StatusBadRequest:
+			entry.Outcome = audit.OutcomeFailed
+		default:
+			entry.Outcome = audit.OutcomeSuccess
+		}
+		if err := auditLog.Record(*entry); err != nil {
+			apiLog.ErrorContext(r.Context(), "could not write audit entry", "endpoint", entry.Endpoint, "error", err)
+		}
+	}
+}
+
+// auditKeys adds the keys a request changes to its audit entry.
+func auditKeys(r *http.Request, keys []string) {
+	if entry, ok := r.Context().Value(auditEntryKey{}).(*audit.Entry); ok {
+		entry.SetKeys(keys)
+	}
+}
+
+// auditHandler queries the audit log. from and to are RFC 3339 times, caller,
+// endpoint and outcome match exactly, limit keeps the newest entries.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if auditLog == nil {
+		http.Error(w, "Audit log is disabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	filter := audit.Filter{
+		Caller:   query.Get("caller"),
+		Endpoint: query.Get("endpoint"),
+		Outcome:  query.Get("outcome"),
+		Limit:    defaultAuditQueryLimit,
+	}
+	var err error
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			http.Error(w, "Invalid from, use RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			http.Error(w, "Invalid to, use RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		apiLog.ErrorContext(r.Context(), "could not read audit log", "error", err)
+		http.Error(w, "Could not read audit log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
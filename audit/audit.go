@@ -0,0 +1,163 @@
+// Package audit keeps an append-only trail of who changed the cluster or its
+// data, one JSON entry per line in rotated files.
+package audit
+
+import (
+	"bufio"
+	"distributed-inmemory-cache/logging"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const FileName = "audit.log"
+
+// MaxListedKeys is how many affected keys an entry lists, bulk operations
+// only record their count.
+const MaxListedKeys = 20
+
+// Outcomes of an audited operation.
+const (
+	OutcomeSuccess   = "success"
+	OutcomeDenied    = "denied"
+	OutcomeThrottled = "throttled"
+	OutcomeFailed    = "failed"
+)
+
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Caller    string    `json:"caller"`
+	Role      string    `json:"role,omitempty"`
+	SourceIP  string    `json:"source_ip"`
+	Method    string    `json:"method"`
+	Endpoint  string    `json:"endpoint"`
+	Query     string    `json:"query,omitempty"`
+	Keys      []string  `json:"keys,omitempty"`
+	KeyCount  int       `json:"key_count,omitempty"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// SetKeys records the affected keys, or only their number for bulk
+// operations.
+func (entry *Entry) SetKeys(keys []string) {
+	entry.KeyCount = len(keys)
+	entry.Keys = nil
+	if len(keys) <= MaxListedKeys {
+		entry.Keys = append([]string(nil), keys...)
+	}
+}
+
+// Filter selects entries of a query. Zero values match everything, Limit
+// keeps the newest entries.
+type Filter struct {
+	From     time.Time
+	To       time.Time
+	Caller   string
+	Endpoint string
+	Outcome  string
+	Limit    int
+}
+
+func (filter Filter) matches(entry Entry) bool {
+	return (filter.From.IsZero() || !entry.Time.Before(filter.From)) &&
+		(filter.To.IsZero() || entry.Time.Before(filter.To)) &&
+		(filter.Caller == "" || entry.Caller == filter.Caller) &&
+		(filter.Endpoint == "" || entry.Endpoint == filter.Endpoint) &&
+		(filter.Outcome == "" || entry.Outcome == filter.Outcome)
+}
+
+// Log appends entries to audit.log in its directory. Old entries are in
+// audit.log.1 (the newest) to audit.log.<maxFiles-1>.
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	maxFiles int
+	file     *logging.RotatingFile
+}
+
+func Open(dir string, maxSizeMB int, maxFiles int) (*Log, error) {
+	if maxFiles <= 0 {
+		maxFiles = 10
+	}
+	path := filepath.Join(dir, FileName)
+	file, err := logging.NewRotatingFile(path, maxSizeMB, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{path: path, maxFiles: maxFiles, file: file}, nil
+}
+
+func (log *Log) Record(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	_, err = log.file.Write(append(line, '\n'))
+	return err
+}
+
+// Query returns the matching entries, oldest first.
+func (log *Log) Query(filter Filter) ([]Entry, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	entries := []Entry{}
+	for i := log.maxFiles - 1; i >= 0; i-- {
+		path := log.path
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", log.path, i)
+		}
+		var err error
+		if entries, err = readEntries(path, filter, entries); err != nil {
+			return nil, err
+		}
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
+
+func readEntries(path string, filter Filter, entries []Entry) ([]Entry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			// A torn last line of a crash, the entries around it are fine
+			continue
+		}
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (log *Log) Close() error {
+	return log.file.Close()
+}
@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueryFiltersAcrossRotatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// An entry rotated out earlier and a torn line of a crash
+	rotated, _ := json.Marshal(Entry{Time: start, Caller: "ops", Endpoint: "/api/infra/killall", Outcome: OutcomeSuccess})
+	if err := os.WriteFile(filepath.Join(dir, FileName+".1"), append(rotated, []byte("\n{\"time\":")...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := Open(dir, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	for i := 1; i <= 3; i++ {
+		entry := Entry{Time: start.Add(time.Duration(i) * time.Minute), Caller: "billing", Endpoint: "/api/data/set", Outcome: OutcomeSuccess}
+		entry.SetKeys([]string{"billing:" + strconv.Itoa(i)})
+		if err := log.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Record(Entry{Time: start.Add(5 * time.Minute), Caller: "unauthenticated", Endpoint: "/api/infra/scaleup", Outcome: OutcomeDenied}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := log.Query(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 5 || all[0].Endpoint != "/api/infra/killall" || all[4].Outcome != OutcomeDenied {
+		t.Fatalf("expected every entry oldest first, got %+v", all)
+	}
+
+	window, _ := log.Query(Filter{From: start.Add(2 * time.Minute), To: start.Add(5 * time.Minute)})
+	if len(window) != 2 || window[0].Keys[0] != "billing:2" {
+		t.Errorf("unexpected entries in time range %+v", window)
+	}
+	newest, _ := log.Query(Filter{Caller: "billing", Limit: 1})
+	if len(newest) != 1 || newest[0].Keys[0] != "billing:3" {
+		t.Errorf("limit should keep the newest entry, got %+v", newest)
+	}
+	denied, _ := log.Query(Filter{Outcome: OutcomeDenied})
+	if len(denied) != 1 || denied[0].Endpoint != "/api/infra/scaleup" {
+		t.Errorf("unexpected denied entries %+v", denied)
+	}
+}
+
+func TestSetKeysCountsBulkOperations(t *testing.T) {
+	keys := make([]string, MaxListedKeys+1)
+	for i := range keys {
+		keys[i] = "k" + strconv.Itoa(i)
+	}
+	var entry Entry
+	entry.SetKeys(keys)
+	if entry.Keys != nil || entry.KeyCount != len(keys) {
+		t.Errorf("bulk operation should only record the count, got %d keys and count %d", len(entry.Keys), entry.KeyCount)
+	}
+	entry.SetKeys(keys[:2])
+	if len(entry.Keys) != 2 || entry.KeyCount != 2 {
+		t.Errorf("expected the keys listed, got %+v", entry)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"distributed-inmemory-cache/auth"
+	"fmt"
+	"net/http"
+)
+
+// authenticator checks the API keys of the public api, nil when auth is
+// disabled.
+var authenticator *auth.Authenticator
+
+// unrestricted is every caller without auth.
+var unrestricted = &auth.Principal{Name: "anonymous", Role: auth.Admin}
+
+func setupAuth() error {
+	if !conf.Service.Auth.Enabled {
+		return nil
+	}
+	var keys []auth.Key
+	for _, configured := range conf.Service.Auth.Keys {
+		role, err := auth.ParseRole(configured.Role)
+		if err != nil {
+			return fmt.Errorf("API key %q: %w", configured.Name, err)
+		}
+		keys = append(keys, auth.Key{Name: configured.Name, Key: configured.Key, Role: role, Prefixes: configured.Prefixes})
+	}
+	var err error
+	authenticator, err = auth.New(keys)
+	return err
+}
+
+// authorized only lets callers with role or a higher one call handler.
+func authorized(role auth.Role, handler http.HandlerFunc) http.HandlerFunc {
+	if authenticator == nil {
+		return handler
+	}
+	return authenticator.Require(role, handler)
+}
+
+// principal is the caller of an authorized handler.
+func principal(r *http.Request) *auth.Principal {
+	if principal := auth.FromContext(r.Context()); principal != nil {
+		return principal
+	}
+	return unrestricted
+}
+
+// keysAllowed answers 403 and returns false when a key is outside the
+// prefixes of the caller's API key.
+func keysAllowed(w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	caller := principal(r)
+	for _, key := range keys {
+		if !caller.CanAccess(key) {
+			apiLog.InfoContext(r.Context(), "key outside of API key prefixes", "api_key", caller.Name, "key", key)
+			http.Error(w, fmt.Sprintf("API key %s may not access key %s", caller.Name, key), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
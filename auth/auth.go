@@ -0,0 +1,202 @@
+// Package auth checks the API keys callers present and what their roles allow.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role orders what a key may do, every role may do what the ones below it
+// may. Internal stands apart, see Allows.
+type Role int
+
+const (
+	Reader Role = iota + 1
+	Writer
+	Operator
+	Admin
+	// Internal is the role of the cluster's own nodes. It may only call the
+	// endpoints nodes call, which admins may call too.
+	Internal
+)
+
+var roleNames = map[Role]string{Reader: "reader", Writer: "writer", Operator: "operator", Admin: "admin", Internal: "internal"}
+
+func (role Role) String() string {
+	if name, ok := roleNames[role]; ok {
+		return name
+	}
+	return fmt.Sprintf("role(%d)", int(role))
+}
+
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if strings.EqualFold(name, roleName) {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q, use reader, writer, operator, admin or internal", name)
+}
+
+// APIKeyHeader is an alternative to "Authorization: Bearer <key>".
+const APIKeyHeader = "X-API-Key"
+
+var (
+	ErrMissingKey = errors.New("an API key is required")
+	ErrUnknownKey = errors.New("unknown API key")
+)
+
+// Key is a configured API key. Prefixes limit the keys of the cache it may
+// read and write, it may use every key without any.
+type Key struct {
+	Name     string
+	Key      string
+	Role     Role
+	Prefixes []string
+}
+
+// Principal is the caller a request authenticated as.
+type Principal struct {
+	Name     string
+	Role     Role
+	Prefixes []string
+}
+
+// Allows is true when the principal has role or a higher one. Internal is
+// allowed to internal and admin principals, and internal principals are
+// allowed nothing else.
+func (principal *Principal) Allows(role Role) bool {
+	switch {
+	case role == Internal:
+		return principal.Role == Internal || principal.Role == Admin
+	case principal.Role == Internal:
+		return false
+	}
+	return principal.Role >= role
+}
+
+// CanAccess is true when key is within the principal's prefixes.
+func (principal *Principal) CanAccess(key string) bool {
+	if len(principal.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range principal.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessPrefix is true when every key starting with prefix is within the
+// principal's prefixes.
+func (principal *Principal) CanAccessPrefix(prefix string) bool {
+	return principal.CanAccess(prefix) && (prefix != "" || len(principal.Prefixes) == 0)
+}
+
+// Filter returns the entries of data the principal may read.
+func (principal *Principal) Filter(data map[string]string) map[string]string {
+	if len(principal.Prefixes) == 0 {
+		return data
+	}
+	filtered := make(map[string]string)
+	for key, value := range data {
+		if principal.CanAccess(key) {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+// Authenticator looks up the keys requests present. Only digests of the keys
+// are kept.
+type Authenticator struct {
+	principals map[[sha256.Size]byte]*Principal
+}
+
+func New(keys []Key) (*Authenticator, error) {
+	authenticator := &Authenticator{principals: make(map[[sha256.Size]byte]*Principal)}
+	for _, key := range keys {
+		if key.Key == "" {
+			return nil, fmt.Errorf("API key %q has no key", key.Name)
+		}
+		if _, ok := roleNames[key.Role]; !ok {
+			return nil, fmt.Errorf("API key %q has no role", key.Name)
+		}
+		digest := sha256.Sum256([]byte(key.Key))
+		if _, ok := authenticator.principals[digest]; ok {
+			return nil, fmt.Errorf("API key %q is configured twice", key.Name)
+		}
+		authenticator.principals[digest] = &Principal{Name: key.Name, Role: key.Role, Prefixes: key.Prefixes}
+	}
+	return authenticator, nil
+}
+
+// Authenticate returns the principal of the key r presents.
+func (authenticator *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key, err := presentedKey(r)
+	if err != nil {
+		return nil, err
+	}
+	return authenticator.Lookup(key)
+}
+
+// Lookup returns the principal of key, for keys presented other than over
+// HTTP.
+func (authenticator *Authenticator) Lookup(key string) (*Principal, error) {
+	principal, ok := authenticator.principals[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return principal, nil
+}
+
+func presentedKey(r *http.Request) (string, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if header := r.Header.Get("Authorization"); key == "" && header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return "", ErrMissingKey
+		}
+		key = strings.TrimSpace(token)
+	}
+	if key == "" {
+		return "", ErrMissingKey
+	}
+	return key, nil
+}
+
+// Require only lets requests through whose key has role or a higher one. It
+// answers 401 without a valid key and 403 when the role is too low.
+func (authenticator *Authenticator) Require(role Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := authenticator.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cache"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !principal.Allows(role) {
+			http.Error(w, fmt.Sprintf("API key %s is a %s, this needs %s", principal.Name, principal.Role, role), http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	}
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext returns the principal of the request, nil without
+// authentication.
+func FromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
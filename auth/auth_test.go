@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireRoles(t *testing.T) {
+	authenticator, err := New([]Key{
+		{Name: "dashboard", Key: "read-key", Role: Reader},
+		{Name: "ops", Key: "ops-key", Role: Operator},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called *Principal
+	handler := authenticator.Require(Operator, func(w http.ResponseWriter, r *http.Request) {
+		called = FromContext(r.Context())
+	})
+
+	cases := []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"no key", "", "", http.StatusUnauthorized},
+		{"unknown key", "Authorization", "Bearer nope", http.StatusUnauthorized},
+		{"other scheme", "Authorization", "Basic b3BzLWtleQ==", http.StatusUnauthorized},
+		{"role too low", "Authorization", "Bearer read-key", http.StatusForbidden},
+		{"bearer", "Authorization", "Bearer ops-key", http.StatusOK},
+		{"api key header", APIKeyHeader, "ops-key", http.StatusOK},
+	}
+	for _, c := range cases {
+		called = nil
+		request := httptest.NewRequest(http.MethodPost, "/api/infra/killall", nil)
+		if c.header != "" {
+			request.Header.Set(c.header, c.value)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, recorder.Code, c.want)
+		}
+		if c.want == http.StatusOK && (called == nil || called.Name != "ops") {
+			t.Errorf("%s: handler did not see the principal", c.name)
+		}
+		if c.want == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without WWW-Authenticate", c.name)
+		}
+	}
+}
+
+func TestPrincipalPrefixes(t *testing.T) {
+	scoped := &Principal{Name: "billing", Role: Writer, Prefixes: []string{"billing:", "invoice:"}}
+	if !scoped.CanAccess("billing:42") || scoped.CanAccess("user:42") {
+		t.Error("keys should be limited to the prefixes")
+	}
+	if !scoped.CanAccessPrefix("invoice:2024") || scoped.CanAccessPrefix("") || scoped.CanAccessPrefix("bill") {
+		t.Error("prefixes should be limited to the prefixes")
+	}
+	filtered := scoped.Filter(map[string]string{"billing:1": "a", "user:1": "b"})
+	if len(filtered) != 1 || filtered["billing:1"] != "a" {
+		t.Errorf("unexpected filtered data %v", filtered)
+	}
+
+	everything := &Principal{Name: "admin", Role: Admin}
+	if !everything.CanAccess("user:42") || !everything.CanAccessPrefix("") {
+		t.Error("a key without prefixes should access every key")
+	}
+}
+
+func TestNewRejectsInvalidKeys(t *testing.T) {
+	for _, keys := range [][]Key{
+		{{Name: "empty", Role: Reader}},
+		{{Name: "roleless", Key: "k"}},
+		{{Name: "a", Key: "k", Role: Reader}, {Name: "b", Key: "k", Role: Admin}},
+	} {
+		if _, err := New(keys); err == nil {
+			t.Errorf("expected an error for %+v", keys)
+		}
+	}
+	if _, err := ParseRole("root"); err == nil {
+		t.Error("expected an error for an unknown role")
+	}
+}
+
+func TestInternalRoleStandsApart(t *testing.T) {
+	internal := &Principal{Name: "nodes", Role: Internal}
+	for _, role := range []Role{Reader, Writer, Operator, Admin} {
+		if internal.Allows(role) {
+			t.Errorf("the internal role should not be allowed %s", role)
+		}
+	}
+	for role, want := range map[Role]bool{Internal: true, Admin: true, Operator: false, Reader: false} {
+		if got := (&Principal{Role: role}).Allows(Internal); got != want {
+			t.Errorf("%s allowed internal: %v, want %v", role, got, want)
+		}
+	}
+	if role, err := ParseRole("internal"); err != nil || role != Internal {
+		t.Errorf("expected the internal role to be configurable, got %v, %v", role, err)
+	}
+
+	handler := RequireKey("node-key", func(w http.ResponseWriter, r *http.Request) {})
+	for value, want := range map[string]int{"": http.StatusUnauthorized, "other": http.StatusForbidden, "node-key": http.StatusOK} {
+		request := httptest.NewRequest(http.MethodPost, "/notify", nil)
+		if value != "" {
+			request.Header.Set(APIKeyHeader, value)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != want {
+			t.Errorf("key %q: got %d, want %d", value, recorder.Code, want)
+		}
+	}
+}
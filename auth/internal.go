@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// InternalKeyEnv is where a node finds the key of the internal role. The
+// master passes it to the nodes it spawns when the cluster runs without TLS,
+// with TLS the nodes authenticate with their certificates.
+const InternalKeyEnv = "CACHE_INTERNAL_KEY"
+
+// Transport presents Key on every request, for calls between the master and
+// its nodes. Requests carrying a caller's key must not use it.
+type Transport struct {
+	Key  string
+	Base http.RoundTripper
+}
+
+func (transport *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := transport.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set(APIKeyHeader, transport.Key)
+	return base.RoundTrip(r)
+}
+
+// RequireKey only lets requests through that present key. Nodes guard the
+// endpoints only the master calls with it.
+func RequireKey(key string, handler http.HandlerFunc) http.HandlerFunc {
+	digest := sha256.Sum256([]byte(key))
+	return func(w http.ResponseWriter, r *http.Request) {
+		presented, err := presentedKey(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cache"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		presentedDigest := sha256.Sum256([]byte(presented))
+		if subtle.ConstantTimeCompare(presentedDigest[:], digest[:]) != 1 {
+			http.Error(w, "Only the master may call this endpoint", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
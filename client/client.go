@@ -0,0 +1,230 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"distributed-inmemory-cache/loader"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("key not found")
+
+// Client talks to the master's data api. Loaders registered on the client
+// implement cache-aside on the caller's side: misses are filled from the
+// backend and stored in the cluster, and write-through routes see every write
+// before the cluster does.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// APIKey is sent as bearer token when the master requires one.
+	APIKey  string
+	loaders *loader.Registry
+	loads   loader.Group
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		loaders:    loader.NewRegistry(),
+	}
+}
+
+// RegisterLoader fills misses for keys starting with prefix from backend. If
+// writeThrough is set, backend must implement loader.Writer.
+func (c *Client) RegisterLoader(prefix string, backend loader.Loader, writeThrough bool, ttl time.Duration) error {
+	route := loader.Route{Prefix: prefix, Loader: backend, TTL: ttl}
+	if writeThrough {
+		writer, ok := backend.(loader.Writer)
+		if !ok {
+			return fmt.Errorf("write-through backend for prefix %s does not implement loader.Writer", prefix)
+		}
+		route.Writer = writer
+	}
+	return c.loaders.Register(route)
+}
+
+// Get returns the value of key. A miss is filled by the loader registered
+// for the key, concurrent misses for the same key share a single load.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	value, err := c.get(ctx, key)
+	if !errors.Is(err, ErrNotFound) {
+		return value, err
+	}
+	route, ok := c.loaders.Lookup(key)
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	loadCtx := context.WithoutCancel(ctx)
+	value, err, _ = c.loads.Do(key, func() (string, error) {
+		loaded, err := route.Loader.Load(loadCtx, key)
+		if err != nil {
+			return "", err
+		}
+		// A writer may have set the key since the miss, its value wins
+		return c.fill(loadCtx, key, loaded, route.TTL)
+	})
+	if errors.Is(err, loader.ErrNotFound) {
+		return "", ErrNotFound
+	}
+	return value, err
+}
+
+func (c *Client) GetAll(ctx context.Context) (map[string]string, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/api/data/get", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+	var data map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Set stores the keys, expiring them after ttl when it is positive. Keys with
+// a write-through loader are written to their backend first.
+func (c *Client) Set(ctx context.Context, data map[string]string, ttl time.Duration) error {
+	for key, value := range data {
+		if route, ok := c.loaders.Lookup(key); ok && route.Writer != nil {
+			if err := route.Writer.Store(ctx, key, value); err != nil {
+				return fmt.Errorf("write-through for key %s failed: %w", key, err)
+			}
+		}
+	}
+	return c.set(ctx, data, ttl)
+}
+
+func (c *Client) Delete(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if route, ok := c.loaders.Lookup(key); ok && route.Writer != nil {
+			if err := route.Writer.Delete(ctx, key); err != nil {
+				return fmt.Errorf("write-through delete for key %s failed: %w", key, err)
+			}
+		}
+	}
+	body, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/api/data/delete", nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	return nil
+}
+
+func (c *Client) get(ctx context.Context, key string) (string, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/api/data/get", url.Values{"key": {key}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp)
+	}
+	var data map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", err
+	}
+	value, ok := data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (c *Client) set(ctx context.Context, data map[string]string, ttl time.Duration) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var query url.Values
+	if ttl > 0 {
+		query = url.Values{"ttl": {ttl.String()}}
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/api/data/set", query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// fill sets key to a loaded value unless it is set by now, and returns the
+// value the cache holds.
+func (c *Client) fill(ctx context.Context, key string, value string, ttl time.Duration) (string, error) {
+	body, err := json.Marshal(map[string]string{key: value})
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{"only_missing": {"true"}}
+	if ttl > 0 {
+		query.Set("ttl", ttl.String())
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/api/data/set", query, body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp)
+	}
+	var data map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", err
+	}
+	if current, ok := data[key]; ok {
+		return current, nil
+	}
+	return value, nil
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body []byte) (*http.Response, error) {
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	return c.HTTPClient.Do(request)
+}
+
+func statusError(resp *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("cache answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+}
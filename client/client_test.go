@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"distributed-inmemory-cache/loader"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMaster serves the data api from a map and records the ttl of sets.
+type fakeMaster struct {
+	mu     sync.Mutex
+	data   map[string]string
+	ttls   map[string]string
+	writes int
+}
+
+func startFakeMaster(t *testing.T, data map[string]string) (*fakeMaster, *Client) {
+	master := &fakeMaster{data: data, ttls: make(map[string]string)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "missing api key", http.StatusUnauthorized)
+			return
+		}
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		switch r.URL.Path {
+		case "/api/data/get":
+			key := r.URL.Query().Get("key")
+			value, ok := master.data[key]
+			if !ok {
+				http.Error(w, "Key not found", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{key: value})
+		case "/api/data/set":
+			var data map[string]string
+			json.NewDecoder(r.Body).Decode(&data)
+			for key, value := range data {
+				if _, ok := master.data[key]; ok && r.URL.Query().Get("only_missing") == "true" {
+					continue
+				}
+				master.data[key] = value
+				master.ttls[key] = r.URL.Query().Get("ttl")
+			}
+			master.writes++
+			json.NewEncoder(w).Encode(master.data)
+		case "/api/data/delete":
+			var keys []string
+			json.NewDecoder(r.Body).Decode(&keys)
+			for _, key := range keys {
+				delete(master.data, key)
+			}
+			master.writes++
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	client := New(server.URL)
+	client.APIKey = "secret"
+	return master, client
+}
+
+func TestGetHit(t *testing.T) {
+	_, client := startFakeMaster(t, map[string]string{"user:1": "alice"})
+	loads := 0
+	client.RegisterLoader("user:", loader.Functions{LoadFunc: func(ctx context.Context, key string) (string, error) {
+		loads++
+		return "", nil
+	}}, false, 0)
+
+	value, err := client.Get(context.Background(), "user:1")
+	if err != nil || value != "alice" {
+		t.Fatalf("expected alice, got %q, %v", value, err)
+	}
+	if loads != 0 {
+		t.Errorf("a hit should not call the loader")
+	}
+}
+
+func TestGetMissFillsFromLoader(t *testing.T) {
+	master, client := startFakeMaster(t, map[string]string{})
+	client.RegisterLoader("user:", loader.Functions{LoadFunc: func(ctx context.Context, key string) (string, error) {
+		if key == "user:2" {
+			return "bob", nil
+		}
+		return "", loader.ErrNotFound
+	}}, false, time.Minute)
+
+	value, err := client.Get(context.Background(), "user:2")
+	if err != nil || value != "bob" {
+		t.Fatalf("expected bob from the loader, got %q, %v", value, err)
+	}
+	if master.data["user:2"] != "bob" || master.ttls["user:2"] != "1m0s" {
+		t.Errorf("expected the loaded value to be stored with its ttl, got %q with ttl %q", master.data["user:2"], master.ttls["user:2"])
+	}
+	if _, err := client.Get(context.Background(), "user:3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound when the loader has no value, got %v", err)
+	}
+	if _, err := client.Get(context.Background(), "order:1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound without a loader, got %v", err)
+	}
+}
+
+func TestGetMissKeepsAConcurrentWrite(t *testing.T) {
+	master, client := startFakeMaster(t, map[string]string{})
+	client.RegisterLoader("user:", loader.Functions{LoadFunc: func(ctx context.Context, key string) (string, error) {
+		// A writer sets the key while the backend is read
+		master.mu.Lock()
+		master.data[key] = "carol"
+		master.mu.Unlock()
+		return "stale", nil
+	}}, false, 0)
+
+	value, err := client.Get(context.Background(), "user:4")
+	if err != nil || value != "carol" {
+		t.Fatalf("expected the written value, got %q, %v", value, err)
+	}
+	if master.data["user:4"] != "carol" {
+		t.Errorf("the fill must not overwrite the written value, got %q", master.data["user:4"])
+	}
+}
+
+func TestWriteThroughFailureLeavesTheCache(t *testing.T) {
+	master, client := startFakeMaster(t, map[string]string{"user:1": "alice"})
+	backendDown := errors.New("backend down")
+	client.RegisterLoader("user:", loader.Functions{
+		StoreFunc: func(ctx context.Context, key string, value string) error { return backendDown },
+	}, true, 0)
+
+	err := client.Set(context.Background(), map[string]string{"user:1": "mallory"}, 0)
+	if !errors.Is(err, backendDown) {
+		t.Fatalf("expected the backend error, got %v", err)
+	}
+	if master.writes != 0 || master.data["user:1"] != "alice" {
+		t.Errorf("the cache should not change when the backend write failed, got %q after %d writes", master.data["user:1"], master.writes)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	master, client := startFakeMaster(t, map[string]string{"user:1": "alice", "user:2": "bob"})
+	var deleted []string
+	client.RegisterLoader("user:", loader.Functions{
+		DeleteFunc: func(ctx context.Context, key string) error {
+			deleted = append(deleted, key)
+			return nil
+		},
+	}, true, 0)
+
+	if err := client.Delete(context.Background(), "user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := master.data["user:1"]; ok || master.data["user:2"] != "bob" {
+		t.Errorf("expected only user:1 to be deleted, got %v", master.data)
+	}
+	if len(deleted) != 1 || deleted[0] != "user:1" {
+		t.Errorf("expected the delete to go through to the backend, got %v", deleted)
+	}
+
+	client.APIKey = ""
+	if err := client.Delete(context.Background(), "user:2"); err == nil {
+		t.Error("expected the master's refusal to be returned")
+	}
+}
@@ -10,19 +10,117 @@ import (
 type Config struct {
 	Service struct {
 		Master struct {
-			Port            int `yaml:"port"`
-			NodePortInitial int `yaml:"node_port_initial"`
+			Port             int    `yaml:"port"`
+			NodePortInitial  int    `yaml:"node_port_initial"`
+			RespPort         int    `yaml:"resp_port"`
+			RespMaxCommandKB int    `yaml:"resp_max_command_kb"`
+			AdvertiseHost    string `yaml:"advertise_host"`
+			ClusterID        string `yaml:"cluster_id"`
+			WebhooksFile     string `yaml:"webhooks_file"`
 		} `yaml:"master"`
 		Nodes struct {
-			MinCount int `yaml:"min_count"`
-			MaxCount int `yaml:"max_count"`
+			MinCount            int      `yaml:"min_count"`
+			MaxCount            int      `yaml:"max_count"`
+			ScaleDownPolicy     string   `yaml:"scale_down_policy"`
+			DrainTimeoutSeconds int      `yaml:"drain_timeout_seconds"`
+			Provisioner         string   `yaml:"provisioner"`
+			Binary              string   `yaml:"binary"`
+			Agents              []string `yaml:"agents"`
+			AgentToken          string   `yaml:"agent_token"`
+			RegistryFile        string   `yaml:"registry_file"`
 		} `yaml:"nodes"`
 		Logs struct {
-			Dir string `yaml:"dir"`
+			Dir       string `yaml:"dir"`
+			Level     string `yaml:"level"`
+			Format    string `yaml:"format"`
+			MaxSizeMB int    `yaml:"max_size_mb"`
+			MaxFiles  int    `yaml:"max_files"`
 		} `yaml:"logs"`
+		Tracing struct {
+			OTLPEndpoint string `yaml:"otlp_endpoint"`
+			File         string `yaml:"file"`
+		} `yaml:"tracing"`
+		TLS struct {
+			Enabled           bool   `yaml:"enabled"`
+			Port              int    `yaml:"port"`
+			CACert            string `yaml:"ca_cert"`
+			CAKey             string `yaml:"ca_key"`
+			CertValidityHours int    `yaml:"cert_validity_hours"`
+		} `yaml:"tls"`
+		Auth struct {
+			Enabled bool `yaml:"enabled"`
+			Keys    []struct {
+				Name     string   `yaml:"name"`
+				Key      string   `yaml:"key"`
+				Role     string   `yaml:"role"`
+				Prefixes []string `yaml:"prefixes"`
+			} `yaml:"keys"`
+		} `yaml:"auth"`
+		Audit struct {
+			Enabled   bool `yaml:"enabled"`
+			MaxSizeMB int  `yaml:"max_size_mb"`
+			MaxFiles  int  `yaml:"max_files"`
+		} `yaml:"audit"`
+		RateLimits struct {
+			RequestsPerSecond       float64              `yaml:"requests_per_second"`
+			Burst                   int                  `yaml:"burst"`
+			Clients                 map[string]RateLimit `yaml:"clients"`
+			MaxConcurrentWrites     int                  `yaml:"max_concurrent_writes"`
+			MaxConcurrentBroadcasts int                  `yaml:"max_concurrent_broadcasts"`
+		} `yaml:"rate_limits"`
+		Replication struct {
+			Mode              string `yaml:"mode"`
+			BatchWindowMs     int    `yaml:"batch_window_ms"`
+			BatchMaxWrites    int    `yaml:"batch_max_writes"`
+			ClockFile         string `yaml:"clock_file"`
+			CompressSnapshots bool   `yaml:"compress_snapshots"`
+		} `yaml:"replication"`
+		Autoscaler struct {
+			Enabled         bool               `yaml:"enabled"`
+			DryRun          bool               `yaml:"dry_run"`
+			IntervalSeconds int                `yaml:"interval_seconds"`
+			CooldownSeconds int                `yaml:"cooldown_seconds"`
+			ScaleUpAfter    int                `yaml:"scale_up_after"`
+			ScaleDownAfter  int                `yaml:"scale_down_after"`
+			ScaleUp         AutoscalerTriggers `yaml:"scale_up"`
+			ScaleDown       AutoscalerTriggers `yaml:"scale_down"`
+		} `yaml:"autoscaler"`
+		FailureDetector struct {
+			Enabled      bool `yaml:"enabled"`
+			IntervalMs   int  `yaml:"interval_ms"`
+			SuspectAfter int  `yaml:"suspect_after"`
+			DeadAfter    int  `yaml:"dead_after"`
+			Restart      bool `yaml:"restart"`
+		} `yaml:"failure_detector"`
+		AntiEntropy struct {
+			Enabled         bool `yaml:"enabled"`
+			IntervalSeconds int  `yaml:"interval_seconds"`
+			Depth           int  `yaml:"depth"`
+		} `yaml:"anti_entropy"`
+		Loaders []struct {
+			Prefix       string `yaml:"prefix"`
+			URL          string `yaml:"url"`
+			WriteThrough bool   `yaml:"write_through"`
+			TimeoutMs    int    `yaml:"timeout_ms"`
+			TTLSeconds   int    `yaml:"ttl_seconds"`
+		} `yaml:"loaders"`
 	} `yaml:"service"`
 }
 
+// AutoscalerTriggers are load thresholds, a zero value ignores that metric.
+type AutoscalerTriggers struct {
+	RequestRate     float64 `yaml:"request_rate"`
+	KeysPerNode     int     `yaml:"keys_per_node"`
+	MemoryPerNodeMB int     `yaml:"memory_per_node_mb"`
+	P99LatencyMs    int     `yaml:"p99_latency_ms"`
+}
+
+// RateLimit is a token bucket, a zero rate does not limit.
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+}
+
 func ReadConfig() (*Config, error) {
 	yamlFile, err := os.ReadFile("config/config.yaml")
 	if err != nil {
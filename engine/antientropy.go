@@ -0,0 +1,325 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"distributed-inmemory-cache/config"
+	"distributed-inmemory-cache/logging"
+	"distributed-inmemory-cache/merkle"
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const antiEntropyHistorySize = 50
+
+var antiEntropyLog = logging.Component("anti-entropy")
+
+// errVersionMoved is a node refusing a repair because it took another data
+// version since it was compared, replication brings it up to date instead.
+var errVersionMoved = errors.New("node moved to another data version")
+
+// NodeRepair is what anti-entropy found on one node. Ranges is the number
+// of key ranges that differed, WrongKeys the keys that were missing on the
+// node, should not have been there or had another value.
+type NodeRepair struct {
+	Node        string `json:"node"`
+	NodeVersion int64  `json:"nodeVersion"`
+	Skipped     string `json:"skipped,omitempty"`
+	Ranges      int    `json:"ranges"`
+	Missing     int    `json:"missing"`
+	Extra       int    `json:"extra"`
+	Mismatched  int    `json:"mismatched"`
+	WrongKeys   int    `json:"wrongKeys"`
+	Repaired    bool   `json:"repaired"`
+	Error       string `json:"error,omitempty"`
+}
+
+type AntiEntropyReport struct {
+	Time        int64        `json:"time"`
+	DataVersion int64        `json:"dataVersion"`
+	Depth       int          `json:"depth"`
+	DurationMs  int64        `json:"durationMs"`
+	WrongKeys   int          `json:"wrongKeys"`
+	Nodes       []NodeRepair `json:"nodes"`
+}
+
+// AntiEntropy periodically compares the data of every node with the
+// master's. Both sides hash their keys into a Merkle tree over key ranges,
+// a node whose root differs sends the hashes of its ranges and only the
+// ranges that differ are fetched and replaced. Nodes that are not at the
+// master's version are left to replication.
+type AntiEntropy struct {
+	master   *Master
+	interval time.Duration
+	depth    int
+	// running lets one comparison run at a time
+	running sync.Mutex
+	mu      sync.Mutex
+	reports []AntiEntropyReport
+}
+
+func NewAntiEntropy(master *Master, conf *config.Config) *AntiEntropy {
+	settings := conf.Service.AntiEntropy
+	job := &AntiEntropy{
+		master:   master,
+		interval: time.Duration(settings.IntervalSeconds) * time.Second,
+		depth:    settings.Depth,
+	}
+	if job.interval <= 0 {
+		job.interval = 5 * time.Minute
+	}
+	if job.depth <= 0 || job.depth > merkle.MaxDepth {
+		job.depth = merkle.DefaultDepth
+	}
+	return job
+}
+
+func (job *AntiEntropy) Start() {
+	antiEntropyLog.Info("started", "interval", job.interval, "depth", job.depth)
+	go func() {
+		ticker := time.NewTicker(job.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			job.Run(context.Background())
+		}
+	}()
+}
+
+// Reports returns the latest runs, oldest first.
+func (job *AntiEntropy) Reports() []AntiEntropyReport {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return append([]AntiEntropyReport{}, job.reports...)
+}
+
+// Run compares and repairs every active node once.
+func (job *AntiEntropy) Run(ctx context.Context) AntiEntropyReport {
+	job.running.Lock()
+	defer job.running.Unlock()
+	start := time.Now()
+	snapshot := job.master.GetReplicationData()
+	tree := merkle.Build(snapshot.Data, job.depth)
+
+	nodes := job.master.nodeList()
+	report := AntiEntropyReport{
+		Time:        start.UnixMilli(),
+		DataVersion: snapshot.DataVersion,
+		Depth:       job.depth,
+		Nodes:       make([]NodeRepair, len(nodes)),
+	}
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Nodes[i] = job.check(ctx, node, tree, snapshot)
+		}()
+	}
+	wg.Wait()
+	report.DurationMs = time.Since(start).Milliseconds()
+
+	for _, repair := range report.Nodes {
+		report.WrongKeys += repair.WrongKeys
+		if repair.WrongKeys > 0 {
+			job.master.metrics.wrongKeys.Add(float64(repair.WrongKeys), repair.Node)
+			antiEntropyLog.Warn("node had wrong keys", "node", repair.Node, "ranges", repair.Ranges, "missing", repair.Missing, "extra", repair.Extra, "mismatched", repair.Mismatched, "repaired", repair.Repaired)
+		}
+		if repair.Error != "" {
+			antiEntropyLog.Warn("could not compare node", "node", repair.Node, "error", repair.Error)
+		}
+	}
+	antiEntropyLog.Debug("compared nodes", "nodes", len(nodes), "wrong_keys", report.WrongKeys, "duration_ms", report.DurationMs)
+
+	job.mu.Lock()
+	job.reports = append(job.reports, report)
+	if overflow := len(job.reports) - antiEntropyHistorySize; overflow > 0 {
+		job.reports = append(job.reports[:0], job.reports[overflow:]...)
+	}
+	job.mu.Unlock()
+	return report
+}
+
+// check compares one node with the master's snapshot and replaces the key
+// ranges that differ.
+func (job *AntiEntropy) check(ctx context.Context, node *Slave, tree *merkle.Tree, snapshot *model.DataPayload) NodeRepair {
+	repair := NodeRepair{Node: nodeLabel(node)}
+	if status := node.status(); status != Active {
+		repair.Skipped = "node is " + status.String()
+		return repair
+	}
+	comparison, err := compareNode(ctx, node, tree, snapshot, true)
+	if comparison != nil {
+		repair.NodeVersion = comparison.version
+	}
+	if errors.Is(err, errVersionMoved) {
+		repair.Skipped = "node is not at the master's data version"
+		return repair
+	}
+	if err != nil {
+		repair.Error = err.Error()
+		return repair
+	}
+	repair.Ranges = len(comparison.ranges)
+	repair.Missing = len(comparison.missing)
+	repair.Extra = len(comparison.extra)
+	repair.Mismatched = len(comparison.mismatched)
+	repair.WrongKeys = comparison.wrongKeys()
+	if len(comparison.ranges) == 0 {
+		return repair
+	}
+
+	err = node.repair(ctx, model.MerkleRepair{DataVersion: snapshot.DataVersion, Depth: tree.Depth(), Ranges: comparison.ranges, Data: comparison.ours})
+	if errors.Is(err, errVersionMoved) {
+		repair.Skipped = "node moved to another data version during the repair"
+		return repair
+	}
+	if err != nil {
+		repair.Error = err.Error()
+		return repair
+	}
+	repair.Repaired = true
+	return repair
+}
+
+// nodeComparison is how a node's data differs from a snapshot of the
+// master's. Ranges are the key ranges whose hashes differ, ours the master's
+// keys in them and the key lists are sorted.
+type nodeComparison struct {
+	version    int64
+	checksum   string
+	ranges     []int
+	ours       map[string]string
+	missing    []string
+	extra      []string
+	mismatched []string
+}
+
+func (comparison *nodeComparison) wrongKeys() int {
+	return len(comparison.missing) + len(comparison.extra) + len(comparison.mismatched)
+}
+
+// compareNode compares a node's data with the snapshot hashed into tree,
+// fetching only the node's keys in ranges that differ. With sameVersion a
+// node at another version than the snapshot is not compared, the error is
+// then errVersionMoved.
+func compareNode(ctx context.Context, node *Slave, tree *merkle.Tree, snapshot *model.DataPayload, sameVersion bool) (*nodeComparison, error) {
+	depth := tree.Depth()
+	root, err := node.merkleLevel(ctx, depth, 0)
+	if err != nil {
+		return nil, err
+	}
+	comparison := &nodeComparison{version: root.DataVersion}
+	if len(root.Hashes) == 1 {
+		comparison.checksum = root.Hashes[0]
+	}
+	if sameVersion && root.DataVersion != snapshot.DataVersion {
+		return comparison, errVersionMoved
+	}
+	if comparison.checksum == tree.Root() {
+		return comparison, nil
+	}
+
+	leaves, err := node.merkleLevel(ctx, depth, depth)
+	if err != nil {
+		return comparison, err
+	}
+	if sameVersion && leaves.DataVersion != snapshot.DataVersion {
+		return comparison, errVersionMoved
+	}
+	comparison.ranges = tree.Diff(leaves.Hashes)
+	if len(comparison.ranges) == 0 {
+		return comparison, nil
+	}
+	theirs, err := node.merkleKeys(ctx, model.MerkleRanges{Depth: depth, Ranges: comparison.ranges})
+	if err != nil {
+		return comparison, err
+	}
+	comparison.ours = merkle.Keys(snapshot.Data, comparison.ranges, depth)
+	for key, value := range comparison.ours {
+		if theirValue, ok := theirs[key]; !ok {
+			comparison.missing = append(comparison.missing, key)
+		} else if theirValue != value {
+			comparison.mismatched = append(comparison.mismatched, key)
+		}
+	}
+	for key := range theirs {
+		if _, ok := comparison.ours[key]; !ok {
+			comparison.extra = append(comparison.extra, key)
+		}
+	}
+	sort.Strings(comparison.missing)
+	sort.Strings(comparison.extra)
+	sort.Strings(comparison.mismatched)
+	return comparison, nil
+}
+
+func (n *Slave) merkleLevel(ctx context.Context, depth int, level int) (*model.MerkleLevel, error) {
+	query := url.Values{"depth": {strconv.Itoa(depth)}, "level": {strconv.Itoa(level)}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, n.merkleURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var result model.MerkleLevel
+	if err := n.merkleCall(request, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (n *Slave) merkleKeys(ctx context.Context, ranges model.MerkleRanges) (map[string]string, error) {
+	body, err := json.Marshal(ranges)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, n.merkleURL+"/keys", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	var result model.DataPayload
+	if err := n.merkleCall(request, &result); err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
+func (n *Slave) repair(ctx context.Context, repair model.MerkleRepair) error {
+	body, err := json.Marshal(repair)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, n.merkleURL+"/repair", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return n.merkleCall(request, nil)
+}
+
+// merkleCall sends a request to one of the node's /merkle endpoints and
+// decodes the answer into result, unless result is nil.
+func (n *Slave) merkleCall(request *http.Request, result interface{}) error {
+	if request.Body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := n.client().Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return errVersionMoved
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("%s answered %s", request.URL.Path, resp.Status)
+	case result == nil:
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"context"
+	"distributed-inmemory-cache/loader"
+	"distributed-inmemory-cache/model"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// startComparedCluster runs a master holding data at version 42 with an
+// in-process node for each payload. Nodes that pull get the master's data.
+func startComparedCluster(t *testing.T, data map[string]string, payloads ...model.DataPayload) *Master {
+	provisioner := NewInProcessProvisioner()
+	master := &Master{
+		data:          data,
+		dataVersionId: 42,
+		advertiseHost: "127.0.0.1",
+		provisioners:  []Provisioner{provisioner},
+		locks:         newLockTable(),
+		webhooks:      newWebhookDispatcher(),
+		loaders:       loader.NewRegistry(),
+	}
+	master.initMetrics()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		master.WriteSnapshot(w)
+	}))
+	t.Cleanup(server.Close)
+	serverURL, _ := url.Parse(server.URL)
+	master.MasterPort, _ = strconv.Atoi(serverURL.Port())
+
+	for _, payload := range payloads {
+		node := master.newNode(freePort(t))
+		node.Start()
+		t.Cleanup(func() { provisioner.Stop(node.Port) })
+		provisioner.nodes[node.Port].store.Replace(payload)
+		master.nodes = append(master.nodes, node)
+	}
+	return master
+}
+
+func TestAntiEntropyRepairsDivergedNodes(t *testing.T) {
+	master := startComparedCluster(t, map[string]string{"a": "1", "b": "2", "c": "3"},
+		model.DataPayload{DataVersion: 42, Data: map[string]string{"a": "1", "b": "2", "c": "3"}},
+		// Missed a key, kept a deleted one and holds a stale value
+		model.DataPayload{DataVersion: 42, Data: map[string]string{"a": "1", "b": "old", "gone": "x"}},
+		// Behind, replication will catch it up
+		model.DataPayload{DataVersion: 41, Data: map[string]string{}},
+	)
+
+	job := &AntiEntropy{master: master, depth: 4}
+	report := job.Run(context.Background())
+	if report.WrongKeys != 3 || len(report.Nodes) != 3 {
+		t.Fatalf("expected 3 wrong keys on one node, got %+v", report)
+	}
+	healthy, diverged, behind := report.Nodes[0], report.Nodes[1], report.Nodes[2]
+	if healthy.WrongKeys != 0 || healthy.Ranges != 0 || healthy.Error != "" {
+		t.Errorf("the healthy node should match, got %+v", healthy)
+	}
+	if diverged.Missing != 1 || diverged.Extra != 1 || diverged.Mismatched != 1 || !diverged.Repaired {
+		t.Errorf("unexpected repair of the diverged node %+v", diverged)
+	}
+	if behind.Skipped == "" || behind.WrongKeys != 0 {
+		t.Errorf("the node behind should be left to replication, got %+v", behind)
+	}
+
+	data, err := master.nodes[1].GetData()
+	if err != nil || len(data.Data) != 3 || data.Data["b"] != "2" || data.Data["c"] != "3" || data.DataVersion != 42 {
+		t.Fatalf("node was not repaired: %+v, %v", data, err)
+	}
+	if again := job.Run(context.Background()); again.WrongKeys != 0 {
+		t.Errorf("a second run should find nothing, got %+v", again)
+	}
+	if len(job.Reports()) != 2 {
+		t.Errorf("expected both runs to be kept, got %d", len(job.Reports()))
+	}
+}
@@ -0,0 +1,256 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/config"
+	"distributed-inmemory-cache/logging"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const autoscalerHistorySize = 100
+
+var autoscalerLog = logging.Component("autoscaler")
+
+type ScaleAction string
+
+const (
+	ScaleNone ScaleAction = "none"
+	ScaleUp   ScaleAction = "scale_up"
+	ScaleDown ScaleAction = "scale_down"
+)
+
+type AutoscalerMetrics struct {
+	NodeCount       int     `json:"nodeCount"`
+	RequestRate     float64 `json:"requestRate"`
+	KeyCount        int     `json:"keyCount"`
+	KeysPerNode     float64 `json:"keysPerNode"`
+	MemoryPerNodeMB float64 `json:"memoryPerNodeMB"`
+	P99LatencyMs    float64 `json:"p99LatencyMs"`
+}
+
+type AutoscalerDecision struct {
+	Time       int64             `json:"time"`
+	Action     ScaleAction       `json:"action"`
+	Applied    bool              `json:"applied"`
+	DryRun     bool              `json:"dryRun"`
+	Reason     string            `json:"reason"`
+	Metrics    AutoscalerMetrics `json:"metrics"`
+	UpStreak   int               `json:"upStreak"`
+	DownStreak int               `json:"downStreak"`
+}
+
+// Autoscaler periodically compares load metrics with the configured
+// thresholds and scales the nodes within min_count and max_count. Separate
+// up and down thresholds, consecutive evaluations and a cooldown keep it from
+// flapping. In dry-run mode it only logs what it would have done.
+type Autoscaler struct {
+	master     *Master
+	conf       *config.Config
+	mu         sync.Mutex
+	upStreak   int
+	downStreak int
+	lastScale  time.Time
+	decisions  []AutoscalerDecision
+}
+
+func NewAutoscaler(master *Master, conf *config.Config) *Autoscaler {
+	return &Autoscaler{master: master, conf: conf}
+}
+
+func (autoscaler *Autoscaler) Start() {
+	settings := autoscaler.conf.Service.Autoscaler
+	interval := time.Duration(settings.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	autoscalerLog.Info("started", "interval", interval, "dry_run", settings.DryRun)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			autoscaler.Evaluate()
+		}
+	}()
+}
+
+// Evaluate runs one autoscaling step and returns the decision taken.
+func (autoscaler *Autoscaler) Evaluate() AutoscalerDecision {
+	metrics := autoscaler.master.autoscalerMetrics()
+
+	autoscaler.mu.Lock()
+	lastScale := autoscaler.lastScale
+	decision := autoscaler.decide(metrics, time.Now())
+	autoscaler.mu.Unlock()
+
+	if decision.Action != ScaleNone {
+		if decision.DryRun {
+			autoscalerLog.Info("dry run, not scaling", "action", decision.Action, "reason", decision.Reason)
+		} else {
+			autoscalerLog.Info("scaling", "action", decision.Action, "reason", decision.Reason)
+			if decision.Action == ScaleUp {
+				decision.Applied = autoscaler.master.ScaleUp(autoscaler.conf)
+			} else {
+				decision.Applied = autoscaler.master.ScaleDown(autoscaler.conf)
+			}
+			if !decision.Applied {
+				decision.Reason = "could not " + string(decision.Action) + ": " + decision.Reason
+			}
+		}
+	}
+
+	autoscaler.mu.Lock()
+	if decision.Action != ScaleNone && !decision.DryRun && !decision.Applied {
+		// Nothing changed, the cooldown does not start
+		autoscaler.lastScale = lastScale
+	}
+	autoscaler.decisions = append(autoscaler.decisions, decision)
+	if overflow := len(autoscaler.decisions) - autoscalerHistorySize; overflow > 0 {
+		autoscaler.decisions = append(autoscaler.decisions[:0], autoscaler.decisions[overflow:]...)
+	}
+	autoscaler.mu.Unlock()
+	return decision
+}
+
+func (autoscaler *Autoscaler) decide(metrics AutoscalerMetrics, now time.Time) AutoscalerDecision {
+	settings := autoscaler.conf.Service.Autoscaler
+	nodes := autoscaler.conf.Service.Nodes
+	decision := AutoscalerDecision{Time: now.UnixMilli(), Action: ScaleNone, DryRun: settings.DryRun, Metrics: metrics}
+
+	exceeded := exceededTriggers(metrics, settings.ScaleUp)
+	switch {
+	case len(exceeded) > 0:
+		autoscaler.upStreak++
+		autoscaler.downStreak = 0
+	case belowTriggers(metrics, settings.ScaleDown):
+		autoscaler.downStreak++
+		autoscaler.upStreak = 0
+	default:
+		autoscaler.upStreak = 0
+		autoscaler.downStreak = 0
+	}
+	decision.UpStreak = autoscaler.upStreak
+	decision.DownStreak = autoscaler.downStreak
+
+	var action ScaleAction
+	switch {
+	case autoscaler.upStreak >= max(settings.ScaleUpAfter, 1):
+		if metrics.NodeCount >= nodes.MaxCount {
+			decision.Reason = "load is high but max_count is reached: " + strings.Join(exceeded, ", ")
+			return decision
+		}
+		action = ScaleUp
+		decision.Reason = strings.Join(exceeded, ", ")
+	case autoscaler.downStreak >= max(settings.ScaleDownAfter, 1):
+		if metrics.NodeCount <= nodes.MinCount {
+			decision.Reason = "load is low but min_count is reached"
+			return decision
+		}
+		action = ScaleDown
+		decision.Reason = fmt.Sprintf("every metric below the scale down thresholds for %d evaluations", autoscaler.downStreak)
+	default:
+		decision.Reason = "within thresholds"
+		return decision
+	}
+
+	cooldown := time.Duration(settings.CooldownSeconds) * time.Second
+	if since := now.Sub(autoscaler.lastScale); since < cooldown {
+		decision.Reason = fmt.Sprintf("cooling down for another %s, wanted to %s: %s", (cooldown - since).Round(time.Second), action, decision.Reason)
+		return decision
+	}
+
+	// A dry run moves the streaks and cooldown as well, so the log shows the
+	// same cadence a real run would have.
+	decision.Action = action
+	autoscaler.lastScale = now
+	autoscaler.upStreak = 0
+	autoscaler.downStreak = 0
+	return decision
+}
+
+// exceededTriggers lists the configured thresholds that metrics go above.
+func exceededTriggers(metrics AutoscalerMetrics, triggers config.AutoscalerTriggers) []string {
+	var exceeded []string
+	if triggers.RequestRate > 0 && metrics.RequestRate > triggers.RequestRate {
+		exceeded = append(exceeded, fmt.Sprintf("request rate %.1f/s > %.1f/s", metrics.RequestRate, triggers.RequestRate))
+	}
+	if triggers.KeysPerNode > 0 && metrics.KeysPerNode > float64(triggers.KeysPerNode) {
+		exceeded = append(exceeded, fmt.Sprintf("keys per node %.0f > %d", metrics.KeysPerNode, triggers.KeysPerNode))
+	}
+	if triggers.MemoryPerNodeMB > 0 && metrics.MemoryPerNodeMB > float64(triggers.MemoryPerNodeMB) {
+		exceeded = append(exceeded, fmt.Sprintf("memory per node %.1fMB > %dMB", metrics.MemoryPerNodeMB, triggers.MemoryPerNodeMB))
+	}
+	if triggers.P99LatencyMs > 0 && metrics.P99LatencyMs > float64(triggers.P99LatencyMs) {
+		exceeded = append(exceeded, fmt.Sprintf("p99 latency %.1fms > %dms", metrics.P99LatencyMs, triggers.P99LatencyMs))
+	}
+	return exceeded
+}
+
+// belowTriggers reports whether metrics are under every configured threshold.
+// Without any configured threshold it never asks to scale down.
+func belowTriggers(metrics AutoscalerMetrics, triggers config.AutoscalerTriggers) bool {
+	configured := false
+	if triggers.RequestRate > 0 {
+		configured = true
+		if metrics.RequestRate >= triggers.RequestRate {
+			return false
+		}
+	}
+	if triggers.KeysPerNode > 0 {
+		configured = true
+		if metrics.KeysPerNode >= float64(triggers.KeysPerNode) {
+			return false
+		}
+	}
+	if triggers.MemoryPerNodeMB > 0 {
+		configured = true
+		if metrics.MemoryPerNodeMB >= float64(triggers.MemoryPerNodeMB) {
+			return false
+		}
+	}
+	if triggers.P99LatencyMs > 0 {
+		configured = true
+		if metrics.P99LatencyMs >= float64(triggers.P99LatencyMs) {
+			return false
+		}
+	}
+	return configured
+}
+
+func (autoscaler *Autoscaler) Decisions() []AutoscalerDecision {
+	autoscaler.mu.Lock()
+	defer autoscaler.mu.Unlock()
+	return append([]AutoscalerDecision{}, autoscaler.decisions...)
+}
+
+// autoscalerMetrics gathers the current load. Every node holds the full
+// dataset, so keys and memory per node do not drop after scaling up; their
+// thresholds are guards rather than something scaling relieves.
+func (master *Master) autoscalerMetrics() AutoscalerMetrics {
+	nodes := master.nodeList()
+	rate, p99 := master.requests.snapshot()
+
+	master.mu.RLock()
+	keyCount := len(master.data)
+	master.mu.RUnlock()
+
+	metrics := AutoscalerMetrics{
+		NodeCount:    len(nodes),
+		RequestRate:  rate,
+		KeyCount:     keyCount,
+		P99LatencyMs: float64(p99.Microseconds()) / 1000,
+	}
+	if len(nodes) > 0 {
+		metrics.KeysPerNode = float64(keyCount)
+	}
+	for _, node := range nodes {
+		stats, err := node.GetStats()
+		if err != nil {
+			autoscalerLog.Warn("could not read node stats", "port", node.Port, "error", err)
+			continue
+		}
+		metrics.MemoryPerNodeMB = max(metrics.MemoryPerNodeMB, float64(stats.HeapAllocBytes)/(1024*1024))
+	}
+	return metrics
+}
@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/config"
+	"testing"
+	"time"
+)
+
+func testAutoscaler() *Autoscaler {
+	conf := &config.Config{}
+	conf.Service.Nodes.MinCount = 2
+	conf.Service.Nodes.MaxCount = 4
+	settings := &conf.Service.Autoscaler
+	settings.CooldownSeconds = 60
+	settings.ScaleUpAfter = 2
+	settings.ScaleDownAfter = 3
+	settings.ScaleUp = config.AutoscalerTriggers{RequestRate: 100, P99LatencyMs: 50}
+	settings.ScaleDown = config.AutoscalerTriggers{RequestRate: 10, P99LatencyMs: 5}
+	return NewAutoscaler(nil, conf)
+}
+
+func TestAutoscalerNeedsConsecutiveBreachesAndCooldown(t *testing.T) {
+	autoscaler := testAutoscaler()
+	now := time.Now()
+	busy := AutoscalerMetrics{NodeCount: 2, RequestRate: 250, P99LatencyMs: 20}
+
+	if decision := autoscaler.decide(busy, now); decision.Action != ScaleNone {
+		t.Fatalf("expected no action after one breach, got %s", decision.Action)
+	}
+	if decision := autoscaler.decide(busy, now.Add(time.Second)); decision.Action != ScaleUp {
+		t.Fatalf("expected scale up after two breaches, got %s (%s)", decision.Action, decision.Reason)
+	}
+
+	busy.NodeCount = 3
+	autoscaler.decide(busy, now.Add(2*time.Second))
+	if decision := autoscaler.decide(busy, now.Add(3*time.Second)); decision.Action != ScaleNone {
+		t.Fatalf("expected the cooldown to hold back scaling, got %s", decision.Action)
+	}
+	if decision := autoscaler.decide(busy, now.Add(2*time.Minute)); decision.Action != ScaleUp {
+		t.Fatalf("expected scale up after the cooldown, got %s (%s)", decision.Action, decision.Reason)
+	}
+}
+
+func TestAutoscalerHysteresis(t *testing.T) {
+	autoscaler := testAutoscaler()
+	now := time.Now()
+
+	// Between the up and down thresholds nothing accumulates
+	moderate := AutoscalerMetrics{NodeCount: 3, RequestRate: 50, P99LatencyMs: 20}
+	for i := 0; i < 5; i++ {
+		if decision := autoscaler.decide(moderate, now.Add(time.Duration(i)*time.Minute)); decision.Action != ScaleNone {
+			t.Fatalf("expected no action between thresholds, got %s", decision.Action)
+		}
+	}
+
+	idle := AutoscalerMetrics{NodeCount: 3, RequestRate: 1, P99LatencyMs: 1}
+	var decision AutoscalerDecision
+	for i := 0; i < 3; i++ {
+		decision = autoscaler.decide(idle, now.Add(time.Duration(10+i)*time.Minute))
+	}
+	if decision.Action != ScaleDown {
+		t.Fatalf("expected scale down after three idle evaluations, got %s (%s)", decision.Action, decision.Reason)
+	}
+
+	idle.NodeCount = 2
+	for i := 0; i < 3; i++ {
+		decision = autoscaler.decide(idle, now.Add(time.Duration(20+i)*time.Minute))
+	}
+	if decision.Action != ScaleNone {
+		t.Fatalf("expected min_count to stop scaling down, got %s", decision.Action)
+	}
+}
+
+func TestAutoscalerCooldownOnlyFollowsAppliedScaling(t *testing.T) {
+	conf := &config.Config{}
+	conf.Service.Nodes.ScaleDownPolicy = "port:1"
+	settings := &conf.Service.Autoscaler
+	settings.CooldownSeconds = 60
+	settings.ScaleDownAfter = 1
+	settings.ScaleDown = config.AutoscalerTriggers{RequestRate: 10}
+	master := &Master{}
+	master.nodes = []*Slave{NewNode(NewInProcessProvisioner(), freePort(t), master)}
+	autoscaler := NewAutoscaler(master, conf)
+
+	// No node listens on port 1, so the scale down finds nothing to remove
+	for i := 0; i < 2; i++ {
+		decision := autoscaler.Evaluate()
+		if decision.Action != ScaleDown || decision.Applied {
+			t.Fatalf("evaluation %d: expected an unapplied scale down, got %+v", i, decision)
+		}
+	}
+}
+
+func TestOnlyReadsFeedTheLatency(t *testing.T) {
+	master := &Master{}
+	master.RecordRequest(time.Second, false)
+	master.RecordRequest(time.Millisecond, true)
+	rate, p99 := master.requests.snapshot()
+	if p99 != time.Millisecond {
+		t.Errorf("expected the p99 of the read alone, got %s", p99)
+	}
+	if rate != 2/statsWindow.Seconds() {
+		t.Errorf("expected both requests in the rate, got %.2f/s", rate)
+	}
+}
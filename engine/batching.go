@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WriteConcern is when a write is acknowledged to its caller.
+type WriteConcern int
+
+const (
+	// WriteApplied acknowledges once the master applied the write, its batch
+	// reaches the nodes afterwards.
+	WriteApplied WriteConcern = iota
+	// WriteReplicated acknowledges once the batch of the write reached every
+	// node.
+	WriteReplicated
+)
+
+func ParseWriteConcern(name string) (WriteConcern, error) {
+	switch name {
+	case "", "applied":
+		return WriteApplied, nil
+	case "replicated":
+		return WriteReplicated, nil
+	}
+	return 0, fmt.Errorf("unknown write concern %q, use applied or replicated", name)
+}
+
+type writeConcernKey struct{}
+
+// WithWriteConcern makes the writes done with ctx wait for concern.
+func WithWriteConcern(ctx context.Context, concern WriteConcern) context.Context {
+	return context.WithValue(ctx, writeConcernKey{}, concern)
+}
+
+func writeConcern(ctx context.Context) WriteConcern {
+	concern, _ := ctx.Value(writeConcernKey{}).(WriteConcern)
+	return concern
+}
+
+// ErrNotReplicated is returned to writes with WriteReplicated when a node did
+// not take their batch. The master applied the write nonetheless.
+var ErrNotReplicated = errors.New("write was not replicated to every node")
+
+// broadcastBatch is the writes folded into one broadcast. done is closed
+// once it was sent, err is set before.
+type broadcastBatch struct {
+	ctx    context.Context
+	writes int
+	done   chan struct{}
+	err    error
+}
+
+// broadcastBatcher folds the writes of window, or up to maxWrites of them,
+// into one broadcast. The window starts with the first write of a batch.
+type broadcastBatcher struct {
+	mu        sync.Mutex
+	window    time.Duration
+	maxWrites int
+	current   *broadcastBatch
+	send      func(ctx context.Context, writes int) error
+}
+
+func newBroadcastBatcher(window time.Duration, maxWrites int, send func(ctx context.Context, writes int) error) *broadcastBatcher {
+	return &broadcastBatcher{window: window, maxWrites: maxWrites, send: send}
+}
+
+// add puts a write into the current batch. The batch's broadcast is part of
+// the trace of its first write.
+func (batcher *broadcastBatcher) add(ctx context.Context) *broadcastBatch {
+	batcher.mu.Lock()
+	defer batcher.mu.Unlock()
+	batch := batcher.current
+	if batch == nil {
+		batch = &broadcastBatch{ctx: context.WithoutCancel(ctx), done: make(chan struct{})}
+		batcher.current = batch
+		time.AfterFunc(batcher.window, func() { batcher.flush(batch) })
+	}
+	batch.writes++
+	if batcher.maxWrites > 0 && batch.writes >= batcher.maxWrites {
+		batcher.current = nil
+		go batcher.sendBatch(batch)
+	}
+	return batch
+}
+
+// flush sends batch when its window ends, unless it was full before.
+func (batcher *broadcastBatcher) flush(batch *broadcastBatch) {
+	batcher.mu.Lock()
+	if batcher.current != batch {
+		batcher.mu.Unlock()
+		return
+	}
+	batcher.current = nil
+	batcher.mu.Unlock()
+	batcher.sendBatch(batch)
+}
+
+func (batcher *broadcastBatcher) sendBatch(batch *broadcastBatch) {
+	batch.err = batcher.send(batch.ctx, batch.writes)
+	close(batch.done)
+}
+
+// replicateWrite broadcasts a write, or adds it to the current batch when
+// batching is on. Only writes with WriteReplicated wait for their batch and
+// learn whether every node took it.
+func (master *Master) replicateWrite(ctx context.Context) error {
+	if master.batcher == nil {
+		err := master.broadcast(ctx, 1)
+		if writeConcern(ctx) != WriteReplicated {
+			return nil
+		}
+		return err
+	}
+	batch := master.batcher.add(ctx)
+	if writeConcern(ctx) != WriteReplicated {
+		return nil
+	}
+	select {
+	case <-batch.done:
+		return batch.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
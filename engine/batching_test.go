@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"context"
+	"distributed-inmemory-cache/model"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedBatches struct {
+	mu     sync.Mutex
+	writes []int
+	err    error
+}
+
+func (recorded *recordedBatches) send(ctx context.Context, writes int) error {
+	recorded.mu.Lock()
+	defer recorded.mu.Unlock()
+	recorded.writes = append(recorded.writes, writes)
+	return recorded.err
+}
+
+func (recorded *recordedBatches) sent() []int {
+	recorded.mu.Lock()
+	defer recorded.mu.Unlock()
+	return append([]int(nil), recorded.writes...)
+}
+
+func TestBatcherFoldsWritesOfAWindow(t *testing.T) {
+	recorded := &recordedBatches{}
+	master := &Master{batcher: newBroadcastBatcher(30*time.Millisecond, 0, recorded.send)}
+
+	for i := 0; i < 9; i++ {
+		if err := master.replicateWrite(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sent := recorded.sent(); len(sent) != 0 {
+		t.Fatalf("applied writes should not wait for the window, sent %v", sent)
+	}
+	// A replicated write waits for its batch, which holds the writes before it
+	if err := master.replicateWrite(WithWriteConcern(context.Background(), WriteReplicated)); err != nil {
+		t.Fatal(err)
+	}
+	if sent := recorded.sent(); len(sent) != 1 || sent[0] != 10 {
+		t.Fatalf("expected one broadcast of 10 writes, got %v", sent)
+	}
+}
+
+func TestBatcherSendsFullBatches(t *testing.T) {
+	recorded := &recordedBatches{}
+	master := &Master{batcher: newBroadcastBatcher(time.Hour, 3, recorded.send)}
+
+	replicated := WithWriteConcern(context.Background(), WriteReplicated)
+	done := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { done <- master.replicateWrite(replicated) }()
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("a full batch should be sent without waiting for the window")
+		}
+	}
+	if sent := recorded.sent(); len(sent) != 1 || sent[0] != 3 {
+		t.Fatalf("expected one broadcast of 3 writes, got %v", sent)
+	}
+}
+
+func TestReplicatedWritesLearnOfFailedBatches(t *testing.T) {
+	recorded := &recordedBatches{err: ErrNotReplicated}
+	master := &Master{batcher: newBroadcastBatcher(5*time.Millisecond, 0, recorded.send)}
+
+	if err := master.replicateWrite(context.Background()); err != nil {
+		t.Errorf("an applied write should not learn of replication, got %v", err)
+	}
+	if err := master.replicateWrite(WithWriteConcern(context.Background(), WriteReplicated)); !errors.Is(err, ErrNotReplicated) {
+		t.Errorf("expected ErrNotReplicated, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(WithWriteConcern(context.Background(), WriteReplicated))
+	cancel()
+	master.batcher = newBroadcastBatcher(time.Hour, 0, recorded.send)
+	if err := master.replicateWrite(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("a writer that gave up should not wait for its batch, got %v", err)
+	}
+}
+
+func TestParseWriteConcern(t *testing.T) {
+	for name, want := range map[string]WriteConcern{"": WriteApplied, "applied": WriteApplied, "replicated": WriteReplicated} {
+		if concern, err := ParseWriteConcern(name); err != nil || concern != want {
+			t.Errorf("%q: got %v %v", name, concern, err)
+		}
+	}
+	if _, err := ParseWriteConcern("majority"); err == nil {
+		t.Error("expected an error for an unknown write concern")
+	}
+}
+
+func TestConcurrentBatchesReachANodeInTurn(t *testing.T) {
+	master := startComparedCluster(t, map[string]string{"a": "1"},
+		model.DataPayload{DataVersion: 42, Data: map[string]string{"a": "1"}})
+	// Every write is a full batch, sent right away
+	master.batcher = newBroadcastBatcher(time.Hour, 1, master.broadcast)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			master.mu.Lock()
+			master.dataVersionId++
+			master.mu.Unlock()
+			if err := master.replicateWrite(WithWriteConcern(context.Background(), WriteReplicated)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if node := master.nodes[0]; node.dataVersion() != master.DataVersion() || node.DataQuality != Fresh {
+		t.Errorf("expected the node at version %d, got %d", master.DataVersion(), node.dataVersion())
+	}
+}
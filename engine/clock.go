@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// logicalBits of a version count writes within the same millisecond, the
+	// bits above them are the wall clock in milliseconds.
+	logicalBits = 16
+	// clockReservation is how far ahead of the versions handed out the
+	// persisted ceiling is kept, so the file is written about once per it.
+	clockReservation = 10 * time.Second
+)
+
+// hybridClock hands out data versions that only ever grow, also across
+// restarts of the master and when the wall clock steps back. A version is
+// the wall clock in milliseconds shifted by logicalBits plus a counter,
+// which takes over while the wall clock stands still or is behind.
+//
+// Before handing out a version the clock persists a ceiling above it, a
+// restarted master starts above the ceiling of the previous one. The zero
+// value uses the wall clock and persists nothing. The master's mu guards it.
+type hybridClock struct {
+	path    string
+	now     func() time.Time
+	last    int64
+	ceiling int64
+}
+
+// clockFile is replication.clock_file, or a file in logs.dir without one.
+func clockFile(conf *config.Config) string {
+	if conf.Service.Replication.ClockFile != "" {
+		return conf.Service.Replication.ClockFile
+	}
+	return filepath.Join(conf.Service.Logs.Dir, "cache-clock.json")
+}
+
+type clockState struct {
+	Ceiling int64 `json:"ceiling"`
+}
+
+// load continues after the ceiling persisted by a previous master.
+func (clock *hybridClock) load() error {
+	content, err := os.ReadFile(clock.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state clockState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return fmt.Errorf("reading clock file %s: %w", clock.path, err)
+	}
+	clock.last = max(clock.last, state.Ceiling)
+	return nil
+}
+
+// next returns a version above every version handed out or observed before.
+func (clock *hybridClock) next() int64 {
+	clock.last = max(clock.physical(), clock.last+1)
+	clock.reserve()
+	return clock.last
+}
+
+// observe moves the clock past a version it did not hand out, e.g. one a
+// recovered node holds.
+func (clock *hybridClock) observe(version int64) {
+	if version > clock.last {
+		clock.last = version
+		clock.reserve()
+	}
+}
+
+func (clock *hybridClock) physical() int64 {
+	now := time.Now
+	if clock.now != nil {
+		now = clock.now
+	}
+	return now().UnixMilli() << logicalBits
+}
+
+// reserve persists a new ceiling once the versions reach the current one. A
+// ceiling that cannot be written only costs monotonicity across a restart
+// with a clock that stepped back, so the versions are handed out anyway.
+func (clock *hybridClock) reserve() {
+	if clock.path == "" || clock.last < clock.ceiling {
+		return
+	}
+	clock.ceiling = max(clock.last, clock.physical()) + clockReservation.Milliseconds()<<logicalBits
+	content, err := json.Marshal(clockState{Ceiling: clock.ceiling})
+	if err != nil {
+		logger.Error("could not encode clock", "error", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(clock.path), 0o755); err != nil {
+		logger.Error("could not create clock dir", "error", err)
+		return
+	}
+	temp := clock.path + ".tmp"
+	if err := os.WriteFile(temp, content, 0o644); err != nil {
+		logger.Error("could not write clock", "error", err)
+		return
+	}
+	if err := os.Rename(temp, clock.path); err != nil {
+		logger.Error("could not replace clock", "error", err)
+	}
+}
+
+// versionTime is the wall clock time a data version was handed out at, or
+// the time the master's clock had caught up to by then.
+func versionTime(version int64) time.Time {
+	return time.UnixMilli(version >> logicalBits)
+}
+
+// versionCounter is the logical part of a data version, the writes handed
+// out before it within the same millisecond.
+func versionCounter(version int64) int64 {
+	return version & (1<<logicalBits - 1)
+}
@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHybridClockNeverGoesBack(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	clock := hybridClock{now: func() time.Time { return now }}
+
+	first := clock.next()
+	second := clock.next()
+	if second <= first || versionTime(second) != now {
+		t.Fatalf("writes in the same millisecond should count up, got %d then %d", first, second)
+	}
+	now = now.Add(-time.Minute)
+	if stepped := clock.next(); stepped <= second {
+		t.Fatalf("a clock stepped back should not go back, got %d after %d", stepped, second)
+	}
+	now = now.Add(2 * time.Minute)
+	if later := clock.next(); versionTime(later) != now {
+		t.Errorf("the wall clock should take over again once it is ahead, got %v", versionTime(later))
+	}
+
+	clock.observe(second + 1<<logicalBits*int64(time.Hour/time.Millisecond))
+	if observed := clock.next(); versionTime(observed).Before(now.Add(59 * time.Minute)) {
+		t.Errorf("the clock should move past an observed version, got %v", versionTime(observed))
+	}
+}
+
+func TestHybridClockPersistsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clock.json")
+	now := time.UnixMilli(1_700_000_000_000)
+	clock := hybridClock{path: path, now: func() time.Time { return now }}
+	last := clock.next()
+	for range 100 {
+		last = clock.next()
+	}
+
+	// The restarted master's wall clock is an hour behind
+	restarted := hybridClock{path: path, now: func() time.Time { return now.Add(-time.Hour) }}
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	if version := restarted.next(); version <= last {
+		t.Fatalf("a restarted clock handed out %d, not after %d", version, last)
+	}
+}
+
+// startVersionedNode fakes a node that holds data at version.
+func startVersionedNode(t *testing.T, version int64, data map[string]string) model.NodeRegistration {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health", "/notify":
+			w.Write([]byte("OK"))
+		case "/dataVersion":
+			fmt.Fprint(w, version)
+		case "/data":
+			json.NewEncoder(w).Encode(model.DataPayload{DataVersion: version, Data: data})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+	return model.NodeRegistration{ID: strconv.FormatInt(version, 10), Host: "127.0.0.1", Port: port}
+}
+
+func TestRecoveryStartsPastEveryNode(t *testing.T) {
+	// Versions of a master whose clock ran ahead of this one's
+	ahead := time.Now().Add(time.Hour).UnixMilli() << logicalBits
+	path := filepath.Join(t.TempDir(), "members.json")
+	members := newMembership(path)
+	members.add(startVersionedNode(t, ahead, map[string]string{"a": "old"}))
+	members.add(startVersionedNode(t, ahead+5, map[string]string{"a": "new"}))
+	members.add(startVersionedNode(t, ahead+2, map[string]string{"a": "older"}))
+
+	master := &Master{
+		data:         make(map[string]string),
+		members:      newMembership(path),
+		provisioners: []Provisioner{NewInProcessProvisioner()},
+		locks:        newLockTable(),
+		webhooks:     newWebhookDispatcher(),
+		clock:        hybridClock{path: filepath.Join(t.TempDir(), "clock.json")},
+	}
+	master.tryRecoveringNodes()
+
+	if len(master.nodes) != 3 || master.data["a"] != "new" {
+		t.Fatalf("expected the data of the newest node, got %v from %d nodes", master.data, len(master.nodes))
+	}
+	if version := master.DataVersion(); version <= ahead+5 {
+		t.Errorf("the master's version %d should be past every node's", version)
+	}
+	for _, node := range master.nodes {
+		if err := node.Broadcast(master.DataVersion()); err != nil || node.DataVersionId != master.DataVersion() {
+			t.Errorf("node %s did not take the recovered data: %v", node.ID, err)
+		}
+	}
+}
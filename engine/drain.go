@@ -0,0 +1,184 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/config"
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ScaleDownOldest      = "oldest"
+	ScaleDownNewest      = "newest"
+	ScaleDownLeastLoaded = "least-loaded"
+	scaleDownPortPrefix  = "port:"
+)
+
+var ErrNoNodeToRemove = errors.New("no node matches the scale down policy")
+
+// Drain asks the node to stop taking reads and waits for its in-flight
+// requests, returning how many were still running when the timeout passed.
+func (n *Slave) Drain(timeout time.Duration) (int64, error) {
+	client := &http.Client{Timeout: timeout + 5*time.Second, Transport: n.client().Transport}
+	resp, err := client.Post(n.drainURL+"?timeout="+url.QueryEscape(timeout.String()), "text/plain", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New(resp.Status)
+	}
+	var result struct {
+		InFlight int64 `json:"in_flight"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.InFlight, nil
+}
+
+func (n *Slave) Undrain() error {
+	request, err := http.NewRequest(http.MethodDelete, n.drainURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client().Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// ScaleDownWith removes one node chosen by policy: oldest, newest,
+// least-loaded or port:<port>. The node is marked draining, so it shows up as
+// such in nodestats and reports itself unavailable to readers, its in-flight
+// requests are awaited and only then is it killed. Every node holds the full
+// dataset, so there are no partitions to hand off before it goes.
+func (master *Master) ScaleDownWith(conf *config.Config, policy string) bool {
+	master.scaleMu.Lock()
+	defer master.scaleMu.Unlock()
+
+	nodes := master.nodeList()
+	if len(nodes) <= conf.Service.Nodes.MinCount {
+		return false
+	}
+	node, err := selectNodeToRemove(nodes, policy)
+	if err != nil {
+		logger.Warn("no node to scale down", "policy", policy, "error", err)
+		return false
+	}
+
+	timeout := time.Duration(conf.Service.Nodes.DrainTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	previous := node.status()
+	master.setNodeStatus(node, Draining, "scale down with policy "+policyName(policy))
+	remaining, err := node.Drain(timeout)
+	if err != nil {
+		node.logger().Warn("drain failed, killing the node anyway", "error", err)
+	} else if remaining > 0 {
+		node.logger().Warn("requests still in flight after drain", "in_flight", remaining, "timeout", timeout)
+	}
+
+	if err := node.Shutdown(); err != nil {
+		node.logger().Error("could not shut down node", "error", err)
+		node.Undrain()
+		master.setNodeStatus(node, previous, "shutdown failed, drain cancelled")
+		return false
+	}
+	master.setNodeStatus(node, Shutdown, "scaled down")
+	master.removeNode(node)
+	master.members.remove(node.Host, node.Port)
+	master.refreshNodes()
+	return true
+}
+
+func (master *Master) removeNode(node *Slave) {
+	master.nodesMu.Lock()
+	defer master.nodesMu.Unlock()
+	for i, existing := range master.nodes {
+		if existing == node {
+			master.nodes = append(master.nodes[:i:i], master.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+func policyName(policy string) string {
+	if policy == "" {
+		return ScaleDownOldest
+	}
+	return policy
+}
+
+func selectNodeToRemove(nodes []*Slave, policy string) (*Slave, error) {
+	var candidates []*Slave
+	for _, node := range nodes {
+		if status := node.status(); status != Draining && status != Shutdown {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoNodeToRemove
+	}
+
+	switch {
+	case policy == "" || policy == ScaleDownOldest:
+		// Nodes are appended as they are started, ties keep that order
+		oldest := candidates[0]
+		for _, node := range candidates[1:] {
+			if node.RunningSince > 0 && node.RunningSince < oldest.RunningSince {
+				oldest = node
+			}
+		}
+		return oldest, nil
+	case policy == ScaleDownNewest:
+		newest := candidates[len(candidates)-1]
+		for _, node := range candidates {
+			if node.RunningSince > newest.RunningSince {
+				newest = node
+			}
+		}
+		return newest, nil
+	case policy == ScaleDownLeastLoaded:
+		var chosen *Slave
+		var chosenStats *model.NodeStats
+		for _, node := range candidates {
+			stats, err := node.GetStats()
+			if err != nil {
+				// An unreachable node carries no load and is the cheapest to lose
+				return node, nil
+			}
+			if chosen == nil || stats.InFlight < chosenStats.InFlight ||
+				(stats.InFlight == chosenStats.InFlight && stats.Requests < chosenStats.Requests) {
+				chosen = node
+				chosenStats = stats
+			}
+		}
+		return chosen, nil
+	case strings.HasPrefix(policy, scaleDownPortPrefix):
+		port, err := strconv.Atoi(strings.TrimPrefix(policy, scaleDownPortPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in policy %q", policy)
+		}
+		for _, node := range candidates {
+			if node.Port == port {
+				return node, nil
+			}
+		}
+		return nil, ErrNoNodeToRemove
+	}
+	return nil, fmt.Errorf("unknown scale down policy %q", policy)
+}
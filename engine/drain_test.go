@@ -0,0 +1,33 @@
+package engine
+
+import "testing"
+
+func TestSelectNodeToRemove(t *testing.T) {
+	first := &Slave{Port: 3001, RunningSince: 300, Status: Active}
+	second := &Slave{Port: 3002, RunningSince: 100, Status: Active}
+	third := &Slave{Port: 3003, RunningSince: 200, Status: Draining}
+	nodes := []*Slave{first, second, third}
+
+	cases := []struct {
+		policy string
+		want   *Slave
+	}{
+		{"", second},
+		{ScaleDownOldest, second},
+		{ScaleDownNewest, first},
+		{"port:3001", first},
+	}
+	for _, c := range cases {
+		got, err := selectNodeToRemove(nodes, c.policy)
+		if err != nil || got != c.want {
+			t.Errorf("policy %q: expected node %d, got %v (%v)", c.policy, c.want.Port, got, err)
+		}
+	}
+
+	if _, err := selectNodeToRemove(nodes, "port:3003"); err == nil {
+		t.Errorf("expected a draining node not to be selected")
+	}
+	if _, err := selectNodeToRemove(nodes, "random"); err == nil {
+		t.Errorf("expected an unknown policy to fail")
+	}
+}
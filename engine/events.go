@@ -0,0 +1,268 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventSet    EventType = "set"
+	EventDelete EventType = "delete"
+	EventExpire EventType = "expire"
+)
+
+const (
+	eventHistorySize   = 4096
+	watcherChannelSize = 256
+)
+
+var ErrHistoryTruncated = errors.New("requested data version is older than the retained event history")
+
+type ChangeEvent struct {
+	DataVersionId int64 `json:"dataVersionId"`
+	// Index tells apart the events of one write, which share its version
+	Index     int       `json:"index"`
+	Type      EventType `json:"type"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+func (event ChangeEvent) ID() EventID {
+	return EventID{Version: event.DataVersionId, Index: event.Index}
+}
+
+// EventID is the position of an event in the stream, unique and increasing
+// across the events of a multi-key write.
+type EventID struct {
+	Version int64
+	Index   int
+}
+
+// LiveEvents watches without replaying any history.
+var LiveEvents = EventID{Version: -1}
+
+// AfterVersion is past every event of version.
+func AfterVersion(version int64) EventID {
+	return EventID{Version: version, Index: math.MaxInt}
+}
+
+// ParseEventID reads an id as written by String. A bare data version id
+// stands for all of its events, so it resumes after the whole write.
+func ParseEventID(value string) (EventID, error) {
+	version, index, found := strings.Cut(value, "-")
+	parsed, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return EventID{}, err
+	}
+	id := AfterVersion(parsed)
+	if found {
+		if id.Index, err = strconv.Atoi(index); err != nil || id.Index < 0 {
+			return EventID{}, fmt.Errorf("invalid event index %q", index)
+		}
+	}
+	return id, nil
+}
+
+func (id EventID) String() string {
+	return fmt.Sprintf("%d-%d", id.Version, id.Index)
+}
+
+// After is true when id comes later in the stream than other.
+func (id EventID) After(other EventID) bool {
+	return id.Version > other.Version || id.Version == other.Version && id.Index > other.Index
+}
+
+// Watcher receives the change events matching its key prefix. The Events
+// channel is closed when the watcher is closed or when it falls too far
+// behind, in which case the consumer should resume from the last version it saw.
+type Watcher struct {
+	Events chan ChangeEvent
+	prefix string
+	// after is the last event in the history when the watcher started, the
+	// watcher saw it replayed or started past it
+	after     EventID
+	hub       *EventHub
+	closeOnce sync.Once
+}
+
+func (w *Watcher) Close() {
+	w.hub.remove(w)
+}
+
+func (w *Watcher) matches(event ChangeEvent) bool {
+	return event.ID().After(w.after) && strings.HasPrefix(event.Key, w.prefix)
+}
+
+// EventHub keeps a bounded history of change events and fans them out to watchers.
+type EventHub struct {
+	mu      sync.Mutex
+	history []ChangeEvent
+	// truncatedAt is the last event dropped from the history
+	truncatedAt  EventID
+	watchers     map[*Watcher]struct{}
+	listeners    []func(ChangeEvent)
+	historyLimit int
+}
+
+func NewEventHub(startVersion int64) *EventHub {
+	return &EventHub{
+		history:      make([]ChangeEvent, 0, eventHistorySize),
+		truncatedAt:  AfterVersion(startVersion),
+		watchers:     make(map[*Watcher]struct{}),
+		historyLimit: eventHistorySize,
+	}
+}
+
+// Watch registers a watcher for keys starting with prefix. Events after from
+// are replayed first; LiveEvents streams live events only.
+func (hub *EventHub) Watch(prefix string, from EventID) (*Watcher, error) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	var replay []ChangeEvent
+	if from.Version >= 0 {
+		if hub.truncatedAt.After(from) {
+			return nil, ErrHistoryTruncated
+		}
+		for _, event := range hub.history {
+			if event.ID().After(from) && strings.HasPrefix(event.Key, prefix) {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	watcher := &Watcher{
+		Events: make(chan ChangeEvent, watcherChannelSize+len(replay)),
+		prefix: prefix,
+		after:  hub.truncatedAt,
+		hub:    hub,
+	}
+	if len(hub.history) > 0 {
+		watcher.after = hub.history[len(hub.history)-1].ID()
+	}
+	for _, event := range replay {
+		watcher.Events <- event
+	}
+	hub.watchers[watcher] = struct{}{}
+	return watcher, nil
+}
+
+// since returns the events newer than version in the order they happened,
+// false when the history no longer reaches back to version.
+func (hub *EventHub) since(version int64) ([]ChangeEvent, bool) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if version < hub.truncatedAt.Version {
+		return nil, false
+	}
+	var events []ChangeEvent
+	for _, event := range hub.history {
+		if event.DataVersionId > version {
+			events = append(events, event)
+		}
+	}
+	return events, true
+}
+
+// AddListener registers a callback invoked synchronously for every published
+// event. Listeners must not block.
+func (hub *EventHub) AddListener(listener func(ChangeEvent)) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.listeners = append(hub.listeners, listener)
+}
+
+func (hub *EventHub) Publish(events []ChangeEvent) {
+	hub.record(events)
+	hub.dispatch(events)
+}
+
+// record adds events to the history, where pushes and new watchers find
+// them, and numbers the events sharing a version. The master records them
+// while it holds its lock, so the history always has the events of its
+// current version.
+func (hub *EventHub) record(events []ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	previous := LiveEvents
+	if len(hub.history) > 0 {
+		previous = hub.history[len(hub.history)-1].ID()
+	}
+	for i := range events {
+		if events[i].Timestamp == 0 {
+			events[i].Timestamp = now
+		}
+		events[i].Index = 0
+		if events[i].DataVersionId == previous.Version {
+			events[i].Index = previous.Index + 1
+		}
+		previous = events[i].ID()
+	}
+
+	hub.history = append(hub.history, events...)
+	if overflow := len(hub.history) - hub.historyLimit; overflow > 0 {
+		hub.truncatedAt = hub.history[overflow-1].ID()
+		hub.history = append(hub.history[:0], hub.history[overflow:]...)
+	}
+}
+
+// dispatch hands recorded events to the watchers and listeners. Watchers
+// that started after the events were recorded already had them replayed.
+// Events must be dispatched in the order they were recorded.
+func (hub *EventHub) dispatch(events []ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	hub.mu.Lock()
+	for watcher := range hub.watchers {
+		for _, event := range events {
+			if !watcher.matches(event) {
+				continue
+			}
+			select {
+			case watcher.Events <- event:
+			default:
+				// Slow consumer, drop it so it can resume from its last version
+				hub.closeLocked(watcher)
+			}
+			if _, ok := hub.watchers[watcher]; !ok {
+				break
+			}
+		}
+	}
+
+	listeners := hub.listeners
+	hub.mu.Unlock()
+
+	for _, listener := range listeners {
+		for _, event := range events {
+			listener(event)
+		}
+	}
+}
+
+func (hub *EventHub) remove(watcher *Watcher) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.closeLocked(watcher)
+}
+
+func (hub *EventHub) closeLocked(watcher *Watcher) {
+	delete(hub.watchers, watcher)
+	watcher.closeOnce.Do(func() {
+		close(watcher.Events)
+	})
+}
@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWatchReplaysHistoryNewerThanVersion(t *testing.T) {
+	hub := NewEventHub(0)
+	hub.Publish([]ChangeEvent{{DataVersionId: 1, Type: EventSet, Key: "user:1", Value: "a"}})
+	hub.Publish([]ChangeEvent{{DataVersionId: 2, Type: EventSet, Key: "order:1", Value: "b"}})
+	hub.Publish([]ChangeEvent{{DataVersionId: 3, Type: EventDelete, Key: "user:1"}})
+
+	watcher, err := hub.Watch("user:", AfterVersion(1))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer watcher.Close()
+
+	event := <-watcher.Events
+	if event.DataVersionId != 3 || event.Type != EventDelete || event.Key != "user:1" {
+		t.Errorf("unexpected replayed event: %+v", event)
+	}
+
+	hub.Publish([]ChangeEvent{{DataVersionId: 4, Type: EventSet, Key: "order:2"}, {DataVersionId: 4, Type: EventExpire, Key: "user:2"}})
+	event = <-watcher.Events
+	if event.Key != "user:2" || event.Type != EventExpire {
+		t.Errorf("expected live expire event for user:2, got %+v", event)
+	}
+	if len(watcher.Events) != 0 {
+		t.Errorf("expected no further events, got %d", len(watcher.Events))
+	}
+}
+
+func TestWatchFromTruncatedHistory(t *testing.T) {
+	hub := NewEventHub(0)
+	hub.historyLimit = 2
+	for version := int64(1); version <= 4; version++ {
+		hub.Publish([]ChangeEvent{{DataVersionId: version, Type: EventSet, Key: "k"}})
+	}
+
+	if _, err := hub.Watch("", AfterVersion(1)); !errors.Is(err, ErrHistoryTruncated) {
+		t.Errorf("expected ErrHistoryTruncated, got %v", err)
+	}
+	watcher, err := hub.Watch("", AfterVersion(2))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer watcher.Close()
+	if len(watcher.Events) != 2 {
+		t.Errorf("expected 2 replayed events, got %d", len(watcher.Events))
+	}
+}
+
+func TestSlowWatcherIsDropped(t *testing.T) {
+	hub := NewEventHub(0)
+	watcher, _ := hub.Watch("", LiveEvents)
+	for version := int64(1); version <= watcherChannelSize+1; version++ {
+		hub.Publish([]ChangeEvent{{DataVersionId: version, Type: EventSet, Key: "k"}})
+	}
+
+	count := 0
+	for range watcher.Events {
+		count++
+	}
+	if count != watcherChannelSize {
+		t.Errorf("expected %d buffered events before close, got %d", watcherChannelSize, count)
+	}
+	watcher.Close()
+}
+
+func TestListenersRunOutsideTheMasterLock(t *testing.T) {
+	master := &Master{
+		data:     make(map[string]string),
+		expiries: make(map[string]int64),
+		events:   NewEventHub(0),
+	}
+	var seen map[string]string
+	// A listener reading the master would deadlock if events went out
+	// while the write still held the lock
+	master.events.AddListener(func(event ChangeEvent) {
+		seen = master.GetData()
+	})
+	master.SetData(map[string]string{"a": "1"})
+	if seen["a"] != "1" {
+		t.Errorf("expected the listener to see the write, got %v", seen)
+	}
+}
+
+func TestWatcherStartedBeforeDispatchSeesEventsOnce(t *testing.T) {
+	hub := NewEventHub(0)
+	events := []ChangeEvent{{DataVersionId: 1, Type: EventSet, Key: "k"}}
+	hub.record(events)
+	replaying, _ := hub.Watch("", AfterVersion(0))
+	live, _ := hub.Watch("", LiveEvents)
+	hub.dispatch(events)
+	hub.Publish([]ChangeEvent{{DataVersionId: 2, Type: EventSet, Key: "k"}})
+
+	if len(replaying.Events) != 2 {
+		t.Errorf("expected version 1 replayed and version 2 live, got %d events", len(replaying.Events))
+	}
+	if len(live.Events) != 1 {
+		t.Errorf("expected only version 2 on a live watcher, got %d events", len(live.Events))
+	}
+}
+
+func TestWatchResumesWithinAWrite(t *testing.T) {
+	hub := NewEventHub(0)
+	hub.Publish([]ChangeEvent{{DataVersionId: 1, Type: EventSet, Key: "a"}, {DataVersionId: 1, Type: EventSet, Key: "b"}, {DataVersionId: 1, Type: EventSet, Key: "c"}})
+	hub.Publish([]ChangeEvent{{DataVersionId: 2, Type: EventDelete, Key: "a"}})
+
+	seen, err := ParseEventID("1-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := hub.Watch("", seen)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer watcher.Close()
+	var keys []string
+	for len(watcher.Events) > 0 {
+		event := <-watcher.Events
+		keys = append(keys, event.ID().String()+":"+event.Key)
+	}
+	if strings.Join(keys, ",") != "1-1:b,1-2:c,2-0:a" {
+		t.Errorf("expected the rest of the write and the next one, got %v", keys)
+	}
+
+	// A bare version resumes after all of its events
+	whole, _ := ParseEventID("1")
+	watcher, _ = hub.Watch("", whole)
+	defer watcher.Close()
+	if event := <-watcher.Events; len(watcher.Events) != 0 || event.DataVersionId != 2 {
+		t.Errorf("expected only version 2 after version 1, got %+v and %d more", event, len(watcher.Events))
+	}
+}
@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"context"
+	"distributed-inmemory-cache/config"
+	"distributed-inmemory-cache/logging"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	nodeEventHistorySize = 500
+	restartHealthChecks  = 20
+)
+
+var detectorLog = logging.Component("failure-detector")
+
+type NodeEvent struct {
+	Time   int64  `json:"time"`
+	Port   int    `json:"port"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+}
+
+type nodeEventLog struct {
+	mu     sync.Mutex
+	events []NodeEvent
+}
+
+func (eventLog *nodeEventLog) record(event NodeEvent) {
+	eventLog.mu.Lock()
+	defer eventLog.mu.Unlock()
+	eventLog.events = append(eventLog.events, event)
+	if overflow := len(eventLog.events) - nodeEventHistorySize; overflow > 0 {
+		eventLog.events = append(eventLog.events[:0], eventLog.events[overflow:]...)
+	}
+}
+
+func (eventLog *nodeEventLog) list() []NodeEvent {
+	eventLog.mu.Lock()
+	defer eventLog.mu.Unlock()
+	return append([]NodeEvent{}, eventLog.events...)
+}
+
+func (status NodeStatus) String() string {
+	switch status {
+	case New:
+		return "new"
+	case Active:
+		return "active"
+	case Shutdown:
+		return "shutdown"
+	case Zombie:
+		return "zombie"
+	case Recovered:
+		return "recovered"
+	case Unrecoverable:
+		return "unrecoverable"
+	case Draining:
+		return "draining"
+	}
+	return fmt.Sprintf("status(%d)", int(status))
+}
+
+// setNodeStatus moves a node to a new status and records the transition.
+func (master *Master) setNodeStatus(node *Slave, status NodeStatus, reason string) {
+	from := node.swapStatus(status)
+	master.nodeEvents.record(NodeEvent{
+		Time:   time.Now().UnixMilli(),
+		Port:   node.Port,
+		From:   from.String(),
+		To:     status.String(),
+		Reason: reason,
+	})
+	node.logger().Info("status changed", "from", from.String(), "to", status.String(), "reason", reason)
+}
+
+func (master *Master) NodeEvents() []NodeEvent {
+	return master.nodeEvents.list()
+}
+
+// FailureDetector polls every node's /health. A node that misses
+// suspect_after beats in a row becomes a Zombie, one that misses dead_after
+// beats is Unrecoverable and, when restart is on, is respawned on the same
+// port and re-seeded with the current data.
+type FailureDetector struct {
+	master       *Master
+	interval     time.Duration
+	suspectAfter int
+	deadAfter    int
+	restart      bool
+}
+
+func NewFailureDetector(master *Master, conf *config.Config) *FailureDetector {
+	settings := conf.Service.FailureDetector
+	detector := &FailureDetector{
+		master:       master,
+		interval:     time.Duration(settings.IntervalMs) * time.Millisecond,
+		suspectAfter: settings.SuspectAfter,
+		deadAfter:    settings.DeadAfter,
+		restart:      settings.Restart,
+	}
+	if detector.interval <= 0 {
+		detector.interval = 2 * time.Second
+	}
+	if detector.suspectAfter <= 0 {
+		detector.suspectAfter = 2
+	}
+	if detector.deadAfter <= detector.suspectAfter {
+		detector.deadAfter = detector.suspectAfter + 3
+	}
+	return detector
+}
+
+func (detector *FailureDetector) Start() {
+	detectorLog.Info("started", "interval", detector.interval, "suspect_after", detector.suspectAfter, "dead_after", detector.deadAfter)
+	go func() {
+		ticker := time.NewTicker(detector.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			detector.CheckAll()
+		}
+	}()
+}
+
+func (detector *FailureDetector) CheckAll() {
+	var wg sync.WaitGroup
+	for _, node := range detector.master.nodeList() {
+		wg.Add(1)
+		go func(node *Slave) {
+			defer wg.Done()
+			detector.check(node)
+		}(node)
+	}
+	wg.Wait()
+}
+
+func (detector *FailureDetector) check(node *Slave) {
+	status := node.status()
+	if status == New || status == Shutdown || status == Draining || node.respawning.Load() {
+		return
+	}
+	master := detector.master
+
+	if detector.probe(node) == Active {
+		node.heartbeat()
+		if status == Zombie || status == Unrecoverable {
+			master.setNodeStatus(node, Active, "heartbeat answered again")
+			node.Broadcast(master.DataVersion())
+		}
+		return
+	}
+
+	missed := node.missBeat()
+	switch {
+	case missed >= detector.deadAfter && status != Unrecoverable:
+		master.setNodeStatus(node, Unrecoverable, fmt.Sprintf("missed %d heartbeats", missed))
+		if detector.restart {
+			detector.startRespawn(node)
+		}
+	case status == Unrecoverable && detector.restart && missed%detector.deadAfter == 0:
+		// Keep retrying a node that did not come back, once per dead_after beats
+		detector.startRespawn(node)
+	case missed >= detector.suspectAfter && (status == Active || status == Recovered):
+		master.setNodeStatus(node, Zombie, fmt.Sprintf("missed %d heartbeats", missed))
+	}
+}
+
+// probe checks a node's health, giving it one heartbeat interval to answer
+// so a hung node cannot hold up the next round.
+func (detector *FailureDetector) probe(node *Slave) NodeStatus {
+	if detector.interval <= 0 {
+		return node.CheckHealth()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), detector.interval)
+	defer cancel()
+	return node.CheckHealthContext(ctx)
+}
+
+// startRespawn respawns node off the check loop, so the next rounds of
+// heartbeats do not wait for it. The node is not checked until it is done.
+func (detector *FailureDetector) startRespawn(node *Slave) {
+	if !node.respawning.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer node.respawning.Store(false)
+		detector.respawn(node)
+	}()
+}
+
+// respawn starts a new process on the dead node's port and, once it answers,
+// pushes the current data to it.
+func (detector *FailureDetector) respawn(node *Slave) {
+	master := detector.master
+	detectorLog.Info("respawning node", "port", node.Port)
+
+	// A hung process may still hold the port, ask it to go away first
+	node.Shutdown()
+	if err := node.launch(); err != nil {
+		master.setNodeStatus(node, Unrecoverable, "respawn failed to start a process")
+		return
+	}
+
+	for i := 0; i < restartHealthChecks; i++ {
+		<-time.After(500 * time.Millisecond)
+		if detector.probe(node) == Active {
+			node.restarted()
+			node.setDataVersion(0)
+			if err := node.Broadcast(master.DataVersion()); err != nil {
+				detectorLog.Warn("could not re-seed node", "port", node.Port, "error", err)
+			}
+			master.setNodeStatus(node, Active, fmt.Sprintf("respawned with pid %d and re-seeded", node.processID()))
+			return
+		}
+	}
+	master.setNodeStatus(node, Unrecoverable, "respawned process never became healthy")
+}
@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFailureDetectorStateTransitions(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	master := &Master{}
+	node := NewNode(NewInProcessProvisioner(), port, master)
+	node.Status = Active
+	detector := &FailureDetector{master: master, suspectAfter: 2, deadAfter: 4}
+
+	detector.check(node)
+	if node.Status != Active || node.LastHeartbeat == 0 {
+		t.Fatalf("expected a healthy active node, got %s", node.Status)
+	}
+
+	healthy.Store(false)
+	for i := 0; i < 2; i++ {
+		detector.check(node)
+	}
+	if node.Status != Zombie {
+		t.Fatalf("expected zombie after 2 missed beats, got %s", node.Status)
+	}
+	for i := 0; i < 2; i++ {
+		detector.check(node)
+	}
+	if node.Status != Unrecoverable {
+		t.Fatalf("expected unrecoverable after 4 missed beats, got %s", node.Status)
+	}
+
+	healthy.Store(true)
+	detector.check(node)
+	if node.Status != Active || node.MissedBeats != 0 {
+		t.Fatalf("expected the node to come back, got %s with %d missed beats", node.Status, node.MissedBeats)
+	}
+
+	events := master.NodeEvents()
+	if len(events) != 3 || events[0].To != "zombie" || events[1].To != "unrecoverable" || events[2].To != "active" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+func TestFailureDetectorDoesNotWaitOnHungNodes(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	master := &Master{}
+	node := NewNode(NewInProcessProvisioner(), port, master)
+	node.Status = Active
+	master.nodes = append(master.nodes, node)
+	detector := &FailureDetector{master: master, interval: 100 * time.Millisecond, suspectAfter: 2, deadAfter: 4}
+
+	start := time.Now()
+	detector.CheckAll()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("a hung node held the round up for %s", elapsed)
+	}
+	if node.MissedBeats != 1 {
+		t.Errorf("a node that did not answer in time should miss a beat, got %d", node.MissedBeats)
+	}
+}
+
+func TestFailureDetectorRespawnsOffTheCheckLoop(t *testing.T) {
+	fakeMaster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer fakeMaster.Close()
+	masterURL, _ := url.Parse(fakeMaster.URL)
+	masterPort, _ := strconv.Atoi(masterURL.Port())
+
+	provisioner := NewInProcessProvisioner()
+	master := &Master{MasterPort: masterPort, advertiseHost: "127.0.0.1", provisioners: []Provisioner{provisioner}}
+	node := master.newNode(freePort(t))
+	node.Status = Active
+	t.Cleanup(func() { provisioner.Stop(node.Port) })
+	detector := &FailureDetector{master: master, suspectAfter: 1, deadAfter: 2, restart: true}
+
+	start := time.Now()
+	detector.check(node)
+	detector.check(node)
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("the respawn held the checks up for %s", elapsed)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for (node.status() != Active || node.respawning.Load()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	events := master.NodeEvents()
+	if len(events) != 3 || events[1].To != "unrecoverable" || events[2].To != "active" || node.Restarts != 1 {
+		t.Fatalf("expected the respawn to be recorded, got %+v with %d restarts", events, node.Restarts)
+	}
+}
@@ -0,0 +1,314 @@
+package engine
+
+import (
+	"context"
+	"distributed-inmemory-cache/agent"
+	"distributed-inmemory-cache/auth"
+	"distributed-inmemory-cache/model"
+	"distributed-inmemory-cache/pki"
+	"distributed-inmemory-cache/replica"
+	"distributed-inmemory-cache/tracing"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InProcessProvisioner runs nodes as http servers inside the master's own
+// process. They keep their data in the replica package the node binary uses
+// and serve it through the same handlers, which makes them useful for tests
+// and for trying the cluster out without building anything.
+type InProcessProvisioner struct {
+	mu    sync.Mutex
+	nodes map[int]*inProcessNode
+}
+
+func NewInProcessProvisioner() *InProcessProvisioner {
+	return &InProcessProvisioner{nodes: make(map[int]*inProcessNode)}
+}
+
+func (provisioner *InProcessProvisioner) Host() string {
+	return "localhost"
+}
+
+// Start ignores the environment of the request, in-process nodes share the
+// master's and do not register themselves. Only the join token and the
+// internal key are used, they authenticate like any other node.
+func (provisioner *InProcessProvisioner) Start(request model.SpawnRequest) (model.ProcessInfo, error) {
+	port := request.Port
+	provisioner.mu.Lock()
+	defer provisioner.mu.Unlock()
+
+	if existing, ok := provisioner.nodes[port]; ok && existing.running.Load() {
+		return existing.info(), agent.ErrPortInUse
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return model.ProcessInfo{}, err
+	}
+
+	node, err := newInProcessNode(port, request.MasterAddress, request.Env)
+	if err != nil {
+		listener.Close()
+		return model.ProcessInfo{}, err
+	}
+	provisioner.nodes[port] = node
+	go func() {
+		if node.identity != nil {
+			node.server.ServeTLS(listener, "", "")
+		} else {
+			node.server.Serve(listener)
+		}
+		node.stop()
+	}()
+	if node.identity != nil {
+		go node.renewLoop()
+	}
+	return node.info(), nil
+}
+
+func (provisioner *InProcessProvisioner) Stop(port int) error {
+	provisioner.mu.Lock()
+	node, ok := provisioner.nodes[port]
+	provisioner.mu.Unlock()
+	if !ok || !node.running.Load() {
+		return agent.ErrProcessNotFound
+	}
+	node.stop()
+	return nil
+}
+
+func (provisioner *InProcessProvisioner) Status(port int) (model.ProcessInfo, error) {
+	provisioner.mu.Lock()
+	defer provisioner.mu.Unlock()
+	node, ok := provisioner.nodes[port]
+	if !ok {
+		return model.ProcessInfo{}, agent.ErrProcessNotFound
+	}
+	return node.info(), nil
+}
+
+func (provisioner *InProcessProvisioner) List() ([]model.ProcessInfo, error) {
+	provisioner.mu.Lock()
+	defer provisioner.mu.Unlock()
+	list := make([]model.ProcessInfo, 0, len(provisioner.nodes))
+	for _, node := range provisioner.nodes {
+		list = append(list, node.info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+	return list, nil
+}
+
+type inProcessNode struct {
+	port          int
+	masterAddress string
+	server        *http.Server
+	running       atomic.Bool
+	runningSince  int64
+	store         *replica.Store
+	requests      replica.Requests
+	identity      *pki.Identity
+	client        *http.Client
+	stopped       chan struct{}
+}
+
+func newInProcessNode(port int, masterAddress string, env map[string]string) (*inProcessNode, error) {
+	node := &inProcessNode{
+		port:          port,
+		masterAddress: masterAddress,
+		runningSince:  time.Now().UnixMilli(),
+		client:        http.DefaultClient,
+		stopped:       make(chan struct{}),
+	}
+	node.store = replica.NewStore(os.Getpid(), node.runningSince, logger.With("node_port", port))
+	node.running.Store(true)
+
+	// Internal endpoints need the master's certificate or internal key, as on
+	// the node binary, and are open when the cluster uses neither
+	internal := func(handler http.HandlerFunc) http.HandlerFunc { return handler }
+	if key := env[auth.InternalKeyEnv]; key != "" {
+		node.client = &http.Client{Transport: &auth.Transport{Key: key}}
+		internal = func(handler http.HandlerFunc) http.HandlerFunc {
+			return auth.RequireKey(key, handler)
+		}
+	}
+	if invitation, ok := pki.InvitationFromEnv(env); ok {
+		bundle, err := pki.Join("https://"+masterAddress+pki.JoinPath, invitation, 10*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("joining the cluster: %w", err)
+		}
+		identity, err := pki.NewIdentity(bundle)
+		if err != nil {
+			return nil, err
+		}
+		node.identity = identity
+		node.client = identity.Client(0)
+		internal = func(handler http.HandlerFunc) http.HandlerFunc {
+			return pki.RequirePeer(pki.MasterName, handler)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data", internal(node.requests.Serving(node.store.DataHandler)))
+	mux.HandleFunc("/dataVersion", internal(node.store.DataVersionHandler))
+	mux.HandleFunc("/health", node.requests.HealthHandler)
+	mux.HandleFunc("/stats", replica.StatsHandler(node.store, &node.requests))
+	mux.HandleFunc("/drain", internal(node.requests.DrainHandler))
+	mux.HandleFunc("/notify", internal(node.notifyHandler))
+	mux.HandleFunc("/replicate/stream", internal(node.streamHandler))
+	mux.HandleFunc("/merkle", internal(node.store.MerkleHandler))
+	mux.HandleFunc("/merkle/keys", internal(node.store.MerkleKeysHandler))
+	mux.HandleFunc("/merkle/repair", internal(node.store.RepairHandler))
+	mux.HandleFunc("/kill", internal(node.killHandler))
+	mux.HandleFunc("/loglevel", internal(node.logLevelHandler))
+	node.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, endpoint := mux.Handler(r)
+		defer node.requests.Start(endpoint)()
+		mux.ServeHTTP(w, r)
+	})}
+	if node.identity != nil {
+		node.server.TLSConfig = node.identity.ServerConfig()
+	}
+	return node, nil
+}
+
+func (node *inProcessNode) masterURL(path string) string {
+	scheme := "http://"
+	if node.identity != nil {
+		scheme = "https://"
+	}
+	return scheme + node.masterAddress + path
+}
+
+// renewLoop renews the node's certificate with the master, the same way the
+// node binary does.
+func (node *inProcessNode) renewLoop() {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-node.stopped:
+			return
+		case <-ticker.C:
+		}
+		if !node.identity.NeedsRenewal(time.Now()) {
+			continue
+		}
+		bundle, err := pki.RequestRenewal(node.client, node.masterURL(pki.RenewalPath))
+		if err == nil {
+			err = node.identity.Update(bundle)
+		}
+		if err != nil {
+			logger.Warn("in-process node could not renew its certificate", "port", node.port, "error", err)
+		}
+	}
+}
+
+func (node *inProcessNode) info() model.ProcessInfo {
+	return model.ProcessInfo{
+		Port:      node.port,
+		PID:       os.Getpid(),
+		StartedAt: node.runningSince,
+		Running:   node.running.Load(),
+	}
+}
+
+func (node *inProcessNode) stop() {
+	if node.running.Swap(false) {
+		close(node.stopped)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	node.server.Shutdown(ctx)
+}
+
+func (node *inProcessNode) notifyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "notify", tracing.Server)
+	defer span.End()
+	span.SetAttribute("cache.node_port", node.port)
+
+	result, err := node.replicate(ctx)
+	if err != nil {
+		span.SetError(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, apply := tracing.Start(ctx, "apply", tracing.Internal)
+	apply.SetAttribute("cache.data_version", result.DataVersion)
+	apply.SetAttribute("cache.keys", len(result.Data))
+	node.store.Replace(result)
+	apply.End()
+	w.WriteHeader(http.StatusOK)
+}
+
+// streamHandler applies the frames the master pushes in push mode.
+func (node *inProcessNode) streamHandler(w http.ResponseWriter, r *http.Request) {
+	replica.ServeStream(w, r, node.stopped, node.applyFrame)
+}
+
+// applyFrame applies a pushed frame. A node that does not hold the frame's
+// base version catches up with a pull instead.
+func (node *inProcessNode) applyFrame(ctx context.Context, frame model.ReplicationFrame) model.ReplicationAck {
+	header := http.Header{}
+	header.Set(tracing.TraceparentHeader, frame.Traceparent)
+	ctx, span := tracing.Start(tracing.Extract(ctx, header), "apply", tracing.Server)
+	defer span.End()
+	span.SetAttribute("cache.node_port", node.port)
+	span.SetAttribute("cache.data_version", frame.DataVersion)
+	span.SetAttribute("cache.changes", len(frame.Changes))
+	ack := model.ReplicationAck{Seq: frame.Seq}
+
+	if node.store.Apply(frame) {
+		ack.DataVersion = frame.DataVersion
+		return ack
+	}
+	result, err := node.replicate(ctx)
+	if err != nil {
+		span.SetError(err)
+		ack.Error = err.Error()
+		return ack
+	}
+	node.store.Replace(result)
+	ack.DataVersion = node.store.Version()
+	ack.Pulled = true
+	return ack
+}
+
+// replicate pulls a streamed snapshot of the master's data, or the data as
+// one document from a master that does not stream snapshots.
+func (node *inProcessNode) replicate(ctx context.Context) (result model.DataPayload, err error) {
+	ctx, span := tracing.Start(ctx, "replicate", tracing.Client)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	return replica.Fetch(ctx, node.getFromMaster)
+}
+
+func (node *inProcessNode) getFromMaster(ctx context.Context, path string) (*http.Response, error) {
+	request, err := tracing.NewRequest(ctx, http.MethodGet, node.masterURL(path))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := node.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach master: %w", err)
+	}
+	return resp, nil
+}
+
+func (node *inProcessNode) killHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Write([]byte("Shutting down node..."))
+	// Shut down after the response went out, Shutdown waits for this handler
+	go node.stop()
+}
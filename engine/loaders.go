@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"context"
+	"distributed-inmemory-cache/config"
+	"distributed-inmemory-cache/loader"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func (master *Master) configureLoaders(conf *config.Config) {
+	for _, loaderConf := range conf.Service.Loaders {
+		timeout := time.Duration(loaderConf.TimeoutMs) * time.Millisecond
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		backend := loader.NewHTTPBackend(loaderConf.URL, timeout)
+		route := loader.Route{
+			Prefix: loaderConf.Prefix,
+			Loader: backend,
+			TTL:    time.Duration(loaderConf.TTLSeconds) * time.Second,
+		}
+		if loaderConf.WriteThrough {
+			route.Writer = backend
+		}
+		if err := master.RegisterLoader(route); err != nil {
+			logger.Error("could not register loader", "error", err)
+			continue
+		}
+		logger.Info("registered loader", "prefix", loaderConf.Prefix, "url", loaderConf.URL)
+	}
+}
+
+func (master *Master) RegisterLoader(route loader.Route) error {
+	return master.loaders.Register(route)
+}
+
+func (master *Master) LoaderPrefixes() []string {
+	return master.loaders.Prefixes()
+}
+
+// GetKey returns a single key, filling a miss from the loader registered for
+// its prefix. Concurrent misses for the same key share one load.
+func (master *Master) GetKey(ctx context.Context, key string) (string, bool, error) {
+	master.mu.RLock()
+	value, ok := master.data[key]
+	master.mu.RUnlock()
+	if ok {
+		master.metrics.hits.Inc()
+		return value, true, nil
+	}
+	master.metrics.misses.Inc()
+
+	route, ok := master.loaders.Lookup(key)
+	if !ok {
+		return "", false, nil
+	}
+
+	// The load is shared, so it must not be cancelled by the caller that started it
+	loadCtx := context.WithoutCancel(ctx)
+	value, err, _ := master.loads.Do(key, func() (string, error) {
+		loaded, err := route.Loader.Load(loadCtx, key)
+		if err != nil {
+			return "", err
+		}
+		return master.fillKey(key, loaded, route.TTL), nil
+	})
+	if errors.Is(err, loader.ErrNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// fillKey stores a loaded value unless a writer got there first, in which
+// case the written value wins and is returned.
+func (master *Master) fillKey(key string, value string, ttl time.Duration) string {
+	master.mu.Lock()
+	if current, ok := master.data[key]; ok {
+		master.mu.Unlock()
+		return current
+	}
+	events := master.setLocked(map[string]string{key: value}, ttl)
+	master.unlockAndDispatch(events)
+	master.Broadcast()
+	return value
+}
+
+// FillData stores the keys that are still missing, values a client loaded
+// on a miss. Keys a writer set in the meantime keep the written value.
+func (master *Master) FillData(ctx context.Context, data map[string]string, ttl time.Duration) error {
+	master.mu.Lock()
+	missing := make(map[string]string, len(data))
+	for key, value := range data {
+		if _, ok := master.data[key]; !ok {
+			missing[key] = value
+		}
+	}
+	if len(missing) == 0 {
+		master.mu.Unlock()
+		return nil
+	}
+	events := master.setLocked(missing, ttl)
+	master.unlockAndDispatch(events)
+	return master.replicateWrite(ctx)
+}
+
+// SetDataThrough writes keys with a write-through loader to their backend
+// first and only changes the cache when every backend write succeeded.
+func (master *Master) SetDataThrough(ctx context.Context, data map[string]string, ttl time.Duration) error {
+	for key, value := range data {
+		if route, ok := master.loaders.Lookup(key); ok && route.Writer != nil {
+			if err := route.Writer.Store(ctx, key, value); err != nil {
+				return fmt.Errorf("write-through for key %s failed: %w", key, err)
+			}
+		}
+	}
+	return master.setData(ctx, data, ttl)
+}
+
+func (master *Master) DeleteDataThrough(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if route, ok := master.loaders.Lookup(key); ok && route.Writer != nil {
+			if err := route.Writer.Delete(ctx, key); err != nil {
+				return fmt.Errorf("write-through delete for key %s failed: %w", key, err)
+			}
+		}
+	}
+	return master.removeKeys(ctx, keys, EventDelete)
+}
@@ -0,0 +1,268 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/model"
+	"errors"
+	"sort"
+	"time"
+)
+
+const DefaultLockTTL = 30 * time.Second
+
+var (
+	ErrLockHeld          = errors.New("lock is held by another owner")
+	ErrLockNotHeld       = errors.New("lock is not held by this owner and token")
+	ErrLockNotReplicated = errors.New("lock state could not be replicated to a majority of nodes")
+	ErrLocksRecovering   = errors.New("lock state is not recovered from a majority of nodes yet")
+)
+
+// lockTable holds the named locks. It is not safe for concurrent use, the
+// master guards it with its own mutex so lock changes and data versions move together.
+type lockTable struct {
+	fence int64
+	held  map[string]model.Lock
+	// awaiting is how many more nodes a restarted master has to hear the
+	// lock state of before it hands out leases again, heard are the nodes
+	// it heard
+	awaiting int
+	heard    map[string]bool
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{held: make(map[string]model.Lock), heard: make(map[string]bool)}
+}
+
+func (table *lockTable) acquire(name string, owner string, ttl time.Duration, now time.Time, version int64) (model.Lock, error) {
+	if table.awaiting > 0 {
+		return model.Lock{}, ErrLocksRecovering
+	}
+	table.prune(now)
+	if current, ok := table.held[name]; ok {
+		return current, ErrLockHeld
+	}
+	// Fencing tokens never go backwards, even if the counter recovered from
+	// a stale node, because data versions only move forward.
+	table.fence = max(table.fence+1, version)
+	lock := model.Lock{
+		Name:      name,
+		Owner:     owner,
+		Token:     table.fence,
+		ExpiresAt: now.Add(ttl).UnixMilli(),
+	}
+	table.held[name] = lock
+	return lock, nil
+}
+
+func (table *lockTable) renew(name string, owner string, token int64, ttl time.Duration, now time.Time) (model.Lock, error) {
+	if table.awaiting > 0 {
+		// The lease may be one the master did not hear of yet
+		return model.Lock{}, ErrLocksRecovering
+	}
+	current, ok := table.held[name]
+	if !ok || current.Owner != owner || current.Token != token || current.ExpiresAt <= now.UnixMilli() {
+		return model.Lock{}, ErrLockNotHeld
+	}
+	current.ExpiresAt = now.Add(ttl).UnixMilli()
+	table.held[name] = current
+	return current, nil
+}
+
+// rollback puts back the lease a renewal replaced, unless the lock changed
+// again since.
+func (table *lockTable) rollback(previous model.Lock, renewed model.Lock) bool {
+	if current, ok := table.held[renewed.Name]; !ok || current != renewed {
+		return false
+	}
+	table.held[renewed.Name] = previous
+	return true
+}
+
+func (table *lockTable) release(name string, owner string, token int64) error {
+	current, ok := table.held[name]
+	if !ok || current.Owner != owner || current.Token != token {
+		return ErrLockNotHeld
+	}
+	delete(table.held, name)
+	return nil
+}
+
+func (table *lockTable) list(now time.Time) []model.Lock {
+	locks := make([]model.Lock, 0, len(table.held))
+	for _, lock := range table.held {
+		if lock.ExpiresAt > now.UnixMilli() {
+			locks = append(locks, lock)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+	return locks
+}
+
+func (table *lockTable) state() *model.LockState {
+	held := make(map[string]model.Lock, len(table.held))
+	for name, lock := range table.held {
+		held[name] = lock
+	}
+	return &model.LockState{Fence: table.fence, Held: held}
+}
+
+// prune forgets the locks whose lease ran out.
+func (table *lockTable) prune(now time.Time) {
+	for name, lock := range table.held {
+		if lock.ExpiresAt <= now.UnixMilli() {
+			delete(table.held, name)
+		}
+	}
+}
+
+// restore merges the lock state of a node into the table. Of two leases of
+// one lock the one with the newer token wins, expired ones are dropped.
+func (table *lockTable) restore(state *model.LockState, now time.Time) {
+	if state == nil {
+		return
+	}
+	table.fence = max(table.fence, state.Fence)
+	for name, lock := range state.Held {
+		if current, ok := table.held[name]; !ok || current.Token < lock.Token {
+			table.held[name] = lock
+		}
+	}
+	table.prune(now)
+}
+
+// hear restores the lock state of the node at address, counting it towards
+// the nodes a restarted master waits for.
+func (table *lockTable) hear(address string, state *model.LockState, now time.Time) {
+	if table.heard[address] {
+		return
+	}
+	table.heard[address] = true
+	table.restore(state, now)
+	if table.awaiting > 0 {
+		table.awaiting--
+		if table.awaiting == 0 {
+			logger.Info("recovered lock state from a majority of nodes, granting locks again")
+		}
+	}
+}
+
+// awaitMajority has the table refuse leases until it heard more than half
+// of the given number of nodes, counting the ones it heard already.
+func (table *lockTable) awaitMajority(nodes int) {
+	table.awaiting = max(nodes/2+1-len(table.heard), 0)
+	if nodes == 0 {
+		table.awaiting = 0
+	}
+}
+
+// recoverLocksFrom reads the lock state of a node the master did not hear
+// yet while it waits for a majority, before a broadcast replaces it.
+func (master *Master) recoverLocksFrom(node *Slave) {
+	if master.locks == nil {
+		return
+	}
+	address := memberKey(node.Host, node.Port)
+	master.mu.RLock()
+	waiting := master.locks.awaiting > 0 && !master.locks.heard[address]
+	master.mu.RUnlock()
+	if !waiting {
+		return
+	}
+	data, err := node.GetData()
+	if err != nil {
+		node.logger().Debug("could not read lock state", "error", err)
+		return
+	}
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	master.locks.hear(address, data.Locks, time.Now())
+}
+
+// AcquireLock grants the named lock to owner for ttl. The grant only succeeds
+// once a majority of nodes hold the new lock state, so a restarted master
+// recovering from the newest node can never hand the same lock out twice.
+func (master *Master) AcquireLock(name string, owner string, ttl time.Duration) (model.Lock, error) {
+	master.mu.Lock()
+	version := master.nextVersionLocked()
+	lock, err := master.locks.acquire(name, owner, ttl, time.Now(), version)
+	master.mu.Unlock()
+	if err != nil {
+		return lock, err
+	}
+
+	if !master.replicateMajority(version) {
+		logger.Warn("lock could not be replicated, rolling back", "lock", name, "owner", owner)
+		master.mu.Lock()
+		if master.locks.release(name, owner, lock.Token) == nil {
+			master.nextVersionLocked()
+		}
+		master.mu.Unlock()
+		master.Broadcast()
+		return model.Lock{}, ErrLockNotReplicated
+	}
+	return lock, nil
+}
+
+// RenewLock extends the lease of a lock still held by owner with the given
+// token. An extension a majority of nodes did not take is rolled back, the
+// caller keeps the lease it had.
+func (master *Master) RenewLock(name string, owner string, token int64, ttl time.Duration) (model.Lock, error) {
+	master.mu.Lock()
+	previous := master.locks.held[name]
+	lock, err := master.locks.renew(name, owner, token, ttl, time.Now())
+	version := master.dataVersionId
+	if err == nil {
+		version = master.nextVersionLocked()
+	}
+	master.mu.Unlock()
+	if err != nil {
+		return lock, err
+	}
+	if !master.replicateMajority(version) {
+		logger.Warn("lock renewal could not be replicated, rolling back", "lock", name, "owner", owner)
+		master.mu.Lock()
+		if master.locks.rollback(previous, lock) {
+			master.nextVersionLocked()
+		}
+		master.mu.Unlock()
+		master.Broadcast()
+		return previous, ErrLockNotReplicated
+	}
+	return lock, nil
+}
+
+func (master *Master) ReleaseLock(name string, owner string, token int64) error {
+	master.mu.Lock()
+	err := master.locks.release(name, owner, token)
+	if err == nil {
+		master.nextVersionLocked()
+	}
+	master.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	master.Broadcast()
+	return nil
+}
+
+func (master *Master) Locks() []model.Lock {
+	master.mu.RLock()
+	defer master.mu.RUnlock()
+	return master.locks.list(time.Now())
+}
+
+// replicateMajority broadcasts and reports whether more than half of the
+// nodes acknowledged a data version at least as new as version.
+func (master *Master) replicateMajority(version int64) bool {
+	master.Broadcast()
+	nodes := master.nodeList()
+	if len(nodes) == 0 {
+		return false
+	}
+	acknowledged := 0
+	for _, node := range nodes {
+		if node.dataVersion() >= version {
+			acknowledged++
+		}
+	}
+	return acknowledged > len(nodes)/2
+}
@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockIsNeverGrantedTwice(t *testing.T) {
+	table := newLockTable()
+	now := time.Now()
+
+	first, err := table.acquire("nightly-report", "host-a", time.Minute, now, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := table.acquire("nightly-report", "host-b", time.Minute, now.Add(30*time.Second), 101); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("expected ErrLockHeld while the lease is live, got %v", err)
+	}
+
+	second, err := table.acquire("nightly-report", "host-b", time.Minute, now.Add(2*time.Minute), 102)
+	if err != nil {
+		t.Fatalf("expected the expired lock to be granted, got %v", err)
+	}
+	if second.Token <= first.Token {
+		t.Errorf("expected fencing token to increase, got %d after %d", second.Token, first.Token)
+	}
+	if err := table.release("nightly-report", "host-a", first.Token); !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("expected the previous holder to be refused, got %v", err)
+	}
+}
+
+func TestLockRenewAndRelease(t *testing.T) {
+	table := newLockTable()
+	now := time.Now()
+	lock, _ := table.acquire("cron", "host-a", time.Second, now, 1)
+
+	if _, err := table.renew("cron", "host-a", lock.Token+1, time.Minute, now); !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("expected renew with a wrong token to fail, got %v", err)
+	}
+	renewed, err := table.renew("cron", "host-a", lock.Token, time.Minute, now.Add(500*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected renew error: %v", err)
+	}
+	if renewed.ExpiresAt <= lock.ExpiresAt {
+		t.Errorf("expected the lease to be extended")
+	}
+	if err := table.release("cron", "host-a", lock.Token); err != nil {
+		t.Errorf("unexpected release error: %v", err)
+	}
+	if len(table.list(now)) != 0 {
+		t.Errorf("expected no held locks after release")
+	}
+}
+
+func TestLockStateRestoreKeepsFenceMonotonic(t *testing.T) {
+	table := newLockTable()
+	lock, _ := table.acquire("cron", "host-a", time.Minute, time.Now(), 50)
+
+	recovered := newLockTable()
+	recovered.restore(table.state(), time.Now())
+	if _, err := recovered.acquire("cron", "host-b", time.Minute, time.Now(), 51); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("expected the recovered lock to still be held, got %v", err)
+	}
+	next, _ := recovered.acquire("other", "host-b", time.Minute, time.Now(), 10)
+	if next.Token <= lock.Token {
+		t.Errorf("expected token after recovery to exceed %d, got %d", lock.Token, next.Token)
+	}
+}
+
+func TestLocksWaitForAMajorityOfNodes(t *testing.T) {
+	now := time.Now()
+	previous := newLockTable()
+	lock, _ := previous.acquire("cron", "host-a", time.Minute, now, 7)
+
+	recovered := newLockTable()
+	recovered.hear("10.0.0.1:9000", nil, now)
+	recovered.awaitMajority(3)
+	if _, err := recovered.acquire("cron", "host-b", time.Minute, now, 8); !errors.Is(err, ErrLocksRecovering) {
+		t.Fatalf("expected ErrLocksRecovering with one of three nodes heard, got %v", err)
+	}
+	recovered.hear("10.0.0.1:9000", previous.state(), now)
+	if recovered.awaiting != 1 {
+		t.Errorf("expected a node to count once, still awaiting %d", recovered.awaiting)
+	}
+	recovered.hear("10.0.0.2:9000", previous.state(), now)
+	if _, err := recovered.acquire("cron", "host-b", time.Minute, now, 8); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("expected the lease of the second node to be held, got %v", err)
+	}
+	if held := recovered.held["cron"]; held != lock {
+		t.Errorf("expected the recovered lease %+v, got %+v", lock, held)
+	}
+}
+
+func TestExpiredLocksAreDropped(t *testing.T) {
+	now := time.Now()
+	table := newLockTable()
+	table.acquire("cron", "host-a", time.Second, now, 1)
+	table.acquire("other", "host-a", time.Second, now, 2)
+
+	table.acquire("cron", "host-b", time.Minute, now.Add(time.Minute), 3)
+	if _, ok := table.held["other"]; ok {
+		t.Errorf("expected the expired lock to be dropped on acquire")
+	}
+
+	recovered := newLockTable()
+	recovered.restore(table.state(), now.Add(time.Hour))
+	if len(recovered.held) != 0 {
+		t.Errorf("expected expired locks to be dropped on restore, got %v", recovered.held)
+	}
+}
+
+func TestUnreplicatedRenewalIsRolledBack(t *testing.T) {
+	// Without nodes no majority can acknowledge anything
+	master := &Master{events: NewEventHub(0), locks: newLockTable()}
+	lock, _ := master.locks.acquire("cron", "host-a", time.Second, time.Now(), 1)
+
+	previous, err := master.RenewLock("cron", "host-a", lock.Token, time.Hour)
+	if !errors.Is(err, ErrLockNotReplicated) {
+		t.Fatalf("expected ErrLockNotReplicated, got %v", err)
+	}
+	if previous.ExpiresAt != lock.ExpiresAt || master.locks.held["cron"] != lock {
+		t.Errorf("expected the old lease to be kept, got %+v", master.locks.held["cron"])
+	}
+}
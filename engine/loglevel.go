@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/logging"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SetLogLevel changes the level of a running node.
+func (n *Slave) SetLogLevel(level string) error {
+	request, err := http.NewRequest(http.MethodPut, n.logLevelURL+"?level="+url.QueryEscape(level), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client().Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return errors.New(resp.Status + ": " + strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// SetNodeLogLevels changes the level of every node, or of the node on port
+// when port is not 0. It reports the outcome by node, "ok" or the error.
+func (master *Master) SetNodeLogLevels(level string, port int) map[string]string {
+	results := make(map[string]string)
+	for _, node := range master.nodeList() {
+		if port != 0 && node.Port != port {
+			continue
+		}
+		if err := node.SetLogLevel(level); err != nil {
+			node.logger().Warn("could not change log level", "level", level, "error", err)
+			results[nodeLabel(node)] = err.Error()
+			continue
+		}
+		results[nodeLabel(node)] = "ok"
+	}
+	return results
+}
+
+// logLevelHandler shares the master's level, in-process nodes log through
+// the master's loggers.
+func (node *inProcessNode) logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		if err := logging.SetLevel(r.URL.Query().Get("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": logging.Level()})
+}
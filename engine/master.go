@@ -1,35 +1,139 @@
 package engine
 
 import (
+	"context"
+	"distributed-inmemory-cache/auth"
 	"distributed-inmemory-cache/config"
+	"distributed-inmemory-cache/loader"
+	"distributed-inmemory-cache/logging"
 	"distributed-inmemory-cache/model"
+	"distributed-inmemory-cache/ratelimit"
+	"distributed-inmemory-cache/tracing"
 	"fmt"
-	"log"
-	"strconv"
+	"net/http"
+	"os"
+	"sync"
 	"time"
 )
 
+var logger = logging.Component("master")
+
 type Master struct {
+	mu sync.RWMutex
+	// dispatching keeps change events going out in the order of their
+	// versions once mu is released
+	dispatching   sync.Mutex
 	data          map[string]string
+	expiries      map[string]int64
 	dataVersionId int64
+	clock         hybridClock
+	events        *EventHub
+	pubsub        *PubSub
+	locks         *lockTable
+	webhooks      *webhookDispatcher
+	loaders       *loader.Registry
+	loads         loader.Group
+	requests      requestStats
+	metrics       masterMetrics
+	nodeEvents    nodeEventLog
+	nodesMu       sync.RWMutex
+	scaleMu       sync.Mutex
 	nodes         []*Slave
-	MasterPort    int
-	nextNodePort  int
+	provisioners  []Provisioner
+	members       *membership
+	clusterID     string
+	advertiseHost string
+	logDir        string
+	logFormat     string
+	traceEndpoint string
+	traceFile     string
+	tls           *clusterTLS
+	// Without TLS but with auth, the master and its nodes authenticate with
+	// the internal key
+	internalKey string
+	keyClient   *http.Client
+	broadcasts  *ratelimit.Gate
+	batcher     *broadcastBatcher
+	// replicationMode is ReplicationPull or ReplicationPush
+	replicationMode string
+	MasterPort      int
+	nextNodePort    int
 }
 
 func NewMaster(config *config.Config) *Master {
 	master := &Master{
-		data:          make(map[string]string),
-		dataVersionId: time.Now().UnixMilli(),
-		MasterPort:    config.Service.Master.Port,
-		nextNodePort:  config.Service.Master.NodePortInitial,
-		nodes:         make([]*Slave, 0, config.Service.Nodes.MinCount),
+		data:            make(map[string]string),
+		expiries:        make(map[string]int64),
+		MasterPort:      config.Service.Master.Port,
+		nextNodePort:    config.Service.Master.NodePortInitial,
+		nodes:           make([]*Slave, 0, config.Service.Nodes.MinCount),
+		pubsub:          NewPubSub(),
+		locks:           newLockTable(),
+		webhooks:        newWebhookDispatcher(),
+		loaders:         loader.NewRegistry(),
+		advertiseHost:   config.Service.Master.AdvertiseHost,
+		members:         newMembership(registryFile(config)),
+		clusterID:       config.Service.Master.ClusterID,
+		logDir:          config.Service.Logs.Dir,
+		logFormat:       config.Service.Logs.Format,
+		traceEndpoint:   config.Service.Tracing.OTLPEndpoint,
+		traceFile:       config.Service.Tracing.File,
+		broadcasts:      ratelimit.NewGate(config.Service.RateLimits.MaxConcurrentBroadcasts),
+		replicationMode: ReplicationPull,
+		clock:           hybridClock{path: clockFile(config)},
+	}
+	if err := master.clock.load(); err != nil {
+		logger.Error("could not load clock", "error", err)
+	}
+	master.webhooks.path = webhooksFile(config)
+	if err := master.webhooks.load(); err != nil {
+		logger.Error("could not load webhooks", "error", err)
+	}
+	switch mode := config.Service.Replication.Mode; mode {
+	case "", ReplicationPull:
+	case ReplicationPush:
+		master.replicationMode = ReplicationPush
+	default:
+		logger.Error("unknown replication mode, use pull or push", "mode", mode)
+		os.Exit(1)
+	}
+	if window := config.Service.Replication.BatchWindowMs; window > 0 {
+		master.batcher = newBroadcastBatcher(time.Duration(window)*time.Millisecond, config.Service.Replication.BatchMaxWrites, master.broadcast)
+	}
+	if config.Service.TLS.Enabled {
+		cluster, err := newClusterTLS(config, master.advertiseHost)
+		if err != nil {
+			logger.Error("could not set up TLS", "error", err)
+			os.Exit(1)
+		}
+		master.tls = cluster
+		go cluster.renewLoop()
+	}
+	if config.Service.Auth.Enabled && master.tls == nil {
+		key, err := internalKey(config)
+		if err != nil {
+			logger.Error("could not set up node authentication", "error", err)
+			os.Exit(1)
+		}
+		master.internalKey = key
+		master.keyClient = &http.Client{Transport: &auth.Transport{Key: key}}
 	}
+	provisioners, err := newProvisioners(config, master.tls)
+	if err != nil {
+		logger.Error("could not set up node provisioning", "error", err)
+		os.Exit(1)
+	}
+	master.provisioners = provisioners
+	master.initMetrics()
+	master.configureLoaders(config)
 
 	master.tryRecoveringNodes()
+	master.events = NewEventHub(master.dataVersionId)
+	master.events.AddListener(master.webhooks.onEvent)
+	go master.expireKeys()
 
 	if len(master.nodes) <= config.Service.Nodes.MinCount {
-		fmt.Println("Scaling to meet minimum node count")
+		logger.Info("scaling to meet minimum node count", "min_count", config.Service.Nodes.MinCount)
 		for i := 0; i <= config.Service.Nodes.MinCount-len(master.nodes); i++ {
 			master.ScaleUp(config)
 		}
@@ -40,36 +144,66 @@ func NewMaster(config *config.Config) *Master {
 }
 
 func (master *Master) tryRecoveringNodes() {
-	fmt.Println("Trying to recover nodes")
-	for i := 0; i < 20; i++ {
-		port := master.nextNodePort
-		existingNode := ExistingNode(port, master)
-		if existingNode.Status == Active {
-			master.nodes = append(master.nodes, existingNode)
-			master.nextNodePort = master.nextNodePort + 1
-			fmt.Println("Recovered 1 node with port: " + strconv.Itoa(port))
-		}
-	}
-	var nodeData map[string]string
-	var currentVersion int64
-	if len(master.nodes) > 0 {
-		for _, node := range master.nodes {
-			if node.DataVersionId > currentVersion {
-				d, err := node.GetData()
-				if err == nil {
-					nodeData = d.Data
-				}
+	logger.Info("trying to recover nodes")
+	if err := master.members.load(); err != nil {
+		logger.Error("could not load membership", "error", err)
+	}
+	registered := len(master.members.list())
+	master.recoverRegisteredNodes()
+	master.recoverProvisionedNodes()
+	// Local nodes started before there was a membership file can only be
+	// found on the ports a previous master would have used
+	if local, ok := master.provisioners[0].(*LocalProvisioner); ok && len(master.nodes) == 0 {
+		initial := master.nextNodePort
+		for port := initial; port < initial+20; port++ {
+			existingNode := ExistingNode(local, port, master)
+			if existingNode.Status == Active {
+				master.nodes = append(master.nodes, existingNode)
+				master.nextNodePort = port + 1
+				logger.Info("recovered node", "port", port)
 			}
 		}
 	}
-	if nodeData != nil {
-		master.data = nodeData
+	var newest *model.DataPayload
+	now := time.Now()
+	for _, node := range master.nodes {
+		// Versions of nodes whose data is not taken still have to be behind
+		// the master's, or broadcasts would skip them
+		master.clock.observe(node.DataVersionId)
+		if node.Status != Active {
+			continue
+		}
+		d, err := node.GetData()
+		if err != nil {
+			node.logger().Warn("could not get data of recovered node", "error", err)
+			continue
+		}
+		master.clock.observe(d.DataVersion)
+		// Every node may hold leases the newest one missed
+		master.locks.hear(memberKey(node.Host, node.Port), d.Locks, now)
+		if newest == nil || d.DataVersion > newest.DataVersion {
+			newest = d
+		}
+	}
+	if newest != nil {
+		if newest.Data != nil {
+			master.data = newest.Data
+		}
+		master.webhooks.adopt(newest.Webhooks)
+	}
+	// Until more than half of the previous nodes were heard, a lock one of
+	// the others holds could be granted again
+	master.locks.awaitMajority(max(registered, len(master.nodes)))
+	if master.locks.awaiting > 0 {
+		logger.Warn("refusing locks until more nodes are recovered", "heard", len(master.locks.heard), "awaiting", master.locks.awaiting)
 	}
+	// A version past every node's, so that all of them get the recovered data
+	master.dataVersionId = master.clock.next()
 }
 
 func (master *Master) AddNode(config *config.Config) error {
 	if len(master.nodes) < config.Service.Nodes.MaxCount {
-		node := NewNode(master.nextNodePort, master)
+		node := master.newNode(master.nextNodePort)
 		master.nodes = append(master.nodes, node)
 		master.nextNodePort = master.nextNodePort + 1
 	}
@@ -77,45 +211,214 @@ func (master *Master) AddNode(config *config.Config) error {
 }
 
 func (master *Master) Broadcast() {
-	log.Println("Master: Sending broadcast")
-	for _, node := range master.nodes {
-		err := node.Broadcast(master.dataVersionId)
+	master.BroadcastContext(context.Background())
+}
+
+// BroadcastContext notifies every node of the current data version, as part
+// of the trace in ctx.
+func (master *Master) BroadcastContext(ctx context.Context) {
+	master.broadcast(ctx, 1)
+}
+
+// broadcast notifies every node of the current data version, which folds in
+// the given number of writes. It fails when a node did not take it.
+func (master *Master) broadcast(ctx context.Context, writes int) error {
+	ctx, span := tracing.Start(ctx, "broadcast", tracing.Internal)
+	defer span.End()
+	if master.broadcasts != nil {
+		// The write is applied already, its broadcast waits its turn even
+		// when the caller is gone
+		master.broadcasts.Acquire(context.WithoutCancel(ctx))
+		defer master.broadcasts.Release()
+	}
+	start := time.Now()
+	version := master.DataVersion()
+	nodes := master.nodeList()
+	span.SetAttribute("cache.data_version", version)
+	span.SetAttribute("cache.nodes", len(nodes))
+	span.SetAttribute("cache.batch_writes", writes)
+	logger.DebugContext(ctx, "sending broadcast", "version", version, "writes", writes)
+	failures := 0
+	for _, node := range nodes {
+		err := node.BroadcastContext(ctx, version)
 		if err != nil {
-			fmt.Println("Could not broadcast to node: " + strconv.Itoa(node.Port))
-			fmt.Println(err)
+			failures++
+			master.metrics.broadcastFailures.Inc(nodeLabel(node))
+			node.logger().WarnContext(ctx, "broadcast failed", "version", version, "error", err)
 		}
 	}
+	master.metrics.broadcastDuration.Observe(time.Since(start).Seconds())
+	master.metrics.broadcastWrites.Observe(float64(writes))
+	if failures > 0 {
+		err := fmt.Errorf("%w: %d of %d nodes did not take version %d", ErrNotReplicated, failures, len(nodes), version)
+		span.SetError(err)
+		return err
+	}
+	return nil
+}
+
+// SetBroadcastLimit caps how many broadcasts run at once, 0 does not limit.
+func (master *Master) SetBroadcastLimit(limit int) {
+	master.broadcasts.SetLimit(limit)
+}
+
+func (master *Master) BroadcastLimit() int {
+	return master.broadcasts.Limit()
+}
+
+// nextVersionLocked moves dataVersionId forward, strictly, so that nodes
+// always notice a change even when two writes land in the same millisecond
+// or the wall clock stepped back.
+func (master *Master) nextVersionLocked() int64 {
+	master.dataVersionId = master.clock.next()
+	return master.dataVersionId
+}
+
+func (master *Master) DataVersion() int64 {
+	master.mu.RLock()
+	defer master.mu.RUnlock()
+	return master.dataVersionId
 }
 
 func (master *Master) GetData() map[string]string {
-	return master.data
+	master.mu.RLock()
+	defer master.mu.RUnlock()
+	return copyData(master.data)
 }
 
 func (master *Master) GetReplicationData() *model.DataPayload {
-	return &model.DataPayload{DataVersion: master.dataVersionId, Data: master.data}
+	master.mu.RLock()
+	defer master.mu.RUnlock()
+	return &model.DataPayload{DataVersion: master.dataVersionId, Data: copyData(master.data), Locks: master.locks.state(), Webhooks: master.webhooks.replicated()}
 }
 
 func (master *Master) SetData(data map[string]string) {
+	master.SetDataWithTTL(data, 0)
+}
+
+// SetDataWithTTL stores the given keys, expiring them after ttl when it is positive.
+func (master *Master) SetDataWithTTL(data map[string]string, ttl time.Duration) {
+	master.setData(context.Background(), data, ttl)
+}
+
+func (master *Master) setData(ctx context.Context, data map[string]string, ttl time.Duration) error {
+	master.mu.Lock()
+	events := master.setLocked(data, ttl)
+	master.unlockAndDispatch(events)
+	return master.replicateWrite(ctx)
+}
+
+func (master *Master) setLocked(data map[string]string, ttl time.Duration) []ChangeEvent {
+	master.nextVersionLocked()
+	events := make([]ChangeEvent, 0, len(data))
 	for k, v := range data {
 		master.data[k] = v
+		if ttl > 0 {
+			master.expiries[k] = time.Now().Add(ttl).UnixMilli()
+		} else {
+			delete(master.expiries, k)
+		}
+		events = append(events, ChangeEvent{DataVersionId: master.dataVersionId, Type: EventSet, Key: k, Value: v})
 	}
-	master.dataVersionId = time.Now().UnixMilli()
-	master.Broadcast()
+	master.events.record(events)
+	return events
 }
 
 func (master *Master) DeleteData(data []string) {
-	for _, val := range data {
+	master.removeKeys(context.Background(), data, EventDelete)
+}
+
+func (master *Master) removeKeys(ctx context.Context, keys []string, eventType EventType) error {
+	master.mu.Lock()
+	events := master.removeKeysLocked(keys, eventType)
+	master.unlockAndDispatch(events)
+	return master.replicateWrite(ctx)
+}
+
+func (master *Master) removeKeysLocked(keys []string, eventType EventType) []ChangeEvent {
+	master.nextVersionLocked()
+	events := make([]ChangeEvent, 0, len(keys))
+	for _, val := range keys {
+		if _, ok := master.data[val]; ok {
+			events = append(events, ChangeEvent{DataVersionId: master.dataVersionId, Type: eventType, Key: val})
+		}
 		delete(master.data, val)
+		delete(master.expiries, val)
 	}
-	master.dataVersionId = time.Now().UnixMilli()
-	master.Broadcast()
+	master.events.record(events)
+	return events
+}
+
+// unlockAndDispatch releases master.mu and hands the events of a write to
+// watchers and webhooks, so slow listeners never hold up readers and
+// writers. Writes still dispatch in the order they took their versions.
+func (master *Master) unlockAndDispatch(events []ChangeEvent) {
+	master.dispatching.Lock()
+	defer master.dispatching.Unlock()
+	master.mu.Unlock()
+	master.events.dispatch(events)
+}
+
+// Watch streams change events for keys with the given prefix, replaying the
+// retained history after from.
+func (master *Master) Watch(prefix string, from EventID) (*Watcher, error) {
+	return master.events.Watch(prefix, from)
+}
+
+func (master *Master) PubSub() *PubSub {
+	return master.pubsub
+}
+
+func (master *Master) expireKeys() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now().UnixMilli()
+		var expired []string
+		var events []ChangeEvent
+		master.mu.Lock()
+		for k, expiresAt := range master.expiries {
+			if expiresAt <= now {
+				expired = append(expired, k)
+			}
+		}
+		if len(expired) > 0 {
+			events = master.removeKeysLocked(expired, EventExpire)
+		}
+		master.unlockAndDispatch(events)
+		if len(expired) > 0 {
+			logger.Info("expired keys", "keys", expired)
+			master.Broadcast()
+		}
+	}
+}
+
+func copyData(data map[string]string) map[string]string {
+	result := make(map[string]string, len(data))
+	for k, v := range data {
+		result[k] = v
+	}
+	return result
+}
+
+// nodeList returns a snapshot of the nodes that is safe to range over while
+// scaling runs concurrently.
+func (master *Master) nodeList() []*Slave {
+	master.nodesMu.RLock()
+	defer master.nodesMu.RUnlock()
+	return append([]*Slave{}, master.nodes...)
 }
 
 func (master *Master) ScaleUp(conf *config.Config) bool {
-	if len(master.nodes) < conf.Service.Nodes.MaxCount {
-		node := NewNode(master.nextNodePort, master)
-		node.Start()
+	master.scaleMu.Lock()
+	defer master.scaleMu.Unlock()
+	if len(master.nodeList()) < conf.Service.Nodes.MaxCount {
+		node := master.newNode(master.nextNodePort)
+		// Listed before it starts, so the node is known when it registers
+		master.nodesMu.Lock()
 		master.nodes = append(master.nodes, node)
+		master.nodesMu.Unlock()
+		node.Start()
 		master.nextNodePort = master.nextNodePort + 1
 		<-time.After(3 * time.Second)
 		master.Broadcast()
@@ -126,44 +429,34 @@ func (master *Master) ScaleUp(conf *config.Config) bool {
 }
 
 func (master *Master) ScaleDown(conf *config.Config) bool {
-	if len(master.nodes) > conf.Service.Nodes.MinCount {
-		node := master.nodes[0]
-		err := node.Shutdown()
-		if err != nil {
-			fmt.Println("Could not shutdown node: " + strconv.Itoa(node.Port) + "Error")
-			return false
-		}
-		master.nodes = master.nodes[1:]
-		master.refreshNodes()
-		return true
-	}
-	return false
+	return master.ScaleDownWith(conf, conf.Service.Nodes.ScaleDownPolicy)
 }
 
 func (master *Master) refreshNodes() {
-	log.Println("Master: Node refresh running")
-	for _, node := range master.nodes {
-		node.Refresh(master.dataVersionId)
+	logger.Debug("refreshing nodes")
+	for _, node := range master.nodeList() {
+		node.Refresh(master.DataVersion())
 	}
 }
 
 func (master *Master) NodeStats() map[string]interface{} {
+	nodes := master.nodeList()
 	response := make(map[string]interface{})
-	response["nodeCount"] = len(master.nodes)
-	response["dataVersionId"] = master.dataVersionId
-	response["nodes"] = master.nodes
+	response["nodeCount"] = len(nodes)
+	response["dataVersionId"] = master.DataVersion()
+	response["nodes"] = nodes
 	return response
 }
 
 func (master *Master) MakeAvailable() {
-	log.Println("Master: made available")
+	logger.Info("made available")
 	<-time.After(2 * time.Second)
-	for _, node := range master.nodes {
-		if node.Status == New {
+	for _, node := range master.nodeList() {
+		if node.status() == New {
 			node.Start()
 		} else {
-			log.Println("Node " + strconv.Itoa(node.Port) + " is still running, will recover it")
-			node.Status = Recovered
+			node.logger().Info("still running, will recover it")
+			node.swapStatus(Recovered)
 		}
 	}
 	<-time.After(3 * time.Second)
@@ -172,12 +465,15 @@ func (master *Master) MakeAvailable() {
 }
 
 func (master *Master) KillAllNodes() error {
-	log.Println("Master: kill all nodes triggered")
-	for _, node := range master.nodes {
+	logger.Info("killing all nodes")
+	for _, node := range master.nodeList() {
 		err := node.Shutdown()
 		if err != nil {
-			log.Fatal(fmt.Sprintf("Node with port %d could not be stopped", node.Port))
+			node.logger().Error("could not stop node", "error", err)
+			os.Exit(1)
 		}
+		master.setNodeStatus(node, Shutdown, "kill all nodes")
+		master.members.remove(node.Host, node.Port)
 	}
 	return nil
 }
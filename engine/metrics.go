@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/metrics"
+	"net"
+	"strconv"
+)
+
+type masterMetrics struct {
+	registry          *metrics.Registry
+	hits              *metrics.Counter
+	misses            *metrics.Counter
+	broadcastDuration *metrics.Histogram
+	broadcastFailures *metrics.Counter
+	broadcastWrites   *metrics.Histogram
+	wrongKeys         *metrics.Counter
+}
+
+var nodeStatuses = []NodeStatus{New, Active, Shutdown, Zombie, Recovered, Unrecoverable, Draining}
+
+// initMetrics registers the master's metrics. Values the master already
+// keeps, like the key count or node versions, are read on every scrape.
+func (master *Master) initMetrics() {
+	registry := metrics.NewRegistry()
+	master.metrics = masterMetrics{
+		registry:          registry,
+		hits:              registry.NewCounter("cache_hits_total", "Single key reads answered from the cache."),
+		misses:            registry.NewCounter("cache_misses_total", "Single key reads not in the cache, whether a loader filled them or not."),
+		broadcastDuration: registry.NewHistogram("cache_broadcast_duration_seconds", "Time to notify every node of a new data version.", metrics.DefaultBuckets),
+		broadcastFailures: registry.NewCounter("cache_broadcast_failures_total", "Notifications a node did not accept.", "node"),
+		broadcastWrites:   registry.NewHistogram("cache_broadcast_batch_writes", "Writes folded into one broadcast.", []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}),
+		wrongKeys:         registry.NewCounter("cache_anti_entropy_wrong_keys_total", "Keys anti-entropy found missing, extra or different on a node.", "node"),
+	}
+
+	registry.NewGaugeFunc("cache_keys", "Keys held by the master.", func() []metrics.Sample {
+		master.mu.RLock()
+		defer master.mu.RUnlock()
+		return []metrics.Sample{{Value: float64(len(master.data))}}
+	})
+	registry.NewGaugeFunc("cache_bytes", "Bytes of all keys and values held by the master.", func() []metrics.Sample {
+		master.mu.RLock()
+		defer master.mu.RUnlock()
+		size := 0
+		for key, value := range master.data {
+			size += len(key) + len(value)
+		}
+		return []metrics.Sample{{Value: float64(size)}}
+	})
+	// A whole version does not fit a float64, its two parts are exported
+	// apart
+	registry.NewGaugeFunc("cache_data_version_time_ms", "Wall clock part of the master's data version, in milliseconds since the epoch.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(versionTime(master.DataVersion()).UnixMilli())}}
+	})
+	registry.NewGaugeFunc("cache_data_version_counter", "Logical part of the master's data version, writes within the same millisecond.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(versionCounter(master.DataVersion()))}}
+	})
+	registry.NewGaugeFunc("cache_nodes", "Nodes known to the master.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(len(master.nodeList()))}}
+	})
+	registry.NewGaugeFunc("cache_node_status", "1 for the current status of every node, 0 for the others.", func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, node := range master.nodeList() {
+			current := node.status()
+			for _, status := range nodeStatuses {
+				value := 0.0
+				if current == status {
+					value = 1
+				}
+				samples = append(samples, metrics.Sample{LabelValues: []string{nodeLabel(node), status.String()}, Value: value})
+			}
+		}
+		return samples
+	}, "node", "status")
+	registry.NewGaugeFunc("cache_node_replication_lag", "Milliseconds between the master's data version and the version a node last acknowledged.", func() []metrics.Sample {
+		version := versionTime(master.DataVersion())
+		var samples []metrics.Sample
+		for _, node := range master.nodeList() {
+			lag := version.Sub(versionTime(node.dataVersion())).Milliseconds()
+			samples = append(samples, metrics.Sample{LabelValues: []string{nodeLabel(node)}, Value: float64(max(lag, 0))})
+		}
+		return samples
+	}, "node")
+}
+
+func (master *Master) Metrics() *metrics.Registry {
+	return master.metrics.registry
+}
+
+func nodeLabel(node *Slave) string {
+	return net.JoinHostPort(node.Host, strconv.Itoa(node.Port))
+}
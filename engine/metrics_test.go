@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"context"
+	"distributed-inmemory-cache/loader"
+	"strings"
+	"testing"
+)
+
+func TestMasterMetrics(t *testing.T) {
+	master := &Master{data: map[string]string{"a": "12", "bc": "3"}, dataVersionId: 1700000000123<<logicalBits | 7, loaders: loader.NewRegistry()}
+	master.initMetrics()
+	node := NewNode(NewInProcessProvisioner(), 3001, master)
+	node.Status = Zombie
+	node.DataVersionId = 1700000000083<<logicalBits | 5
+	master.nodes = []*Slave{node}
+
+	master.GetKey(context.Background(), "a")
+	master.GetKey(context.Background(), "missing")
+
+	var out strings.Builder
+	master.Metrics().Write(&out)
+	for _, line := range []string{
+		"cache_keys 2",
+		"cache_bytes 6",
+		"cache_data_version_time_ms 1.700000000123e+12",
+		"cache_data_version_counter 7",
+		"cache_hits_total 1",
+		"cache_misses_total 1",
+		`cache_node_status{node="localhost:3001",status="zombie"} 1`,
+		`cache_node_status{node="localhost:3001",status="active"} 0`,
+		`cache_node_replication_lag{node="localhost:3001"} 40`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/agent"
+	"distributed-inmemory-cache/config"
+	"distributed-inmemory-cache/model"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProvisionerLocal     = "local"
+	ProvisionerAgent     = "agent"
+	ProvisionerInProcess = "in-process"
+)
+
+// Provisioner runs node lifecycles for the master, which does not need to
+// know whether a node is a local process, a process on an agent's host or a
+// goroutine. Nodes started by a provisioner listen on Host() and their port.
+type Provisioner interface {
+	Host() string
+	Start(request model.SpawnRequest) (model.ProcessInfo, error)
+	Stop(port int) error
+	Status(port int) (model.ProcessInfo, error)
+	List() ([]model.ProcessInfo, error)
+}
+
+// newProvisioners builds the provisioners selected by nodes.provisioner. The
+// agent provisioner yields one provisioner per configured agent, agents on
+// https are reached with the master's certificate.
+func newProvisioners(conf *config.Config, cluster *clusterTLS) ([]Provisioner, error) {
+	nodes := conf.Service.Nodes
+	kind := nodes.Provisioner
+	if kind == "" {
+		kind = ProvisionerLocal
+		if len(nodes.Agents) > 0 {
+			kind = ProvisionerAgent
+		}
+	}
+
+	switch kind {
+	case ProvisionerLocal:
+		binary := nodes.Binary
+		if binary == "" {
+			wd, err := os.Getwd()
+			if err != nil {
+				return nil, fmt.Errorf("getting current working directory: %w", err)
+			}
+			binary = filepath.Join(wd, "node-binary", "node")
+		}
+		return []Provisioner{NewLocalProvisioner(binary)}, nil
+	case ProvisionerAgent:
+		if len(nodes.Agents) == 0 {
+			return nil, fmt.Errorf("the %s provisioner needs at least one entry in nodes.agents", ProvisionerAgent)
+		}
+		if nodes.AgentToken == "" {
+			return nil, fmt.Errorf("the %s provisioner needs the agents' token in nodes.agent_token", ProvisionerAgent)
+		}
+		provisioners := make([]Provisioner, 0, len(nodes.Agents))
+		for _, agentURL := range nodes.Agents {
+			client := agent.NewClient(agentURL, nodes.AgentToken)
+			if strings.HasPrefix(agentURL, "https://") {
+				if cluster == nil {
+					return nil, fmt.Errorf("agent %s uses https, which needs tls.enabled", agentURL)
+				}
+				client.HTTPClient = cluster.identity.Client(client.HTTPClient.Timeout)
+			}
+			provisioners = append(provisioners, NewAgentProvisioner(client))
+		}
+		return provisioners, nil
+	case ProvisionerInProcess:
+		return []Provisioner{NewInProcessProvisioner()}, nil
+	}
+	return nil, fmt.Errorf("unknown node provisioner %q", kind)
+}
+
+// LocalProvisioner starts node binaries on the master's host.
+type LocalProvisioner struct {
+	processes *agent.Processes
+}
+
+func NewLocalProvisioner(binary string) *LocalProvisioner {
+	return &LocalProvisioner{processes: agent.NewProcesses(binary)}
+}
+
+func (provisioner *LocalProvisioner) Host() string {
+	return "localhost"
+}
+
+func (provisioner *LocalProvisioner) Start(request model.SpawnRequest) (model.ProcessInfo, error) {
+	return provisioner.processes.Spawn(request)
+}
+
+func (provisioner *LocalProvisioner) Stop(port int) error {
+	return provisioner.processes.Kill(port)
+}
+
+func (provisioner *LocalProvisioner) Status(port int) (model.ProcessInfo, error) {
+	return findProcess(provisioner.processes.List(), port)
+}
+
+func (provisioner *LocalProvisioner) List() ([]model.ProcessInfo, error) {
+	return provisioner.processes.List(), nil
+}
+
+// AgentProvisioner starts nodes through the node agent on another host.
+type AgentProvisioner struct {
+	client *agent.Client
+}
+
+func NewAgentProvisioner(client *agent.Client) *AgentProvisioner {
+	return &AgentProvisioner{client: client}
+}
+
+func (provisioner *AgentProvisioner) Host() string {
+	return provisioner.client.Host()
+}
+
+func (provisioner *AgentProvisioner) Start(request model.SpawnRequest) (model.ProcessInfo, error) {
+	return provisioner.client.Spawn(request)
+}
+
+func (provisioner *AgentProvisioner) Stop(port int) error {
+	return provisioner.client.Kill(port)
+}
+
+func (provisioner *AgentProvisioner) Status(port int) (model.ProcessInfo, error) {
+	list, err := provisioner.client.List()
+	if err != nil {
+		return model.ProcessInfo{}, err
+	}
+	return findProcess(list, port)
+}
+
+func (provisioner *AgentProvisioner) List() ([]model.ProcessInfo, error) {
+	return provisioner.client.List()
+}
+
+func findProcess(list []model.ProcessInfo, port int) (model.ProcessInfo, error) {
+	for _, info := range list {
+		if info.Port == port {
+			return info, nil
+		}
+	}
+	return model.ProcessInfo{}, agent.ErrProcessNotFound
+}
+
+// newNode places a new node on the provisioner carrying the fewest nodes.
+func (master *Master) newNode(port int) *Slave {
+	placed := make(map[Provisioner]int, len(master.provisioners))
+	for _, node := range master.nodeList() {
+		placed[node.provisioner]++
+	}
+	chosen := master.provisioners[0]
+	for _, provisioner := range master.provisioners[1:] {
+		if placed[provisioner] < placed[chosen] {
+			chosen = provisioner
+		}
+	}
+	return NewNode(chosen, port, master)
+}
+
+// advertiseAddress is the host:port nodes call back on.
+func (master *Master) advertiseAddress() string {
+	host := master.advertiseHost
+	if host == "" {
+		host = "localhost"
+	}
+	// Nodes reach the master on its TLS port once the cluster uses mTLS
+	port := master.MasterPort
+	if master.tls != nil {
+		port = master.tls.port
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// recoverProvisionedNodes adopts the nodes the provisioners still run from an
+// earlier master and moves nextNodePort past all of them.
+func (master *Master) recoverProvisionedNodes() {
+	for _, provisioner := range master.provisioners {
+		processes, err := provisioner.List()
+		if err != nil {
+			logger.Warn("could not list nodes", "host", provisioner.Host(), "error", err)
+			continue
+		}
+		for _, process := range processes {
+			if !process.Running || master.findNode(provisioner.Host(), process.Port) != nil {
+				continue
+			}
+			node := ExistingNode(provisioner, process.Port, master)
+			if node.Status != Active {
+				continue
+			}
+			master.nodes = append(master.nodes, node)
+			master.nextNodePort = max(master.nextNodePort, process.Port+1)
+			logger.Info("recovered node", "port", process.Port, "host", node.Host)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/agent"
+	"distributed-inmemory-cache/auth"
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestInProcessNodeLifecycle(t *testing.T) {
+	fakeMaster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/replicate/data" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(model.DataPayload{DataVersion: 42, Data: map[string]string{"a": "1"}})
+	}))
+	defer fakeMaster.Close()
+	masterURL, _ := url.Parse(fakeMaster.URL)
+	masterPort, _ := strconv.Atoi(masterURL.Port())
+
+	provisioner := NewInProcessProvisioner()
+	master := &Master{MasterPort: masterPort, advertiseHost: "127.0.0.1", provisioners: []Provisioner{provisioner}}
+	node := master.newNode(freePort(t))
+
+	node.Start()
+	if node.Status != Active || node.CheckHealth() != Active {
+		t.Fatalf("expected a running node, got status %s", node.Status)
+	}
+	if err := node.Broadcast(42); err != nil || node.DataQuality != Fresh {
+		t.Fatalf("broadcast failed: %v", err)
+	}
+	data, err := node.GetData()
+	if err != nil || data.DataVersion != 42 || data.Data["a"] != "1" {
+		t.Fatalf("node did not pull the master's data: %+v, %v", data, err)
+	}
+
+	if err := node.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for node.CheckHealth() == Active && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if node.CheckHealth() == Active {
+		t.Fatal("node still answers after shutdown")
+	}
+	info, err := provisioner.Status(node.Port)
+	if err != nil || info.Running {
+		t.Errorf("expected a stopped node, got %+v, %v", info, err)
+	}
+
+	// The port is free again, so the node can be started over
+	node.Start()
+	if node.CheckHealth() != Active {
+		t.Fatal("node did not restart")
+	}
+	provisioner.Stop(node.Port)
+}
+
+func TestNodesUseTheInternalKeyWithoutTLS(t *testing.T) {
+	authenticator, err := auth.New([]auth.Key{{Name: "nodes", Key: "internal-key", Role: auth.Internal}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeMaster := httptest.NewServer(authenticator.Require(auth.Internal, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/replicate/data" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(model.DataPayload{DataVersion: 42, Data: map[string]string{"a": "1"}})
+	}))
+	defer fakeMaster.Close()
+	masterURL, _ := url.Parse(fakeMaster.URL)
+	masterPort, _ := strconv.Atoi(masterURL.Port())
+
+	provisioner := NewInProcessProvisioner()
+	master := &Master{
+		MasterPort:    masterPort,
+		advertiseHost: "127.0.0.1",
+		provisioners:  []Provisioner{provisioner},
+		internalKey:   "internal-key",
+		keyClient:     &http.Client{Transport: &auth.Transport{Key: "internal-key"}},
+	}
+	node := master.newNode(freePort(t))
+	node.Start()
+	defer provisioner.Stop(node.Port)
+
+	if err := node.Broadcast(42); err != nil {
+		t.Fatalf("broadcast with the internal key failed: %v", err)
+	}
+	data, err := node.GetData()
+	if err != nil || data.DataVersion != 42 {
+		t.Fatalf("node did not pull with the internal key: %+v, %v", data, err)
+	}
+	resp, err := http.Get(node.dataUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("a node's data should need the internal key, got %d", resp.StatusCode)
+	}
+}
+
+func TestNewNodeSpreadsAcrossProvisioners(t *testing.T) {
+	first := NewAgentProvisioner(agent.NewClient("http://127.0.0.1:4100", "agent-token"))
+	second := NewAgentProvisioner(agent.NewClient("http://127.0.0.2:4100", "agent-token"))
+	master := &Master{provisioners: []Provisioner{first, second}, MasterPort: 3000, advertiseHost: "10.0.0.1"}
+
+	for port := 3001; port <= 3003; port++ {
+		master.nodes = append(master.nodes, master.newNode(port))
+	}
+
+	if master.nodes[0].provisioner != first || master.nodes[1].provisioner != second || master.nodes[2].provisioner != first {
+		t.Fatalf("nodes were not spread across the agents: %s, %s, %s",
+			master.nodes[0].Host, master.nodes[1].Host, master.nodes[2].Host)
+	}
+	if master.nodes[1].healthURL != "http://127.0.0.2:3002/health" {
+		t.Errorf("node urls must use the agent host, got %s", master.nodes[1].healthURL)
+	}
+	if master.advertiseAddress() != "10.0.0.1:3000" {
+		t.Errorf("unexpected advertised master address %s", master.advertiseAddress())
+	}
+}
@@ -0,0 +1,254 @@
+package engine
+
+import (
+	"sort"
+	"sync"
+)
+
+const subscriptionChannelSize = 256
+
+type Message struct {
+	Channel string `json:"channel"`
+	Pattern string `json:"pattern,omitempty"`
+	Payload string `json:"payload"`
+}
+
+// PubSub delivers published messages to subscriptions listening on a channel
+// name or on a glob pattern. Nothing is persisted or replicated, a message
+// only reaches the subscribers connected at the time it is published.
+type PubSub struct {
+	mu            sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{subscriptions: make(map[*Subscription]struct{})}
+}
+
+// Subscription is a single subscriber. The Messages channel is closed when
+// the subscription is closed or when the subscriber falls behind.
+type Subscription struct {
+	Messages  chan Message
+	pubsub    *PubSub
+	channels  map[string]struct{}
+	patterns  map[string]struct{}
+	closeOnce sync.Once
+}
+
+func (ps *PubSub) NewSubscription() *Subscription {
+	sub := &Subscription{
+		Messages: make(chan Message, subscriptionChannelSize),
+		pubsub:   ps,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+	ps.mu.Lock()
+	ps.subscriptions[sub] = struct{}{}
+	ps.mu.Unlock()
+	return sub
+}
+
+// Publish sends the payload to every matching subscriber and returns how many
+// subscriptions received it, counting a pattern and a channel match separately.
+func (ps *PubSub) Publish(channel string, payload string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	receivers := 0
+	for sub := range ps.subscriptions {
+		var messages []Message
+		if _, ok := sub.channels[channel]; ok {
+			messages = append(messages, Message{Channel: channel, Payload: payload})
+		}
+		for pattern := range sub.patterns {
+			if GlobMatch(pattern, channel) {
+				messages = append(messages, Message{Channel: channel, Pattern: pattern, Payload: payload})
+			}
+		}
+	deliver:
+		for _, message := range messages {
+			select {
+			case sub.Messages <- message:
+				receivers++
+			default:
+				ps.closeLocked(sub)
+				break deliver
+			}
+		}
+	}
+	return receivers
+}
+
+// Channels lists the channels with at least one subscriber.
+func (ps *PubSub) Channels() []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	seen := make(map[string]struct{})
+	for sub := range ps.subscriptions {
+		for channel := range sub.channels {
+			seen[channel] = struct{}{}
+		}
+	}
+	channels := make([]string, 0, len(seen))
+	for channel := range seen {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func (ps *PubSub) closeLocked(sub *Subscription) {
+	delete(ps.subscriptions, sub)
+	sub.closeOnce.Do(func() {
+		close(sub.Messages)
+	})
+}
+
+// Subscribe adds channels and returns the total number of channels and patterns subscribed.
+func (sub *Subscription) Subscribe(channels ...string) int {
+	return sub.update(sub.channels, channels, true)
+}
+
+func (sub *Subscription) Unsubscribe(channels ...string) int {
+	return sub.update(sub.channels, channels, false)
+}
+
+func (sub *Subscription) PSubscribe(patterns ...string) int {
+	return sub.update(sub.patterns, patterns, true)
+}
+
+func (sub *Subscription) PUnsubscribe(patterns ...string) int {
+	return sub.update(sub.patterns, patterns, false)
+}
+
+// Count returns the number of channels and patterns subscribed.
+func (sub *Subscription) Count() int {
+	sub.pubsub.mu.RLock()
+	defer sub.pubsub.mu.RUnlock()
+	return len(sub.channels) + len(sub.patterns)
+}
+
+// ChannelNames and PatternNames return what is currently subscribed, sorted.
+func (sub *Subscription) ChannelNames() []string {
+	return sub.names(sub.channels)
+}
+
+func (sub *Subscription) PatternNames() []string {
+	return sub.names(sub.patterns)
+}
+
+func (sub *Subscription) Close() {
+	sub.pubsub.mu.Lock()
+	defer sub.pubsub.mu.Unlock()
+	sub.pubsub.closeLocked(sub)
+}
+
+func (sub *Subscription) update(set map[string]struct{}, names []string, add bool) int {
+	sub.pubsub.mu.Lock()
+	defer sub.pubsub.mu.Unlock()
+	for _, name := range names {
+		if add {
+			set[name] = struct{}{}
+		} else {
+			delete(set, name)
+		}
+	}
+	return len(sub.channels) + len(sub.patterns)
+}
+
+func (sub *Subscription) names(set map[string]struct{}) []string {
+	sub.pubsub.mu.RLock()
+	defer sub.pubsub.mu.RUnlock()
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GlobMatch matches a channel name against a Redis style glob pattern
+// supporting `*`, `?`, `[...]` classes and `\` escapes.
+func GlobMatch(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if GlobMatch(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		case '[':
+			if len(name) == 0 {
+				return false
+			}
+			end, matched := matchClass(pattern, name[0])
+			if !matched {
+				return false
+			}
+			pattern = pattern[end:]
+			name = name[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchClass evaluates the `[...]` class at the start of pattern against c
+// and returns the index just past the closing bracket.
+func matchClass(pattern string, c byte) (int, bool) {
+	i := 1
+	negate := false
+	if i < len(pattern) && pattern[i] == '^' {
+		negate = true
+		i++
+	}
+	matched := false
+	for i < len(pattern) && pattern[i] != ']' {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		lo := pattern[i]
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi := pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			i += 3
+			continue
+		}
+		if c == lo {
+			matched = true
+		}
+		i++
+	}
+	if i < len(pattern) {
+		i++
+	}
+	return i, matched != negate
+}
@@ -0,0 +1,61 @@
+package engine
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"news.*", "news.sport", true},
+		{"news.*", "newsroom", false},
+		{"*", "anything/at:all", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+	}
+	for _, c := range cases {
+		if got := GlobMatch(c.pattern, c.name); got != c.want {
+			t.Errorf("GlobMatch(%q, %q) = %v, want %v", c.pattern, c.name, got, c.want)
+		}
+	}
+}
+
+func TestPublishDeliversToChannelAndPatternSubscribers(t *testing.T) {
+	ps := NewPubSub()
+	byChannel := ps.NewSubscription()
+	defer byChannel.Close()
+	byPattern := ps.NewSubscription()
+	defer byPattern.Close()
+
+	byChannel.Subscribe("orders")
+	byPattern.PSubscribe("ord*")
+
+	if receivers := ps.Publish("orders", "created"); receivers != 2 {
+		t.Errorf("expected 2 receivers, got %d", receivers)
+	}
+	if receivers := ps.Publish("users", "created"); receivers != 0 {
+		t.Errorf("expected 0 receivers, got %d", receivers)
+	}
+
+	message := <-byChannel.Messages
+	if message.Channel != "orders" || message.Pattern != "" || message.Payload != "created" {
+		t.Errorf("unexpected channel message: %+v", message)
+	}
+	message = <-byPattern.Messages
+	if message.Pattern != "ord*" || message.Channel != "orders" {
+		t.Errorf("unexpected pattern message: %+v", message)
+	}
+
+	if count := byChannel.Unsubscribe("orders"); count != 0 {
+		t.Errorf("expected no remaining subscriptions, got %d", count)
+	}
+	if receivers := ps.Publish("orders", "again"); receivers != 1 {
+		t.Errorf("expected 1 receiver after unsubscribe, got %d", receivers)
+	}
+}
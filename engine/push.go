@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"context"
+	"distributed-inmemory-cache/model"
+	"distributed-inmemory-cache/tracing"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Replication modes. In pull mode the master notifies nodes and they fetch
+// the full data from /replicate/snapshot, in push mode the master streams the
+// changes to them.
+const (
+	ReplicationPull = "pull"
+	ReplicationPush = "push"
+)
+
+const (
+	pushAckTimeout = 10 * time.Second
+	// pushRetryInterval keeps a node whose stream broke on pull for a while
+	// instead of dialing it on every broadcast
+	pushRetryInterval = 5 * time.Second
+)
+
+var errPushUnavailable = errors.New("push stream unavailable")
+
+// pushStream is the long-lived connection the master pushes a node's changes
+// on, frames one way and acks the other. One frame is in flight at a time,
+// so the node applies them in the order they were sent.
+type pushStream struct {
+	mu       sync.Mutex
+	node     *Slave
+	conn     *pushConn
+	seq      int64
+	acked    int64
+	failedAt time.Time
+}
+
+type pushConn struct {
+	writer  *io.PipeWriter
+	body    io.ReadCloser
+	encoder *json.Encoder
+	acks    chan model.ReplicationAck
+	done    chan struct{}
+}
+
+func newPushStream(node *Slave) *pushStream {
+	// Nothing acknowledged yet, the first frame is a snapshot
+	return &pushStream{node: node, acked: -1}
+}
+
+// send pushes what changed since the node's last ack and returns the version
+// the node acknowledged.
+func (stream *pushStream) send(ctx context.Context) (int64, error) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if err := stream.connectLocked(); err != nil {
+		return 0, err
+	}
+	frame := stream.node.master.pushFrame(stream.acked)
+	if frame.DataVersion <= stream.acked {
+		return stream.acked, nil
+	}
+	stream.seq++
+	frame.Seq = stream.seq
+	header := http.Header{}
+	tracing.Inject(ctx, header)
+	frame.Traceparent = header.Get(tracing.TraceparentHeader)
+
+	conn := stream.conn
+	if err := conn.encoder.Encode(frame); err != nil {
+		stream.closeLocked()
+		return 0, err
+	}
+	timeout := time.NewTimer(pushAckTimeout)
+	defer timeout.Stop()
+	select {
+	case ack := <-conn.acks:
+		if ack.Seq != frame.Seq {
+			stream.closeLocked()
+			return 0, fmt.Errorf("node acknowledged frame %d instead of %d", ack.Seq, frame.Seq)
+		}
+		if ack.Error != "" {
+			// The node's state is unknown now, start over with a snapshot
+			stream.acked = -1
+			return 0, errors.New(ack.Error)
+		}
+		stream.acked = ack.DataVersion
+		return ack.DataVersion, nil
+	case <-conn.done:
+		stream.closeLocked()
+		return 0, errors.New("push stream closed by node")
+	case <-timeout.C:
+		stream.closeLocked()
+		return 0, errors.New("node did not acknowledge in time")
+	}
+}
+
+func (stream *pushStream) connectLocked() error {
+	if stream.conn != nil {
+		return nil
+	}
+	if time.Since(stream.failedAt) < pushRetryInterval {
+		return errPushUnavailable
+	}
+	reader, writer := io.Pipe()
+	request, err := http.NewRequest(http.MethodPost, stream.node.streamURL, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	// The stream outlives any request timeout of the node client
+	client := &http.Client{Transport: stream.node.client().Transport}
+	resp, err := client.Do(request)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("node answered %s", resp.Status)
+	}
+	if err != nil {
+		writer.Close()
+		stream.failedAt = time.Now()
+		return fmt.Errorf("%w: %v", errPushUnavailable, err)
+	}
+
+	conn := &pushConn{
+		writer:  writer,
+		body:    resp.Body,
+		encoder: json.NewEncoder(writer),
+		acks:    make(chan model.ReplicationAck),
+		done:    make(chan struct{}),
+	}
+	go conn.readAcks()
+	stream.conn = conn
+	// A new connection may be to a restarted node
+	stream.acked = -1
+	stream.node.logger().Debug("push stream connected")
+	return nil
+}
+
+func (conn *pushConn) readAcks() {
+	defer close(conn.done)
+	decoder := json.NewDecoder(conn.body)
+	for {
+		var ack model.ReplicationAck
+		if err := decoder.Decode(&ack); err != nil {
+			return
+		}
+		select {
+		case conn.acks <- ack:
+		case <-time.After(pushAckTimeout):
+			// Nobody waits for it, the sender gave up on the stream
+			return
+		}
+	}
+}
+
+func (stream *pushStream) closeLocked() {
+	if stream.conn == nil {
+		return
+	}
+	stream.conn.writer.Close()
+	stream.conn.body.Close()
+	stream.conn = nil
+	stream.failedAt = time.Now()
+}
+
+func (stream *pushStream) close() {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.closeLocked()
+}
+
+// pushFrame holds the changes after version from, or all data when the event
+// history no longer reaches back that far.
+func (master *Master) pushFrame(from int64) model.ReplicationFrame {
+	master.mu.RLock()
+	defer master.mu.RUnlock()
+	frame := model.ReplicationFrame{
+		BaseVersion: from,
+		DataVersion: master.dataVersionId,
+		Locks:       master.locks.state(),
+		Webhooks:    master.webhooks.replicated(),
+	}
+	events, ok := master.events.since(from)
+	if from < 0 || !ok || len(events) > len(master.data) {
+		frame.Snapshot = true
+		frame.Data = copyData(master.data)
+		return frame
+	}
+	frame.Changes = make([]model.Change, 0, len(events))
+	for _, event := range events {
+		frame.Changes = append(frame.Changes, model.Change{Key: event.Key, Value: event.Value, Delete: event.Type != EventSet})
+	}
+	return frame
+}
@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// startPushMaster is a master in push mode whose replication endpoints are
+// served for nodes that fall back to pulling.
+func startPushMaster(t *testing.T) *Master {
+	master := &Master{
+		data:            make(map[string]string),
+		expiries:        make(map[string]int64),
+		dataVersionId:   1,
+		events:          NewEventHub(1),
+		locks:           newLockTable(),
+		webhooks:        newWebhookDispatcher(),
+		advertiseHost:   "127.0.0.1",
+		provisioners:    []Provisioner{NewInProcessProvisioner()},
+		replicationMode: ReplicationPush,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/replicate/snapshot" {
+			master.WriteSnapshot(w)
+			return
+		}
+		json.NewEncoder(w).Encode(master.GetReplicationData())
+	}))
+	t.Cleanup(server.Close)
+	serverURL, _ := url.Parse(server.URL)
+	master.MasterPort, _ = strconv.Atoi(serverURL.Port())
+	return master
+}
+
+func TestPushReplicatesChangesInOrder(t *testing.T) {
+	master := startPushMaster(t)
+	node := master.newNode(freePort(t))
+	master.nodes = []*Slave{node}
+	node.Start()
+	defer node.provisioner.Stop(node.Port)
+
+	master.SetData(map[string]string{"a": "1", "b": "2"})
+	if node.push.conn == nil || node.DataVersionId != master.DataVersion() {
+		t.Fatalf("expected the node to acknowledge version %d over its stream, got %d", master.DataVersion(), node.DataVersionId)
+	}
+	first := master.DataVersion()
+
+	frame := master.pushFrame(first)
+	master.SetData(map[string]string{"c": "3"})
+	master.DeleteData([]string{"a"})
+	frame = master.pushFrame(first)
+	if frame.Snapshot || len(frame.Changes) != 2 || frame.Changes[0].Key != "c" || !frame.Changes[1].Delete {
+		t.Fatalf("expected the changes since version %d, got %+v", first, frame)
+	}
+
+	data, err := node.GetData()
+	if err != nil || data.DataVersion != master.DataVersion() || len(data.Data) != 2 || data.Data["c"] != "3" || data.Data["a"] != "" {
+		t.Fatalf("node did not apply the pushed changes: %+v, %v", data, err)
+	}
+}
+
+func TestPushFallsBackToPull(t *testing.T) {
+	master := startPushMaster(t)
+	node := master.newNode(freePort(t))
+	master.nodes = []*Slave{node}
+	node.Start()
+	defer node.provisioner.Stop(node.Port)
+	master.SetData(map[string]string{"a": "1"})
+
+	// A frame on top of a version the node does not hold makes it pull
+	node.push.acked = 1
+	master.SetData(map[string]string{"b": "2"})
+	if data, _ := node.GetData(); data.DataVersion != master.DataVersion() || data.Data["a"] != "1" || data.Data["b"] != "2" {
+		t.Fatalf("node did not catch up with a pull: %+v", data)
+	}
+
+	// A broken stream is not dialed again right away, the node is notified
+	node.push.close()
+	master.SetData(map[string]string{"c": "3"})
+	if node.push.conn != nil {
+		t.Error("stream should stay down until the retry interval passed")
+	}
+	if data, _ := node.GetData(); data.DataVersion != master.DataVersion() || data.Data["c"] != "3" {
+		t.Fatalf("node did not pull after a notify: %+v", data)
+	}
+}
@@ -0,0 +1,303 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/auth"
+	"distributed-inmemory-cache/config"
+	"distributed-inmemory-cache/logging"
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Environment of node processes
+const (
+	clusterIDEnv = "CACHE_CLUSTER_ID"
+	nodeHostEnv  = "CACHE_NODE_HOST"
+	logDirEnv    = "CACHE_LOG_DIR"
+	logLevelEnv  = "CACHE_LOG_LEVEL"
+	logFormatEnv = "CACHE_LOG_FORMAT"
+	traceURLEnv  = "CACHE_TRACING_OTLP_ENDPOINT"
+	traceFileEnv = "CACHE_TRACING_FILE"
+)
+
+var (
+	ErrNotManaged  = errors.New("node is not managed by a provisioner of this master")
+	ErrUnknownNode = errors.New("node is unknown and did not present this cluster's id")
+)
+
+// membership is the persisted list of nodes that registered themselves. A
+// restarted master probes exactly these nodes instead of guessing ports.
+type membership struct {
+	path    string
+	mu      sync.Mutex
+	members map[string]model.NodeRegistration
+}
+
+func newMembership(path string) *membership {
+	return &membership{path: path, members: make(map[string]model.NodeRegistration)}
+}
+
+// registryFile is nodes.registry_file, or a file in logs.dir without one.
+func registryFile(conf *config.Config) string {
+	if conf.Service.Nodes.RegistryFile != "" {
+		return conf.Service.Nodes.RegistryFile
+	}
+	return filepath.Join(conf.Service.Logs.Dir, "cache-members.json")
+}
+
+func memberKey(host string, port int) string {
+	return net.JoinHostPort(canonicalHost(host), strconv.Itoa(port))
+}
+
+// canonicalHost folds the names of the loopback interface together, a local
+// node registers from 127.0.0.1 while the master reaches it on localhost.
+func canonicalHost(host string) string {
+	if host == "localhost" {
+		return "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return "127.0.0.1"
+	}
+	return host
+}
+
+func (members *membership) load() error {
+	members.mu.Lock()
+	defer members.mu.Unlock()
+	content, err := os.ReadFile(members.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []model.NodeRegistration
+	if err := json.Unmarshal(content, &list); err != nil {
+		return fmt.Errorf("reading membership file %s: %w", members.path, err)
+	}
+	for _, member := range list {
+		members.members[memberKey(member.Host, member.Port)] = member
+	}
+	return nil
+}
+
+// saveLocked writes the file to a temporary name first, so a crash never
+// leaves a half written membership behind.
+func (members *membership) saveLocked() {
+	content, err := json.MarshalIndent(members.listLocked(), "", "  ")
+	if err != nil {
+		logger.Error("could not encode membership", "error", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(members.path), 0o755); err != nil {
+		logger.Error("could not create membership dir", "error", err)
+		return
+	}
+	temp := members.path + ".tmp"
+	if err := os.WriteFile(temp, content, 0o644); err != nil {
+		logger.Error("could not write membership", "error", err)
+		return
+	}
+	if err := os.Rename(temp, members.path); err != nil {
+		logger.Error("could not replace membership", "error", err)
+	}
+}
+
+// add records member and reports whether it is new or changed. Heartbeats
+// of unchanged nodes do not rewrite the file.
+func (members *membership) add(member model.NodeRegistration) bool {
+	members.mu.Lock()
+	defer members.mu.Unlock()
+	key := memberKey(member.Host, member.Port)
+	if existing, ok := members.members[key]; ok && existing.ID == member.ID && existing.PID == member.PID &&
+		existing.StartedAt == member.StartedAt && existing.ClusterID == member.ClusterID {
+		return false
+	}
+	member.RegisteredAt = time.Now().UnixMilli()
+	members.members[key] = member
+	members.saveLocked()
+	return true
+}
+
+func (members *membership) remove(host string, port int) {
+	members.mu.Lock()
+	defer members.mu.Unlock()
+	key := memberKey(host, port)
+	if _, ok := members.members[key]; !ok {
+		return
+	}
+	delete(members.members, key)
+	members.saveLocked()
+}
+
+func (members *membership) list() []model.NodeRegistration {
+	members.mu.Lock()
+	defer members.mu.Unlock()
+	return members.listLocked()
+}
+
+func (members *membership) listLocked() []model.NodeRegistration {
+	list := make([]model.NodeRegistration, 0, len(members.members))
+	for _, member := range members.members {
+		list = append(list, member)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Host != list[j].Host {
+			return list[i].Host < list[j].Host
+		}
+		return list[i].Port < list[j].Port
+	})
+	return list
+}
+
+// RegisterNode records a node that announced itself. Nodes register when
+// they start and again on every heartbeat, so a node that lost its master
+// finds the next one. Nodes this master did not start are adopted only when
+// they present its cluster id.
+func (master *Master) RegisterNode(registration model.NodeRegistration) error {
+	if master.clusterID != "" && registration.ClusterID != master.clusterID {
+		return ErrUnknownNode
+	}
+	node := master.findNode(registration.Host, registration.Port)
+	if node == nil {
+		if master.clusterID == "" {
+			return ErrUnknownNode
+		}
+		node = master.adoptNode(registration)
+	}
+	node.setID(registration.ID)
+	if master.members.add(registration) {
+		logger.Info("node registered", "id", registration.ID, "address", memberKey(registration.Host, registration.Port))
+	}
+	return nil
+}
+
+func (master *Master) adoptNode(registration model.NodeRegistration) *Slave {
+	master.scaleMu.Lock()
+	defer master.scaleMu.Unlock()
+	if node := master.findNode(registration.Host, registration.Port); node != nil {
+		return node
+	}
+
+	node := NewNode(master.provisionerFor(registration.Host), registration.Port, master)
+	node.setProcess(registration.PID, registration.StartedAt)
+	master.nodesMu.Lock()
+	master.nodes = append(master.nodes, node)
+	master.nodesMu.Unlock()
+	master.nextNodePort = max(master.nextNodePort, registration.Port+1)
+	master.setNodeStatus(node, Recovered, "adopted, registered with the cluster id")
+	return node
+}
+
+// spawnRequest is how node is started, with the environment it needs to
+// register with this master.
+func (master *Master) spawnRequest(node *Slave) (model.SpawnRequest, error) {
+	env := map[string]string{nodeHostEnv: node.Host}
+	if master.clusterID != "" {
+		env[clusterIDEnv] = master.clusterID
+	}
+	// Nodes start with the level the master runs with at the time
+	env[logLevelEnv] = logging.Level()
+	if master.logDir != "" {
+		env[logDirEnv] = master.logDir
+	}
+	if master.logFormat != "" {
+		env[logFormatEnv] = master.logFormat
+	}
+	if master.traceEndpoint != "" {
+		env[traceURLEnv] = master.traceEndpoint
+	}
+	if master.traceFile != "" {
+		env[traceFileEnv] = filepath.Join(filepath.Dir(master.traceFile), fmt.Sprintf("node-%d-traces.jsonl", node.Port))
+	}
+	if master.internalKey != "" {
+		env[auth.InternalKeyEnv] = master.internalKey
+	}
+	// Only the CA and a one-time token, the node creates its own key and
+	// joins over TLS
+	if master.tls != nil {
+		invitation, err := master.inviteNode(node)
+		if err != nil {
+			return model.SpawnRequest{}, err
+		}
+		for key, value := range invitation.Env() {
+			env[key] = value
+		}
+	}
+	return model.SpawnRequest{MasterAddress: master.advertiseAddress(), Port: node.Port, Env: env}, nil
+}
+
+func (master *Master) Members() []model.NodeRegistration {
+	return master.members.list()
+}
+
+func (master *Master) findNode(host string, port int) *Slave {
+	for _, node := range master.nodeList() {
+		if node.Port == port && canonicalHost(node.Host) == canonicalHost(host) {
+			return node
+		}
+	}
+	return nil
+}
+
+// provisionerFor returns the provisioner running nodes on host, or one that
+// refuses to start and stop nodes it does not know how to reach.
+func (master *Master) provisionerFor(host string) Provisioner {
+	for _, provisioner := range master.provisioners {
+		if canonicalHost(provisioner.Host()) == canonicalHost(host) {
+			return provisioner
+		}
+	}
+	return unmanagedProvisioner{host: host}
+}
+
+// recoverRegisteredNodes probes every node in the membership file and
+// adopts them all. One that does not answer yet is kept as a zombie, the
+// failure detector decides whether it comes back or is restarted.
+func (master *Master) recoverRegisteredNodes() {
+	for _, member := range master.members.list() {
+		node := ExistingNode(master.provisionerFor(member.Host), member.Port, master)
+		node.setID(member.ID)
+		master.nodes = append(master.nodes, node)
+		master.nextNodePort = max(master.nextNodePort, member.Port+1)
+		if node.Status != Active {
+			logger.Warn("registered node does not answer, keeping it as a zombie", "id", member.ID, "address", memberKey(member.Host, member.Port))
+			continue
+		}
+		logger.Info("recovered registered node", "id", member.ID, "port", member.Port, "host", node.Host)
+	}
+}
+
+// unmanagedProvisioner stands in for nodes on hosts none of the configured
+// provisioners covers. The master can use them but not restart them.
+type unmanagedProvisioner struct {
+	host string
+}
+
+func (provisioner unmanagedProvisioner) Host() string {
+	return provisioner.host
+}
+
+func (provisioner unmanagedProvisioner) Start(request model.SpawnRequest) (model.ProcessInfo, error) {
+	return model.ProcessInfo{}, ErrNotManaged
+}
+
+func (provisioner unmanagedProvisioner) Stop(port int) error {
+	return ErrNotManaged
+}
+
+func (provisioner unmanagedProvisioner) Status(port int) (model.ProcessInfo, error) {
+	return model.ProcessInfo{}, ErrNotManaged
+}
+
+func (provisioner unmanagedProvisioner) List() ([]model.ProcessInfo, error) {
+	return nil, nil
+}
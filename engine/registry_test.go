@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/model"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestMembershipPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "members.json")
+	members := newMembership(path)
+	members.add(model.NodeRegistration{ID: "a", Host: "127.0.0.1", Port: 3001, PID: 10})
+	members.add(model.NodeRegistration{ID: "b", Host: "10.0.0.2", Port: 3001, PID: 11})
+	// Registering again from another loopback name replaces the entry
+	members.add(model.NodeRegistration{ID: "a2", Host: "localhost", Port: 3001, PID: 12})
+	members.remove("10.0.0.2", 3001)
+
+	reloaded := newMembership(path)
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	list := reloaded.list()
+	if len(list) != 1 || list[0].ID != "a2" || list[0].PID != 12 {
+		t.Fatalf("unexpected members after reload: %+v", list)
+	}
+}
+
+func TestRecoverRegisteredNodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			w.Write([]byte("OK"))
+		case "/dataVersion":
+			w.Write([]byte("7"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	serverURL, _ := url.Parse(server.URL)
+	livePort, _ := strconv.Atoi(serverURL.Port())
+
+	stopped := httptest.NewServer(http.NotFoundHandler())
+	stoppedURL, _ := url.Parse(stopped.URL)
+	deadPort, _ := strconv.Atoi(stoppedURL.Port())
+	stopped.Close()
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "members.json")
+	members := newMembership(path)
+	members.add(model.NodeRegistration{ID: "live", Host: "127.0.0.1", Port: livePort})
+	members.add(model.NodeRegistration{ID: "dead", Host: "127.0.0.1", Port: deadPort})
+
+	master := &Master{
+		members:      newMembership(path),
+		provisioners: []Provisioner{NewInProcessProvisioner()},
+		nextNodePort: 1,
+	}
+	if err := master.members.load(); err != nil {
+		t.Fatal(err)
+	}
+	master.recoverRegisteredNodes()
+
+	if len(master.nodes) != 2 {
+		t.Fatalf("expected both registered nodes to be recovered, got %+v", master.nodes)
+	}
+	for _, node := range master.nodes {
+		switch node.ID {
+		case "live":
+			if node.Status != Active || node.DataVersionId != 7 {
+				t.Errorf("expected the live node to be active with its version, got %+v", node)
+			}
+		case "dead":
+			if node.Status != Zombie {
+				t.Errorf("expected the unreachable node to be kept as a zombie, got %v", node.Status)
+			}
+		default:
+			t.Errorf("unexpected node %+v", node)
+		}
+	}
+	if master.nextNodePort != max(livePort, deadPort)+1 {
+		t.Errorf("expected the next port to move past %d and %d, got %d", livePort, deadPort, master.nextNodePort)
+	}
+	if list := master.Members(); len(list) != 2 {
+		t.Errorf("expected the unreachable node to stay a member, got %+v", list)
+	}
+}
+
+func TestRegisterNodeChecksClusterID(t *testing.T) {
+	provisioner := NewInProcessProvisioner()
+	master := &Master{
+		members:      newMembership(filepath.Join(t.TempDir(), "members.json")),
+		provisioners: []Provisioner{provisioner},
+		clusterID:    "prod",
+		nextNodePort: 3002,
+	}
+	known := NewNode(provisioner, 3001, master)
+	master.nodes = []*Slave{known}
+
+	if err := master.RegisterNode(model.NodeRegistration{ID: "k", Host: "127.0.0.1", Port: 3001}); err != ErrUnknownNode {
+		t.Fatalf("expected a node without the cluster id to be refused, got %v", err)
+	}
+	if err := master.RegisterNode(model.NodeRegistration{ID: "k", Host: "127.0.0.1", Port: 3001, ClusterID: "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if known.ID != "k" || len(master.nodes) != 1 {
+		t.Fatalf("expected the known node to be updated in place, got %+v", master.nodes)
+	}
+
+	if err := master.RegisterNode(model.NodeRegistration{ID: "x", Host: "10.0.0.9", Port: 3010, ClusterID: "dev"}); err != ErrUnknownNode {
+		t.Fatalf("expected a node of another cluster to be refused, got %v", err)
+	}
+	if err := master.RegisterNode(model.NodeRegistration{ID: "n", Host: "10.0.0.9", Port: 3010, PID: 77, ClusterID: "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	adopted := master.nodes[len(master.nodes)-1]
+	if len(master.nodes) != 2 || adopted.ID != "n" || adopted.Host != "10.0.0.9" || adopted.Status != Recovered || adopted.ProcessId != 77 {
+		t.Fatalf("expected the unknown node to be adopted, got %+v", adopted)
+	}
+	if master.nextNodePort != 3011 || len(master.Members()) != 2 {
+		t.Errorf("unexpected next port %d or members %+v", master.nextNodePort, master.Members())
+	}
+
+	master.clusterID = ""
+	if err := master.RegisterNode(model.NodeRegistration{ID: "y", Host: "10.0.0.8", Port: 3020}); err != ErrUnknownNode {
+		t.Errorf("without a cluster id unknown nodes must be refused, got %v", err)
+	}
+}
@@ -1,18 +1,21 @@
 package engine
 
 import (
+	"context"
+	"distributed-inmemory-cache/logging"
 	"distributed-inmemory-cache/model"
+	"distributed-inmemory-cache/tracing"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strconv"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type NodeStatus int
@@ -24,8 +27,13 @@ const (
 	Zombie // 6
 	Recovered
 	Unrecoverable
+	Draining
 )
 
+// healthCheckTimeout bounds a health probe outside of the failure detector,
+// which gives a node one heartbeat interval.
+const healthCheckTimeout = 5 * time.Second
+
 type NodeDataQuality int
 
 const (
@@ -34,98 +42,224 @@ const (
 )
 
 type Slave struct {
-	DataVersionId  int64 `json:"dataVersionId"`
-	Port           int   `json:"port"`
+	DataVersionId  int64  `json:"dataVersionId"`
+	ID             string `json:"id"`
+	Host           string `json:"host"`
+	Port           int    `json:"port"`
 	master         *Master
-	binary         string
+	provisioner    Provisioner
 	Status         NodeStatus `json:"status"`
 	broadcastURL   string
 	killURL        string
 	healthURL      string
 	dataVersionURL string
 	dataUrl        string
+	statsURL       string
+	drainURL       string
+	logLevelURL    string
+	streamURL      string
+	merkleURL      string
+	push           *pushStream
 	ProcessId      int             `json:"processId"`
 	RunningSince   int64           `json:"runningSince"`
 	DataQuality    NodeDataQuality `json:"dataQuality"`
+	MissedBeats    int             `json:"missedBeats"`
+	LastHeartbeat  int64           `json:"lastHeartbeat"`
+	Restarts       int             `json:"restarts"`
+	// versionMu guards DataVersionId, which broadcasts and lock grants
+	// running at the same time read and move
+	versionMu sync.Mutex
+	// stateMu guards ID, Status, DataQuality, MissedBeats, LastHeartbeat,
+	// Restarts, ProcessId and RunningSince, which registrations, the failure
+	// detector, broadcasts, scaling and the stats api use at the same time
+	stateMu sync.Mutex
+	// respawning is set while the failure detector restarts the node
+	respawning atomic.Bool
+	// broadcastMu lets one broadcast at a time reach the node, batches sent
+	// at the same time queue up and skip a version the node already took
+	broadcastMu sync.Mutex
 }
 
-func NewNode(port int, master *Master) *Slave {
-	wd, err := os.Getwd()
-	if err != nil {
-		fmt.Println("Error getting current working directory:", err)
-		return nil
-	}
-
-	binaryPath := filepath.Join(wd, "node-binary", "node")
-	broadcastURL := fmt.Sprintf("http://localhost:%d/notify", port)
-	killURL := fmt.Sprintf("http://localhost:%d/kill", port)
-	healthURL := fmt.Sprintf("http://localhost:%d/health", port)
-	dataUrl := fmt.Sprintf("http://localhost:%d/data", port)
-	dataVersionURL := fmt.Sprintf("http://localhost:%d/dataVersion", port)
+// NewNode is a node on the given port, started and stopped by provisioner.
+func NewNode(provisioner Provisioner, port int, master *Master) *Slave {
+	baseURL := master.nodeScheme() + "://" + net.JoinHostPort(provisioner.Host(), strconv.Itoa(port))
 	node := &Slave{
+		Host:           provisioner.Host(),
 		Port:           port,
 		master:         master,
-		binary:         binaryPath,
-		broadcastURL:   broadcastURL,
-		killURL:        killURL,
-		healthURL:      healthURL,
-		dataUrl:        dataUrl,
-		dataVersionURL: dataVersionURL,
+		provisioner:    provisioner,
+		broadcastURL:   baseURL + "/notify",
+		killURL:        baseURL + "/kill",
+		healthURL:      baseURL + "/health",
+		dataUrl:        baseURL + "/data",
+		dataVersionURL: baseURL + "/dataVersion",
+		statsURL:       baseURL + "/stats",
+		drainURL:       baseURL + "/drain",
+		logLevelURL:    baseURL + "/loglevel",
+		streamURL:      baseURL + "/replicate/stream",
+		merkleURL:      baseURL + "/merkle",
 		DataQuality:    Dirty,
 		Status:         New,
 	}
+	if master.replicationMode == ReplicationPush {
+		node.push = newPushStream(node)
+	}
 	return node
 }
 
-func ExistingNode(port int, master *Master) *Slave {
-	node := NewNode(port, master)
+func ExistingNode(provisioner Provisioner, port int, master *Master) *Slave {
+	node := NewNode(provisioner, port, master)
 	node.Status = Zombie
 	if node.CheckHealth() == Active {
 		node.Status = Active
-		node.DataVersionId = node.GetDataVersion()
+		node.setDataVersion(node.GetDataVersion())
 	}
 	return node
 }
 
-func (n *Slave) Start() {
-	nodePort := fmt.Sprintf("%d", n.Port)
-	masterPort := fmt.Sprintf("%d", n.master.MasterPort)
+// logger tags records with the node, as slave:<port> or slave:<host:port>
+// for nodes on other hosts.
+func (n *Slave) logger() *slog.Logger {
+	name := strconv.Itoa(n.Port)
+	if n.Host != "" && canonicalHost(n.Host) != "127.0.0.1" {
+		name = net.JoinHostPort(n.Host, name)
+	}
+	return logging.Component("slave:" + name)
+}
 
-	cmd := exec.Command(n.binary, masterPort, nodePort)
+func (n *Slave) Start() {
+	if n.launch() == nil {
+		n.master.setNodeStatus(n, Active, "started")
+	}
+}
 
-	// Daemon process
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setsid: true,
+// launch has the provisioner start a process for the node, leaving its
+// status to the caller.
+func (n *Slave) launch() error {
+	request, err := n.master.spawnRequest(n)
+	if err != nil {
+		n.logger().Error("could not prepare node", "host", n.Host, "error", err)
+		return err
+	}
+	info, err := n.provisioner.Start(request)
+	if err != nil {
+		n.logger().Error("could not start node", "host", n.Host, "error", err)
+		return err
 	}
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	n.ProcessId = info.PID
+	return nil
+}
 
-	cmd.Env = os.Environ()
+func (n *Slave) status() NodeStatus {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	return n.Status
+}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// swapStatus sets the node's status and returns the previous one.
+func (n *Slave) swapStatus(status NodeStatus) NodeStatus {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	from := n.Status
+	n.Status = status
+	return from
+}
 
-	err := cmd.Start()
-	if err != nil {
-		fmt.Println("Error starting the process:", err)
-		return
-	}
+func (n *Slave) setDataQuality(quality NodeDataQuality) {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	n.DataQuality = quality
+}
+
+// heartbeat records a health probe the node answered.
+func (n *Slave) heartbeat() {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	n.MissedBeats = 0
+	n.LastHeartbeat = time.Now().UnixMilli()
+}
 
-	n.Status = Active
-	n.ProcessId = cmd.Process.Pid
+// missBeat records a health probe the node did not answer and returns how
+// many it missed in a row.
+func (n *Slave) missBeat() int {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	n.MissedBeats++
+	return n.MissedBeats
+}
 
-	go func() {
-		err = cmd.Wait()
+// restarted records a respawn that answers its health probe.
+func (n *Slave) restarted() {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	n.Restarts++
+	n.MissedBeats = 0
+	n.LastHeartbeat = time.Now().UnixMilli()
+	n.DataQuality = Dirty
+}
 
-		if err != nil {
-			fmt.Println("Process finished with error:", err)
-			return
-		}
+func (n *Slave) processID() int {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	return n.ProcessId
+}
 
-		fmt.Println("Process finished successfully.")
-	}()
+// setID records the id the node registered with.
+func (n *Slave) setID(id string) {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	n.ID = id
+}
+
+func (n *Slave) setProcess(pid int, runningSince int64) {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	n.ProcessId = pid
+	n.RunningSince = runningSince
+}
+
+// MarshalJSON encodes the node as the stats api shows it, reading the fields
+// under their locks.
+func (n *Slave) MarshalJSON() ([]byte, error) {
+	version := n.dataVersion()
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	return json.Marshal(struct {
+		DataVersionId int64           `json:"dataVersionId"`
+		ID            string          `json:"id"`
+		Host          string          `json:"host"`
+		Port          int             `json:"port"`
+		Status        NodeStatus      `json:"status"`
+		ProcessId     int             `json:"processId"`
+		RunningSince  int64           `json:"runningSince"`
+		DataQuality   NodeDataQuality `json:"dataQuality"`
+		MissedBeats   int             `json:"missedBeats"`
+		LastHeartbeat int64           `json:"lastHeartbeat"`
+		Restarts      int             `json:"restarts"`
+	}{version, n.ID, n.Host, n.Port, n.Status, n.ProcessId, n.RunningSince, n.DataQuality, n.MissedBeats, n.LastHeartbeat, n.Restarts})
+}
+
+// client reaches the node, over mTLS when the cluster uses it.
+func (n *Slave) client() *http.Client {
+	return n.master.httpClient()
 }
 
 func (n *Slave) CheckHealth() NodeStatus {
-	resp, err := http.Get(n.healthURL)
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	return n.CheckHealthContext(ctx)
+}
+
+// CheckHealthContext probes the node's /health, a node that has not answered
+// when ctx is done counts as down.
+func (n *Slave) CheckHealthContext(ctx context.Context) NodeStatus {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, n.healthURL, nil)
+	if err != nil {
+		return Unrecoverable
+	}
+	resp, err := n.client().Do(request)
 	if err != nil {
 		return Unrecoverable
 	}
@@ -140,7 +274,7 @@ func (n *Slave) CheckHealth() NodeStatus {
 }
 
 func (n *Slave) GetDataVersion() int64 {
-	resp, err := http.Get(n.dataVersionURL)
+	resp, err := n.client().Get(n.dataVersionURL)
 	if err != nil {
 		return -1
 	}
@@ -149,7 +283,8 @@ func (n *Slave) GetDataVersion() int64 {
 	if resp.StatusCode == http.StatusOK {
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			log.Fatalf("Failed to read response body: %v", err)
+			n.logger().Error("could not read data version", "error", err)
+			os.Exit(1)
 		}
 
 		vid := string(body)
@@ -163,25 +298,111 @@ func (n *Slave) GetDataVersion() int64 {
 }
 
 func (n *Slave) Broadcast(version int64) error {
-	if version > n.DataVersionId {
-		n.DataQuality = Dirty
-		resp, err := http.Post(n.broadcastURL, "text/plain", nil)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
+	return n.BroadcastContext(context.Background(), version)
+}
 
-		if resp.StatusCode == http.StatusOK {
-			n.DataQuality = Fresh
-			n.DataVersionId = version
+// BroadcastContext brings the node to version, passing the trace in ctx on
+// so the node's side shows up under it. In push mode the changes go over the
+// node's stream, the node is told to pull when the stream is down.
+func (n *Slave) BroadcastContext(ctx context.Context, version int64) error {
+	n.broadcastMu.Lock()
+	defer n.broadcastMu.Unlock()
+	if version <= n.dataVersion() {
+		return nil
+	}
+	// The node's lock state is gone once it takes the master's
+	n.master.recoverLocksFrom(n)
+	if n.push != nil {
+		ctx, span := tracing.Start(ctx, "push", tracing.Client)
+		span.SetAttribute("cache.node", nodeLabel(n))
+		span.SetAttribute("cache.data_version", version)
+		acked, err := n.push.send(ctx)
+		if err == nil {
+			span.End()
+			n.setDataQuality(Fresh)
+			n.acknowledge(acked)
+			return nil
+		}
+		span.SetError(err)
+		span.End()
+		if !errors.Is(err, errPushUnavailable) {
+			n.logger().WarnContext(ctx, "push failed, falling back to pull", "version", version, "error", err)
 		}
 	}
+	return n.notify(ctx, version)
+}
+
+// resync tells the node to pull version even when it acknowledged it.
+func (n *Slave) resync(ctx context.Context, version int64) error {
+	n.broadcastMu.Lock()
+	defer n.broadcastMu.Unlock()
+	n.master.recoverLocksFrom(n)
+	return n.notify(ctx, version)
+}
+
+// notify tells the node to pull version from the master.
+func (n *Slave) notify(ctx context.Context, version int64) error {
+	ctx, span := tracing.Start(ctx, "notify", tracing.Client)
+	defer span.End()
+	span.SetAttribute("cache.node", nodeLabel(n))
+	span.SetAttribute("cache.data_version", version)
+
+	n.setDataQuality(Dirty)
+	request, err := tracing.NewRequest(ctx, http.MethodPost, n.broadcastURL)
+	if err != nil {
+		span.SetError(err)
+		return err
+	}
+	resp, err := n.client().Do(request)
+	if err != nil {
+		span.SetError(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		err := errors.New(resp.Status)
+		span.SetError(err)
+		return err
+	}
+	n.setDataQuality(Fresh)
+	n.acknowledge(version)
 	return nil
 }
 
+// dataVersion is the version the node last acknowledged.
+func (n *Slave) dataVersion() int64 {
+	n.versionMu.Lock()
+	defer n.versionMu.Unlock()
+	return n.DataVersionId
+}
+
+func (n *Slave) setDataVersion(version int64) {
+	n.versionMu.Lock()
+	defer n.versionMu.Unlock()
+	n.DataVersionId = version
+}
+
+// acknowledge records that the node took version, a broadcast finishing
+// after a newer one does not move it back.
+func (n *Slave) acknowledge(version int64) {
+	n.versionMu.Lock()
+	defer n.versionMu.Unlock()
+	n.DataVersionId = max(n.DataVersionId, version)
+}
+
+// Shutdown asks the node to exit. A node that does not answer is stopped by
+// its provisioner instead.
 func (n *Slave) Shutdown() error {
-	resp, err := http.Post(n.killURL, "text/plain", nil)
+	if n.push != nil {
+		n.push.close()
+	}
+	resp, err := n.client().Post(n.killURL, "text/plain", nil)
 	if err != nil {
+		if n.provisioner.Stop(n.Port) == nil {
+			return nil
+		}
 		return err
 	}
 	defer resp.Body.Close()
@@ -195,7 +416,7 @@ func (n *Slave) Shutdown() error {
 }
 
 func (n *Slave) GetData() (*model.DataPayload, error) {
-	resp, err := http.Get(fmt.Sprintf(n.dataUrl))
+	resp, err := n.client().Get(n.dataUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -215,18 +436,35 @@ func (n *Slave) GetData() (*model.DataPayload, error) {
 
 }
 
+func (n *Slave) GetStats() (*model.NodeStats, error) {
+	resp, err := n.client().Get(n.statsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	var stats model.NodeStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
 func (n *Slave) Refresh(dataVersion int64) {
 	data, err := n.GetData()
 	if err != nil {
-		fmt.Println("Error getting data:", err)
+		n.logger().Warn("could not get node data", "error", err)
 	}
-	fmt.Println(fmt.Sprintf("Node Refresh: Port: %d, Node data version: %d, Master data version: %d", n.Port, n.DataVersionId, dataVersion))
+	n.logger().Debug("refreshed", "node_version", n.dataVersion(), "master_version", dataVersion)
 	if data != nil {
-		n.DataVersionId = data.DataVersion
-		if dataVersion != n.DataVersionId {
-			n.DataQuality = Dirty
+		n.setDataVersion(data.DataVersion)
+		if dataVersion != data.DataVersion {
+			n.setDataQuality(Dirty)
 		}
-		n.ProcessId = data.PID
-		n.RunningSince = data.RunningSince
+		n.setProcess(data.PID, data.RunningSince)
 	}
 }
@@ -0,0 +1,14 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/model"
+	"distributed-inmemory-cache/replica"
+	"io"
+)
+
+// WriteSnapshot streams the master's data to a pulling node. The data is
+// copied first, as for /replicate/data, so a slow node does not hold up
+// writers, but it is never encoded as one document.
+func (master *Master) WriteSnapshot(w io.Writer) (model.SnapshotHeader, error) {
+	return replica.WriteSnapshot(w, *master.GetReplicationData())
+}
@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	statsWindow     = time.Minute
+	latencySamples  = 4096
+	rateBucketCount = int(statsWindow / time.Second)
+)
+
+// requestStats keeps a one minute sliding window of request counts per
+// second and a ring of recent latencies for percentiles.
+type requestStats struct {
+	mu           sync.Mutex
+	buckets      [rateBucketCount]int64
+	bucketSecond [rateBucketCount]int64
+	latencies    [latencySamples]latencySample
+	next         int
+}
+
+type latencySample struct {
+	at      int64
+	latency time.Duration
+}
+
+// record counts a request, and samples its latency when timed is set.
+func (stats *requestStats) record(latency time.Duration, timed bool) {
+	now := time.Now()
+	second := now.Unix()
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	bucket := int(second % int64(rateBucketCount))
+	if stats.bucketSecond[bucket] != second {
+		stats.bucketSecond[bucket] = second
+		stats.buckets[bucket] = 0
+	}
+	stats.buckets[bucket]++
+
+	if !timed {
+		return
+	}
+	stats.latencies[stats.next] = latencySample{at: now.UnixMilli(), latency: latency}
+	stats.next = (stats.next + 1) % latencySamples
+}
+
+// snapshot returns the requests per second and the p99 latency over the window.
+func (stats *requestStats) snapshot() (float64, time.Duration) {
+	now := time.Now()
+	oldestSecond := now.Unix() - int64(rateBucketCount) + 1
+	oldestMilli := now.Add(-statsWindow).UnixMilli()
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	var count int64
+	for i, second := range stats.bucketSecond {
+		if second >= oldestSecond {
+			count += stats.buckets[i]
+		}
+	}
+
+	latencies := make([]time.Duration, 0, latencySamples)
+	for _, sample := range stats.latencies {
+		if sample.at >= oldestMilli {
+			latencies = append(latencies, sample.latency)
+		}
+	}
+	if len(latencies) == 0 {
+		return float64(count) / statsWindow.Seconds(), 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p99 := latencies[(len(latencies)*99-1)/100]
+	return float64(count) / statsWindow.Seconds(), p99
+}
+
+// RecordRequest feeds the request rate and, for reads, the latency used by
+// the autoscaler. A write waits for the broadcast to every node, so its
+// latency would grow with the nodes scaling up adds.
+func (master *Master) RecordRequest(latency time.Duration, read bool) {
+	master.requests.record(latency, read)
+}
@@ -0,0 +1,234 @@
+package engine
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"distributed-inmemory-cache/auth"
+	"distributed-inmemory-cache/config"
+	"distributed-inmemory-cache/pki"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCertValidity = 24 * time.Hour
+	certCheckInterval   = time.Minute
+	// A spawned node has this long to trade its token for a certificate
+	joinTokenTTL = 10 * time.Minute
+	// Agent certificates are installed by hand, they are not renewed
+	agentCertValidity = 365 * 24 * time.Hour
+)
+
+var (
+	ErrNotANode    = errors.New("only node certificates can be renewed")
+	ErrJoinRefused = errors.New("unknown, used or expired join token")
+)
+
+// clusterTLS is the master's side of mTLS: the cluster CA, the master's own
+// certificate, the client it reaches the nodes with and the join tokens of
+// nodes that were spawned but have no certificate yet.
+type clusterTLS struct {
+	ca       *pki.CA
+	identity *pki.Identity
+	validity time.Duration
+	port     int
+	client   *http.Client
+
+	mu          sync.Mutex
+	invitations map[string]invitation
+}
+
+// invitation is an unused join token with the hosts the node's certificate
+// will be valid for.
+type invitation struct {
+	hosts   []string
+	expires time.Time
+}
+
+// newClusterTLS loads or creates the CA, by default next to the logs, and
+// issues the master a certificate for the hosts nodes may reach it on.
+func newClusterTLS(conf *config.Config, advertiseHost string) (*clusterTLS, error) {
+	settings := conf.Service.TLS
+	if settings.Port == 0 {
+		return nil, errors.New("tls.port is required with tls enabled")
+	}
+	ca, err := LoadClusterCA(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	validity := time.Duration(settings.CertValidityHours) * time.Hour
+	if validity <= 0 {
+		validity = defaultCertValidity
+	}
+	cluster := &clusterTLS{ca: ca, validity: validity, port: settings.Port, invitations: make(map[string]invitation)}
+	bundle, err := ca.Issue(pki.MasterName, masterHosts(advertiseHost), validity)
+	if err != nil {
+		return nil, err
+	}
+	if cluster.identity, err = pki.NewIdentity(bundle); err != nil {
+		return nil, err
+	}
+	cluster.client = cluster.identity.Client(0)
+	return cluster, nil
+}
+
+// LoadClusterCA loads or creates the CA of tls.ca_cert and tls.ca_key, by
+// default next to the logs.
+func LoadClusterCA(conf *config.Config) (*pki.CA, error) {
+	certPath, keyPath := conf.Service.TLS.CACert, conf.Service.TLS.CAKey
+	if certPath == "" {
+		certPath = filepath.Join(conf.Service.Logs.Dir, "cluster-ca.pem")
+	}
+	if keyPath == "" {
+		keyPath = filepath.Join(conf.Service.Logs.Dir, "cluster-ca-key.pem")
+	}
+	return pki.LoadOrCreateCA(certPath, keyPath)
+}
+
+// IssueAgentCertificate issues a node agent a certificate of the cluster CA
+// for the hosts the master reaches it on.
+func IssueAgentCertificate(conf *config.Config, hosts []string) (pki.Bundle, error) {
+	ca, err := LoadClusterCA(conf)
+	if err != nil {
+		return pki.Bundle{}, err
+	}
+	return ca.Issue(pki.AgentName, hosts, agentCertValidity)
+}
+
+func masterHosts(advertiseHost string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if advertiseHost != "" {
+		hosts = append(hosts, advertiseHost)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
+
+func nodeHosts(host string) []string {
+	if canonicalHost(host) == "127.0.0.1" {
+		return []string{"localhost", "127.0.0.1", "::1"}
+	}
+	return []string{host}
+}
+
+// renewLoop replaces the master's certificate before it expires. Nodes renew
+// their own through RenewCertificate.
+func (cluster *clusterTLS) renewLoop() {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !cluster.identity.NeedsRenewal(time.Now()) {
+			continue
+		}
+		bundle, err := cluster.ca.Issue(pki.MasterName, pki.Hosts(cluster.identity.Leaf()), cluster.validity)
+		if err == nil {
+			err = cluster.identity.Update(bundle)
+		}
+		if err != nil {
+			logger.Error("could not renew the master certificate", "error", err)
+			continue
+		}
+		logger.Info("renewed the master certificate", "not_after", cluster.identity.Leaf().NotAfter)
+	}
+}
+
+func (master *Master) TLSEnabled() bool {
+	return master.tls != nil
+}
+
+// TLSPort is where the master serves nodes over mTLS, 0 without TLS.
+func (master *Master) TLSPort() int {
+	if master.tls == nil {
+		return 0
+	}
+	return master.tls.port
+}
+
+func (master *Master) ServerTLSConfig() *tls.Config {
+	return master.tls.identity.ServerConfig()
+}
+
+// RenewCertificate signs a node's new key for the names of the certificate
+// it authenticated with.
+func (master *Master) RenewCertificate(peer *x509.Certificate, request pki.SigningRequest) (pki.Bundle, error) {
+	if peer.Subject.CommonName != pki.NodeName {
+		return pki.Bundle{}, ErrNotANode
+	}
+	return master.tls.ca.Renew(peer, request.CSR, master.tls.validity)
+}
+
+// inviteNode hands out a join token for a node about to be spawned. It is
+// good for one join within joinTokenTTL, for the hosts of the node.
+func (master *Master) inviteNode(node *Slave) (pki.Invitation, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return pki.Invitation{}, err
+	}
+	token := hex.EncodeToString(secret)
+	cluster := master.tls
+	now := time.Now()
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	for unused, pending := range cluster.invitations {
+		if now.After(pending.expires) {
+			delete(cluster.invitations, unused)
+		}
+	}
+	cluster.invitations[token] = invitation{hosts: nodeHosts(node.Host), expires: now.Add(joinTokenTTL)}
+	return pki.Invitation{CAPEM: cluster.ca.CertPEM(), Token: token}, nil
+}
+
+// JoinNode signs the key of a new node that presents a token of inviteNode.
+// The token is used up even when the request turns out to be broken.
+func (master *Master) JoinNode(request pki.SigningRequest) (pki.Bundle, error) {
+	cluster := master.tls
+	cluster.mu.Lock()
+	pending, ok := cluster.invitations[request.Token]
+	delete(cluster.invitations, request.Token)
+	cluster.mu.Unlock()
+	if !ok || time.Now().After(pending.expires) {
+		return pki.Bundle{}, ErrJoinRefused
+	}
+	return cluster.ca.Sign(request.CSR, pki.NodeName, pending.hosts, cluster.validity)
+}
+
+// internalKey is the first key with the internal role. Without TLS the
+// master passes it to the nodes it spawns and authenticates with it.
+func internalKey(conf *config.Config) (string, error) {
+	for _, key := range conf.Service.Auth.Keys {
+		if role, err := auth.ParseRole(key.Role); err == nil && role == auth.Internal {
+			return key.Key, nil
+		}
+	}
+	return "", errors.New("auth without tls needs a key with role internal for the nodes")
+}
+
+// httpClient reaches the nodes, presenting the master's certificate with TLS
+// or the internal key with auth but without TLS.
+func (master *Master) httpClient() *http.Client {
+	switch {
+	case master == nil:
+		return http.DefaultClient
+	case master.tls != nil:
+		return master.tls.client
+	case master.keyClient != nil:
+		return master.keyClient
+	}
+	return http.DefaultClient
+}
+
+func (master *Master) nodeScheme() string {
+	if master == nil || master.tls == nil {
+		return "http"
+	}
+	return "https"
+}
@@ -0,0 +1,240 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/agent"
+	"distributed-inmemory-cache/config"
+	"distributed-inmemory-cache/model"
+	"distributed-inmemory-cache/pki"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startTLSMaster serves replication, joins and renewal to nodes the way the
+// master does with tls enabled.
+func startTLSMaster(t *testing.T) *Master {
+	ca, _, err := pki.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := ca.Issue(pki.MasterName, masterHosts(""), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := pki.NewIdentity(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := &Master{
+		advertiseHost: "127.0.0.1",
+		provisioners:  []Provisioner{NewInProcessProvisioner()},
+		tls: &clusterTLS{
+			ca:          ca,
+			identity:    identity,
+			validity:    time.Hour,
+			port:        listener.Addr().(*net.TCPAddr).Port,
+			client:      identity.Client(0),
+			invitations: make(map[string]invitation),
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replicate/data", pki.RequirePeer(pki.NodeName, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(model.DataPayload{DataVersion: 7, Data: map[string]string{"a": "1"}})
+	}))
+	mux.HandleFunc(pki.RenewalPath, pki.RequirePeer(pki.NodeName, func(w http.ResponseWriter, r *http.Request) {
+		var request pki.SigningRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		bundle, err := master.RenewCertificate(r.TLS.VerifiedChains[0][0], request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(bundle)
+	}))
+	mux.HandleFunc(pki.JoinPath, func(w http.ResponseWriter, r *http.Request) {
+		var request pki.SigningRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		bundle, err := master.JoinNode(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(bundle)
+	})
+	server := &http.Server{Handler: mux, TLSConfig: identity.ServerConfig()}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+	return master
+}
+
+func TestNodesTalkMutualTLS(t *testing.T) {
+	master := startTLSMaster(t)
+	node := master.newNode(freePort(t))
+	node.Start()
+	defer node.provisioner.Stop(node.Port)
+
+	if node.Status != Active || node.CheckHealth() != Active {
+		t.Fatalf("expected a running node, got status %s", node.Status)
+	}
+	if err := node.Broadcast(7); err != nil {
+		t.Fatalf("broadcast over mTLS failed: %v", err)
+	}
+	data, err := node.GetData()
+	if err != nil || data.DataVersion != 7 || data.Data["a"] != "1" {
+		t.Fatalf("node did not pull over mTLS: %+v, %v", data, err)
+	}
+
+	// Only the master may call internal endpoints
+	nodeIdentity := joinedIdentity(t, master, node)
+	anonymous := nodeIdentity.Client(time.Second)
+	anonymous.Transport.(*http.Transport).TLSClientConfig.GetClientCertificate = nil
+	for client, want := range map[*http.Client]int{anonymous: http.StatusUnauthorized, nodeIdentity.Client(time.Second): http.StatusForbidden} {
+		resp, err := client.Post(node.killURL, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("kill answered %d, want %d", resp.StatusCode, want)
+		}
+	}
+	if resp, err := http.Get("http://" + nodeLabel(node) + "/data"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Error("node should not serve plain http")
+		}
+	}
+}
+
+// joinedIdentity joins the cluster the way a spawned node does.
+func joinedIdentity(t *testing.T, master *Master, node *Slave) *pki.Identity {
+	invitation, err := master.inviteNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := pki.Join("https://"+master.advertiseAddress()+pki.JoinPath, invitation, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := pki.NewIdentity(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestJoinTokensWorkOnce(t *testing.T) {
+	master := startTLSMaster(t)
+	node := master.newNode(freePort(t))
+	invited, err := master.inviteNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinURL := "https://" + master.advertiseAddress() + pki.JoinPath
+	bundle, err := pki.Join(joinURL, invited, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := pki.NewIdentity(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf := identity.Leaf(); leaf.Subject.CommonName != pki.NodeName || len(leaf.IPAddresses) == 0 {
+		t.Errorf("expected a node certificate for the node's hosts, got %s %v", leaf.Subject.CommonName, leaf.IPAddresses)
+	}
+	if _, err := pki.Join(joinURL, invited, time.Second); err == nil {
+		t.Error("a join token should only be good once")
+	}
+	if _, err := pki.Join(joinURL, pki.Invitation{CAPEM: invited.CAPEM, Token: "guessed"}, time.Second); err == nil {
+		t.Error("an unknown join token should be refused")
+	}
+
+	expired, err := master.inviteNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master.tls.invitations[expired.Token] = invitation{expires: time.Now().Add(-time.Second)}
+	if _, err := master.JoinNode(pki.SigningRequest{Token: expired.Token}); !errors.Is(err, ErrJoinRefused) {
+		t.Errorf("an expired join token should be refused, got %v", err)
+	}
+}
+
+func TestNodeCertificatesRenew(t *testing.T) {
+	master := startTLSMaster(t)
+	node := master.newNode(freePort(t))
+	identity := joinedIdentity(t, master, node)
+	if identity.NeedsRenewal(time.Now()) || !identity.NeedsRenewal(time.Now().Add(45*time.Minute)) {
+		t.Error("renewal should be due after two thirds of the lifetime")
+	}
+
+	renewed, err := pki.RequestRenewal(identity.Client(time.Second), "https://"+master.advertiseAddress()+pki.RenewalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := identity.Leaf()
+	if err := identity.Update(renewed); err != nil {
+		t.Fatal(err)
+	}
+	after := identity.Leaf()
+	if after.SerialNumber.Cmp(before.SerialNumber) == 0 || after.Subject.CommonName != pki.NodeName || len(after.IPAddresses) != len(before.IPAddresses) {
+		t.Errorf("unexpected renewed certificate %+v", after.Subject)
+	}
+
+	if _, err := master.RenewCertificate(master.tls.identity.Leaf(), pki.SigningRequest{}); !errors.Is(err, ErrNotANode) {
+		t.Errorf("renewing the master's certificate for a caller should fail, got %v", err)
+	}
+}
+
+func TestAgentsOnHTTPSOnlyLetTheMasterIn(t *testing.T) {
+	master := startTLSMaster(t)
+	agentBundle, err := master.tls.ca.Issue(pki.AgentName, []string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentIdentity, err := pki.NewIdentity(agentBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:   pki.RequirePeer(pki.MasterName, agent.NewServer("/bin/false", "agent-token").Handler().ServeHTTP),
+		TLSConfig: agentIdentity.ServerConfig(),
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+	agentURL := "https://" + listener.Addr().String()
+
+	conf := &config.Config{}
+	conf.Service.Nodes.Provisioner = ProvisionerAgent
+	conf.Service.Nodes.Agents = []string{agentURL}
+	conf.Service.Nodes.AgentToken = "agent-token"
+	if _, err := newProvisioners(conf, nil); err == nil {
+		t.Error("expected https agents to need tls")
+	}
+	provisioners, err := newProvisioners(conf, master.tls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provisioners[0].List(); err != nil {
+		t.Errorf("the master should reach the agent over mTLS: %v", err)
+	}
+
+	// Another certificate of the cluster is not enough
+	stranger := joinedIdentity(t, master, master.newNode(freePort(t)))
+	client := agent.NewClient(agentURL, "agent-token")
+	client.HTTPClient = stranger.Client(time.Second)
+	if _, err := client.List(); err == nil {
+		t.Error("expected the agent to refuse a node's certificate")
+	}
+}
@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"context"
+	"distributed-inmemory-cache/merkle"
+	"sync"
+	"time"
+)
+
+// maxListedDiffKeys caps each key list of a verification, the counts stay
+// exact.
+const maxListedDiffKeys = 1000
+
+// VerifyOptions ask for the names of the keys that differ, not only their
+// counts, and for divergent nodes to pull the master's data.
+type VerifyOptions struct {
+	Diff   bool
+	Resync bool
+}
+
+// NodeVerification compares one node with the master. A node behind the
+// master's version differs by the writes it has not taken yet.
+type NodeVerification struct {
+	Node           string   `json:"node"`
+	Status         string   `json:"status"`
+	NodeVersion    int64    `json:"nodeVersion"`
+	Checksum       string   `json:"checksum,omitempty"`
+	Consistent     bool     `json:"consistent"`
+	Missing        int      `json:"missing"`
+	Extra          int      `json:"extra"`
+	Mismatched     int      `json:"mismatched"`
+	MissingKeys    []string `json:"missingKeys,omitempty"`
+	ExtraKeys      []string `json:"extraKeys,omitempty"`
+	MismatchedKeys []string `json:"mismatchedKeys,omitempty"`
+	Truncated      bool     `json:"truncated,omitempty"`
+	Resynced       bool     `json:"resynced,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+type Verification struct {
+	Time        int64              `json:"time"`
+	DataVersion int64              `json:"dataVersion"`
+	Checksum    string             `json:"checksum"`
+	Consistent  bool               `json:"consistent"`
+	Nodes       []NodeVerification `json:"nodes"`
+}
+
+// Verify compares the data of every node with the master's by checksum, the
+// root of a Merkle tree over the data, and counts the missing, extra and
+// mismatched keys of nodes whose checksum differs. Nodes that could not be
+// compared do not count as consistent.
+func (master *Master) Verify(ctx context.Context, options VerifyOptions) Verification {
+	snapshot := master.GetReplicationData()
+	tree := merkle.Build(snapshot.Data, merkle.DefaultDepth)
+	nodes := master.nodeList()
+	verification := Verification{
+		Time:        time.Now().UnixMilli(),
+		DataVersion: snapshot.DataVersion,
+		Checksum:    tree.Root(),
+		Consistent:  true,
+		Nodes:       make([]NodeVerification, len(nodes)),
+	}
+
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := NodeVerification{Node: nodeLabel(node), Status: node.status().String()}
+			comparison, err := compareNode(ctx, node, tree, snapshot, false)
+			if err != nil {
+				result.Error = err.Error()
+				verification.Nodes[i] = result
+				return
+			}
+			result.NodeVersion = comparison.version
+			result.Checksum = comparison.checksum
+			result.Consistent = comparison.checksum == tree.Root()
+			result.Missing = len(comparison.missing)
+			result.Extra = len(comparison.extra)
+			result.Mismatched = len(comparison.mismatched)
+			if options.Diff {
+				result.MissingKeys, result.Truncated = capKeys(comparison.missing, result.Truncated)
+				result.ExtraKeys, result.Truncated = capKeys(comparison.extra, result.Truncated)
+				result.MismatchedKeys, result.Truncated = capKeys(comparison.mismatched, result.Truncated)
+			}
+			if options.Resync && !result.Consistent {
+				if err := node.resync(ctx, snapshot.DataVersion); err != nil {
+					result.Error = "resync failed: " + err.Error()
+				} else {
+					result.Resynced = true
+					node.logger().InfoContext(ctx, "resynced divergent node", "missing", result.Missing, "extra", result.Extra, "mismatched", result.Mismatched)
+				}
+			}
+			verification.Nodes[i] = result
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range verification.Nodes {
+		if !result.Consistent {
+			verification.Consistent = false
+		}
+	}
+	return verification
+}
+
+func capKeys(keys []string, truncated bool) ([]string, bool) {
+	if len(keys) > maxListedDiffKeys {
+		return keys[:maxListedDiffKeys], true
+	}
+	return keys, truncated
+}
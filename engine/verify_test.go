@@ -0,0 +1,39 @@
+package engine
+
+import (
+	"context"
+	"distributed-inmemory-cache/model"
+	"slices"
+	"testing"
+)
+
+func TestVerifyReportsAndResyncsDivergentNodes(t *testing.T) {
+	master := startComparedCluster(t, map[string]string{"a": "1", "b": "2", "c": "3"},
+		model.DataPayload{DataVersion: 42, Data: map[string]string{"a": "1", "b": "2", "c": "3"}},
+		model.DataPayload{DataVersion: 42, Data: map[string]string{"a": "1", "b": "old", "gone": "x"}},
+	)
+
+	verification := master.Verify(context.Background(), VerifyOptions{Diff: true})
+	if verification.Consistent || verification.DataVersion != 42 || len(verification.Nodes) != 2 {
+		t.Fatalf("expected an inconsistent cluster, got %+v", verification)
+	}
+	healthy, divergent := verification.Nodes[0], verification.Nodes[1]
+	if !healthy.Consistent || healthy.Checksum != verification.Checksum || healthy.Missing+healthy.Extra+healthy.Mismatched != 0 {
+		t.Errorf("the healthy node should match, got %+v", healthy)
+	}
+	if divergent.Consistent || divergent.Resynced ||
+		!slices.Equal(divergent.MissingKeys, []string{"c"}) || !slices.Equal(divergent.ExtraKeys, []string{"gone"}) || !slices.Equal(divergent.MismatchedKeys, []string{"b"}) {
+		t.Errorf("unexpected diff of the divergent node %+v", divergent)
+	}
+	if counts := master.Verify(context.Background(), VerifyOptions{}).Nodes[1]; counts.Missing != 1 || counts.MissingKeys != nil {
+		t.Errorf("without diff only the counts should be reported, got %+v", counts)
+	}
+
+	resynced := master.Verify(context.Background(), VerifyOptions{Resync: true})
+	if !resynced.Nodes[1].Resynced || resynced.Nodes[0].Resynced {
+		t.Fatalf("only the divergent node should be resynced, got %+v", resynced.Nodes)
+	}
+	if again := master.Verify(context.Background(), VerifyOptions{}); !again.Consistent {
+		t.Errorf("the cluster should be consistent after the resync, got %+v", again)
+	}
+}
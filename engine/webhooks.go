@@ -0,0 +1,450 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"distributed-inmemory-cache/config"
+	"distributed-inmemory-cache/logging"
+	"distributed-inmemory-cache/model"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookQueueSize      = 1024
+	webhookWorkers        = 4
+	webhookMaxAttempts    = 5
+	webhookInitialBackoff = time.Second
+	webhookMaxBackoff     = time.Minute
+	deadLetterLimit       = 1000
+
+	WebhookSignatureHeader = "X-Cache-Signature"
+	WebhookTimestampHeader = "X-Cache-Timestamp"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+var webhookLog = logging.Component("webhooks")
+
+type WebhookDelivery struct {
+	ID        string      `json:"id"`
+	WebhookID string      `json:"webhookId"`
+	URL       string      `json:"url"`
+	Event     ChangeEvent `json:"event"`
+	Attempts  int         `json:"attempts"`
+	LastError string      `json:"lastError,omitempty"`
+	FailedAt  int64       `json:"failedAt,omitempty"`
+	secret    string
+}
+
+type webhookBody struct {
+	ID        string      `json:"id"`
+	WebhookID string      `json:"webhookId"`
+	Event     ChangeEvent `json:"event"`
+}
+
+// webhookDispatcher POSTs matching change events to the registered webhooks,
+// retrying failures with exponential backoff and keeping the deliveries that
+// ran out of attempts in a dead-letter list. The webhooks are kept with
+// their secrets in the file at path, the secrets never go to the nodes.
+type webhookDispatcher struct {
+	mu       sync.Mutex
+	webhooks map[string]model.Webhook
+	path     string
+	// persistMu orders writes of the file, which happen outside of mu
+	persistMu      sync.Mutex
+	deadLetters    []WebhookDelivery
+	queue          chan *WebhookDelivery
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+}
+
+func newWebhookDispatcher() *webhookDispatcher {
+	dispatcher := &webhookDispatcher{
+		webhooks:       make(map[string]model.Webhook),
+		queue:          make(chan *WebhookDelivery, webhookQueueSize),
+		client:         &http.Client{Timeout: 10 * time.Second},
+		maxAttempts:    webhookMaxAttempts,
+		initialBackoff: webhookInitialBackoff,
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go dispatcher.work()
+	}
+	return dispatcher
+}
+
+// onEvent is registered as an event hub listener, so it only queues work.
+func (dispatcher *webhookDispatcher) onEvent(event ChangeEvent) {
+	dispatcher.mu.Lock()
+	var deliveries []*WebhookDelivery
+	for _, webhook := range dispatcher.webhooks {
+		if paused(webhook) {
+			continue
+		}
+		if strings.HasPrefix(event.Key, webhook.Prefix) {
+			deliveries = append(deliveries, &WebhookDelivery{
+				ID:        randomID(),
+				WebhookID: webhook.ID,
+				URL:       webhook.URL,
+				Event:     event,
+				secret:    webhook.Secret,
+			})
+		}
+	}
+	dispatcher.mu.Unlock()
+
+	for _, delivery := range deliveries {
+		dispatcher.enqueue(delivery)
+	}
+}
+
+func (dispatcher *webhookDispatcher) enqueue(delivery *WebhookDelivery) {
+	select {
+	case dispatcher.queue <- delivery:
+	default:
+		delivery.LastError = "delivery queue full"
+		dispatcher.deadLetter(delivery)
+	}
+}
+
+func (dispatcher *webhookDispatcher) work() {
+	for delivery := range dispatcher.queue {
+		delivery.Attempts++
+		err := dispatcher.deliver(delivery)
+		if err == nil {
+			continue
+		}
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= dispatcher.maxAttempts {
+			webhookLog.Warn("delivery moved to dead letters", "delivery", delivery.ID, "url", delivery.URL, "attempts", delivery.Attempts, "error", err)
+			dispatcher.deadLetter(delivery)
+			continue
+		}
+		backoff := min(dispatcher.initialBackoff<<(delivery.Attempts-1), webhookMaxBackoff)
+		time.AfterFunc(backoff, func() {
+			dispatcher.enqueue(delivery)
+		})
+	}
+}
+
+func (dispatcher *webhookDispatcher) deliver(delivery *WebhookDelivery) error {
+	body, err := json.Marshal(webhookBody{ID: delivery.ID, WebhookID: delivery.WebhookID, Event: delivery.Event})
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(delivery.secret, timestamp, body))
+
+	resp, err := dispatcher.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (dispatcher *webhookDispatcher) deadLetter(delivery *WebhookDelivery) {
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	delivery.FailedAt = time.Now().UnixMilli()
+	dispatcher.deadLetters = append(dispatcher.deadLetters, *delivery)
+	if overflow := len(dispatcher.deadLetters) - deadLetterLimit; overflow > 0 {
+		dispatcher.deadLetters = append(dispatcher.deadLetters[:0], dispatcher.deadLetters[overflow:]...)
+	}
+}
+
+// SignWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>" that
+// receivers compare with the X-Cache-Signature header.
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (dispatcher *webhookDispatcher) deadLetterList() []WebhookDelivery {
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	return append([]WebhookDelivery{}, dispatcher.deadLetters...)
+}
+
+func (dispatcher *webhookDispatcher) clearDeadLetters() {
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	dispatcher.deadLetters = nil
+}
+
+func (dispatcher *webhookDispatcher) snapshot() map[string]model.Webhook {
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	webhooks := make(map[string]model.Webhook, len(dispatcher.webhooks))
+	for id, webhook := range dispatcher.webhooks {
+		webhooks[id] = webhook
+	}
+	return webhooks
+}
+
+// replicated lists the webhooks for the nodes. Only the master signs
+// deliveries, so the secrets are left out.
+func (dispatcher *webhookDispatcher) replicated() map[string]model.Webhook {
+	webhooks := dispatcher.snapshot()
+	for id, webhook := range webhooks {
+		webhook.Secret = ""
+		webhooks[id] = webhook
+	}
+	return webhooks
+}
+
+// paused tells if a webhook is one recovered from the nodes without its
+// secret. Registering requires a secret, so nothing would verify what it
+// sent until it is registered again.
+func paused(webhook model.Webhook) bool {
+	return webhook.Secret == ""
+}
+
+// register adds a webhook. It takes the place, and the id, of a paused one
+// for the same url and prefix. The caller persists the webhooks.
+func (dispatcher *webhookDispatcher) register(webhook model.Webhook) model.Webhook {
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	for id, existing := range dispatcher.webhooks {
+		if paused(existing) && existing.URL == webhook.URL && existing.Prefix == webhook.Prefix {
+			webhookLog.Info("resuming recovered webhook with its new secret", "id", id, "url", webhook.URL)
+			webhook.ID = id
+			break
+		}
+	}
+	dispatcher.webhooks[webhook.ID] = webhook
+	return webhook
+}
+
+// adopt takes the webhooks of a recovered node the master does not know,
+// e.g. after its webhooks file was lost. Nodes hold no secrets, so these
+// stay paused until they are registered again.
+func (dispatcher *webhookDispatcher) adopt(webhooks map[string]model.Webhook) {
+	dispatcher.mu.Lock()
+	adopted := false
+	for id, webhook := range webhooks {
+		if _, ok := dispatcher.webhooks[id]; ok {
+			continue
+		}
+		if paused(webhook) {
+			webhookLog.Warn("recovered webhook without its secret, paused until it is registered again", "id", id, "url", webhook.URL)
+		}
+		dispatcher.webhooks[id] = webhook
+		adopted = true
+	}
+	dispatcher.mu.Unlock()
+	if adopted {
+		dispatcher.persist()
+	}
+}
+
+// remove deletes a webhook. The caller persists the webhooks.
+func (dispatcher *webhookDispatcher) remove(id string) bool {
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	_, ok := dispatcher.webhooks[id]
+	delete(dispatcher.webhooks, id)
+	return ok
+}
+
+func webhooksFile(conf *config.Config) string {
+	if conf.Service.Master.WebhooksFile != "" {
+		return conf.Service.Master.WebhooksFile
+	}
+	return filepath.Join(conf.Service.Logs.Dir, "cache-webhooks.json")
+}
+
+// load continues with the webhooks a previous master stored.
+func (dispatcher *webhookDispatcher) load() error {
+	content, err := os.ReadFile(dispatcher.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var webhooks map[string]model.Webhook
+	if err := json.Unmarshal(content, &webhooks); err != nil {
+		return fmt.Errorf("reading webhooks file %s: %w", dispatcher.path, err)
+	}
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	for id, webhook := range webhooks {
+		dispatcher.webhooks[id] = webhook
+	}
+	return nil
+}
+
+// persist writes the webhooks with their secrets to a file only the
+// master's user can read. Without it, a restarted master would only get the
+// webhooks back from the nodes, without secrets. The webhooks are read once
+// the previous write is done, so the last write has the latest of them.
+func (dispatcher *webhookDispatcher) persist() {
+	if dispatcher.path == "" {
+		return
+	}
+	dispatcher.persistMu.Lock()
+	defer dispatcher.persistMu.Unlock()
+	content, err := json.Marshal(dispatcher.snapshot())
+	if err != nil {
+		webhookLog.Error("could not encode webhooks", "error", err)
+		return
+	}
+	dir := filepath.Dir(dispatcher.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		webhookLog.Error("could not create webhooks dir", "error", err)
+		return
+	}
+	// Created with mode 0600
+	temp, err := os.CreateTemp(dir, filepath.Base(dispatcher.path)+".*.tmp")
+	if err != nil {
+		webhookLog.Error("could not write webhooks", "error", err)
+		return
+	}
+	_, err = temp.Write(content)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), dispatcher.path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		webhookLog.Error("could not replace webhooks", "error", err)
+	}
+}
+
+// RegisterWebhook stores a webhook subscription in the cluster.
+func (master *Master) RegisterWebhook(rawURL string, prefix string, secret string) (model.Webhook, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return model.Webhook{}, errors.New("webhook url must be an absolute http or https url")
+	}
+	webhook := model.Webhook{
+		ID:        randomID(),
+		URL:       rawURL,
+		Prefix:    prefix,
+		Secret:    secret,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+
+	master.mu.Lock()
+	master.nextVersionLocked()
+	webhook = master.webhooks.register(webhook)
+	master.mu.Unlock()
+
+	master.webhooks.persist()
+	master.Broadcast()
+	webhook.Secret = ""
+	return webhook, nil
+}
+
+func (master *Master) DeleteWebhook(id string) error {
+	master.mu.Lock()
+	ok := master.webhooks.remove(id)
+	if ok {
+		master.nextVersionLocked()
+	}
+	master.mu.Unlock()
+
+	if !ok {
+		return ErrWebhookNotFound
+	}
+	master.webhooks.persist()
+	master.Broadcast()
+	return nil
+}
+
+// Webhooks lists the registered webhooks without their secrets.
+func (master *Master) Webhooks() []model.Webhook {
+	webhooks := make([]model.Webhook, 0)
+	for _, webhook := range master.webhooks.snapshot() {
+		webhook.Paused = paused(webhook)
+		webhook.Secret = ""
+		webhooks = append(webhooks, webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].CreatedAt < webhooks[j].CreatedAt })
+	return webhooks
+}
+
+func (master *Master) WebhookDeadLetters() []WebhookDelivery {
+	return master.webhooks.deadLetterList()
+}
+
+// retry queues a dead-lettered delivery again with a fresh attempt budget,
+// or every dead letter when id is empty.
+func (dispatcher *webhookDispatcher) retry(id string) int {
+	dispatcher.mu.Lock()
+	var retry []*WebhookDelivery
+	remaining := dispatcher.deadLetters[:0]
+	for _, delivery := range dispatcher.deadLetters {
+		if id != "" && delivery.ID != id {
+			remaining = append(remaining, delivery)
+			continue
+		}
+		// Pick up a rotated secret, or drop the delivery if the webhook is gone
+		webhook, ok := dispatcher.webhooks[delivery.WebhookID]
+		if !ok {
+			continue
+		}
+		if paused(webhook) {
+			remaining = append(remaining, delivery)
+			continue
+		}
+		delivery := delivery
+		delivery.Attempts = 0
+		delivery.FailedAt = 0
+		delivery.secret = webhook.Secret
+		retry = append(retry, &delivery)
+	}
+	dispatcher.deadLetters = remaining
+	dispatcher.mu.Unlock()
+
+	for _, delivery := range retry {
+		dispatcher.enqueue(delivery)
+	}
+	return len(retry)
+}
+
+func (master *Master) RetryWebhookDeadLetter(id string) int {
+	return master.webhooks.retry(id)
+}
+
+func (master *Master) ClearWebhookDeadLetters() {
+	master.webhooks.clearDeadLetters()
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	received := make(chan webhookBody, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		expected := "sha256=" + SignWebhook("s3cret", r.Header.Get(WebhookTimestampHeader), body)
+		if r.Header.Get(WebhookSignatureHeader) != expected {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var payload webhookBody
+		json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer server.Close()
+
+	dispatcher := newWebhookDispatcher()
+	dispatcher.register(model.Webhook{ID: "orders", URL: server.URL, Prefix: "order:", Secret: "s3cret"})
+
+	dispatcher.onEvent(ChangeEvent{DataVersionId: 1, Type: EventSet, Key: "user:1"})
+	dispatcher.onEvent(ChangeEvent{DataVersionId: 2, Type: EventDelete, Key: "order:1"})
+
+	select {
+	case payload := <-received:
+		if payload.WebhookID != "orders" || payload.Event.Key != "order:1" || payload.Event.Type != EventDelete {
+			t.Errorf("unexpected delivery: %+v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+}
+
+func TestWebhookDeadLetterAfterRetries(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	dispatcher := newWebhookDispatcher()
+	dispatcher.maxAttempts = 3
+	dispatcher.initialBackoff = time.Millisecond
+	dispatcher.register(model.Webhook{ID: "all", URL: server.URL, Secret: "s3cret"})
+
+	dispatcher.onEvent(ChangeEvent{DataVersionId: 1, Type: EventExpire, Key: "session"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(dispatcher.deadLetterList()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	deadLetters := dispatcher.deadLetterList()
+	if len(deadLetters) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(deadLetters))
+	}
+	if deadLetters[0].Attempts != 3 || attempts.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d recorded and %d received", deadLetters[0].Attempts, attempts.Load())
+	}
+	if deadLetters[0].LastError == "" {
+		t.Errorf("expected the last error to be recorded")
+	}
+}
+
+func TestWebhookSecretsStayWithTheMaster(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	dispatcher := newWebhookDispatcher()
+	dispatcher.path = path
+	dispatcher.register(model.Webhook{ID: "orders", URL: "http://localhost:9000/hook", Prefix: "order:", Secret: "s3cret"})
+	dispatcher.persist()
+	master := &Master{data: map[string]string{}, locks: newLockTable(), webhooks: dispatcher}
+	if webhook := master.GetReplicationData().Webhooks["orders"]; webhook.Secret != "" || webhook.URL == "" {
+		t.Errorf("nodes should get the webhook without its secret, got %+v", webhook)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("the webhooks file should only be readable by the master, got %v", info.Mode())
+	}
+
+	// A restarted master takes the secrets from its file, not from the nodes
+	restarted := newWebhookDispatcher()
+	restarted.path = path
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	restarted.adopt(master.GetReplicationData().Webhooks)
+	restarted.adopt(map[string]model.Webhook{"users": {ID: "users", URL: "http://localhost:9000/users"}})
+	webhooks := restarted.snapshot()
+	if webhooks["orders"].Secret != "s3cret" || len(webhooks) != 2 {
+		t.Errorf("expected the stored secret and the adopted webhook, got %+v", webhooks)
+	}
+}
+
+func TestRecoveredWebhooksStayPausedUntilRegisteredAgain(t *testing.T) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer server.Close()
+
+	dispatcher := newWebhookDispatcher()
+	dispatcher.adopt(map[string]model.Webhook{"orders": {ID: "orders", URL: server.URL, Prefix: "order:"}})
+	master := &Master{webhooks: dispatcher}
+	if webhooks := master.Webhooks(); len(webhooks) != 1 || !webhooks[0].Paused {
+		t.Fatalf("expected the recovered webhook to be listed as paused, got %+v", webhooks)
+	}
+	dispatcher.onEvent(ChangeEvent{Type: EventSet, Key: "order:1"})
+	time.Sleep(100 * time.Millisecond)
+	if received.Load() != 0 {
+		t.Fatalf("a paused webhook must not be delivered to")
+	}
+
+	webhook := dispatcher.register(model.Webhook{ID: "new", URL: server.URL, Prefix: "order:", Secret: "s3cret"})
+	if webhook.ID != "orders" || len(dispatcher.snapshot()) != 1 {
+		t.Errorf("expected the registration to resume the recovered webhook, got %+v", dispatcher.snapshot())
+	}
+	dispatcher.onEvent(ChangeEvent{Type: EventSet, Key: "order:2"})
+	deadline := time.Now().Add(2 * time.Second)
+	for received.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received.Load() != 1 {
+		t.Errorf("expected one delivery after registering again, got %d", received.Load())
+	}
+}
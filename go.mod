@@ -2,4 +2,7 @@ module distributed-inmemory-cache
 
 go 1.23.0
 
-require gopkg.in/yaml.v2 v2.4.0
+require (
+	github.com/gorilla/websocket v1.5.3
+	gopkg.in/yaml.v2 v2.4.0
+)
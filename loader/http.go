@@ -0,0 +1,85 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HTTPBackend loads and writes keys through an HTTP endpoint:
+//
+//	GET    <URL>?key=<key>  returns the value as the body, 404 when missing
+//	PUT    <URL>?key=<key>  stores the body as the value
+//	DELETE <URL>?key=<key>  removes the key
+type HTTPBackend struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTPBackend(endpoint string, timeout time.Duration) *HTTPBackend {
+	return &HTTPBackend{URL: endpoint, Client: &http.Client{Timeout: timeout}}
+}
+
+func (backend *HTTPBackend) Load(ctx context.Context, key string) (string, error) {
+	resp, err := backend.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("loader %s answered %s", backend.URL, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (backend *HTTPBackend) Store(ctx context.Context, key string, value string) error {
+	return backend.write(ctx, http.MethodPut, key, value)
+}
+
+func (backend *HTTPBackend) Delete(ctx context.Context, key string) error {
+	return backend.write(ctx, http.MethodDelete, key, "")
+}
+
+func (backend *HTTPBackend) write(ctx context.Context, method string, key string, value string) error {
+	resp, err := backend.do(ctx, method, key, strings.NewReader(value))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("loader %s answered %s", backend.URL, resp.Status)
+	}
+	return nil
+}
+
+func (backend *HTTPBackend) do(ctx context.Context, method string, key string, body io.Reader) (*http.Response, error) {
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		return nil, err
+	}
+	query := target.Query()
+	query.Set("key", key)
+	target.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	client := backend.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(request)
+}
@@ -0,0 +1,153 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("key not found in backend")
+
+// Loader fills a cache miss from the backing store. It returns ErrNotFound
+// when the backend has no value for the key.
+type Loader interface {
+	Load(ctx context.Context, key string) (string, error)
+}
+
+// Writer receives writes that go through the cache to the backing store.
+type Writer interface {
+	Store(ctx context.Context, key string, value string) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Functions adapts plain functions, for example ones wrapping a database/sql
+// query, to a backend. Nil StoreFunc or DeleteFunc make those writes no-ops.
+type Functions struct {
+	LoadFunc   func(ctx context.Context, key string) (string, error)
+	StoreFunc  func(ctx context.Context, key string, value string) error
+	DeleteFunc func(ctx context.Context, key string) error
+}
+
+func (f Functions) Load(ctx context.Context, key string) (string, error) {
+	if f.LoadFunc == nil {
+		return "", ErrNotFound
+	}
+	return f.LoadFunc(ctx, key)
+}
+
+func (f Functions) Store(ctx context.Context, key string, value string) error {
+	if f.StoreFunc == nil {
+		return nil
+	}
+	return f.StoreFunc(ctx, key, value)
+}
+
+func (f Functions) Delete(ctx context.Context, key string) error {
+	if f.DeleteFunc == nil {
+		return nil
+	}
+	return f.DeleteFunc(ctx, key)
+}
+
+// Route is the backend registered for a key prefix. Writer is nil unless
+// writes go through to the backend, and loaded values expire after TTL when
+// it is positive.
+type Route struct {
+	Prefix string
+	Loader Loader
+	Writer Writer
+	TTL    time.Duration
+}
+
+// Registry maps key prefixes to backends, the longest matching prefix wins.
+type Registry struct {
+	mu     sync.RWMutex
+	routes []Route
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a route, replacing any route already registered for the same prefix.
+func (registry *Registry) Register(route Route) error {
+	if route.Loader == nil {
+		return errors.New("no loader given for prefix " + route.Prefix)
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for i, existing := range registry.routes {
+		if existing.Prefix == route.Prefix {
+			registry.routes[i] = route
+			return nil
+		}
+	}
+	registry.routes = append(registry.routes, route)
+	return nil
+}
+
+func (registry *Registry) Lookup(key string) (Route, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	var best Route
+	found := false
+	for _, route := range registry.routes {
+		if strings.HasPrefix(key, route.Prefix) && (!found || len(route.Prefix) > len(best.Prefix)) {
+			best = route
+			found = true
+		}
+	}
+	return best, found
+}
+
+func (registry *Registry) Prefixes() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	prefixes := make([]string, 0, len(registry.routes))
+	for _, route := range registry.routes {
+		prefixes = append(prefixes, route.Prefix)
+	}
+	return prefixes
+}
+
+type call struct {
+	done  chan struct{}
+	value string
+	err   error
+}
+
+// Group coalesces concurrent loads of the same key into a single call.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// Do runs fn once for all callers asking for key at the same time and hands
+// every caller the same result. shared reports whether the result came from
+// another caller's load.
+func (group *Group) Do(key string, fn func() (string, error)) (value string, err error, shared bool) {
+	group.mu.Lock()
+	if group.calls == nil {
+		group.calls = make(map[string]*call)
+	}
+	if existing, ok := group.calls[key]; ok {
+		group.mu.Unlock()
+		<-existing.done
+		return existing.value, existing.err, true
+	}
+	c := &call{done: make(chan struct{})}
+	group.calls[key] = c
+	group.mu.Unlock()
+
+	defer func() {
+		group.mu.Lock()
+		delete(group.calls, key)
+		group.mu.Unlock()
+		close(c.done)
+	}()
+	c.value, c.err = fn()
+	return c.value, c.err, false
+}
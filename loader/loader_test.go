@@ -0,0 +1,113 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupCoalescesConcurrentLoads(t *testing.T) {
+	var group Group
+	var loads atomic.Int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]string, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, _ = group.Do("user:1", func() (string, error) {
+				loads.Add(1)
+				<-release
+				return "alice", nil
+			})
+		}(i)
+	}
+
+	// Give every caller time to join the in-flight load
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loads.Load() != 1 {
+		t.Errorf("expected a single load, got %d", loads.Load())
+	}
+	for i, result := range results {
+		if result != "alice" {
+			t.Errorf("caller %d got %q", i, result)
+		}
+	}
+}
+
+func TestRegistryLongestPrefixWins(t *testing.T) {
+	registry := NewRegistry()
+	general := Functions{LoadFunc: func(ctx context.Context, key string) (string, error) { return "general", nil }}
+	specific := Functions{LoadFunc: func(ctx context.Context, key string) (string, error) { return "specific", nil }}
+	registry.Register(Route{Prefix: "user:", Loader: general})
+	registry.Register(Route{Prefix: "user:admin:", Loader: specific, Writer: specific})
+
+	route, ok := registry.Lookup("user:admin:1")
+	if !ok || route.Prefix != "user:admin:" || route.Writer == nil {
+		t.Errorf("expected the user:admin: route, got %+v", route)
+	}
+	route, ok = registry.Lookup("user:2")
+	if !ok || route.Prefix != "user:" || route.Writer != nil {
+		t.Errorf("expected the user: route without writer, got %+v", route)
+	}
+	if _, ok := registry.Lookup("order:1"); ok {
+		t.Errorf("expected no route for order:1")
+	}
+}
+
+func TestHTTPBackend(t *testing.T) {
+	stored := map[string]string{"user:1": "alice"}
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := r.URL.Query().Get("key")
+		switch r.Method {
+		case http.MethodGet:
+			value, ok := stored[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(value))
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			stored[key] = string(body)
+		case http.MethodDelete:
+			delete(stored, key)
+		}
+	}))
+	defer server.Close()
+
+	backend := NewHTTPBackend(server.URL, time.Second)
+	ctx := context.Background()
+
+	if value, err := backend.Load(ctx, "user:1"); err != nil || value != "alice" {
+		t.Errorf("expected alice, got %q (%v)", value, err)
+	}
+	if _, err := backend.Load(ctx, "user:2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := backend.Store(ctx, "user:2", "bob"); err != nil {
+		t.Fatalf("unexpected store error: %v", err)
+	}
+	if err := backend.Delete(ctx, "user:1"); err != nil {
+		t.Fatalf("unexpected delete error: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if stored["user:2"] != "bob" || len(stored) != 1 {
+		t.Errorf("unexpected backend state: %v", stored)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"distributed-inmemory-cache/engine"
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+type lockRequest struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	Token int64  `json:"token"`
+	TTL   string `json:"ttl"`
+}
+
+func locksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(master.Locks())
+}
+
+func acquireLockHandler(w http.ResponseWriter, r *http.Request) {
+	request, ttl, ok := readLockRequest(w, r)
+	if !ok {
+		return
+	}
+	apiLog.DebugContext(r.Context(), "acquire lock", "lock", request.Name, "owner", request.Owner)
+	lock, err := master.AcquireLock(request.Name, request.Owner, ttl)
+	writeLockResponse(w, lock, err)
+}
+
+func renewLockHandler(w http.ResponseWriter, r *http.Request) {
+	request, ttl, ok := readLockRequest(w, r)
+	if !ok {
+		return
+	}
+	lock, err := master.RenewLock(request.Name, request.Owner, request.Token, ttl)
+	writeLockResponse(w, lock, err)
+}
+
+func releaseLockHandler(w http.ResponseWriter, r *http.Request) {
+	request, _, ok := readLockRequest(w, r)
+	if !ok {
+		return
+	}
+	apiLog.DebugContext(r.Context(), "release lock", "lock", request.Name, "owner", request.Owner)
+	err := master.ReleaseLock(request.Name, request.Owner, request.Token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func readLockRequest(w http.ResponseWriter, r *http.Request) (*lockRequest, time.Duration, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return nil, 0, false
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	defer r.Body.Close()
+
+	var request lockRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	if request.Name == "" || request.Owner == "" {
+		http.Error(w, "Lock name and owner are required", http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	ttl := engine.DefaultLockTTL
+	if request.TTL != "" {
+		ttl, err = time.ParseDuration(request.TTL)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return nil, 0, false
+		}
+	}
+	return &request, ttl, true
+}
+
+func writeLockResponse(w http.ResponseWriter, lock model.Lock, err error) {
+	switch {
+	case errors.Is(err, engine.ErrLockHeld), errors.Is(err, engine.ErrLockNotHeld):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, engine.ErrLockNotReplicated), errors.Is(err, engine.ErrLocksRecovering):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lock)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"distributed-inmemory-cache/logging"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var apiLog = logging.Component("api")
+
+// withRequestID tags every request with the id the caller sent, or a new one,
+// and echoes it so callers can find their request in the logs.
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		handler.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// logLevelHandler reads and changes the log level at runtime. With node=all
+// or node=<port> the change is passed on to the nodes as well.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level := r.URL.Query().Get("level")
+		if err := logging.SetLevel(level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		apiLog.InfoContext(r.Context(), "log level changed", "level", logging.Level())
+		if node := r.URL.Query().Get("node"); node != "" {
+			port := 0
+			if node != "all" {
+				var err error
+				if port, err = strconv.Atoi(node); err != nil {
+					http.Error(w, "node must be all or a port", http.StatusBadRequest)
+					return
+				}
+			}
+			response["nodes"] = master.SetNodeLogLevels(logging.Level(), port)
+		}
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	response["level"] = logging.Level()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,157 @@
+// Package logging sets up leveled, structured logging with log/slog. Loggers
+// carry a component tag, records logged with a request context carry its
+// request id, and the level can be changed while the process runs.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+type Options struct {
+	// Dir and File name the log file, without a Dir logs only go to Stdout
+	Dir       string
+	File      string
+	Format    string
+	Level     string
+	MaxSizeMB int
+	MaxFiles  int
+	// Stdout also writes every record to standard output
+	Stdout bool
+}
+
+var (
+	level   = new(slog.LevelVar)
+	current atomic.Pointer[slog.Handler]
+)
+
+func init() {
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	current.Store(&handler)
+}
+
+// Setup replaces the output of every logger, including ones created before
+// it ran, and routes the standard log package through it as well.
+func Setup(options Options) error {
+	if err := SetLevel(options.Level); err != nil {
+		return err
+	}
+
+	var writers []io.Writer
+	if options.Stdout || options.Dir == "" {
+		writers = append(writers, os.Stdout)
+	}
+	if options.Dir != "" {
+		file, err := NewRotatingFile(filepath.Join(options.Dir, options.File), options.MaxSizeMB, options.MaxFiles)
+		if err != nil {
+			return err
+		}
+		writers = append(writers, file)
+	}
+	output := io.MultiWriter(writers...)
+
+	handlerOptions := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch options.Format {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(output, handlerOptions)
+	case FormatLogfmt, "":
+		handler = slog.NewTextHandler(output, handlerOptions)
+	default:
+		return fmt.Errorf("unknown log format %q, use %s or %s", options.Format, FormatJSON, FormatLogfmt)
+	}
+	current.Store(&handler)
+	slog.SetDefault(slog.New(forwardingHandler{}))
+	log.SetFlags(0)
+	return nil
+}
+
+// Component returns a logger tagged with the component, e.g. master,
+// slave:3001 or node.
+func Component(name string) *slog.Logger {
+	return slog.New(forwardingHandler{}).With("component", name)
+}
+
+func SetLevel(name string) error {
+	if name == "" {
+		name = "info"
+	}
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+	}
+	level.Set(parsed)
+	return nil
+}
+
+func Level() string {
+	return strings.ToLower(level.Level().String())
+}
+
+type requestIDKey struct{}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func NewRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// forwardingHandler hands records to the handler installed by Setup at the
+// time they are logged, and adds the request id from the context.
+type forwardingHandler struct {
+	wrap []func(slog.Handler) slog.Handler
+}
+
+func (h forwardingHandler) handler() slog.Handler {
+	handler := *current.Load()
+	for _, wrap := range h.wrap {
+		handler = wrap(handler)
+	}
+	return handler
+}
+
+func (h forwardingHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= level.Level()
+}
+
+func (h forwardingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.handler().Handle(ctx, record)
+}
+
+func (h forwardingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return forwardingHandler{wrap: append(h.wrap[:len(h.wrap):len(h.wrap)], func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})}
+}
+
+func (h forwardingHandler) WithGroup(name string) slog.Handler {
+	return forwardingHandler{wrap: append(h.wrap[:len(h.wrap):len(h.wrap)], func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})}
+}
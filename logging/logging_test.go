@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestComponentLoggerWritesJSONWithRequestID(t *testing.T) {
+	dir := t.TempDir()
+	if err := Setup(Options{Dir: dir, File: "test.log", Format: FormatJSON, Level: "info"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Created before the level change, it must follow it
+	logger := Component("slave:3001")
+	logger.Debug("hidden")
+	ctx := WithRequestID(context.Background(), "abc123")
+	logger.InfoContext(ctx, "refreshed", "version", 7)
+
+	if err := SetLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLevel("info")
+	logger.Debug("shown")
+
+	content, err := os.ReadFile(filepath.Join(dir, "test.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d records, want 2:\n%s", len(lines), content)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["component"] != "slave:3001" || record["request_id"] != "abc123" || record["msg"] != "refreshed" || record["level"] != "INFO" {
+		t.Fatalf("unexpected record %v", record)
+	}
+	if !strings.Contains(lines[1], `"msg":"shown"`) {
+		t.Fatalf("debug record missing after level change: %s", lines[1])
+	}
+	if Level() != "debug" {
+		t.Fatalf("level is %s, want debug", Level())
+	}
+}
+
+func TestSetLevelRejectsUnknownLevels(t *testing.T) {
+	if err := SetLevel("loud"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestRotatingFileKeepsMaxFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.log")
+	file, err := NewRotatingFile(path, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	chunk := []byte(strings.Repeat("x", 600*1024))
+	for i := 0; i < 6; i++ {
+		if _, err := file.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Fatalf("%s missing: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("%s should have been dropped", path+".3")
+	}
+	info, _ := os.Stat(path)
+	if info.Size() > 1024*1024 {
+		t.Fatalf("current file grew to %d bytes", info.Size())
+	}
+}
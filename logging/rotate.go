@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RotatingFile is a log file that is renamed to name.1, name.2 and so on
+// once it grows past its maximum size. The oldest of maxFiles is dropped.
+type RotatingFile struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+func NewRotatingFile(path string, maxSizeMB int, maxFiles int) (*RotatingFile, error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = 10
+	}
+	if maxFiles <= 0 {
+		maxFiles = 5
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	rotating := &RotatingFile{path: path, maxBytes: int64(maxSizeMB) * 1024 * 1024, maxFiles: maxFiles}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+func (rotating *RotatingFile) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+func (rotating *RotatingFile) Write(p []byte) (int, error) {
+	rotating.mu.Lock()
+	defer rotating.mu.Unlock()
+	if rotating.size > 0 && rotating.size+int64(len(p)) > rotating.maxBytes {
+		if err := rotating.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rotating.file.Write(p)
+	rotating.size += int64(n)
+	return n, err
+}
+
+func (rotating *RotatingFile) rotate() error {
+	rotating.file.Close()
+	for i := rotating.maxFiles - 1; i >= 1; i-- {
+		from := rotating.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", rotating.path, i-1)
+		}
+		// Missing files are fine, the first rotations have fewer of them
+		os.Rename(from, fmt.Sprintf("%s.%d", rotating.path, i))
+	}
+	return rotating.open()
+}
+
+func (rotating *RotatingFile) Close() error {
+	rotating.mu.Lock()
+	defer rotating.mu.Unlock()
+	return rotating.file.Close()
+}
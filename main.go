@@ -1,18 +1,33 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"distributed-inmemory-cache/auth"
 	c "distributed-inmemory-cache/config"
 	"distributed-inmemory-cache/engine"
+	"distributed-inmemory-cache/logging"
+	"distributed-inmemory-cache/model"
+	"distributed-inmemory-cache/pki"
+	"distributed-inmemory-cache/replica"
+	"distributed-inmemory-cache/resp"
+	"distributed-inmemory-cache/tracing"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 var master *engine.Master
 var conf *c.Config
+var autoscaler *engine.Autoscaler
+var antiEntropy *engine.AntiEntropy
 
 func main() {
 	var err error
@@ -21,17 +36,94 @@ func main() {
 		log.Fatal("Error reading config: ", err)
 		os.Exit(-1)
 	}
+	// go run . agent-cert <dir> <host>... writes a node agent's certificate
+	if len(os.Args) > 3 && os.Args[1] == "agent-cert" {
+		if err := writeAgentCertificate(os.Args[2], os.Args[3:]); err != nil {
+			log.Fatal("Error issuing the agent certificate: ", err)
+		}
+		return
+	}
+	logs := conf.Service.Logs
+	err = logging.Setup(logging.Options{
+		Dir:       logs.Dir,
+		File:      "master.log",
+		Format:    logs.Format,
+		Level:     logs.Level,
+		MaxSizeMB: logs.MaxSizeMB,
+		MaxFiles:  logs.MaxFiles,
+		Stdout:    true,
+	})
+	if err != nil {
+		log.Fatal("Error setting up logging: ", err)
+	}
+	err = tracing.Setup(tracing.Options{
+		Service:  "cache-master",
+		Endpoint: conf.Service.Tracing.OTLPEndpoint,
+		File:     conf.Service.Tracing.File,
+	})
+	if err != nil {
+		log.Fatal("Error setting up tracing: ", err)
+	}
+
+	if err := setupAuth(); err != nil {
+		apiLog.Error("invalid auth config", "error", err)
+		os.Exit(1)
+	}
+	if err := setupAudit(); err != nil {
+		apiLog.Error("could not open audit log", "error", err)
+		os.Exit(1)
+	}
+	setupRateLimits()
 
 	master = engine.NewMaster(conf)
-	master.MakeAvailable()
-	http.HandleFunc("/replicate/data", replicateDataHandler)
-	http.HandleFunc("/api/data/get", getDataHandler)
-	http.HandleFunc("/api/data/set", setDataHandler)
-	http.HandleFunc("/api/data/delete", deleteDataHandler)
-	http.HandleFunc("/api/infra/scaleup", infraScaleUpHandler)
-	http.HandleFunc("/api/infra/scaledown", infraScaleDownHandler)
-	http.HandleFunc("/api/infra/killall", killAllHandler)
-	http.HandleFunc("/api/infra/nodestats", nodeCountHandler)
+	if conf.Service.Autoscaler.Enabled {
+		autoscaler = engine.NewAutoscaler(master, conf)
+	}
+	antiEntropy = engine.NewAntiEntropy(master, conf)
+	http.HandleFunc("/replicate/data", internal(replicateDataHandler))
+	http.HandleFunc("/replicate/snapshot", internal(replicateSnapshotHandler))
+	http.HandleFunc("/api/data/get", authorized(auth.Reader, limited(instrumented(getDataHandler))))
+	http.HandleFunc("/api/data/set", audited(authorized(auth.Writer, limited(admitted(instrumented(setDataHandler))))))
+	http.HandleFunc("/api/data/delete", audited(authorized(auth.Writer, limited(admitted(instrumented(deleteDataHandler))))))
+	http.HandleFunc("/api/data/loaders", authorized(auth.Reader, limited(loadersHandler)))
+	http.HandleFunc("/api/infra/scaleup", audited(authorized(auth.Operator, infraScaleUpHandler)))
+	http.HandleFunc("/api/infra/scaledown", audited(authorized(auth.Operator, infraScaleDownHandler)))
+	http.HandleFunc("/api/infra/killall", audited(authorized(auth.Operator, killAllHandler)))
+	http.HandleFunc("/api/infra/nodestats", authorized(auth.Operator, nodeCountHandler))
+	http.HandleFunc("/api/infra/autoscaler", authorized(auth.Operator, autoscalerHandler))
+	http.HandleFunc("/api/infra/events", authorized(auth.Operator, nodeEventsHandler))
+	http.HandleFunc("/api/infra/register", internal(registerNodeHandler))
+	http.HandleFunc("/api/infra/members", authorized(auth.Operator, membersHandler))
+	http.HandleFunc("/api/watch", authorized(auth.Reader, limited(watchHandler)))
+	http.HandleFunc("/api/pubsub/publish", authorized(auth.Writer, limited(publishHandler)))
+	http.HandleFunc("/api/pubsub/subscribe", authorized(auth.Reader, limited(subscribeHandler)))
+	http.HandleFunc("/api/pubsub/channels", authorized(auth.Reader, limited(channelsHandler)))
+	http.HandleFunc("/api/locks", authorized(auth.Reader, limited(locksHandler)))
+	http.HandleFunc("/api/locks/acquire", authorized(auth.Writer, limited(acquireLockHandler)))
+	http.HandleFunc("/api/locks/renew", authorized(auth.Writer, limited(renewLockHandler)))
+	http.HandleFunc("/api/locks/release", authorized(auth.Writer, limited(releaseLockHandler)))
+	http.HandleFunc("/api/webhooks", audited(authorized(auth.Operator, webhooksHandler), http.MethodGet))
+	http.HandleFunc("/api/admin/webhooks/deadletters", audited(authorized(auth.Admin, webhookDeadLettersHandler), http.MethodGet))
+	http.HandleFunc("/api/admin/audit", authorized(auth.Admin, auditHandler))
+	http.HandleFunc("/api/admin/ratelimits", audited(authorized(auth.Admin, rateLimitsHandler), http.MethodGet))
+	http.HandleFunc("/api/admin/loglevel", audited(authorized(auth.Admin, logLevelHandler), http.MethodGet))
+	http.HandleFunc("/api/admin/antientropy", audited(authorized(auth.Admin, antiEntropyHandler), http.MethodGet))
+	http.HandleFunc("/api/admin/verify", audited(authorized(auth.Admin, verifyHandler), http.MethodGet))
+	if master.TLSEnabled() {
+		http.HandleFunc(pki.RenewalPath, internal(certificateHandler))
+		http.HandleFunc(pki.JoinPath, joinHandler)
+	}
+	registerHTTPMetrics(master.Metrics())
+	http.Handle("/metrics", master.Metrics().Handler())
+
+	if conf.Service.Master.RespPort > 0 {
+		go func() {
+			respAddr := fmt.Sprintf(":%d", conf.Service.Master.RespPort)
+			apiLog.Info("RESP pub/sub front-end listening", "port", conf.Service.Master.RespPort)
+			err := resp.NewServer(master.PubSub(), conf.Service.Master.RespMaxCommandKB*1024, authenticator).ListenAndServe(respAddr)
+			apiLog.Error("RESP pub/sub front-end stopped", "error", err)
+		}()
+	}
 
 	fs := http.FileServer(http.Dir("public"))
 
@@ -40,15 +132,93 @@ func main() {
 	http.Handle("/css/", fs)
 	http.Handle("/js/", fs)
 
+	handler := withRequestID(observed(http.DefaultServeMux))
+	// Nodes spawned now join over TLS, so it has to serve before
+	if master.TLSEnabled() {
+		go serveTLS(handler)
+	}
+	master.MakeAvailable()
+	if conf.Service.FailureDetector.Enabled {
+		engine.NewFailureDetector(master, conf).Start()
+	}
+	if autoscaler != nil {
+		autoscaler.Start()
+	}
+	if conf.Service.AntiEntropy.Enabled {
+		antiEntropy.Start()
+	}
+
 	addr := fmt.Sprintf(":%d", conf.Service.Master.Port)
-	fmt.Printf("Server running on port %d and server is ready !!!\n", conf.Service.Master.Port)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	apiLog.Info("server ready", "port", conf.Service.Master.Port)
+	err = http.ListenAndServe(addr, handler)
+	apiLog.Error("server stopped", "error", err)
+	os.Exit(1)
+}
+
+// instrumented counts data requests for the autoscaler and times the reads.
+func instrumented(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler(w, r)
+		master.RecordRequest(time.Since(start), r.Method == http.MethodGet)
+	}
+}
+
+func autoscalerHandler(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{"enabled": autoscaler != nil}
+	if autoscaler != nil {
+		response["dryRun"] = conf.Service.Autoscaler.DryRun
+		response["decisions"] = autoscaler.Decisions()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func nodeEventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(master.NodeEvents())
+}
+
+// antiEntropyHandler lists the latest anti-entropy runs, POST runs one now.
+func antiEntropyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": conf.Service.AntiEntropy.Enabled, "reports": antiEntropy.Reports()})
+	case http.MethodPost:
+		json.NewEncoder(w).Encode(antiEntropy.Run(r.Context()))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// verifyHandler compares every node with the master, diff=true lists the
+// keys that differ and resync=true, only on POST, has divergent nodes pull.
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	options := engine.VerifyOptions{Diff: query.Get("diff") == "true", Resync: query.Get("resync") == "true"}
+	if options.Resync && r.Method != http.MethodPost {
+		http.Error(w, "resync needs POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(master.Verify(r.Context(), options))
 }
 
 func killAllHandler(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
 	err := master.KillAllNodes()
 	if err != nil {
-		log.Println("Error killing all nodes: ", err)
+		apiLog.ErrorContext(request.Context(), "could not kill all nodes", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 
 		return
@@ -58,12 +228,18 @@ func killAllHandler(w http.ResponseWriter, request *http.Request) {
 }
 
 func replicateDataHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "replicate", tracing.Server)
+	defer span.End()
 	w.Header().Set("Content-Type", "application/json")
-	finalResponse, err := json.Marshal(master.GetReplicationData())
+	payload := master.GetReplicationData()
+	span.SetAttribute("cache.data_version", payload.DataVersion)
+	span.SetAttribute("cache.keys", len(payload.Data))
+	finalResponse, err := json.Marshal(payload)
 
-	log.Println("Replication API: Get replication data called")
+	apiLog.DebugContext(ctx, "replication data requested")
 
 	if err != nil {
+		span.SetError(err)
 		http.Error(w, "Failed to marshal map to JSON", http.StatusInternalServerError)
 		return
 	}
@@ -75,6 +251,31 @@ func replicateDataHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// replicateSnapshotHandler streams the data to a pulling node line by line,
+// gzipped when replication.compress_snapshots is on and the node accepts it.
+// Errors can only cut the stream short, which the node notices.
+func replicateSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "replicate", tracing.Server)
+	defer span.End()
+	w.Header().Set("Content-Type", replica.SnapshotContentType)
+	var out io.Writer = w
+	if conf.Service.Replication.CompressSnapshots && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		compressed := gzip.NewWriter(w)
+		defer compressed.Close()
+		out = compressed
+	}
+	header, err := master.WriteSnapshot(out)
+	span.SetAttribute("cache.data_version", header.DataVersion)
+	span.SetAttribute("cache.keys", header.Keys)
+	if err != nil {
+		span.SetError(err)
+		apiLog.WarnContext(ctx, "snapshot transfer failed", "error", err)
+		return
+	}
+	apiLog.DebugContext(ctx, "snapshot sent", "keys", header.Keys)
+}
+
 func nodeCountHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	finalResponse, err := json.Marshal(master.NodeStats())
@@ -96,8 +297,14 @@ func infraScaleDownHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	log.Println("Infra API: Scale DOWN called")
-	state := master.ScaleDown(conf)
+	apiLog.InfoContext(r.Context(), "scale down requested")
+	policy := conf.Service.Nodes.ScaleDownPolicy
+	if port := r.URL.Query().Get("port"); port != "" {
+		policy = "port:" + port
+	} else if requested := r.URL.Query().Get("policy"); requested != "" {
+		policy = requested
+	}
+	state := master.ScaleDownWith(conf, policy)
 	if state {
 		w.WriteHeader(http.StatusAccepted)
 	} else {
@@ -110,7 +317,7 @@ func infraScaleUpHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	log.Println("Infra API: Scale UP called")
+	apiLog.InfoContext(r.Context(), "scale up requested")
 	state := master.ScaleUp(conf)
 	if state {
 		w.WriteHeader(http.StatusAccepted)
@@ -119,9 +326,49 @@ func infraScaleUpHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// registerNodeHandler is called by every node when it starts and on every
+// heartbeat. A node that does not name its host is reached on the address it
+// called from.
+func registerNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var registration model.NodeRegistration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil || registration.Port <= 0 {
+		http.Error(w, "Invalid registration", http.StatusBadRequest)
+		return
+	}
+	if registration.Host == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "Unknown node address", http.StatusBadRequest)
+			return
+		}
+		registration.Host = host
+	}
+	if err := master.RegisterNode(registration); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func membersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(master.Members())
+}
+
 func getDataHandler(w http.ResponseWriter, request *http.Request) {
+	if key := request.URL.Query().Get("key"); key != "" {
+		if keysAllowed(w, request, key) {
+			getKeyHandler(w, request, key)
+		}
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	finalResponse, err := json.Marshal(master.GetData())
+	finalResponse, err := json.Marshal(principal(request).Filter(master.GetData()))
 
 	if err != nil {
 		http.Error(w, "Failed to marshal map to JSON", http.StatusInternalServerError)
@@ -135,13 +382,34 @@ func getDataHandler(w http.ResponseWriter, request *http.Request) {
 	}
 }
 
+// getKeyHandler answers a single key, filling a miss through a registered loader.
+func getKeyHandler(w http.ResponseWriter, request *http.Request, key string) {
+	value, found, err := master.GetKey(request.Context(), key)
+	if err != nil {
+		apiLog.WarnContext(request.Context(), "loader failed", "key", key, "error", err)
+		http.Error(w, "Failed to load key", http.StatusBadGateway)
+		return
+	}
+	if !found {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{key: value})
+}
+
 func setDataHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-
-	log.Println("Data API: Set called")
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "set", tracing.Server)
+	defer span.End()
+	ctx, ok := withWriteConcern(ctx, w, r)
+	if !ok {
+		return
+	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -157,13 +425,72 @@ func setDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println("Received data:", data)
+	var ttl time.Duration
+	if rawTTL := r.URL.Query().Get("ttl"); rawTTL != "" {
+		ttl, err = time.ParseDuration(rawTTL)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
 
-	master.SetData(data)
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	auditKeys(r, keys)
+	if !keysAllowed(w, r, keys...) {
+		return
+	}
+
+	span.SetAttribute("cache.keys", len(data))
+	apiLog.DebugContext(ctx, "set", "keys", len(data), "ttl", ttl)
+
+	// A client filling a miss from its own backend only sets missing keys
+	write := master.SetDataThrough
+	if r.URL.Query().Get("only_missing") == "true" {
+		write = master.FillData
+	}
+	if err := write(ctx, data, ttl); err != nil {
+		span.SetError(err)
+		writeFailed(ctx, w, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(master.GetData())
+	json.NewEncoder(w).Encode(principal(r).Filter(master.GetData()))
+}
+
+// withWriteConcern sets the write concern asked for with the write_concern
+// query parameter on ctx. Without one, writes are acknowledged once applied.
+func withWriteConcern(ctx context.Context, w http.ResponseWriter, r *http.Request) (context.Context, bool) {
+	concern, err := engine.ParseWriteConcern(r.URL.Query().Get("write_concern"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ctx, false
+	}
+	return engine.WithWriteConcern(ctx, concern), true
+}
+
+func writeFailed(ctx context.Context, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, engine.ErrNotReplicated):
+		apiLog.WarnContext(ctx, "write not replicated", "error", err)
+		http.Error(w, "Written on the master, not replicated: "+err.Error(), http.StatusBadGateway)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		apiLog.InfoContext(ctx, "gave up waiting for replication", "error", err)
+		http.Error(w, "Written on the master, gave up waiting for replication", http.StatusGatewayTimeout)
+	default:
+		apiLog.WarnContext(ctx, "write-through failed", "error", err)
+		http.Error(w, "Write-through failed", http.StatusBadGateway)
+	}
+}
+
+func loadersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(master.LoaderPrefixes())
 }
 
 func deleteDataHandler(w http.ResponseWriter, r *http.Request) {
@@ -171,7 +498,12 @@ func deleteDataHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	log.Println("Data API: Delete called")
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "delete", tracing.Server)
+	defer span.End()
+	ctx, ok := withWriteConcern(ctx, w, r)
+	if !ok {
+		return
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Unable to read body", http.StatusBadRequest)
@@ -186,13 +518,23 @@ func deleteDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println("Received data:", data)
+	auditKeys(r, data)
+	if !keysAllowed(w, r, data...) {
+		return
+	}
+
+	span.SetAttribute("cache.keys", len(data))
+	apiLog.DebugContext(ctx, "delete", "keys", data)
 
-	master.DeleteData(data)
+	if err := master.DeleteDataThrough(ctx, data); err != nil {
+		span.SetError(err)
+		writeFailed(ctx, w, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(master.GetData())
+	json.NewEncoder(w).Encode(principal(r).Filter(master.GetData()))
 }
 
 //TIP See GoLand help at <a href="https://www.jetbrains.com/help/go/">jetbrains.com/help/go/</a>.
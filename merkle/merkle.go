@@ -0,0 +1,166 @@
+// Package merkle hashes a key/value map into a binary tree over key ranges.
+// Two copies of a map are compared by their root hashes, and when those
+// differ, by the hashes of the ranges, so only the ranges that differ need
+// to be sent. Nodes hash their copy with this package too.
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"slices"
+)
+
+const (
+	// DefaultDepth splits the keys into 256 ranges.
+	DefaultDepth = 8
+	MaxDepth     = 16
+)
+
+// Range is the range key falls into at depth, the top depth bits of the
+// key's sha256.
+func Range(key string, depth int) int {
+	if depth <= 0 {
+		return 0
+	}
+	sum := sha256.Sum256([]byte(key))
+	return int(binary.BigEndian.Uint32(sum[:4]) >> (32 - depth))
+}
+
+// Tree holds the hashes of every level, level 0 is the root and level
+// Depth has one hash per range.
+type Tree struct {
+	levels [][][sha256.Size]byte
+}
+
+// Build hashes data into a tree of 2^depth ranges. A range hashes its keys
+// and values in key order, an empty range hashes nothing.
+func Build(data map[string]string, depth int) *Tree {
+	depth = min(max(depth, 0), MaxDepth)
+	ranges := make([][]string, 1<<depth)
+	for key := range data {
+		index := Range(key, depth)
+		ranges[index] = append(ranges[index], key)
+	}
+
+	leaves := make([][sha256.Size]byte, len(ranges))
+	var length [4]byte
+	for index, keys := range ranges {
+		slices.Sort(keys)
+		hash := sha256.New()
+		for _, key := range keys {
+			binary.BigEndian.PutUint32(length[:], uint32(len(key)))
+			hash.Write(length[:])
+			hash.Write([]byte(key))
+			value := data[key]
+			binary.BigEndian.PutUint32(length[:], uint32(len(value)))
+			hash.Write(length[:])
+			hash.Write([]byte(value))
+		}
+		hash.Sum(leaves[index][:0])
+	}
+
+	return fromLeaves(leaves, depth)
+}
+
+// fromLeaves hashes the levels above the 2^depth range hashes.
+func fromLeaves(leaves [][sha256.Size]byte, depth int) *Tree {
+	levels := make([][][sha256.Size]byte, depth+1)
+	levels[depth] = leaves
+	for level := depth - 1; level >= 0; level-- {
+		below := levels[level+1]
+		hashes := make([][sha256.Size]byte, len(below)/2)
+		for index := range hashes {
+			hashes[index] = sha256.Sum256(append(below[2*index][:], below[2*index+1][:]...))
+		}
+		levels[level] = hashes
+	}
+	return &Tree{levels: levels}
+}
+
+func (tree *Tree) Depth() int {
+	return len(tree.levels) - 1
+}
+
+func (tree *Tree) Root() string {
+	return hex.EncodeToString(tree.levels[0][0][:])
+}
+
+// Level returns the hashes of a level in hex, nil for a level the tree does
+// not have.
+func (tree *Tree) Level(level int) []string {
+	if level < 0 || level > tree.Depth() {
+		return nil
+	}
+	hashes := make([]string, len(tree.levels[level]))
+	for index, hash := range tree.levels[level] {
+		hashes[index] = hex.EncodeToString(hash[:])
+	}
+	return hashes
+}
+
+// Diff returns the ranges whose hashes differ between this tree and the
+// ranges of another copy, e.g. the leaf level a node sent. Walking down from
+// the root skips the subtrees that match.
+func (tree *Tree) Diff(other []string) []int {
+	if len(other) != len(tree.levels[tree.Depth()]) {
+		return nil
+	}
+	leaves := make([][sha256.Size]byte, len(other))
+	for index, encoded := range other {
+		// A hash that does not decode stays zero and differs
+		hex.Decode(leaves[index][:], []byte(encoded))
+	}
+	theirs := fromLeaves(leaves, tree.Depth())
+
+	var differing []int
+	var walk func(level, index int)
+	walk = func(level, index int) {
+		if tree.levels[level][index] == theirs.levels[level][index] {
+			return
+		}
+		if level == tree.Depth() {
+			differing = append(differing, index)
+			return
+		}
+		walk(level+1, 2*index)
+		walk(level+1, 2*index+1)
+	}
+	walk(0, 0)
+	return differing
+}
+
+// Keys returns the entries of data that fall into the given ranges.
+func Keys(data map[string]string, ranges []int, depth int) map[string]string {
+	wanted := make(map[int]bool, len(ranges))
+	for _, index := range ranges {
+		wanted[index] = true
+	}
+	keys := make(map[string]string)
+	for key, value := range data {
+		if wanted[Range(key, depth)] {
+			keys[key] = value
+		}
+	}
+	return keys
+}
+
+// Repair returns a copy of data whose keys in the given ranges are replaced
+// with the entries of replacement. Data itself is left alone, readers may
+// still hold it.
+func Repair(data map[string]string, ranges []int, depth int, replacement map[string]string) map[string]string {
+	wanted := make(map[int]bool, len(ranges))
+	for _, index := range ranges {
+		wanted[index] = true
+	}
+	repaired := make(map[string]string, len(data))
+	for key, value := range data {
+		if !wanted[Range(key, depth)] {
+			repaired[key] = value
+		}
+	}
+	for key, value := range replacement {
+		repaired[key] = value
+	}
+	return repaired
+}
@@ -0,0 +1,59 @@
+package merkle
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// Nodes hash their copy with this package as well.
+const knownRoot = "98b4e1b93af1a31fb9be0ea15c4ba6cc1a3528b4493e074aa46c1ca85ff01d1d"
+
+func TestBuildIsStable(t *testing.T) {
+	tree := Build(map[string]string{"a": "1", "b": "2", "user:42": "x"}, 4)
+	if tree.Root() != knownRoot {
+		t.Errorf("root changed to %s, nodes would all look different", tree.Root())
+	}
+	if len(tree.Level(0)) != 1 || len(tree.Level(4)) != 16 || tree.Level(5) != nil {
+		t.Error("unexpected level sizes")
+	}
+	// A value moving from one key to another changes the hash
+	if Build(map[string]string{"ab": ""}, 0).Root() == Build(map[string]string{"a": "b"}, 0).Root() {
+		t.Error("keys and values should be kept apart")
+	}
+}
+
+func TestDiffFindsOnlyChangedRanges(t *testing.T) {
+	data := make(map[string]string)
+	for i := range 1000 {
+		data[fmt.Sprintf("key-%d", i)] = fmt.Sprint(i)
+	}
+	copied := make(map[string]string)
+	for key, value := range data {
+		copied[key] = value
+	}
+	copied["key-7"] = "changed"
+	delete(copied, "key-500")
+	copied["extra"] = "x"
+
+	ours := Build(data, DefaultDepth)
+	theirs := Build(copied, DefaultDepth)
+	if ours.Root() == theirs.Root() {
+		t.Fatal("roots should differ")
+	}
+	differing := ours.Diff(theirs.Level(DefaultDepth))
+	want := []int{Range("key-7", DefaultDepth), Range("key-500", DefaultDepth), Range("extra", DefaultDepth)}
+	slices.Sort(want)
+	want = slices.Compact(want)
+	if !slices.Equal(differing, want) {
+		t.Fatalf("expected ranges %v to differ, got %v", want, differing)
+	}
+
+	repaired := Repair(copied, differing, DefaultDepth, Keys(data, differing, DefaultDepth))
+	if Build(repaired, DefaultDepth).Root() != ours.Root() {
+		t.Error("repairing the differing ranges should make the copies equal")
+	}
+	if copied["key-7"] != "changed" {
+		t.Error("repair should not change the map it was given")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"distributed-inmemory-cache/metrics"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequests *metrics.Counter
+	httpDuration *metrics.Histogram
+)
+
+func registerHTTPMetrics(registry *metrics.Registry) {
+	httpRequests = registry.NewCounter("cache_http_requests_total", "HTTP requests by endpoint, method and status code.", "endpoint", "method", "code")
+	httpDuration = registry.NewHistogram("cache_http_request_duration_seconds", "HTTP request latency by endpoint.", metrics.DefaultBuckets, "endpoint")
+}
+
+// observed counts and times every request. The endpoint is the pattern the
+// mux routes the request to and unknown methods are "other", so neither
+// unknown paths nor methods add series.
+func observed(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, endpoint := mux.Handler(r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		mux.ServeHTTP(recorder, r)
+		httpRequests.Inc(endpoint, metrics.MethodLabel(r.Method), strconv.Itoa(recorder.status))
+		httpDuration.Observe(time.Since(start).Seconds(), endpoint)
+	})
+}
+
+// statusRecorder remembers the status code and keeps streaming and websocket
+// upgrades working for the wrapped handlers.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if !recorder.wroteHeader {
+		recorder.status = status
+		recorder.wroteHeader = true
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (recorder *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := recorder.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	recorder.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
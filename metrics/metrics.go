@@ -0,0 +1,302 @@
+// Package metrics is a small Prometheus client: counters, gauges and
+// histograms with labels, written in the text exposition format. Every
+// metric method is safe on a nil metric, so code can record unconditionally.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are latency buckets in seconds, from 500µs to 10s.
+var DefaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MethodLabel returns method as a label value. Any method but the standard
+// ones is "other", a client inventing methods would add a series each.
+func MethodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// Sample is one value of a metric collected at scrape time.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (registry *Registry) register(c collector) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.collectors = append(registry.collectors, c)
+}
+
+func (registry *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	counter := &Counter{family: newFamily(name, help, "counter", labels)}
+	registry.register(counter)
+	return counter
+}
+
+func (registry *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	gauge := &Gauge{family: newFamily(name, help, "gauge", labels)}
+	registry.register(gauge)
+	return gauge
+}
+
+func (registry *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := &Histogram{
+		family:  newFamily(name, help, "histogram", labels),
+		buckets: append([]float64{}, buckets...),
+		series:  make(map[string]*histogramSeries),
+	}
+	sort.Float64s(histogram.buckets)
+	registry.register(histogram)
+	return histogram
+}
+
+// NewGaugeFunc reports the samples collect returns on every scrape, for
+// values that are cheaper to read than to keep up to date.
+func (registry *Registry) NewGaugeFunc(name string, help string, collect func() []Sample, labels ...string) {
+	registry.register(&gaugeFunc{family: newFamily(name, help, "gauge", labels), collect: collect})
+}
+
+func (registry *Registry) Write(w io.Writer) {
+	registry.mu.Lock()
+	collectors := append([]collector{}, registry.collectors...)
+	registry.mu.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+func (registry *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registry.Write(w)
+	})
+}
+
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func newFamily(name string, help string, kind string, labels []string) family {
+	return family{name: name, help: help, kind: kind, labels: labels}
+}
+
+func (f family) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, strings.ReplaceAll(f.help, "\n", " "), f.name, f.kind)
+}
+
+// labelString renders {a="x",b="y"}, with extra appended after the family's labels.
+func (f family) labelString(values []string, extra ...string) string {
+	if len(f.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var parts []string
+	for i, label := range f.labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		parts = append(parts, label+`="`+escape(value)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+escape(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// scalarSeries holds the values of a counter or gauge by label values.
+type scalarSeries struct {
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+}
+
+func (series *scalarSeries) add(delta float64, values []string, set bool) {
+	series.mu.Lock()
+	defer series.mu.Unlock()
+	if series.values == nil {
+		series.values = make(map[string]float64)
+		series.labels = make(map[string][]string)
+	}
+	key := seriesKey(values)
+	if set {
+		series.values[key] = delta
+	} else {
+		series.values[key] += delta
+	}
+	if _, ok := series.labels[key]; !ok {
+		series.labels[key] = append([]string{}, values...)
+	}
+}
+
+func (series *scalarSeries) write(w io.Writer, f family) {
+	series.mu.Lock()
+	defer series.mu.Unlock()
+	f.header(w)
+	keys := make([]string, 0, len(series.values))
+	for key := range series.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelString(series.labels[key]), formatValue(series.values[key]))
+	}
+}
+
+type Counter struct {
+	family
+	series scalarSeries
+}
+
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+func (counter *Counter) Add(delta float64, labelValues ...string) {
+	if counter == nil || delta < 0 {
+		return
+	}
+	counter.series.add(delta, labelValues, false)
+}
+
+func (counter *Counter) write(w io.Writer) {
+	counter.series.write(w, counter.family)
+}
+
+type Gauge struct {
+	family
+	series scalarSeries
+}
+
+func (gauge *Gauge) Set(value float64, labelValues ...string) {
+	if gauge == nil {
+		return
+	}
+	gauge.series.add(value, labelValues, true)
+}
+
+func (gauge *Gauge) Add(delta float64, labelValues ...string) {
+	if gauge == nil {
+		return
+	}
+	gauge.series.add(delta, labelValues, false)
+}
+
+func (gauge *Gauge) write(w io.Writer) {
+	gauge.series.write(w, gauge.family)
+}
+
+type gaugeFunc struct {
+	family
+	collect func() []Sample
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	g.header(w)
+	for _, sample := range g.collect() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(sample.LabelValues), formatValue(sample.Value))
+	}
+}
+
+type Histogram struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	if histogram == nil {
+		return
+	}
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	key := seriesKey(labelValues)
+	series, ok := histogram.series[key]
+	if !ok {
+		series = &histogramSeries{labels: append([]string{}, labelValues...), counts: make([]uint64, len(histogram.buckets))}
+		histogram.series[key] = series
+	}
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (histogram *Histogram) write(w io.Writer) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	histogram.header(w)
+	keys := make([]string, 0, len(histogram.series))
+	for key := range histogram.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := histogram.series[key]
+		for i, bound := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, histogram.labelString(series.labels, "le", formatValue(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, histogram.labelString(series.labels, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, histogram.labelString(series.labels), formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, histogram.labelString(series.labels), series.count)
+	}
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounter("requests_total", "Requests.", "endpoint", "code")
+	latency := registry.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "endpoint")
+	keys := registry.NewGauge("keys", "Keys.")
+	registry.NewGaugeFunc("node_up", "Up.", func() []Sample {
+		return []Sample{{LabelValues: []string{`a"b`}, Value: 1}}
+	}, "node")
+
+	requests.Inc("/get", "200")
+	requests.Add(2, "/get", "200")
+	requests.Inc("/set", "500")
+	latency.Observe(0.05, "/get")
+	latency.Observe(0.5, "/get")
+	keys.Set(7)
+
+	var nilCounter *Counter
+	nilCounter.Inc()
+
+	var out strings.Builder
+	registry.Write(&out)
+	for _, line := range []string{
+		"# TYPE requests_total counter",
+		`requests_total{endpoint="/get",code="200"} 3`,
+		`requests_total{endpoint="/set",code="500"} 1`,
+		`latency_seconds_bucket{endpoint="/get",le="0.1"} 1`,
+		`latency_seconds_bucket{endpoint="/get",le="1"} 2`,
+		`latency_seconds_bucket{endpoint="/get",le="+Inf"} 2`,
+		`latency_seconds_sum{endpoint="/get"} 0.55`,
+		`latency_seconds_count{endpoint="/get"} 2`,
+		"keys 7",
+		`node_up{node="a\"b"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	for method, label := range map[string]string{"GET": "GET", "DELETE": "DELETE", "PROPFIND": "other", "get": "other", "": "other"} {
+		if got := MethodLabel(method); got != label {
+			t.Errorf("expected %q for method %q, got %q", label, method, got)
+		}
+	}
+}
@@ -1,8 +1,145 @@
 package model
 
 type DataPayload struct {
-	DataVersion  int64             `json:"data_version"`
-	Data         map[string]string `json:"data"`
-	PID          int               `json:"pid"`
-	RunningSince int64             `json:"running_since"`
+	DataVersion  int64              `json:"data_version"`
+	Data         map[string]string  `json:"data"`
+	PID          int                `json:"pid"`
+	RunningSince int64              `json:"running_since"`
+	Locks        *LockState         `json:"locks,omitempty"`
+	Webhooks     map[string]Webhook `json:"webhooks,omitempty"`
+}
+
+type Lock struct {
+	Name      string `json:"name"`
+	Owner     string `json:"owner"`
+	Token     int64  `json:"token"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// LockState is replicated to the nodes together with the data so that held
+// locks and the fencing counter survive a master restart.
+type LockState struct {
+	Fence int64           `json:"fence"`
+	Held  map[string]Lock `json:"held"`
+}
+
+// Webhook is a subscription for change events on keys starting with Prefix.
+// Deliveries are signed with Secret. Paused is only set in listings, for a
+// webhook recovered without its secret.
+type Webhook struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Prefix    string `json:"prefix"`
+	Secret    string `json:"secret,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	Paused    bool   `json:"paused,omitempty"`
+}
+
+// NodeStats is the load a node reports on its /stats endpoint.
+type NodeStats struct {
+	Keys           int    `json:"keys"`
+	HeapAllocBytes uint64 `json:"heap_alloc_bytes"`
+	SysBytes       uint64 `json:"sys_bytes"`
+	Requests       int64  `json:"requests"`
+	InFlight       int64  `json:"in_flight"`
+}
+
+// SpawnRequest asks a node agent to start a node process.
+type SpawnRequest struct {
+	MasterAddress string            `json:"master_address"`
+	Port          int               `json:"port"`
+	Env           map[string]string `json:"env,omitempty"`
+}
+
+// ProcessInfo describes a node process started by a node agent.
+type ProcessInfo struct {
+	Port      int    `json:"port"`
+	PID       int    `json:"pid"`
+	StartedAt int64  `json:"started_at"`
+	Running   bool   `json:"running"`
+	ExitError string `json:"exit_error,omitempty"`
+}
+
+// NodeRegistration is what a node tells the master about itself on startup,
+// and what the master keeps in its membership file.
+type NodeRegistration struct {
+	ID           string `json:"id"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	PID          int    `json:"pid"`
+	StartedAt    int64  `json:"started_at"`
+	ClusterID    string `json:"cluster_id,omitempty"`
+	RegisteredAt int64  `json:"registered_at"`
+}
+
+// ReplicationFrame is what the master pushes to a node in push mode. A
+// snapshot replaces the node's data, other frames apply Changes in order on
+// top of BaseVersion.
+type ReplicationFrame struct {
+	Seq         int64              `json:"seq"`
+	BaseVersion int64              `json:"base_version"`
+	DataVersion int64              `json:"data_version"`
+	Snapshot    bool               `json:"snapshot,omitempty"`
+	Data        map[string]string  `json:"data,omitempty"`
+	Changes     []Change           `json:"changes,omitempty"`
+	Locks       *LockState         `json:"locks,omitempty"`
+	Webhooks    map[string]Webhook `json:"webhooks,omitempty"`
+	Traceparent string             `json:"traceparent,omitempty"`
+}
+
+type Change struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// ReplicationAck answers a frame with the version the node holds. Pulled is
+// set when the node did not hold the frame's base version and pulled the
+// full data instead.
+type ReplicationAck struct {
+	Seq         int64  `json:"seq"`
+	DataVersion int64  `json:"data_version"`
+	Pulled      bool   `json:"pulled,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// MerkleLevel is one level of the Merkle tree over a node's data, level 0
+// is the root and level Depth has one hash per key range.
+type MerkleLevel struct {
+	DataVersion int64    `json:"data_version"`
+	Depth       int      `json:"depth"`
+	Level       int      `json:"level"`
+	Hashes      []string `json:"hashes"`
+}
+
+// MerkleRanges asks a node for its keys in Ranges of the tree at Depth.
+type MerkleRanges struct {
+	Depth  int   `json:"depth"`
+	Ranges []int `json:"ranges"`
+}
+
+// MerkleRepair replaces a node's keys in Ranges with Data, provided the
+// node still holds DataVersion.
+type MerkleRepair struct {
+	DataVersion int64             `json:"data_version"`
+	Depth       int               `json:"depth"`
+	Ranges      []int             `json:"ranges"`
+	Data        map[string]string `json:"data"`
+}
+
+// SnapshotHeader opens a streamed snapshot of the master's data. One
+// SnapshotRecord per key follows, each on its own line.
+type SnapshotHeader struct {
+	DataVersion int64              `json:"data_version"`
+	Keys        int                `json:"keys"`
+	Locks       *LockState         `json:"locks,omitempty"`
+	Webhooks    map[string]Webhook `json:"webhooks,omitempty"`
+}
+
+// SnapshotRecord is one key of a streamed snapshot. The last record has End
+// set and no key, a stream without it was cut off.
+type SnapshotRecord struct {
+	Key   string `json:"k,omitempty"`
+	Value string `json:"v,omitempty"`
+	End   bool   `json:"end,omitempty"`
 }
@@ -1,3 +1,7 @@
 module distribute-node
 
 go 1.23.0
+
+require distributed-inmemory-cache v0.0.0
+
+replace distributed-inmemory-cache => ../
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	maxLogSize      = 10 * 1024 * 1024
+	maxLogFiles     = 5
+)
+
+var (
+	logLevel = new(slog.LevelVar)
+	logger   = slog.New(requestIDHandler{slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})}).With("component", "node")
+)
+
+// setupLogging logs to node-<port>.log in the directory the master passes
+// on, in its format and at its level, and to standard output without one.
+func setupLogging(port int) error {
+	if err := setLogLevel(os.Getenv("CACHE_LOG_LEVEL")); err != nil {
+		return err
+	}
+
+	var output io.Writer = os.Stdout
+	if dir := os.Getenv("CACHE_LOG_DIR"); dir != "" {
+		file, err := newRotatingFile(filepath.Join(dir, fmt.Sprintf("node-%d.log", port)))
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format := os.Getenv("CACHE_LOG_FORMAT"); format {
+	case "json":
+		handler = slog.NewJSONHandler(output, options)
+	case "logfmt", "":
+		handler = slog.NewTextHandler(output, options)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	logger = slog.New(requestIDHandler{handler}).With("component", "node", "port", port)
+	log.SetOutput(output)
+	return nil
+}
+
+func setLogLevel(name string) error {
+	if name == "" {
+		name = "info"
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		if err := setLogLevel(r.URL.Query().Get("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.InfoContext(r.Context(), "log level changed", "level", strings.ToLower(logLevel.Level().String()))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": strings.ToLower(logLevel.Level().String())})
+}
+
+type requestIDKey struct{}
+
+// withRequestID keeps the request id the master or a client sent, so the
+// node's records can be matched with theirs.
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get(requestIDHeader); id != "" {
+			w.Header().Set(requestIDHeader, id)
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// rotatingFile renames the log to .1, .2 and so on once it reaches
+// maxLogSize, keeping maxLogFiles of them.
+type rotatingFile struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	rotating := &rotatingFile{path: path}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+func (rotating *rotatingFile) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+func (rotating *rotatingFile) Write(p []byte) (int, error) {
+	rotating.mu.Lock()
+	defer rotating.mu.Unlock()
+	if rotating.size > 0 && rotating.size+int64(len(p)) > maxLogSize {
+		rotating.file.Close()
+		for i := maxLogFiles - 1; i >= 1; i-- {
+			from := rotating.path
+			if i > 1 {
+				from = rotating.path + "." + strconv.Itoa(i-1)
+			}
+			os.Rename(from, rotating.path+"."+strconv.Itoa(i))
+		}
+		if err := rotating.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rotating.file.Write(p)
+	rotating.size += int64(n)
+	return n, err
+}
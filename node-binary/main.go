@@ -2,32 +2,22 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"distributed-inmemory-cache/replica"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var node *Node
 
-func nodeDataHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	finalResponse, err := json.Marshal(DataPayload{DataVersion: node.DataVersion, Data: node.Data, PID: node.PID, RunningSince: node.RunningSince})
-
-	if err != nil {
-		http.Error(w, "Failed to marshal map to JSON", http.StatusInternalServerError)
-		return
-	}
-
-	_, err = w.Write(finalResponse)
-	if err != nil {
-		return
-	}
-}
+const shutdownTimeout = 30 * time.Second
 
 func broadcastHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -36,37 +26,24 @@ func broadcastHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/replicate/data", node.MasterPort))
-	if err != nil {
-		http.Error(w, "Failed to consume master API", http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "Failed to read response", http.StatusInternalServerError)
+	ctx, span := startSpan(extractTrace(r), "notify", spanServer)
+	defer span.finish()
+	span.attributes["cache.node_port"] = node.NodePort
+	if err := node.pull(ctx); err != nil {
+		span.setError(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	var result DataPayload
-	if err := json.Unmarshal(body, &result); err != nil {
-		http.Error(w, "Failed to unmarshal response", http.StatusInternalServerError)
-		return
-	}
-
-	node.Data = result.Data
-	node.DataVersion = result.DataVersion
 }
 
 func main() {
 	if len(os.Args) < 2 {
-		log.Fatal("Usage: go run main.go <master-port> <node-port>")
+		log.Fatal("Usage: go run main.go <[master-host:]master-port[,...]> <node-port>")
 	}
 
-	masterServicePort, err := strconv.Atoi(os.Args[1])
+	masters, err := parseMasterAddresses(os.Args[1])
 	if err != nil {
-		log.Fatalf("Invalid master port number: %v", err)
+		log.Fatalf("Invalid master address: %v", err)
 	}
 
 	nodePort, err := strconv.Atoi(os.Args[2])
@@ -74,21 +51,57 @@ func main() {
 		log.Fatalf("Invalid node port number: %v", err)
 	}
 
+	if err := setupLogging(nodePort); err != nil {
+		log.Fatalf("Could not set up logging: %v", err)
+	}
+	if err := setupTracing(nodePort); err != nil {
+		log.Fatalf("Could not set up tracing: %v", err)
+	}
+	if err := setupTLS(masters); err != nil {
+		log.Fatalf("Could not set up TLS: %v", err)
+	}
+	setupInternalKey()
+
 	shutdownChan := make(chan bool, 1)
 
 	pid := os.Getpid()
 
-	node = NewNode(nodePort, masterServicePort, shutdownChan, pid)
+	node = NewNode(nodePort, masters, shutdownChan, pid)
+	// Host the master should reach this node on, the calling address otherwise
+	node.AdvertiseHost = os.Getenv("CACHE_NODE_HOST")
+	node.ClusterID = os.Getenv("CACHE_CLUSTER_ID")
+
+	// Node agents stop their nodes with SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		shutdownChan <- true
+	}()
 
 	srv := &http.Server{
-		Addr: fmt.Sprintf(":%d", nodePort),
+		Addr:    fmt.Sprintf(":%d", nodePort),
+		Handler: withRequestID(node.countRequests(http.DefaultServeMux)),
+	}
+	if identity != nil {
+		srv.TLSConfig = identity.ServerConfig()
 	}
 
-	http.HandleFunc("/data", nodeDataHandler)
-	http.HandleFunc("/dataVersion", nodeDataVersionHandler)
-	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/notify", broadcastHandler)
-	http.HandleFunc("/kill", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/data", requireMaster(node.Requests.Serving(node.Store.DataHandler)))
+	http.HandleFunc("/dataVersion", requireMaster(node.Store.DataVersionHandler))
+	http.HandleFunc("/health", node.Requests.HealthHandler)
+	http.HandleFunc("/stats", replica.StatsHandler(node.Store, &node.Requests))
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/drain", requireMaster(node.Requests.DrainHandler))
+	http.HandleFunc("/loglevel", requireMaster(logLevelHandler))
+	http.HandleFunc("/notify", requireMaster(broadcastHandler))
+	http.HandleFunc("/replicate/stream", requireMaster(streamHandler))
+	http.HandleFunc("/merkle", requireMaster(node.Store.MerkleHandler))
+	http.HandleFunc("/merkle/keys", requireMaster(node.Store.MerkleKeysHandler))
+	http.HandleFunc("/merkle/repair", requireMaster(node.Store.RepairHandler))
+	http.HandleFunc("/pubsub/publish", node.Requests.Serving(pubSubRelayHandler("/api/pubsub/publish")))
+	http.HandleFunc("/pubsub/subscribe", node.Requests.Serving(pubSubRelayHandler("/api/pubsub/subscribe")))
+	http.HandleFunc("/kill", requireMaster(func(w http.ResponseWriter, r *http.Request) {
 
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -98,35 +111,71 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Shutting down node..."))
 		shutdownChan <- true
-	})
+	}))
 
 	go func() {
-		fmt.Printf("Node running on port %d\n", nodePort)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Could not listen on port %d: %v\n", nodePort, err)
+		logger.Info("node running", "masters", strings.Join(masters, ","), "pid", pid)
+		var err error
+		if identity != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("could not listen", "error", err)
+			os.Exit(1)
 		}
 	}()
+	go node.heartbeatLoop()
+	if identity != nil {
+		go node.renewLoop()
+	}
 
 	<-shutdownChan
+	node.stopping.Store(true)
+	close(stopping)
 
-	fmt.Println("Shutting down server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	logger.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		logger.Error("server forced to shut down", "error", err)
+		os.Exit(1)
 	}
-	fmt.Println("Server exited cleanly")
+	logger.Info("exited cleanly")
 
 }
 
-func nodeDataVersionHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "text/plain")
-	writer.WriteHeader(http.StatusOK)
-	writer.Write([]byte(fmt.Sprintf("%d", node.DataVersion)))
+// parseMasterAddresses accepts a comma separated list of masters, each
+// either a port, for a master on this host, or a host:port.
+func parseMasterAddresses(list string) ([]string, error) {
+	var masters []string
+	for _, address := range strings.Split(list, ",") {
+		host, port, err := parseMasterAddress(strings.TrimSpace(address))
+		if err != nil {
+			return nil, err
+		}
+		masters = append(masters, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return masters, nil
 }
 
-func healthHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "text/plain")
-	writer.WriteHeader(http.StatusOK)
-	writer.Write([]byte("OK"))
+func parseMasterAddress(address string) (string, int, error) {
+	host := "localhost"
+	portText := address
+	if strings.Contains(address, ":") {
+		var err error
+		host, portText, err = net.SplitHostPort(address)
+		if err != nil {
+			return "", 0, err
+		}
+		if host == "" {
+			host = "localhost"
+		}
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"distributed-inmemory-cache/metrics"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are in seconds, the same as the master's.
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// versionLogicalBits of a data version count writes within a millisecond,
+// the rest is the master's clock in milliseconds, as on the master.
+const versionLogicalBits = 16
+
+// Metrics holds what the node reports on /metrics in the Prometheus text
+// format. The node has no dependencies, so this is the few lines it needs.
+type Metrics struct {
+	mu           sync.Mutex
+	requests     map[[3]string]int64
+	latencies    map[string]*histogram
+	pullDuration histogram
+	pullFailures int64
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	separator := ""
+	if labels != "" {
+		separator = ","
+	}
+	for i, bound := range latencyBuckets {
+		count := uint64(0)
+		if h.counts != nil {
+			count = h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, separator, strconv.FormatFloat(bound, 'g', -1, 64), count)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, separator, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{requests: make(map[[3]string]int64), latencies: make(map[string]*histogram)}
+}
+
+func (m *Metrics) observeRequest(endpoint string, method string, code int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[3]string{endpoint, metrics.MethodLabel(method), strconv.Itoa(code)}]++
+	latency, ok := m.latencies[endpoint]
+	if !ok {
+		latency = &histogram{}
+		m.latencies[endpoint] = latency
+	}
+	latency.observe(duration.Seconds())
+}
+
+func (m *Metrics) observePull(duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.pullFailures++
+		return
+	}
+	m.pullDuration.observe(duration.Seconds())
+}
+
+func gauge(w io.Writer, name string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := node.metrics
+
+	count, size := node.Store.Size()
+	version := node.Store.Version()
+	gauge(w, "cache_node_keys", "Keys held by the node.", float64(count))
+	gauge(w, "cache_node_bytes", "Bytes of all keys and values held by the node.", float64(size))
+	gauge(w, "cache_node_data_version_time_ms", "Wall clock part of the node's data version, in milliseconds since the epoch.", float64(version>>versionLogicalBits))
+	gauge(w, "cache_node_data_version_counter", "Logical part of the node's data version.", float64(version&(1<<versionLogicalBits-1)))
+	gauge(w, "cache_node_in_flight_requests", "Requests being served.", float64(node.Requests.InFlight()))
+	gauge(w, "cache_node_draining", "1 while the node is draining.", boolValue(node.Requests.Draining()))
+	gauge(w, "cache_node_master_connected", "1 while the node is registered with a master.", boolValue(node.connected.Load()))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprint(w, "# HELP cache_node_http_requests_total HTTP requests by endpoint, method and status code.\n# TYPE cache_node_http_requests_total counter\n")
+	keys := make([][3]string, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0]+keys[i][1]+keys[i][2] < keys[j][0]+keys[j][1]+keys[j][2]
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "cache_node_http_requests_total{endpoint=%q,method=%q,code=%q} %d\n", key[0], key[1], key[2], m.requests[key])
+	}
+
+	fmt.Fprint(w, "# HELP cache_node_http_request_duration_seconds HTTP request latency by endpoint.\n# TYPE cache_node_http_request_duration_seconds histogram\n")
+	endpoints := make([]string, 0, len(m.latencies))
+	for endpoint := range m.latencies {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		m.latencies[endpoint].write(w, "cache_node_http_request_duration_seconds", fmt.Sprintf("endpoint=%q", endpoint))
+	}
+
+	fmt.Fprint(w, "# HELP cache_node_pull_duration_seconds Time to pull a full copy from the master.\n# TYPE cache_node_pull_duration_seconds histogram\n")
+	m.pullDuration.write(w, "cache_node_pull_duration_seconds", "")
+	fmt.Fprintf(w, "# HELP cache_node_pull_failures_total Pulls from the master that failed.\n# TYPE cache_node_pull_failures_total counter\ncache_node_pull_failures_total %d\n", m.pullFailures)
+}
+
+// statusRecorder remembers the status code for the request metrics. Relayed
+// subscriptions stream, so it passes flushes through.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets the replication stream enable full duplex on the connection.
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
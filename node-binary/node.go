@@ -1,31 +1,106 @@
 package main
 
-import "time"
-
-type DataPayload struct {
-	DataVersion  int64             `json:"data_version"`
-	Data         map[string]string `json:"data"`
-	PID          int               `json:"pid"`
-	RunningSince int64             `json:"running_since"`
-}
+import (
+	"context"
+	"distributed-inmemory-cache/model"
+	"distributed-inmemory-cache/replica"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
 
 type Node struct {
-	Data            map[string]string
-	DataVersion     int64
-	NodePort        int
-	MasterPort      int
+	ID            string
+	AdvertiseHost string
+	NodePort      int
+	ClusterID     string
+	// Masters are the host:port addresses of the masters this node may
+	// register with, the one in use is at masterIndex
+	Masters         []string
 	ShutdownChannel chan bool
 	PID             int
 	RunningSince    int64
+	// Store holds the data, its version and the master's locks and webhooks
+	Store       *replica.Store
+	Requests    replica.Requests
+	masterIndex atomic.Int64
+	connected   atomic.Bool
+	stopping    atomic.Bool
+	metrics     *Metrics
 }
 
-func NewNode(nodePort int, masterPort int, shutdownChannel chan bool, pid int) *Node {
+func NewNode(nodePort int, masters []string, shutdownChannel chan bool, pid int) *Node {
+	runningSince := time.Now().UnixMilli()
 	return &Node{
-		Data:            make(map[string]string),
+		ID:              newNodeID(),
+		metrics:         NewMetrics(),
+		Store:           replica.NewStore(pid, runningSince, logger),
 		NodePort:        nodePort,
-		MasterPort:      masterPort,
+		Masters:         masters,
 		ShutdownChannel: shutdownChannel,
 		PID:             pid,
-		RunningSince:    time.Now().UnixMilli(),
+		RunningSince:    runningSince,
+	}
+}
+
+func (n *Node) masterURL(path string) string {
+	return masterScheme() + n.Masters[n.masterIndex.Load()] + path
+}
+
+// countRequests tracks the total and in-flight requests reported on /stats,
+// and the per endpoint counts and latencies reported on /metrics.
+func (n *Node) countRequests(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, endpoint := mux.Handler(r)
+		defer n.Requests.Start(endpoint)()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		mux.ServeHTTP(recorder, r)
+		n.metrics.observeRequest(endpoint, r.Method, recorder.status, time.Since(start))
+	})
+}
+
+// pull replaces the node's state with a full copy from the master, as part
+// of the trace in ctx.
+func (n *Node) pull(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() { n.metrics.observePull(time.Since(start), err) }()
+
+	replicateCtx, replicate := startSpan(ctx, "replicate", spanClient)
+	result, err := n.fetch(replicateCtx)
+	replicate.setError(err)
+	replicate.finish()
+	if err != nil {
+		return err
+	}
+
+	_, apply := startSpan(ctx, "apply", spanInternal)
+	apply.attributes["cache.data_version"] = result.DataVersion
+	apply.attributes["cache.keys"] = len(result.Data)
+	if !n.Store.Replace(result) {
+		logger.DebugContext(ctx, "ignored a pull older than the held data", "version", result.DataVersion, "held", n.Store.Version())
+	}
+	apply.finish()
+	return nil
+}
+
+// fetch pulls a streamed snapshot of the master's data, or the data as one
+// document from a master that does not stream snapshots.
+func (n *Node) fetch(ctx context.Context) (model.DataPayload, error) {
+	return replica.Fetch(ctx, n.getFromMaster)
+}
+
+func (n *Node) getFromMaster(ctx context.Context, path string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, n.masterURL(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	injectTrace(ctx, request.Header)
+	resp, err := masterClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to consume master API: %w", err)
 	}
+	return resp, nil
 }
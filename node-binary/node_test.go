@@ -1,28 +1,53 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"distributed-inmemory-cache/auth"
+	"distributed-inmemory-cache/merkle"
+	"distributed-inmemory-cache/model"
+	"distributed-inmemory-cache/replica"
+	"encoding/hex"
 	"encoding/json"
-	_ "io"
+	"errors"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+func startTestMaster(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	masterServer := httptest.NewServer(handler)
+	t.Cleanup(masterServer.Close)
+
+	masterURL, err := url.Parse(masterServer.URL)
+	if err != nil {
+		t.Fatalf("invalid test server url: %v", err)
+	}
+	node = NewNode(0, []string{masterURL.Host}, make(chan bool, 1), 0)
+	return masterServer
+}
+
 func TestBroadcastHandler(t *testing.T) {
 	masterData := map[string]string{
 		"key1": "value1",
 		"key2": "value2",
 	}
 
-	masterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/data" {
+	startTestMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/replicate/data" {
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(masterData)
+			json.NewEncoder(w).Encode(model.DataPayload{DataVersion: 42, Data: masterData})
 		} else {
 			http.Error(w, "Not Found", http.StatusNotFound)
 		}
-	}))
-	defer masterServer.Close()
+	})
 
 	req := httptest.NewRequest(http.MethodPost, "/notify", nil)
 	w := httptest.NewRecorder()
@@ -33,6 +58,7 @@ func TestBroadcastHandler(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 
+	data := node.Store.Payload().Data
 	if len(data) != len(masterData) {
 		t.Errorf("expected data to have %d entries, but got %d", len(masterData), len(data))
 	}
@@ -42,4 +68,413 @@ func TestBroadcastHandler(t *testing.T) {
 			t.Errorf("expected data[%q] = %q, but got %q", key, expectedValue, value)
 		}
 	}
+
+	if version := node.Store.Version(); version != 42 {
+		t.Errorf("expected data version 42, but got %d", version)
+	}
+}
+
+func TestPubSubRelayHandler(t *testing.T) {
+	startTestMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/pubsub/publish" || r.URL.Query().Get("channel") != "jobs" {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "hello" {
+			http.Error(w, "unexpected body", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"receivers":3}`))
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/pubsub/publish?channel=jobs", strings.NewReader("hello"))
+	w := httptest.NewRecorder()
+
+	pubSubRelayHandler("/api/pubsub/publish")(w, req)
+
+	if status := w.Code; status != http.StatusOK {
+		t.Fatalf("relay returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != `{"receivers":3}` {
+		t.Errorf("unexpected relay body: %s", body)
+	}
+}
+
+func TestPubSubRelayForwardsAPIKeys(t *testing.T) {
+	authenticator, err := auth.New([]auth.Key{
+		{Name: "publisher", Key: "writer-key", Role: auth.Writer},
+		{Name: "dashboard", Key: "reader-key", Role: auth.Reader},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestMaster(t, authenticator.Require(auth.Writer, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"receivers":1}`))
+	}))
+
+	for _, test := range []struct {
+		header, value string
+		want          int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{auth.APIKeyHeader, "writer-key", http.StatusOK},
+		{"Authorization", "Bearer writer-key", http.StatusOK},
+		{auth.APIKeyHeader, "reader-key", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/pubsub/publish?channel=jobs", strings.NewReader("hello"))
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		pubSubRelayHandler("/api/pubsub/publish")(w, req)
+		if w.Code != test.want {
+			t.Errorf("relay with %s %q answered %d, want %d", test.header, test.value, w.Code, test.want)
+		}
+	}
+}
+
+func TestInternalKeyOnlyAuthenticatesTheNode(t *testing.T) {
+	authenticator, err := auth.New([]auth.Key{{Name: "nodes", Key: "internal-key", Role: auth.Internal}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		role := auth.Internal
+		if strings.HasPrefix(r.URL.Path, "/api/pubsub/") {
+			role = auth.Writer
+		}
+		authenticator.Require(role, func(w http.ResponseWriter, r *http.Request) {})(w, r)
+	})
+	t.Setenv(auth.InternalKeyEnv, "internal-key")
+	setupInternalKey()
+	defer func() {
+		internalKey, masterClient = "", http.DefaultClient
+	}()
+
+	if err := node.register(0); err != nil {
+		t.Errorf("the node should register with the internal key: %v", err)
+	}
+	w := httptest.NewRecorder()
+	pubSubRelayHandler("/api/pubsub/publish")(w, httptest.NewRequest(http.MethodPost, "/pubsub/publish?channel=jobs", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("the relay should not lend clients the internal key, got %d", w.Code)
+	}
+
+	guarded := requireMaster(func(w http.ResponseWriter, r *http.Request) {})
+	for value, want := range map[string]int{"": http.StatusUnauthorized, "internal-key": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodPost, "/notify", nil)
+		if value != "" {
+			req.Header.Set(auth.APIKeyHeader, value)
+		}
+		w := httptest.NewRecorder()
+		guarded(w, req)
+		if w.Code != want {
+			t.Errorf("internal endpoint with key %q answered %d, want %d", value, w.Code, want)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	var registration Registration
+	startTestMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/infra/register" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&registration)
+	})
+	node.NodePort = 3005
+	node.PID = 4242
+
+	if err := node.register(0); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if registration.ID == "" || registration.ID != node.ID || registration.Port != 3005 || registration.PID != 4242 {
+		t.Errorf("unexpected registration: %+v", registration)
+	}
+}
+
+func TestHeartbeatFailsOverAndPulls(t *testing.T) {
+	var registrations, pulls int
+	live := startTestMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/infra/register":
+			registrations++
+		case "/replicate/snapshot":
+			pulls++
+			replica.WriteSnapshot(w, model.DataPayload{DataVersion: 9, Data: map[string]string{"k": "v"}})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	liveURL, _ := url.Parse(live.URL)
+	goneURL, _ := url.Parse(gone.URL)
+	node.Masters = []string{goneURL.Host, liveURL.Host}
+
+	node.heartbeat()
+	if node.masterIndex.Load() != 1 || registrations != 1 || pulls != 1 {
+		t.Fatalf("expected a switch to the live master and one pull, got index %d, %d registrations, %d pulls",
+			node.masterIndex.Load(), registrations, pulls)
+	}
+	if payload := node.Store.Payload(); payload.DataVersion != 9 || payload.Data["k"] != "v" {
+		t.Fatalf("expected the master's data after connecting, got %d %v", payload.DataVersion, payload.Data)
+	}
+
+	// Staying connected does not pull again
+	node.heartbeat()
+	if registrations != 2 || pulls != 1 {
+		t.Errorf("expected a plain heartbeat, got %d registrations, %d pulls", registrations, pulls)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	node = NewNode(0, []string{"localhost:1"}, make(chan bool, 1), 0)
+	node.Store.Replace(model.DataPayload{DataVersion: 1700000000123<<16 | 5, Data: map[string]string{"ab": "cd"}})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", node.Requests.HealthHandler)
+	handler := node.countRequests(mux)
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+	}
+	node.pull(context.Background())
+
+	recorder := httptest.NewRecorder()
+	metricsHandler(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"cache_node_keys 1",
+		"cache_node_bytes 4",
+		"cache_node_data_version_time_ms 1.700000000123e+12",
+		"cache_node_data_version_counter 5",
+		`cache_node_http_requests_total{endpoint="/health",method="GET",code="200"} 2`,
+		`cache_node_http_request_duration_seconds_count{endpoint="/health"} 2`,
+		"cache_node_pull_failures_total 1",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	defer setLogLevel("info")
+
+	recorder := httptest.NewRecorder()
+	logLevelHandler(recorder, httptest.NewRequest(http.MethodPut, "/loglevel?level=debug", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"level":"debug"`) {
+		t.Fatalf("unexpected response %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("debug records should be enabled")
+	}
+
+	recorder = httptest.NewRecorder()
+	logLevelHandler(recorder, httptest.NewRequest(http.MethodPut, "/loglevel?level=loud", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("got %d for an unknown level, want 400", recorder.Code)
+	}
+}
+
+func TestBroadcastHandlerContinuesTrace(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var received string
+	startTestMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(traceparentHeader)
+		json.NewEncoder(w).Encode(model.DataPayload{DataVersion: 1, Data: map[string]string{}})
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/notify", nil)
+	req.Header.Set(traceparentHeader, "00-"+traceID+"-00f067aa0ba902b7-01")
+	broadcastHandler(httptest.NewRecorder(), req)
+
+	sc, ok := parseTraceparent(received)
+	if !ok {
+		t.Fatalf("master got no valid traceparent: %q", received)
+	}
+	if hex.EncodeToString(sc.traceID[:]) != traceID || !sc.sampled {
+		t.Errorf("pull is not part of the broadcast's trace: %q", received)
+	}
+	if hex.EncodeToString(sc.spanID[:]) == "00f067aa0ba902b7" {
+		t.Errorf("pull should be a span of its own: %q", received)
+	}
+}
+
+func TestStreamHandlerAppliesFramesAndPullsOnGaps(t *testing.T) {
+	startTestMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		replica.WriteSnapshot(w, model.DataPayload{DataVersion: 9, Data: map[string]string{"pulled": "yes"}})
+	})
+	stream := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer stream.Close()
+
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	resp, err := http.Post(stream.URL, "application/x-ndjson", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	encoder := json.NewEncoder(writer)
+	decoder := json.NewDecoder(resp.Body)
+	send := func(frame model.ReplicationFrame) model.ReplicationAck {
+		if err := encoder.Encode(frame); err != nil {
+			t.Fatal(err)
+		}
+		var ack model.ReplicationAck
+		if err := decoder.Decode(&ack); err != nil {
+			t.Fatal(err)
+		}
+		return ack
+	}
+
+	ack := send(model.ReplicationFrame{Seq: 1, BaseVersion: -1, DataVersion: 5, Snapshot: true, Data: map[string]string{"a": "1", "b": "2"}})
+	if data := node.Store.Payload().Data; ack.Seq != 1 || ack.DataVersion != 5 || data["a"] != "1" {
+		t.Fatalf("snapshot not applied: %+v %v", ack, data)
+	}
+	ack = send(model.ReplicationFrame{Seq: 2, BaseVersion: 5, DataVersion: 7, Changes: []model.Change{{Key: "c", Value: "3"}, {Key: "a", Delete: true}}})
+	if data := node.Store.Payload().Data; ack.DataVersion != 7 || len(data) != 2 || data["c"] != "3" || data["a"] != "" {
+		t.Fatalf("changes not applied: %+v %v", ack, data)
+	}
+	// Version 8 was missed, the node pulls instead of applying on top of it
+	ack = send(model.ReplicationFrame{Seq: 3, BaseVersion: 8, DataVersion: 9, Changes: []model.Change{{Key: "d", Value: "4"}}})
+	if data := node.Store.Payload().Data; !ack.Pulled || ack.DataVersion != 9 || data["pulled"] != "yes" || data["d"] != "" {
+		t.Fatalf("expected a pull after the gap: %+v %v", ack, data)
+	}
+}
+
+func TestMerkleHandlersMatchTheMaster(t *testing.T) {
+	node = NewNode(0, []string{"localhost:0"}, make(chan bool, 1), 0)
+	node.Store.Replace(model.DataPayload{DataVersion: 42, Data: map[string]string{"a": "1", "b": "2", "user:42": "x", "stale": "y"}})
+
+	// Same data, same root as the master's merkle package
+	recorder := httptest.NewRecorder()
+	node.Store.MerkleHandler(recorder, httptest.NewRequest(http.MethodGet, "/merkle?depth=4&level=0", nil))
+	var root model.MerkleLevel
+	json.NewDecoder(recorder.Body).Decode(&root)
+	if root.DataVersion != 42 || len(root.Hashes) != 1 || root.Hashes[0] == "98b4e1b93af1a31fb9be0ea15c4ba6cc1a3528b4493e074aa46c1ca85ff01d1d" {
+		t.Fatalf("unexpected root before the repair %+v", root)
+	}
+
+	stale := merkle.Range("stale", 4)
+	body := `{"data_version":41,"depth":4,"ranges":[` + strconv.Itoa(stale) + `],"data":{}}`
+	recorder = httptest.NewRecorder()
+	node.Store.RepairHandler(recorder, httptest.NewRequest(http.MethodPost, "/merkle/repair", strings.NewReader(body)))
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("a repair for another version should conflict, got %d", recorder.Code)
+	}
+	body = strings.Replace(body, "41", "42", 1)
+	recorder = httptest.NewRecorder()
+	node.Store.RepairHandler(recorder, httptest.NewRequest(http.MethodPost, "/merkle/repair", strings.NewReader(body)))
+	if _, ok := node.Store.Get("stale"); recorder.Code != http.StatusOK || ok {
+		t.Fatalf("repair failed with %d, data %v", recorder.Code, node.Store.Payload().Data)
+	}
+
+	recorder = httptest.NewRecorder()
+	node.Store.MerkleHandler(recorder, httptest.NewRequest(http.MethodGet, "/merkle?depth=4&level=0", nil))
+	json.NewDecoder(recorder.Body).Decode(&root)
+	if root.Hashes[0] != "98b4e1b93af1a31fb9be0ea15c4ba6cc1a3528b4493e074aa46c1ca85ff01d1d" {
+		t.Errorf("root %s differs from the master's for the same data", root.Hashes[0])
+	}
+}
+
+func TestPullStreamsSnapshots(t *testing.T) {
+	var cutOff bool
+	startTestMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/replicate/snapshot" {
+			http.NotFound(w, r)
+			return
+		}
+		if cutOff {
+			json.NewEncoder(w).Encode(model.SnapshotHeader{DataVersion: 12, Keys: 2})
+			json.NewEncoder(w).Encode(model.SnapshotRecord{Key: "a", Value: "lost"})
+			return
+		}
+		// Compressed as the master does with compress_snapshots
+		w.Header().Set("Content-Encoding", "gzip")
+		compressed := gzip.NewWriter(w)
+		defer compressed.Close()
+		replica.WriteSnapshot(compressed, model.DataPayload{DataVersion: 11, Data: map[string]string{"a": "1", "b": "2"}})
+	})
+
+	if err := node.pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if payload := node.Store.Payload(); payload.DataVersion != 11 || len(payload.Data) != 2 || payload.Data["b"] != "2" {
+		t.Fatalf("snapshot not applied: %d %v", payload.DataVersion, payload.Data)
+	}
+
+	cutOff = true
+	if err := node.pull(context.Background()); !errors.Is(err, replica.ErrSnapshotIncomplete) {
+		t.Fatalf("expected a cut off snapshot to fail, got %v", err)
+	}
+	if payload := node.Store.Payload(); payload.DataVersion != 11 || payload.Data["a"] != "1" {
+		t.Errorf("a cut off snapshot should leave the data alone, got %d %v", payload.DataVersion, payload.Data)
+	}
+}
+
+func TestLongLivedRequestsAreNotInFlight(t *testing.T) {
+	node = NewNode(0, []string{"localhost:1"}, make(chan bool, 1), 0)
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	for _, path := range []string{"/replicate/stream", "/pubsub/subscribe", "/stats"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+		})
+	}
+	handler := node.countRequests(mux)
+	var wg sync.WaitGroup
+	for _, path := range []string{"/replicate/stream", "/pubsub/subscribe", "/stats"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		}()
+		<-started
+	}
+	if inFlight := node.Requests.InFlight(); inFlight != 1 || node.Requests.Total() != 3 {
+		t.Errorf("expected only the stats request in flight, got %d of %d", inFlight, node.Requests.Total())
+	}
+	close(release)
+	wg.Wait()
+}
+
+func TestDrainRefusesClientsAndWaitsForRequests(t *testing.T) {
+	node = NewNode(0, []string{"localhost:1"}, make(chan bool, 1), 0)
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	mux.HandleFunc("/pubsub/publish", node.Requests.Serving(func(w http.ResponseWriter, r *http.Request) {}))
+	mux.HandleFunc("/drain", node.Requests.DrainHandler)
+	handler := node.countRequests(mux)
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stats", nil))
+	<-started
+
+	drained := make(chan *httptest.ResponseRecorder)
+	go func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/drain?timeout=5s", nil))
+		drained <- recorder
+	}()
+	for !node.Requests.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/pubsub/publish", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("a draining node should refuse clients, got %d", recorder.Code)
+	}
+
+	close(release)
+	recorder = <-drained
+	if body := recorder.Body.String(); !strings.Contains(body, `"drained":true`) || !strings.Contains(body, `"in_flight":0`) {
+		t.Errorf("expected the drain to wait for the request, got %s", body)
+	}
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"distributed-inmemory-cache/model"
+	"distributed-inmemory-cache/replica"
+	"net/http"
+)
+
+// stopping is closed when the node shuts down, so open streams end instead
+// of holding up the shutdown.
+var stopping = make(chan struct{})
+
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	logger.Info("master opened replication stream", "remote", r.RemoteAddr)
+	replica.ServeStream(w, r, stopping, node.apply)
+	logger.Info("replication stream closed")
+}
+
+// apply applies a pushed frame. A node that does not hold the frame's base
+// version, e.g. after a missed frame, catches up with a pull instead.
+func (n *Node) apply(ctx context.Context, frame model.ReplicationFrame) model.ReplicationAck {
+	ctx, span := startSpan(continueTrace(ctx, frame.Traceparent), "apply", spanServer)
+	defer span.finish()
+	span.attributes["cache.node_port"] = n.NodePort
+	span.attributes["cache.data_version"] = frame.DataVersion
+	span.attributes["cache.changes"] = len(frame.Changes)
+	ack := model.ReplicationAck{Seq: frame.Seq}
+
+	if n.Store.Apply(frame) {
+		ack.DataVersion = frame.DataVersion
+		return ack
+	}
+	logger.Info("pushed frame does not follow the node's version, pulling", "version", n.Store.Version(), "base_version", frame.BaseVersion)
+	if err := n.pull(ctx); err != nil {
+		span.setError(err)
+		ack.Error = err.Error()
+		return ack
+	}
+	ack.DataVersion = n.Store.Version()
+	ack.Pulled = true
+	return ack
+}
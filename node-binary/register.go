@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const heartbeatInterval = 5 * time.Second
+
+// Registration mirrors the master's model.NodeRegistration.
+type Registration struct {
+	ID        string `json:"id"`
+	Host      string `json:"host,omitempty"`
+	Port      int    `json:"port"`
+	PID       int    `json:"pid"`
+	StartedAt int64  `json:"started_at"`
+	ClusterID string `json:"cluster_id,omitempty"`
+}
+
+func newNodeID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(id)
+}
+
+// register tells the master at masterIndex that this node exists. Without an
+// advertised host the master uses the caller's address.
+func (n *Node) register(masterIndex int) error {
+	body, err := json.Marshal(Registration{
+		ID:        n.ID,
+		Host:      n.AdvertiseHost,
+		Port:      n.NodePort,
+		PID:       n.PID,
+		StartedAt: n.RunningSince,
+		ClusterID: n.ClusterID,
+	})
+	if err != nil {
+		return err
+	}
+	target := masterScheme() + n.Masters[masterIndex] + "/api/infra/register"
+	resp, err := masterClient.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+func (n *Node) heartbeatLoop() {
+	n.heartbeat()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// A node on its way out must not be adopted again
+		if n.stopping.Load() {
+			return
+		}
+		n.heartbeat()
+	}
+}
+
+// heartbeat registers with the current master, or with the first other
+// master that accepts the node. Data may have changed while the node had no
+// master, so after (re)connecting it pulls a full copy.
+func (n *Node) heartbeat() {
+	current := int(n.masterIndex.Load())
+	for offset := 0; offset < len(n.Masters); offset++ {
+		index := (current + offset) % len(n.Masters)
+		err := n.register(index)
+		if err != nil {
+			logger.Warn("registration failed", "master", n.Masters[index], "error", err)
+			continue
+		}
+		if index != current {
+			logger.Info("switched master", "master", n.Masters[index])
+			n.masterIndex.Store(int64(index))
+			n.connected.Store(false)
+		}
+		if !n.connected.Swap(true) {
+			logger.Info("registered", "id", n.ID, "master", n.Masters[index])
+			if err := n.pull(context.Background()); err != nil {
+				logger.Warn("full sync after connecting failed", "error", err)
+				n.connected.Store(false)
+			}
+		}
+		return
+	}
+	if n.connected.Swap(false) {
+		logger.Warn("lost every master, retrying on the next heartbeat")
+	}
+}
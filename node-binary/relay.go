@@ -0,0 +1,65 @@
+package main
+
+import (
+	"distributed-inmemory-cache/auth"
+	"io"
+	"net/http"
+)
+
+// pubSubRelayHandler forwards pub/sub requests to the master so subscribers and
+// publishers can attach to any node. Subscription streams are copied through
+// as they arrive.
+func pubSubRelayHandler(masterPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upstreamURL := node.masterURL(masterPath)
+		if r.URL.RawQuery != "" {
+			upstreamURL += "?" + r.URL.RawQuery
+		}
+
+		upstreamRequest, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, r.Body)
+		if err != nil {
+			http.Error(w, "Failed to build master request", http.StatusInternalServerError)
+			return
+		}
+		// The master checks the caller's key, the node only passes it on
+		for _, header := range []string{"Content-Type", "Authorization", auth.APIKeyHeader} {
+			if value := r.Header.Get(header); value != "" {
+				upstreamRequest.Header.Set(header, value)
+			}
+		}
+
+		resp, err := relayClient.Do(upstreamRequest)
+		if err != nil {
+			http.Error(w, "Failed to consume master API", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		for _, header := range []string{"Content-Type", "Cache-Control"} {
+			if value := resp.Header.Get(header); value != "" {
+				w.Header().Set(header, value)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+
+		flusher, _ := w.(http.Flusher)
+		buf := make([]byte, 4096)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			if err != nil {
+				if err != io.EOF && r.Context().Err() == nil {
+					logger.WarnContext(r.Context(), "pub/sub relay stream ended", "error", err)
+				}
+				return
+			}
+		}
+	}
+}
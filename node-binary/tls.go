@@ -0,0 +1,128 @@
+package main
+
+import (
+	"distributed-inmemory-cache/auth"
+	"distributed-inmemory-cache/pki"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	certCheckInterval = time.Minute
+	// How long a node keeps trying to join a master that is still starting
+	joinTimeout = 2 * time.Minute
+)
+
+// identity is the node's certificate, replaced on renewal without a
+// restart, and the cluster CA. Nil without TLS.
+var identity *pki.Identity
+
+// masterClient reaches the master, presenting the node's certificate with
+// TLS or the internal key with auth but without TLS.
+var masterClient = http.DefaultClient
+
+// relayClient passes client requests on to the master. It never presents the
+// internal key, the master checks the client's own.
+var relayClient = http.DefaultClient
+
+// internalKey is the master's internal key, only the master presents it.
+var internalKey string
+
+// setupTLS joins the cluster with the token the master passed in the
+// environment: the node creates its key and the master signs it, the key
+// never leaves the process.
+func setupTLS(masters []string) error {
+	invitation, ok := pki.InvitationFromEnv(map[string]string{
+		pki.CAEnv:        os.Getenv(pki.CAEnv),
+		pki.JoinTokenEnv: os.Getenv(pki.JoinTokenEnv),
+	})
+	if !ok {
+		return nil
+	}
+	bundle, err := join(masters, invitation)
+	if err != nil {
+		return err
+	}
+	if identity, err = pki.NewIdentity(bundle); err != nil {
+		return err
+	}
+	masterClient = identity.Client(0)
+	relayClient = masterClient
+	return nil
+}
+
+// setupInternalKey authenticates the node with the internal key the master
+// passed in the environment, when the cluster runs without TLS.
+func setupInternalKey() {
+	if identity != nil {
+		return
+	}
+	internalKey = os.Getenv(auth.InternalKeyEnv)
+	if internalKey != "" {
+		masterClient = &http.Client{Transport: &auth.Transport{Key: internalKey}}
+	}
+}
+
+// join asks the masters in turn until one signs the node's key, a master
+// that spawned the node may not serve TLS yet.
+func join(masters []string, invitation pki.Invitation) (pki.Bundle, error) {
+	deadline := time.Now().Add(joinTimeout)
+	for attempt := 0; ; attempt++ {
+		master := masters[attempt%len(masters)]
+		bundle, err := pki.Join("https://"+master+pki.JoinPath, invitation, 10*time.Second)
+		if err == nil {
+			logger.Info("joined the cluster", "master", master)
+			return bundle, nil
+		}
+		if time.Now().After(deadline) {
+			return pki.Bundle{}, fmt.Errorf("could not join the cluster: %w", err)
+		}
+		logger.Warn("could not join the cluster, retrying", "master", master, "error", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func masterScheme() string {
+	if identity != nil {
+		return "https://"
+	}
+	return "http://"
+}
+
+// requireMaster only lets the master call handler, by its certificate or
+// the internal key. It is open when the cluster uses neither.
+func requireMaster(handler http.HandlerFunc) http.HandlerFunc {
+	switch {
+	case identity != nil:
+		return pki.RequirePeer(pki.MasterName, handler)
+	case internalKey != "":
+		return auth.RequireKey(internalKey, handler)
+	}
+	return handler
+}
+
+// renewLoop has the master sign a new key once two thirds of the current
+// certificate's lifetime passed.
+func (n *Node) renewLoop() {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if n.stopping.Load() {
+			return
+		}
+		if !identity.NeedsRenewal(time.Now()) {
+			continue
+		}
+		bundle, err := pki.RequestRenewal(masterClient, n.masterURL(pki.RenewalPath))
+		if err == nil {
+			err = identity.Update(bundle)
+		}
+		if err != nil {
+			logger.Warn("could not renew certificate", "not_after", identity.Leaf().NotAfter, "error", err)
+			continue
+		}
+		logger.Info("renewed certificate", "not_after", identity.Leaf().NotAfter)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceparentHeader  = "traceparent"
+	traceFlushInterval = 2 * time.Second
+	traceQueueSize     = 1024
+)
+
+// The node's side of the master's tracing: spans for notify, replicate and
+// apply, linked to the master's with traceparent headers and exported in
+// the same OTLP JSON encoding.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+func parseTraceparent(header string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+type span struct {
+	context    spanContext
+	parent     [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+type spanKey struct{}
+
+// startSpan begins a child of the span in ctx, or a new trace without one.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	s := &span{name: name, kind: kind, start: time.Now(), attributes: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanKey{}).(spanContext); ok {
+		s.context.traceID = parent.traceID
+		s.context.sampled = parent.sampled
+		s.parent = parent.spanID
+	} else {
+		rand.Read(s.context.traceID[:])
+		s.context.sampled = true
+	}
+	rand.Read(s.context.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s.context), s
+}
+
+// extractTrace continues the trace of an incoming traceparent header.
+func extractTrace(r *http.Request) context.Context {
+	if sc, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		return context.WithValue(r.Context(), spanKey{}, sc)
+	}
+	return r.Context()
+}
+
+// continueTrace continues the trace of a traceparent carried in a message.
+func continueTrace(ctx context.Context, traceparent string) context.Context {
+	if sc, ok := parseTraceparent(traceparent); ok {
+		return context.WithValue(ctx, spanKey{}, sc)
+	}
+	return ctx
+}
+
+func injectTrace(ctx context.Context, header http.Header) {
+	if sc, ok := ctx.Value(spanKey{}).(spanContext); ok {
+		header.Set(traceparentHeader, sc.traceparent())
+	}
+}
+
+func (s *span) setError(err error) {
+	if err != nil {
+		s.err = err
+	}
+}
+
+func (s *span) finish() {
+	s.end = time.Now()
+	if s.context.sampled && traces != nil {
+		traces.add(s)
+	}
+}
+
+var traces *traceExporter
+
+// traceExporter posts batches of spans to an OTLP/HTTP collector and/or
+// appends them to a file, from the background.
+type traceExporter struct {
+	url   string
+	file  *os.File
+	mu    sync.Mutex
+	queue chan *span
+}
+
+// setupTracing exports spans where the master asked its nodes to.
+func setupTracing(port int) error {
+	endpoint := os.Getenv("CACHE_TRACING_OTLP_ENDPOINT")
+	path := os.Getenv("CACHE_TRACING_FILE")
+	if endpoint == "" && path == "" {
+		return nil
+	}
+	exporter := &traceExporter{queue: make(chan *span, traceQueueSize)}
+	if endpoint != "" {
+		exporter.url = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		exporter.file = file
+	}
+	traces = exporter
+	go exporter.run("cache-node-" + strconv.Itoa(port))
+	return nil
+}
+
+func (exporter *traceExporter) add(s *span) {
+	select {
+	case exporter.queue <- s:
+	default:
+	}
+}
+
+func (exporter *traceExporter) run(service string) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-exporter.queue:
+			batch = append(batch, s)
+		case <-ticker.C:
+			if len(batch) > 0 {
+				exporter.export(service, batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+func (exporter *traceExporter) export(service string, batch []*span) {
+	payload, err := json.Marshal(encodeSpans(service, batch))
+	if err != nil {
+		return
+	}
+	if exporter.url != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		if resp, err := client.Post(exporter.url, "application/json", bytes.NewReader(payload)); err == nil {
+			resp.Body.Close()
+		} else {
+			logger.Debug("could not export spans", "error", err)
+		}
+	}
+	if exporter.file != nil {
+		exporter.mu.Lock()
+		exporter.file.Write(append(payload, '\n'))
+		exporter.mu.Unlock()
+	}
+}
+
+func otlpValue(value interface{}) map[string]interface{} {
+	switch typed := value.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": typed}
+	case bool:
+		return map[string]interface{}{"boolValue": typed}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(typed)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(typed, 10)}
+	}
+	return map[string]interface{}{"stringValue": ""}
+}
+
+// encodeSpans builds an OTLP ExportTraceServiceRequest in its JSON encoding.
+func encodeSpans(service string, batch []*span) map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		data := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.context.traceID[:]),
+			"spanId":            hex.EncodeToString(s.context.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"status":            map[string]interface{}{},
+		}
+		if s.parent != [8]byte{} {
+			data["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		var attributes []map[string]interface{}
+		for key, value := range s.attributes {
+			attributes = append(attributes, map[string]interface{}{"key": key, "value": otlpValue(value)})
+		}
+		if attributes != nil {
+			data["attributes"] = attributes
+		}
+		if s.err != nil {
+			data["status"] = map[string]interface{}{"code": 2, "message": s.err.Error()}
+		}
+		spans = append(spans, data)
+	}
+	return map[string]interface{}{"resourceSpans": []interface{}{map[string]interface{}{
+		"resource": map[string]interface{}{"attributes": []interface{}{
+			map[string]interface{}{"key": "service.name", "value": otlpValue(service)},
+		}},
+		"scopeSpans": []interface{}{map[string]interface{}{
+			"scope": map[string]interface{}{"name": "distributed-inmemory-cache"},
+			"spans": spans,
+		}},
+	}}}
+}
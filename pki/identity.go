@@ -0,0 +1,113 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Identity is the certificate a process presents and the CA it trusts. The
+// certificate can be replaced while connections use it, new handshakes pick
+// up the new one.
+type Identity struct {
+	current atomic.Pointer[tls.Certificate]
+	pool    *x509.CertPool
+}
+
+func NewIdentity(bundle Bundle) (*Identity, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle.CAPEM) {
+		return nil, errors.New("no CA certificate in bundle")
+	}
+	identity := &Identity{pool: pool}
+	if err := identity.Update(bundle); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// Update switches to the certificate of bundle. The CA stays the one the
+// identity was created with.
+func (identity *Identity) Update(bundle Bundle) error {
+	cert, err := tls.X509KeyPair(bundle.CertPEM, bundle.KeyPEM)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	identity.current.Store(&cert)
+	return nil
+}
+
+func (identity *Identity) Leaf() *x509.Certificate {
+	return identity.current.Load().Leaf
+}
+
+// NeedsRenewal is true once two thirds of the certificate's lifetime passed.
+func (identity *Identity) NeedsRenewal(now time.Time) bool {
+	leaf := identity.Leaf()
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return now.After(leaf.NotBefore.Add(lifetime * 2 / 3))
+}
+
+// ServerConfig asks clients for a certificate but lets them in without one,
+// RequirePeer guards the endpoints that need it.
+func (identity *Identity) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return identity.current.Load(), nil
+		},
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  identity.pool,
+	}
+}
+
+func (identity *Identity) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    identity.pool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return identity.current.Load(), nil
+		},
+	}
+}
+
+// Client is an http client that presents the identity and only trusts
+// servers with a certificate of the cluster CA.
+func (identity *Identity) Client(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = identity.ClientConfig()
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// RequirePeer only lets requests through that presented a certificate of
+// the cluster CA with the given common name, any name when it is empty.
+func RequirePeer(commonName string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "A client certificate of the cluster is required", http.StatusUnauthorized)
+			return
+		}
+		if commonName != "" && r.TLS.VerifiedChains[0][0].Subject.CommonName != commonName {
+			http.Error(w, "Certificate is not allowed to call this endpoint", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// RenewalPath is where nodes ask the master for a new certificate.
+const RenewalPath = "/internal/certificate"
+
+// RequestRenewal asks the master at url to sign a new key, client has to
+// present the current certificate.
+func RequestRenewal(client *http.Client, url string) (Bundle, error) {
+	return requestCertificate(client, url, "")
+}
@@ -0,0 +1,89 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Environment the master passes a node it spawns: the CA to trust and a
+// token the node trades once for a certificate of a key it creates itself.
+const (
+	CAEnv        = "CACHE_TLS_CA"
+	JoinTokenEnv = "CACHE_TLS_JOIN_TOKEN"
+)
+
+// JoinPath is where a new node trades its join token for a certificate.
+const JoinPath = "/internal/join"
+
+// Invitation lets one node join the cluster. The token is only good for one
+// join and expires soon, so it is no secret worth stealing once used.
+type Invitation struct {
+	CAPEM []byte
+	Token string
+}
+
+// Env returns the invitation as the environment of a node process.
+func (invitation Invitation) Env() map[string]string {
+	return map[string]string{CAEnv: string(invitation.CAPEM), JoinTokenEnv: invitation.Token}
+}
+
+// InvitationFromEnv reads an invitation from an environment, ok is false
+// without one.
+func InvitationFromEnv(env map[string]string) (Invitation, bool) {
+	if env[CAEnv] == "" || env[JoinTokenEnv] == "" {
+		return Invitation{}, false
+	}
+	return Invitation{CAPEM: []byte(env[CAEnv]), Token: env[JoinTokenEnv]}, true
+}
+
+// SigningRequest asks the master to sign the key of CSR. A joining node
+// proves who it is with Token, a renewing one with its current certificate.
+type SigningRequest struct {
+	Token string `json:"token,omitempty"`
+	CSR   []byte `json:"csr"`
+}
+
+// Join creates the node's key and has the master at url sign it for the
+// invitation's token. The master has to present a certificate of the
+// invitation's CA, the returned bundle holds the new key.
+func Join(url string, invitation Invitation, timeout time.Duration) (Bundle, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(invitation.CAPEM) {
+		return Bundle{}, errors.New("no CA certificate in invitation")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	return requestCertificate(&http.Client{Timeout: timeout, Transport: transport}, url, invitation.Token)
+}
+
+// requestCertificate sends a request for a new key to url and returns the
+// certificate the master signed with that key.
+func requestCertificate(client *http.Client, url string, token string) (Bundle, error) {
+	keyPEM, csrPEM, err := NewRequest(NodeName)
+	if err != nil {
+		return Bundle{}, err
+	}
+	body, err := json.Marshal(SigningRequest{Token: token, CSR: csrPEM})
+	if err != nil {
+		return Bundle{}, err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return Bundle{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Bundle{}, errors.New("master answered " + resp.Status)
+	}
+	var bundle Bundle
+	if err := json.NewDecoder(resp.Body).Decode(&bundle); err != nil {
+		return Bundle{}, err
+	}
+	bundle.KeyPEM = keyPEM
+	return bundle, nil
+}
@@ -0,0 +1,251 @@
+// Package pki is the cluster's certificate authority. The master keeps the CA,
+// issues itself and every node a short-lived certificate and renews them
+// before they expire, so master↔node traffic is mutually authenticated. Nodes
+// create their keys themselves and only send certificate requests, a private
+// key never leaves the process it was made in.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Common names of the kinds of certificates the CA issues.
+const (
+	MasterName = "cache-master"
+	NodeName   = "cache-node"
+	AgentName  = "cache-agent"
+)
+
+// Bundle is a certificate with its key and the CA that signed it, PEM encoded.
+// The key is never encoded, bundles sent to a node only carry certificates.
+type Bundle struct {
+	CertPEM []byte `json:"cert"`
+	KeyPEM  []byte `json:"-"`
+	CAPEM   []byte `json:"ca"`
+}
+
+type CA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+}
+
+// LoadOrCreateCA reads the CA from certPath and keyPath, and creates and
+// stores a new one when neither exists. Nodes trust the CA they were started
+// with, so it has to outlive master restarts.
+func LoadOrCreateCA(certPath string, keyPath string) (*CA, error) {
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil {
+		return ParseCA(certPEM, keyPEM)
+	}
+	if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+		return nil, fmt.Errorf("read CA: %w", errors.Join(certErr, keyErr))
+	}
+
+	ca, keyPEM, err := NewCA()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{filepath.Dir(certPath), filepath.Dir(keyPath)} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certPath, ca.certPEM, 0o644); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// NewCA creates a CA valid for ten years, it returns the key PEM encoded.
+func NewCA() (*CA, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "cache cluster CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := ParseCA(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM)
+	return ca, keyPEM, err
+}
+
+func ParseCA(certPEM []byte, keyPEM []byte) (*CA, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate in CA file")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, errors.New("CA certificate is not a CA")
+	}
+	key, err := parseKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{cert: cert, key: key, certPEM: certPEM}, nil
+}
+
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Issue signs a new key for commonName, valid for hosts, which may be names
+// or IP addresses, for both server and client authentication.
+func (ca *CA) Issue(commonName string, hosts []string, validity time.Duration) (Bundle, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Bundle{}, err
+	}
+	bundle, err := ca.sign(&key.PublicKey, commonName, hosts, validity)
+	if err != nil {
+		return Bundle{}, err
+	}
+	if bundle.KeyPEM, err = encodeKey(key); err != nil {
+		return Bundle{}, err
+	}
+	return bundle, nil
+}
+
+// Sign issues a certificate for the key of the PEM encoded request csrPEM.
+// The name and hosts are the ones the CA decides, not the request's.
+func (ca *CA) Sign(csrPEM []byte, commonName string, hosts []string, validity time.Duration) (Bundle, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return Bundle{}, errors.New("no certificate request")
+	}
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return Bundle{}, err
+	}
+	if err := request.CheckSignature(); err != nil {
+		return Bundle{}, fmt.Errorf("certificate request: %w", err)
+	}
+	return ca.sign(request.PublicKey, commonName, hosts, validity)
+}
+
+// Renew signs the request csrPEM with the name and hosts of cert.
+func (ca *CA) Renew(cert *x509.Certificate, csrPEM []byte, validity time.Duration) (Bundle, error) {
+	return ca.Sign(csrPEM, cert.Subject.CommonName, Hosts(cert), validity)
+}
+
+// Hosts returns the names and IP addresses a certificate is valid for.
+func Hosts(cert *x509.Certificate) []string {
+	hosts := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	return hosts
+}
+
+func (ca *CA) sign(publicKey crypto.PublicKey, commonName string, hosts []string, validity time.Duration) (Bundle, error) {
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: commonName},
+		// Some slack for clocks that are a little behind the master's
+		NotBefore:   time.Now().Add(-5 * time.Minute),
+		NotAfter:    time.Now().Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, publicKey, ca.key)
+	if err != nil {
+		return Bundle{}, err
+	}
+	return Bundle{
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		CAPEM:   ca.certPEM,
+	}, nil
+}
+
+// NewRequest creates a key and a certificate request for it, both PEM encoded.
+func NewRequest(commonName string) (keyPEM []byte, csrPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyPEM, err = encodeKey(key); err != nil {
+		return nil, nil, err
+	}
+	return keyPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+func serialNumber() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return serial
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func parseKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no key in CA key file")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("CA key cannot sign")
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unsupported CA key type %s", block.Type)
+}
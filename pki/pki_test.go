@@ -0,0 +1,72 @@
+package pki
+
+import (
+	"bytes"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateCAKeepsTheCA(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	created, err := LoadOrCreateCA(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreateCA(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(created.CertPEM(), loaded.CertPEM()) {
+		t.Fatal("a restart should keep the CA the nodes trust")
+	}
+
+	bundle, err := created.Issue(NodeName, []string{"127.0.0.1", "node.local"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := NewIdentity(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, csrPEM, err := NewRequest("anything")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := loaded.Renew(identity.Leaf(), csrPEM, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.KeyPEM != nil {
+		t.Fatal("a signed request should not come with a key")
+	}
+	// Fails unless the certificate is for the requested key
+	renewed.KeyPEM = keyPEM
+	if err := identity.Update(renewed); err != nil {
+		t.Fatal(err)
+	}
+	leaf := identity.Leaf()
+	if leaf.Subject.CommonName != NodeName || len(leaf.IPAddresses) != 1 || len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "node.local" {
+		t.Errorf("renewal should keep name and hosts, got %s %v %v", leaf.Subject.CommonName, leaf.IPAddresses, leaf.DNSNames)
+	}
+}
+
+func TestSignRefusesBrokenRequests(t *testing.T) {
+	ca, _, err := NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, csrPEM, err := NewRequest(NodeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(csrPEM)
+	block.Bytes[len(block.Bytes)-1] ^= 0xff
+	for _, request := range [][]byte{nil, []byte("not a request"), pem.EncodeToMemory(block)} {
+		if _, err := ca.Sign(request, NodeName, []string{"127.0.0.1"}, time.Hour); err == nil {
+			t.Errorf("expected %q to be refused", request)
+		}
+	}
+}
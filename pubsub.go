@@ -0,0 +1,226 @@
+package main
+
+import (
+	"distributed-inmemory-cache/auth"
+	"distributed-inmemory-cache/engine"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type pubSubCommand struct {
+	Action   string   `json:"action"`
+	Channels []string `json:"channels"`
+	Channel  string   `json:"channel"`
+	Message  string   `json:"message"`
+}
+
+type pubSubReply struct {
+	Type      string `json:"type"`
+	Channel   string `json:"channel,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+	Payload   string `json:"payload,omitempty"`
+	Count     int    `json:"count"`
+	Receivers int    `json:"receivers,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// publishHandler publishes the raw request body to the channel given in the query string.
+func publishHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	channel := r.URL.Query().Get("channel")
+	if channel == "" {
+		http.Error(w, "Missing channel", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	receivers := master.PubSub().Publish(channel, string(body))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int{"receivers": receivers})
+}
+
+func channelsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(master.PubSub().Channels())
+}
+
+// subscribeHandler subscribes to the `channel` and `pattern` query parameters
+// (both repeatable) and delivers messages as Server-Sent Events, or over a
+// WebSocket that also accepts subscribe, psubscribe, unsubscribe, punsubscribe
+// and publish commands.
+func subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	websocketUpgrade := websocket.IsWebSocketUpgrade(r)
+	if len(query["channel"]) == 0 && len(query["pattern"]) == 0 && !websocketUpgrade {
+		http.Error(w, "Missing channel or pattern", http.StatusBadRequest)
+		return
+	}
+
+	sub := master.PubSub().NewSubscription()
+	defer sub.Close()
+	sub.Subscribe(query["channel"]...)
+	sub.PSubscribe(query["pattern"]...)
+
+	if websocketUpgrade {
+		serveSubscriptionWebSocket(w, r, sub)
+		return
+	}
+	serveSubscriptionSSE(w, r, sub)
+}
+
+func serveSubscriptionSSE(w http.ResponseWriter, r *http.Request, sub *engine.Subscription) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case message, ok := <-sub.Messages:
+			if !ok {
+				return
+			}
+			payload, err := json.Marshal(message)
+			if err != nil {
+				apiLog.ErrorContext(r.Context(), "could not marshal message", "error", err)
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: message\ndata: %s\n\n", payload); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func serveSubscriptionWebSocket(w http.ResponseWriter, r *http.Request, sub *engine.Subscription) {
+	conn, err := watchUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		apiLog.WarnContext(r.Context(), "websocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	caller := principal(r)
+	var writeMu sync.Mutex
+	write := func(reply pubSubReply) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteJSON(reply)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var command pubSubCommand
+			if err := conn.ReadJSON(&command); err != nil {
+				return
+			}
+			if err := write(handlePubSubCommand(sub, caller, command)); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(watchKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-keepAlive.C:
+			writeMu.Lock()
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
+			writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		case message, ok := <-sub.Messages:
+			if !ok {
+				writeMu.Lock()
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber fell behind"))
+				writeMu.Unlock()
+				return
+			}
+			replyType := "message"
+			if message.Pattern != "" {
+				replyType = "pmessage"
+			}
+			err := write(pubSubReply{Type: replyType, Channel: message.Channel, Pattern: message.Pattern, Payload: message.Payload})
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handlePubSubCommand runs a command of a WebSocket subscriber. Subscribing
+// only needs a reader, so publishing checks for a writer here.
+func handlePubSubCommand(sub *engine.Subscription, caller *auth.Principal, command pubSubCommand) pubSubReply {
+	switch command.Action {
+	case "subscribe":
+		return pubSubReply{Type: command.Action, Count: sub.Subscribe(command.Channels...)}
+	case "psubscribe":
+		return pubSubReply{Type: command.Action, Count: sub.PSubscribe(command.Channels...)}
+	case "unsubscribe":
+		if len(command.Channels) == 0 {
+			command.Channels = sub.ChannelNames()
+		}
+		return pubSubReply{Type: command.Action, Count: sub.Unsubscribe(command.Channels...)}
+	case "punsubscribe":
+		if len(command.Channels) == 0 {
+			command.Channels = sub.PatternNames()
+		}
+		return pubSubReply{Type: command.Action, Count: sub.PUnsubscribe(command.Channels...)}
+	case "publish":
+		if command.Channel == "" {
+			return pubSubReply{Type: "error", Error: "missing channel", Count: sub.Count()}
+		}
+		if !caller.Allows(auth.Writer) {
+			return pubSubReply{Type: "error", Error: fmt.Sprintf("API key %s is a %s, publishing needs %s", caller.Name, caller.Role, auth.Writer), Count: sub.Count()}
+		}
+		receivers := master.PubSub().Publish(command.Channel, command.Message)
+		return pubSubReply{Type: command.Action, Channel: command.Channel, Receivers: receivers, Count: sub.Count()}
+	}
+	return pubSubReply{Type: "error", Error: "unknown action: " + command.Action, Count: sub.Count()}
+}
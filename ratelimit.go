@@ -0,0 +1,122 @@
+package main
+
+import (
+	"distributed-inmemory-cache/auth"
+	"distributed-inmemory-cache/ratelimit"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// limiter throttles every client, writeGate caps the sets and deletes that
+// run at once.
+var (
+	limiter   *ratelimit.Limiter
+	writeGate *ratelimit.Gate
+)
+
+// rateLimits is what /api/admin/ratelimits shows and changes.
+type rateLimits struct {
+	Default                 ratelimit.Rate            `json:"default"`
+	Clients                 map[string]ratelimit.Rate `json:"clients"`
+	MaxConcurrentWrites     int                       `json:"max_concurrent_writes"`
+	MaxConcurrentBroadcasts int                       `json:"max_concurrent_broadcasts"`
+}
+
+func setupRateLimits() {
+	limits := conf.Service.RateLimits
+	clients := make(map[string]ratelimit.Rate, len(limits.Clients))
+	for client, rate := range limits.Clients {
+		clients[client] = ratelimit.Rate{Rate: rate.RequestsPerSecond, Burst: rate.Burst}
+	}
+	limiter = ratelimit.NewLimiter(ratelimit.Rate{Rate: limits.RequestsPerSecond, Burst: limits.Burst}, clients)
+	writeGate = ratelimit.NewGate(limits.MaxConcurrentWrites)
+}
+
+// clientID is the API key's name, or the caller's ip without auth.
+func clientID(r *http.Request) string {
+	if principal := auth.FromContext(r.Context()); principal != nil {
+		return principal.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limited throttles each client to its rate.
+func limited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientID(r)
+		if ok, wait := limiter.Allow(client, time.Now()); !ok {
+			apiLog.DebugContext(r.Context(), "rate limited", "client", client, "retry_after", wait)
+			tooManyRequests(w, wait, fmt.Sprintf("Rate limit of %s exceeded", client))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// admitted refuses writes while max_concurrent_writes are running.
+func admitted(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !writeGate.TryAcquire() {
+			apiLog.DebugContext(r.Context(), "write refused", "running", writeGate.Running())
+			tooManyRequests(w, time.Second, "Too many concurrent writes")
+			return
+		}
+		defer writeGate.Release()
+		handler(w, r)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+func currentRateLimits() rateLimits {
+	rate, clients := limiter.Rates()
+	return rateLimits{
+		Default:                 rate,
+		Clients:                 clients,
+		MaxConcurrentWrites:     writeGate.Limit(),
+		MaxConcurrentBroadcasts: master.BroadcastLimit(),
+	}
+}
+
+// rateLimitsHandler shows the limits on GET and changes them on PUT. Fields
+// left out of the body keep their value.
+func rateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		limits := currentRateLimits()
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if limits.MaxConcurrentWrites < 0 || limits.MaxConcurrentBroadcasts < 0 {
+			http.Error(w, "Concurrency limits can not be negative", http.StatusBadRequest)
+			return
+		}
+		limiter.SetRates(limits.Default, limits.Clients)
+		writeGate.SetLimit(limits.MaxConcurrentWrites)
+		master.SetBroadcastLimit(limits.MaxConcurrentBroadcasts)
+		apiLog.InfoContext(r.Context(), "rate limits changed", "rate", limits.Default.Rate, "burst", limits.Default.Burst,
+			"clients", len(limits.Clients), "max_concurrent_writes", limits.MaxConcurrentWrites,
+			"max_concurrent_broadcasts", limits.MaxConcurrentBroadcasts)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(currentRateLimits())
+}
@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+)
+
+// Gate caps how many operations run at once. A limit of 0 lets everything
+// through. The limit can change while operations run, a lower one is
+// reached as they finish.
+type Gate struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	waiters []chan struct{}
+}
+
+func NewGate(limit int) *Gate {
+	return &Gate{limit: limit}
+}
+
+func (gate *Gate) SetLimit(limit int) {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	gate.limit = limit
+	gate.wakeLocked()
+}
+
+func (gate *Gate) Limit() int {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	return gate.limit
+}
+
+// Running is the number of operations holding the gate.
+func (gate *Gate) Running() int {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	return gate.running
+}
+
+// TryAcquire enters the gate if it is not full.
+func (gate *Gate) TryAcquire() bool {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	if gate.limit > 0 && gate.running >= gate.limit {
+		return false
+	}
+	gate.running++
+	return true
+}
+
+// Acquire waits until the gate has room, operations enter in the order they
+// arrived.
+func (gate *Gate) Acquire(ctx context.Context) error {
+	gate.mu.Lock()
+	if len(gate.waiters) == 0 && (gate.limit <= 0 || gate.running < gate.limit) {
+		gate.running++
+		gate.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	gate.waiters = append(gate.waiters, ready)
+	gate.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		gate.mu.Lock()
+		defer gate.mu.Unlock()
+		for i, waiter := range gate.waiters {
+			if waiter == ready {
+				gate.waiters = append(gate.waiters[:i], gate.waiters[i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// Admitted while giving up, pass the slot on
+		gate.running--
+		gate.wakeLocked()
+		return ctx.Err()
+	}
+}
+
+func (gate *Gate) Release() {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	gate.running--
+	gate.wakeLocked()
+}
+
+func (gate *Gate) wakeLocked() {
+	for len(gate.waiters) > 0 && (gate.limit <= 0 || gate.running < gate.limit) {
+		gate.running++
+		close(gate.waiters[0])
+		gate.waiters = gate.waiters[1:]
+	}
+}
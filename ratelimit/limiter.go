@@ -0,0 +1,114 @@
+// Package ratelimit throttles clients with token buckets and caps how many
+// operations run at once.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Rate is a bucket that refills Rate tokens per second up to Burst. A Rate
+// of 0 does not limit.
+type Rate struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (rate Rate) unlimited() bool {
+	return rate.Rate <= 0
+}
+
+func (rate Rate) burst() float64 {
+	return math.Max(float64(rate.Burst), 1)
+}
+
+// idleAfter is how long a client's bucket is kept without requests. A full
+// bucket is the same as a new one, so dropping it changes nothing.
+const idleAfter = 10 * time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps a token bucket per client. Clients without their own rate
+// share the default rate, each with a bucket of its own.
+type Limiter struct {
+	mu        sync.Mutex
+	rate      Rate
+	overrides map[string]Rate
+	buckets   map[string]*bucket
+	swept     time.Time
+}
+
+func NewLimiter(rate Rate, overrides map[string]Rate) *Limiter {
+	limiter := &Limiter{buckets: make(map[string]*bucket)}
+	limiter.SetRates(rate, overrides)
+	return limiter
+}
+
+// SetRates changes the limits. Buckets keep their tokens, capped at the new
+// burst.
+func (limiter *Limiter) SetRates(rate Rate, overrides map[string]Rate) {
+	copied := make(map[string]Rate, len(overrides))
+	for client, override := range overrides {
+		copied[client] = override
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.rate = rate
+	limiter.overrides = copied
+}
+
+// Rates returns the default rate and the clients with their own.
+func (limiter *Limiter) Rates() (Rate, map[string]Rate) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	overrides := make(map[string]Rate, len(limiter.overrides))
+	for client, override := range limiter.overrides {
+		overrides[client] = override
+	}
+	return limiter.rate, overrides
+}
+
+// Allow takes a token from client's bucket. Without one it returns how long
+// until the next token.
+func (limiter *Limiter) Allow(client string, now time.Time) (bool, time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.sweepLocked(now)
+
+	rate, ok := limiter.overrides[client]
+	if !ok {
+		rate = limiter.rate
+	}
+	if rate.unlimited() {
+		return true, 0
+	}
+	current, ok := limiter.buckets[client]
+	if !ok {
+		current = &bucket{tokens: rate.burst(), last: now}
+		limiter.buckets[client] = current
+	}
+	current.tokens = math.Min(rate.burst(), current.tokens+now.Sub(current.last).Seconds()*rate.Rate)
+	current.last = now
+	if current.tokens >= 1 {
+		current.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - current.tokens) / rate.Rate * float64(time.Second))
+	return false, wait
+}
+
+func (limiter *Limiter) sweepLocked(now time.Time) {
+	if now.Sub(limiter.swept) < idleAfter {
+		return
+	}
+	limiter.swept = now
+	for client, idle := range limiter.buckets {
+		if now.Sub(idle.last) > idleAfter {
+			delete(limiter.buckets, client)
+		}
+	}
+}
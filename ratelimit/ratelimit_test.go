@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterRefillsPerClient(t *testing.T) {
+	limiter := NewLimiter(Rate{Rate: 2, Burst: 2}, map[string]Rate{"batch-import": {Rate: 0}})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("10.0.0.1", now); !ok {
+			t.Fatalf("request %d within the burst was throttled", i)
+		}
+	}
+	ok, wait := limiter.Allow("10.0.0.1", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected a throttle for 500ms, got %v %v", ok, wait)
+	}
+	if ok, _ := limiter.Allow("10.0.0.2", now); !ok {
+		t.Error("another client should have its own bucket")
+	}
+	if ok, _ := limiter.Allow("10.0.0.1", now.Add(500*time.Millisecond)); !ok {
+		t.Error("the bucket should refill")
+	}
+	for i := 0; i < 100; i++ {
+		if ok, _ := limiter.Allow("batch-import", now); !ok {
+			t.Fatal("a client without a rate should not be throttled")
+		}
+	}
+
+	limiter.SetRates(Rate{Rate: 1, Burst: 1}, nil)
+	if ok, _ := limiter.Allow("batch-import", now); !ok {
+		t.Error("the first request after a change should pass")
+	}
+	if ok, _ := limiter.Allow("batch-import", now); ok {
+		t.Error("changed rates should apply to clients")
+	}
+}
+
+func TestGateCapsConcurrency(t *testing.T) {
+	gate := NewGate(1)
+	if !gate.TryAcquire() || gate.TryAcquire() {
+		t.Fatal("the gate should admit exactly one")
+	}
+
+	entered := make(chan struct{})
+	go func() {
+		gate.Acquire(context.Background())
+		close(entered)
+	}()
+	select {
+	case <-entered:
+		t.Fatal("Acquire should wait for room")
+	case <-time.After(20 * time.Millisecond):
+	}
+	gate.Release()
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := gate.Acquire(ctx); err == nil {
+		t.Fatal("Acquire should give up with its context")
+	}
+
+	gate.SetLimit(2)
+	if !gate.TryAcquire() || gate.Running() != 2 {
+		t.Error("a raised limit should admit more")
+	}
+	gate.SetLimit(0)
+	if !gate.TryAcquire() {
+		t.Error("a limit of 0 should admit everything")
+	}
+}
@@ -0,0 +1,69 @@
+package replica
+
+import (
+	"distributed-inmemory-cache/merkle"
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// DataHandler answers the whole state as one document. The data is copied
+// first, so a slow reader does not hold up replication.
+func (store *Store) DataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(store.Payload())
+}
+
+func (store *Store) DataVersionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%d", store.Version())
+}
+
+// MerkleHandler answers one level of the Merkle tree over the data for
+// anti-entropy.
+func (store *Store) MerkleHandler(w http.ResponseWriter, r *http.Request) {
+	depth, err := strconv.Atoi(r.URL.Query().Get("depth"))
+	if err != nil || depth < 0 || depth > merkle.MaxDepth {
+		http.Error(w, "Invalid depth", http.StatusBadRequest)
+		return
+	}
+	level, err := strconv.Atoi(r.URL.Query().Get("level"))
+	if err != nil || level < 0 || level > depth {
+		http.Error(w, "Invalid level", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(store.MerkleLevel(depth, level))
+}
+
+func (store *Store) MerkleKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var ranges model.MerkleRanges
+	if err := json.NewDecoder(r.Body).Decode(&ranges); err != nil {
+		http.Error(w, "Invalid ranges", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(store.MerkleKeys(ranges))
+}
+
+// RepairHandler replaces the keys of the ranges the master found to differ,
+// a node that took another version since answers 409.
+func (store *Store) RepairHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var repair model.MerkleRepair
+	if err := json.NewDecoder(r.Body).Decode(&repair); err != nil {
+		http.Error(w, "Invalid repair", http.StatusBadRequest)
+		return
+	}
+	if err := store.Repair(repair); errors.Is(err, ErrVersionMoved) {
+		http.Error(w, "Data version moved", http.StatusConflict)
+		return
+	}
+	store.logger.InfoContext(r.Context(), "repaired key ranges", "ranges", len(repair.Ranges), "keys", len(repair.Data))
+}
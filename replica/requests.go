@@ -0,0 +1,122 @@
+package replica
+
+import (
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultDrainTimeout = 30 * time.Second
+
+// LongLived are the endpoints whose requests stay open for as long as the
+// master, a subscriber or a drain wants, a drain only waits for the others.
+var LongLived = map[string]bool{"/replicate/stream": true, "/pubsub/subscribe": true, "/drain": true}
+
+// Requests counts the requests a node serves and drains it: while draining
+// /health reports the node unavailable and client requests are refused.
+type Requests struct {
+	total    atomic.Int64
+	inFlight atomic.Int64
+	draining atomic.Bool
+}
+
+// Start counts a request to endpoint, the returned func ends it.
+func (requests *Requests) Start(endpoint string) func() {
+	requests.total.Add(1)
+	if LongLived[endpoint] {
+		return func() {}
+	}
+	requests.inFlight.Add(1)
+	return func() { requests.inFlight.Add(-1) }
+}
+
+func (requests *Requests) Total() int64 {
+	return requests.total.Load()
+}
+
+func (requests *Requests) InFlight() int64 {
+	return requests.inFlight.Load()
+}
+
+func (requests *Requests) Draining() bool {
+	return requests.draining.Load()
+}
+
+// Serving refuses client requests while the node drains, so readers go to
+// another node instead of starting new requests here.
+func (requests *Requests) Serving(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requests.draining.Load() {
+			http.Error(w, "DRAINING", http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (requests *Requests) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if requests.draining.Load() {
+		http.Error(w, "DRAINING", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+// DrainHandler marks the node as draining on POST, then waits for the
+// requests in flight to finish or for the `timeout` query parameter to pass.
+// DELETE takes the node out of draining again.
+func (requests *Requests) DrainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodDelete:
+		requests.draining.Store(false)
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout := DefaultDrainTimeout
+	if raw := r.URL.Query().Get("timeout"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = parsed
+	}
+
+	requests.draining.Store(true)
+	deadline := time.Now().Add(timeout)
+	for requests.inFlight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	remaining := requests.inFlight.Load()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"drained": remaining == 0, "in_flight": remaining})
+}
+
+// StatsHandler reports the keys of store, the memory of the process and the
+// requests of the node.
+func StatsHandler(store *Store, requests *Requests) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		keys, _ := store.Size()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(model.NodeStats{
+			Keys:           keys,
+			HeapAllocBytes: mem.HeapAlloc,
+			SysBytes:       mem.Sys,
+			Requests:       requests.Total(),
+			InFlight:       requests.InFlight(),
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package replica
+
+import (
+	"bufio"
+	"context"
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// SnapshotContentType is a streamed snapshot, one JSON document per line.
+const SnapshotContentType = "application/x-ndjson"
+
+var ErrSnapshotIncomplete = errors.New("snapshot ended before all keys were sent")
+
+// WriteSnapshot streams payload as a model.SnapshotHeader, a
+// model.SnapshotRecord per key and a closing record, never as one document.
+func WriteSnapshot(w io.Writer, payload model.DataPayload) (model.SnapshotHeader, error) {
+	header := model.SnapshotHeader{
+		DataVersion: payload.DataVersion,
+		Keys:        len(payload.Data),
+		Locks:       payload.Locks,
+		Webhooks:    payload.Webhooks,
+	}
+	buffered := bufio.NewWriterSize(w, 64*1024)
+	encoder := json.NewEncoder(buffered)
+	if err := encoder.Encode(header); err != nil {
+		return header, err
+	}
+	for key, value := range payload.Data {
+		if err := encoder.Encode(model.SnapshotRecord{Key: key, Value: value}); err != nil {
+			return header, err
+		}
+	}
+	if err := encoder.Encode(model.SnapshotRecord{End: true}); err != nil {
+		return header, err
+	}
+	return header, buffered.Flush()
+}
+
+// ReadSnapshot builds a new data map from a streamed snapshot, key by key.
+// A stream cut off early, or with another number of keys than its header
+// announced, is an error, so a broken transfer never replaces a node's data.
+func ReadSnapshot(r io.Reader) (model.DataPayload, error) {
+	decoder := json.NewDecoder(r)
+	var header model.SnapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return model.DataPayload{}, fmt.Errorf("reading snapshot header: %w", err)
+	}
+	data := make(map[string]string, header.Keys)
+	for {
+		var record model.SnapshotRecord
+		if err := decoder.Decode(&record); errors.Is(err, io.EOF) {
+			return model.DataPayload{}, ErrSnapshotIncomplete
+		} else if err != nil {
+			return model.DataPayload{}, fmt.Errorf("reading snapshot: %w", err)
+		}
+		if record.End {
+			break
+		}
+		data[record.Key] = record.Value
+	}
+	if len(data) != header.Keys {
+		return model.DataPayload{}, fmt.Errorf("%w: got %d of %d keys", ErrSnapshotIncomplete, len(data), header.Keys)
+	}
+	return model.DataPayload{DataVersion: header.DataVersion, Data: data, Locks: header.Locks, Webhooks: header.Webhooks}, nil
+}
+
+// Fetch pulls a streamed snapshot of the master's data through get, or the
+// data as one document from a master that does not stream snapshots.
+func Fetch(ctx context.Context, get func(ctx context.Context, path string) (*http.Response, error)) (model.DataPayload, error) {
+	resp, err := get(ctx, "/replicate/snapshot")
+	if err != nil {
+		return model.DataPayload{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		if resp, err = get(ctx, "/replicate/data"); err != nil {
+			return model.DataPayload{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return model.DataPayload{}, fmt.Errorf("master answered %s", resp.Status)
+		}
+		var result model.DataPayload
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return model.DataPayload{}, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		return result, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return model.DataPayload{}, fmt.Errorf("master answered %s", resp.Status)
+	}
+	return ReadSnapshot(resp.Body)
+}
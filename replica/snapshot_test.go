@@ -0,0 +1,39 @@
+package replica
+
+import (
+	"bytes"
+	"distributed-inmemory-cache/model"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	payload := model.DataPayload{DataVersion: 7, Data: make(map[string]string), Locks: &model.LockState{}}
+	for i := range 1000 {
+		payload.Data[fmt.Sprintf("key-%d", i)] = strings.Repeat("v", i%7)
+	}
+	var stream bytes.Buffer
+	header, err := WriteSnapshot(&stream, payload)
+	if err != nil || header.Keys != 1000 {
+		t.Fatalf("unexpected header %+v, %v", header, err)
+	}
+	if lines := strings.Count(stream.String(), "\n"); lines != 1002 {
+		t.Errorf("expected a line per key plus header and end, got %d", lines)
+	}
+
+	payload, err = ReadSnapshot(bytes.NewReader(stream.Bytes()))
+	if err != nil || payload.DataVersion != 7 || len(payload.Data) != 1000 || payload.Data["key-13"] != "vvvvvv" || payload.Locks == nil {
+		t.Fatalf("snapshot not read back: %d keys, %v", len(payload.Data), err)
+	}
+
+	// Cut off within the last record and before the end record
+	for _, cut := range []int{stream.Len() - 20, stream.Len() - len("{\"end\":true}\n")} {
+		if _, err := ReadSnapshot(bytes.NewReader(stream.Bytes()[:cut])); err == nil {
+			t.Errorf("a snapshot cut at %d should fail", cut)
+		} else if cut == stream.Len()-len("{\"end\":true}\n") && !errors.Is(err, ErrSnapshotIncomplete) {
+			t.Errorf("expected ErrSnapshotIncomplete, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Package replica is a node's copy of the master's state and the node's
+// side of replication: pulls, pushed frames and anti-entropy repairs. The
+// node binary and the master's in-process nodes share it, so it only
+// depends on the standard library and the model and merkle packages.
+package replica
+
+import (
+	"distributed-inmemory-cache/merkle"
+	"distributed-inmemory-cache/model"
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+// ErrVersionMoved is a repair for another data version than the one the
+// node holds.
+var ErrVersionMoved = errors.New("node moved to another data version")
+
+// Store holds the data, version, locks and webhooks a node took from the
+// master. They only change together under the lock, so a reader never sees
+// the data of one version with the number of another.
+type Store struct {
+	mu      sync.RWMutex
+	payload model.DataPayload
+	logger  *slog.Logger
+}
+
+// NewStore returns an empty store. The pid and start time of the node are
+// reported with its data.
+func NewStore(pid int, runningSince int64, logger *slog.Logger) *Store {
+	return &Store{
+		payload: model.DataPayload{
+			Data:         make(map[string]string),
+			PID:          pid,
+			RunningSince: runningSince,
+		},
+		logger: logger,
+	}
+}
+
+func (store *Store) Version() int64 {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.payload.DataVersion
+}
+
+// Size returns the number of keys and the bytes of all keys and values.
+func (store *Store) Size() (keys int, bytes int) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	for key, value := range store.payload.Data {
+		bytes += len(key) + len(value)
+	}
+	return len(store.payload.Data), bytes
+}
+
+// Get returns the value of key.
+func (store *Store) Get(key string) (string, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	value, ok := store.payload.Data[key]
+	return value, ok
+}
+
+// Payload returns a copy of the store's state.
+func (store *Store) Payload() model.DataPayload {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	payload := store.payload
+	payload.Data = make(map[string]string, len(store.payload.Data))
+	for key, value := range store.payload.Data {
+		payload.Data[key] = value
+	}
+	return payload
+}
+
+// Replace takes the state pulled from the master, the store keeps the map.
+// Pulls running at the same time may finish out of order, so a payload older
+// than the store's version is refused and Replace returns false.
+func (store *Store) Replace(payload model.DataPayload) bool {
+	if payload.Data == nil {
+		payload.Data = make(map[string]string)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if payload.DataVersion < store.payload.DataVersion {
+		return false
+	}
+	payload.PID = store.payload.PID
+	payload.RunningSince = store.payload.RunningSince
+	store.payload = payload
+	return true
+}
+
+// Apply applies a frame the master pushed. A frame that does not follow the
+// version the store holds is not applied and Apply returns false, the node
+// then has to pull.
+func (store *Store) Apply(frame model.ReplicationFrame) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if frame.Snapshot {
+		store.payload.Data = frame.Data
+		if store.payload.Data == nil {
+			store.payload.Data = make(map[string]string)
+		}
+	} else {
+		if store.payload.DataVersion != frame.BaseVersion {
+			return false
+		}
+		for _, change := range frame.Changes {
+			if change.Delete {
+				delete(store.payload.Data, change.Key)
+			} else {
+				store.payload.Data[change.Key] = change.Value
+			}
+		}
+	}
+	store.payload.DataVersion = frame.DataVersion
+	store.payload.Locks = frame.Locks
+	store.payload.Webhooks = frame.Webhooks
+	return true
+}
+
+// Repair replaces the keys in the ranges anti-entropy found to differ,
+// unless the store took another version since it was compared.
+func (store *Store) Repair(repair model.MerkleRepair) error {
+	wanted := make(map[int]bool, len(repair.Ranges))
+	for _, index := range repair.Ranges {
+		wanted[index] = true
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.payload.DataVersion != repair.DataVersion {
+		return ErrVersionMoved
+	}
+	for key := range store.payload.Data {
+		if wanted[merkle.Range(key, repair.Depth)] {
+			delete(store.payload.Data, key)
+		}
+	}
+	for key, value := range repair.Data {
+		store.payload.Data[key] = value
+	}
+	return nil
+}
+
+// MerkleLevel hashes the data into a tree at depth and returns one level.
+func (store *Store) MerkleLevel(depth int, level int) model.MerkleLevel {
+	store.mu.RLock()
+	version := store.payload.DataVersion
+	tree := merkle.Build(store.payload.Data, depth)
+	store.mu.RUnlock()
+	return model.MerkleLevel{DataVersion: version, Depth: depth, Level: level, Hashes: tree.Level(level)}
+}
+
+// MerkleKeys returns the data in the given ranges with the version.
+func (store *Store) MerkleKeys(ranges model.MerkleRanges) model.DataPayload {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return model.DataPayload{DataVersion: store.payload.DataVersion, Data: merkle.Keys(store.payload.Data, ranges.Ranges, ranges.Depth)}
+}
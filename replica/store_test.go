@@ -0,0 +1,69 @@
+package replica
+
+import (
+	"distributed-inmemory-cache/model"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestApplyFollowsTheBaseVersion(t *testing.T) {
+	store := NewStore(1, 0, nil)
+	store.Replace(model.DataPayload{DataVersion: 5, Data: map[string]string{"a": "1", "b": "2"}})
+
+	if !store.Apply(model.ReplicationFrame{BaseVersion: 5, DataVersion: 7, Changes: []model.Change{{Key: "c", Value: "3"}, {Key: "a", Delete: true}}}) {
+		t.Fatal("a frame on top of the held version should apply")
+	}
+	if payload := store.Payload(); payload.DataVersion != 7 || len(payload.Data) != 2 || payload.Data["c"] != "3" || payload.PID != 1 {
+		t.Fatalf("changes not applied: %+v", payload)
+	}
+	if store.Apply(model.ReplicationFrame{BaseVersion: 8, DataVersion: 9, Changes: []model.Change{{Key: "d", Value: "4"}}}) {
+		t.Fatal("a frame after a missed one should not apply")
+	}
+	if _, ok := store.Get("d"); ok || store.Version() != 7 {
+		t.Error("a frame that was not applied changed the store")
+	}
+	if err := store.Repair(model.MerkleRepair{DataVersion: 6}); err != ErrVersionMoved {
+		t.Errorf("expected a repair for another version to fail, got %v", err)
+	}
+}
+
+func TestReplaceRefusesOlderPulls(t *testing.T) {
+	store := NewStore(1, 0, nil)
+	if !store.Replace(model.DataPayload{DataVersion: 7, Data: map[string]string{"a": "2"}}) {
+		t.Fatal("a newer pull should replace the data")
+	}
+	// A pull that started earlier finishing last
+	if store.Replace(model.DataPayload{DataVersion: 5, Data: map[string]string{"a": "1"}}) {
+		t.Error("an older pull should be refused")
+	}
+	if value, _ := store.Get("a"); value != "2" || store.Version() != 7 {
+		t.Errorf("an older pull replaced the data: %q at version %d", value, store.Version())
+	}
+}
+
+// Run with -race: readers and writers only meet under the store's lock.
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	store := NewStore(1, 0, nil)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := range 200 {
+			store.Apply(model.ReplicationFrame{BaseVersion: int64(i), DataVersion: int64(i + 1), Changes: []model.Change{{Key: fmt.Sprint(i), Value: "v"}}})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 200 {
+			payload := store.Payload()
+			if int64(len(payload.Data)) != payload.DataVersion {
+				t.Errorf("version %d does not match its %d keys", payload.DataVersion, len(payload.Data))
+				return
+			}
+			store.MerkleLevel(4, 0)
+			store.Size()
+		}
+	}()
+	wg.Wait()
+}
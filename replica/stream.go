@@ -0,0 +1,58 @@
+package replica
+
+import (
+	"context"
+	"distributed-inmemory-cache/model"
+	"encoding/json"
+	"net/http"
+)
+
+// ServeStream takes the frames the master pushes on /replicate/stream in
+// push mode, one model.ReplicationFrame per line, hands each to apply and
+// answers with its model.ReplicationAck line. The stream ends when the
+// master closes it or stopped is closed, so it does not hold up a shutdown.
+func ServeStream(w http.ResponseWriter, r *http.Request, stopped <-chan struct{}, apply func(ctx context.Context, frame model.ReplicationFrame) model.ReplicationAck) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	controller := http.NewResponseController(w)
+	// Acks go out while frames still come in, HTTP/2 does this anyway
+	controller.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+
+	// Frames are read aside, so a stopping node does not wait for the next
+	frames := make(chan model.ReplicationFrame)
+	go func() {
+		defer close(frames)
+		decoder := json.NewDecoder(r.Body)
+		for {
+			var frame model.ReplicationFrame
+			if err := decoder.Decode(&frame); err != nil {
+				return
+			}
+			select {
+			case frames <- frame:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-stopped:
+			return
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(apply(r.Context(), frame)); err != nil {
+				return
+			}
+			controller.Flush()
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"distributed-inmemory-cache/auth"
+	"distributed-inmemory-cache/engine"
+	"distributed-inmemory-cache/logging"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultMaxCommandSize caps the bulk strings of one command together when
+// the server is not given a limit.
+const defaultMaxCommandSize = 4 * 1024 * 1024
+
+var (
+	errProtocol        = errors.New("protocol error")
+	errCommandTooLarge = errors.New("command too large")
+)
+
+var respLog = logging.Component("resp")
+
+// Server is a Redis protocol (RESP2) front-end exposing the master's pub/sub
+// channels, so existing Redis clients can PUBLISH, SUBSCRIBE and PSUBSCRIBE.
+type Server struct {
+	pubsub         *engine.PubSub
+	maxCommandSize int
+	authenticator  *auth.Authenticator
+}
+
+// NewServer serves pubsub, refusing commands whose arguments add up to more
+// than maxCommandSize bytes, a default of 4 MB when it is 0. With an
+// authenticator clients have to AUTH with an API key first, publishing
+// needs a writer key and subscribing a reader key.
+func NewServer(pubsub *engine.PubSub, maxCommandSize int, authenticator *auth.Authenticator) *Server {
+	if maxCommandSize <= 0 {
+		maxCommandSize = defaultMaxCommandSize
+	}
+	return &Server{pubsub: pubsub, maxCommandSize: maxCommandSize, authenticator: authenticator}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+type client struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	writer *bufio.Writer
+	sub    *engine.Subscription
+	// principal is the API key the client authenticated with, nil before
+	// AUTH
+	principal *auth.Principal
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	c := &client{conn: conn, writer: bufio.NewWriter(conn)}
+	defer func() {
+		if c.sub != nil {
+			c.sub.Close()
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader, s.maxCommandSize)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				c.reply(func(w *bufio.Writer) { writeError(w, "ERR "+err.Error()) })
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if !s.dispatch(c, strings.ToUpper(args[0]), args[1:]) {
+			return
+		}
+	}
+}
+
+// dispatch runs one command and reports whether the connection should stay open.
+func (s *Server) dispatch(c *client, command string, args []string) bool {
+	subscribed := c.sub != nil && c.sub.Count() > 0
+	if s.authenticator != nil && c.principal == nil && command != "AUTH" && command != "QUIT" {
+		c.reply(func(w *bufio.Writer) { writeError(w, "NOAUTH Authentication required.") })
+		return true
+	}
+	switch command {
+	case "AUTH":
+		s.authenticate(c, args)
+	case "PING":
+		if subscribed {
+			message := ""
+			if len(args) > 0 {
+				message = args[0]
+			}
+			c.reply(func(w *bufio.Writer) {
+				writeArrayHeader(w, 2)
+				writeBulk(w, "pong")
+				writeBulk(w, message)
+			})
+		} else if len(args) > 0 {
+			c.reply(func(w *bufio.Writer) { writeBulk(w, args[0]) })
+		} else {
+			c.reply(func(w *bufio.Writer) { w.WriteString("+PONG\r\n") })
+		}
+	case "QUIT":
+		c.reply(func(w *bufio.Writer) { w.WriteString("+OK\r\n") })
+		return false
+	case "PUBLISH":
+		if subscribed {
+			c.reply(func(w *bufio.Writer) {
+				writeError(w, "ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context")
+			})
+			break
+		}
+		if len(args) != 2 {
+			c.reply(func(w *bufio.Writer) { writeError(w, "ERR wrong number of arguments for 'publish' command") })
+			break
+		}
+		if !s.permitted(c, auth.Writer, command) {
+			break
+		}
+		receivers := s.pubsub.Publish(args[0], args[1])
+		c.reply(func(w *bufio.Writer) { writeInteger(w, receivers) })
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(args) == 0 {
+			c.reply(func(w *bufio.Writer) {
+				writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+			})
+			break
+		}
+		if !s.permitted(c, auth.Reader, command) {
+			break
+		}
+		s.ensureSubscription(c)
+		for _, name := range args {
+			var count int
+			if command == "SUBSCRIBE" {
+				count = c.sub.Subscribe(name)
+			} else {
+				count = c.sub.PSubscribe(name)
+			}
+			c.reply(func(w *bufio.Writer) { writeSubscriptionReply(w, strings.ToLower(command), name, count) })
+		}
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		kind := strings.ToLower(command)
+		if c.sub == nil {
+			c.reply(func(w *bufio.Writer) { writeSubscriptionReply(w, kind, "", 0) })
+			break
+		}
+		if len(args) == 0 {
+			if command == "UNSUBSCRIBE" {
+				args = c.sub.ChannelNames()
+			} else {
+				args = c.sub.PatternNames()
+			}
+		}
+		if len(args) == 0 {
+			c.reply(func(w *bufio.Writer) { writeSubscriptionReply(w, kind, "", c.sub.Count()) })
+		}
+		for _, name := range args {
+			var count int
+			if command == "UNSUBSCRIBE" {
+				count = c.sub.Unsubscribe(name)
+			} else {
+				count = c.sub.PUnsubscribe(name)
+			}
+			c.reply(func(w *bufio.Writer) { writeSubscriptionReply(w, kind, name, count) })
+		}
+	default:
+		c.reply(func(w *bufio.Writer) {
+			writeError(w, fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(command)))
+		})
+	}
+	return true
+}
+
+// authenticate handles AUTH with an API key as the password. The username
+// of AUTH <username> <password> is ignored, keys have no user.
+func (s *Server) authenticate(c *client, args []string) {
+	if len(args) != 1 && len(args) != 2 {
+		c.reply(func(w *bufio.Writer) { writeError(w, "ERR wrong number of arguments for 'auth' command") })
+		return
+	}
+	if s.authenticator == nil {
+		c.reply(func(w *bufio.Writer) { writeError(w, "ERR AUTH called without any API keys configured") })
+		return
+	}
+	principal, err := s.authenticator.Lookup(args[len(args)-1])
+	if err != nil {
+		respLog.Info("refused AUTH", "remote", c.conn.RemoteAddr().String(), "error", err)
+		c.reply(func(w *bufio.Writer) { writeError(w, "WRONGPASS invalid API key") })
+		return
+	}
+	c.principal = principal
+	c.reply(func(w *bufio.Writer) { w.WriteString("+OK\r\n") })
+}
+
+// permitted answers NOPERM and returns false when the client's API key does
+// not have role. Without auth every client is permitted.
+func (s *Server) permitted(c *client, role auth.Role, command string) bool {
+	if s.authenticator == nil || c.principal.Allows(role) {
+		return true
+	}
+	c.reply(func(w *bufio.Writer) {
+		writeError(w, fmt.Sprintf("NOPERM API key %s is a %s, '%s' needs %s", c.principal.Name, c.principal.Role, strings.ToLower(command), role))
+	})
+	return false
+}
+
+// ensureSubscription creates the client's subscription on first use and
+// starts forwarding its messages to the connection.
+func (s *Server) ensureSubscription(c *client) {
+	if c.sub != nil {
+		return
+	}
+	c.sub = s.pubsub.NewSubscription()
+	go func(sub *engine.Subscription) {
+		for message := range sub.Messages {
+			message := message
+			c.reply(func(w *bufio.Writer) {
+				if message.Pattern != "" {
+					writeArrayHeader(w, 4)
+					writeBulk(w, "pmessage")
+					writeBulk(w, message.Pattern)
+				} else {
+					writeArrayHeader(w, 3)
+					writeBulk(w, "message")
+				}
+				writeBulk(w, message.Channel)
+				writeBulk(w, message.Payload)
+			})
+		}
+		// Closed because the client fell behind or disconnected
+		c.conn.Close()
+	}(c.sub)
+}
+
+func (c *client) reply(write func(w *bufio.Writer)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	write(c.writer)
+	if err := c.writer.Flush(); err != nil {
+		respLog.Warn("write failed", "error", err)
+	}
+}
+
+// readCommand reads either a RESP array of bulk strings or an inline command.
+// Lengths are the client's word, so a bulk string is read as it arrives
+// rather than into a buffer of the announced size, and the bulk strings of
+// one command may not add up to more than maxSize. No line, inline commands
+// included, may be longer than maxSize either.
+func readCommand(reader *bufio.Reader, maxSize int) ([]string, error) {
+	line, err := readLine(reader, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 {
+		return nil, errProtocol
+	}
+	if count > maxSize {
+		return nil, errCommandTooLarge
+	}
+	args := make([]string, 0, min(count, 16))
+	remaining := maxSize
+	for i := 0; i < count; i++ {
+		header, err := readLine(reader, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) == 0 || header[0] != '$' {
+			return nil, errProtocol
+		}
+		length, err := strconv.Atoi(header[1:])
+		if err != nil || length < 0 {
+			return nil, errProtocol
+		}
+		if length > remaining {
+			return nil, errCommandTooLarge
+		}
+		remaining -= length
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, reader, int64(length)+2); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf.Bytes()[:length]))
+	}
+	return args, nil
+}
+
+// readLine reads up to the next newline, refusing lines longer than maxSize
+// instead of buffering whatever the client sends.
+func readLine(reader *bufio.Reader, maxSize int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxSize+2 {
+			return "", errCommandTooLarge
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			return strings.TrimRight(string(line), "\r\n"), nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+	}
+}
+
+func writeSubscriptionReply(w *bufio.Writer, kind string, name string, count int) {
+	writeArrayHeader(w, 3)
+	writeBulk(w, kind)
+	if name == "" {
+		w.WriteString("$-1\r\n")
+	} else {
+		writeBulk(w, name)
+	}
+	writeInteger(w, count)
+}
+
+func writeArrayHeader(w *bufio.Writer, n int) {
+	fmt.Fprintf(w, "*%d\r\n", n)
+}
+
+func writeBulk(w *bufio.Writer, value string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(value), value)
+}
+
+func writeInteger(w *bufio.Writer, value int) {
+	fmt.Fprintf(w, ":%d\r\n", value)
+}
+
+func writeError(w *bufio.Writer, message string) {
+	fmt.Fprintf(w, "-%s\r\n", message)
+}
@@ -0,0 +1,96 @@
+package resp
+
+import (
+	"bufio"
+	"distributed-inmemory-cache/auth"
+	"distributed-inmemory-cache/engine"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadCommandCapsItsSize(t *testing.T) {
+	read := func(input string) ([]string, error) {
+		return readCommand(bufio.NewReader(strings.NewReader(input)), 10)
+	}
+	args, err := read("*2\r\n$7\r\nPUBLISH\r\n$3\r\nabc\r\n")
+	if err != nil || len(args) != 2 || args[0] != "PUBLISH" || args[1] != "abc" {
+		t.Fatalf("unexpected command %q, %v", args, err)
+	}
+	// A length far past what is sent is refused before anything is allocated
+	if _, err := read("*1\r\n$2147483647\r\nx\r\n"); !errors.Is(err, errCommandTooLarge) {
+		t.Errorf("expected a huge bulk string to be refused, got %v", err)
+	}
+	// The arguments count together
+	if _, err := read("*2\r\n$7\r\nPUBLISH\r\n$4\r\nabcd\r\n"); !errors.Is(err, errCommandTooLarge) {
+		t.Errorf("expected the command to be refused, got %v", err)
+	}
+	if _, err := read("*2000000000\r\n"); !errors.Is(err, errCommandTooLarge) {
+		t.Errorf("expected a huge array to be refused, got %v", err)
+	}
+}
+
+func TestAuthGuardsCommands(t *testing.T) {
+	authenticator, err := auth.New([]auth.Key{
+		{Name: "reader", Key: "reader-key", Role: auth.Reader},
+		{Name: "writer", Key: "writer-key", Role: auth.Writer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(engine.NewPubSub(), 0, authenticator)
+	send := func(conn net.Conn, reader *bufio.Reader, command string) string {
+		t.Helper()
+		if _, err := conn.Write([]byte(command + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimRight(line, "\r\n")
+	}
+	connect := func() (net.Conn, *bufio.Reader) {
+		client, conn := net.Pipe()
+		go server.handle(conn)
+		t.Cleanup(func() { client.Close() })
+		return client, bufio.NewReader(client)
+	}
+
+	anonymous, reader := connect()
+	if reply := send(anonymous, reader, "PUBLISH jobs run"); !strings.HasPrefix(reply, "-NOAUTH") {
+		t.Errorf("expected PUBLISH without AUTH to be refused, got %q", reply)
+	}
+	if reply := send(anonymous, reader, "AUTH wrong-key"); !strings.HasPrefix(reply, "-WRONGPASS") {
+		t.Errorf("expected an unknown key to be refused, got %q", reply)
+	}
+	if reply := send(anonymous, reader, "AUTH reader-key"); reply != "+OK" {
+		t.Fatalf("expected the reader key to authenticate, got %q", reply)
+	}
+	if reply := send(anonymous, reader, "PUBLISH jobs run"); !strings.HasPrefix(reply, "-NOPERM") {
+		t.Errorf("expected a reader to be refused PUBLISH, got %q", reply)
+	}
+
+	writer, reader := connect()
+	send(writer, reader, "AUTH default writer-key")
+	if reply := send(writer, reader, "PUBLISH jobs run"); reply != ":0" {
+		t.Errorf("expected a writer to publish, got %q", reply)
+	}
+}
+
+func TestReadCommandCapsLines(t *testing.T) {
+	read := func(input string) ([]string, error) {
+		return readCommand(bufio.NewReaderSize(strings.NewReader(input), 16), 32)
+	}
+	args, err := read("PUBLISH jobs " + strings.Repeat("x", 15) + "\r\n")
+	if err != nil || len(args) != 3 {
+		t.Fatalf("expected an inline command past the read buffer to be read, got %q, %v", args, err)
+	}
+	if _, err := read("PUBLISH jobs " + strings.Repeat("x", 64) + "\r\n"); !errors.Is(err, errCommandTooLarge) {
+		t.Errorf("expected a long inline command to be refused, got %v", err)
+	}
+	if _, err := read("*1" + strings.Repeat("0", 64) + "\r\n"); !errors.Is(err, errCommandTooLarge) {
+		t.Errorf("expected a long header line to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"distributed-inmemory-cache/auth"
+	"distributed-inmemory-cache/engine"
+	"distributed-inmemory-cache/pki"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// internal guards an endpoint only nodes call. With TLS it needs a node
+// certificate, so it is unreachable on the plain port. Without it needs the
+// internal key the master passes its nodes, or an admin key.
+func internal(handler http.HandlerFunc) http.HandlerFunc {
+	if !master.TLSEnabled() {
+		return authorized(auth.Internal, handler)
+	}
+	return pki.RequirePeer(pki.NodeName, handler)
+}
+
+// writeAgentCertificate issues a node agent a certificate of the cluster CA
+// for hosts and writes it with its key and the CA to dir, for the agent's
+// -tls-cert, -tls-key and -tls-ca.
+func writeAgentCertificate(dir string, hosts []string) error {
+	bundle, err := engine.IssueAgentCertificate(conf, hosts)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	files := []struct {
+		name    string
+		content []byte
+		mode    os.FileMode
+	}{
+		{"agent.pem", bundle.CertPEM, 0o644},
+		{"agent-key.pem", bundle.KeyPEM, 0o600},
+		{"ca.pem", bundle.CAPEM, 0o644},
+	}
+	for _, file := range files {
+		if err := os.WriteFile(filepath.Join(dir, file.name), file.content, file.mode); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("wrote agent.pem, agent-key.pem and ca.pem for %s to %s\n", strings.Join(hosts, ", "), dir)
+	return nil
+}
+
+// serveTLS serves the same endpoints as the plain port with mTLS, for nodes.
+func serveTLS(handler http.Handler) {
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", master.TLSPort()),
+		Handler:   handler,
+		TLSConfig: master.ServerTLSConfig(),
+	}
+	apiLog.Info("serving nodes with mTLS", "port", master.TLSPort())
+	err := server.ListenAndServeTLS("", "")
+	apiLog.Error("mTLS server stopped", "error", err)
+}
+
+func certificateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var request pki.SigningRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid certificate request", http.StatusBadRequest)
+		return
+	}
+	bundle, err := master.RenewCertificate(r.TLS.VerifiedChains[0][0], request)
+	if errors.Is(err, engine.ErrNotANode) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		apiLog.WarnContext(r.Context(), "could not renew certificate", "error", err)
+		http.Error(w, "Could not renew certificate", http.StatusBadRequest)
+		return
+	}
+	apiLog.InfoContext(r.Context(), "renewed node certificate", "remote", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(bundle)
+}
+
+// joinHandler signs the key of a node the master spawned, for the join token
+// it was started with. Only served on the TLS port, the node has no
+// certificate yet.
+func joinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.TLS == nil {
+		http.Error(w, "Nodes join on the TLS port", http.StatusForbidden)
+		return
+	}
+	var request pki.SigningRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid join request", http.StatusBadRequest)
+		return
+	}
+	bundle, err := master.JoinNode(request)
+	if errors.Is(err, engine.ErrJoinRefused) {
+		apiLog.WarnContext(r.Context(), "refused node join", "remote", r.RemoteAddr, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		apiLog.WarnContext(r.Context(), "could not sign node certificate", "remote", r.RemoteAddr, "error", err)
+		http.Error(w, "Could not sign certificate request", http.StatusBadRequest)
+		return
+	}
+	apiLog.InfoContext(r.Context(), "node joined", "remote", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(bundle)
+}
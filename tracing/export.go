@@ -0,0 +1,324 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queueSize     = 2048
+	batchSize     = 256
+	flushInterval = 2 * time.Second
+)
+
+// Exporter ships a batch of finished spans, encoded as an OTLP
+// ExportTraceServiceRequest in JSON.
+type Exporter interface {
+	Export(payload []byte) error
+}
+
+type Options struct {
+	// Service is reported as service.name, e.g. cache-master
+	Service string
+	// Endpoint of an OTLP/HTTP collector, spans are posted to Endpoint/v1/traces
+	Endpoint string
+	// File receives one export request per line, the format of the
+	// collector's otlpjsonfile receiver
+	File string
+}
+
+var current atomic.Pointer[pipeline]
+
+// Setup starts exporting sampled spans. Without an endpoint or a file spans
+// are still propagated, just not exported.
+func Setup(options Options) error {
+	var exporters []Exporter
+	if options.Endpoint != "" {
+		exporters = append(exporters, NewOTLPExporter(options.Endpoint))
+	}
+	if options.File != "" {
+		file, err := NewFileExporter(options.File)
+		if err != nil {
+			return err
+		}
+		exporters = append(exporters, file)
+	}
+	if previous := current.Swap(nil); previous != nil {
+		previous.stop()
+	}
+	if len(exporters) == 0 {
+		return nil
+	}
+	current.Store(newPipeline(options.Service, exporters))
+	return nil
+}
+
+// Flush exports the spans ended so far and waits for it.
+func Flush() {
+	if p := current.Load(); p != nil {
+		p.flush()
+	}
+}
+
+func export(span *Span) {
+	if p := current.Load(); p != nil {
+		p.add(span)
+	}
+}
+
+// pipeline batches spans in the background, so ending a span never waits
+// for a collector. Spans are dropped while the queue is full.
+type pipeline struct {
+	service   string
+	exporters []Exporter
+	queue     chan *Span
+	flushes   chan chan struct{}
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+func newPipeline(service string, exporters []Exporter) *pipeline {
+	p := &pipeline{
+		service:   service,
+		exporters: exporters,
+		queue:     make(chan *Span, queueSize),
+		flushes:   make(chan chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *pipeline) add(span *Span) {
+	select {
+	case p.queue <- span:
+	default:
+	}
+}
+
+func (p *pipeline) flush() {
+	flushed := make(chan struct{})
+	select {
+	case p.flushes <- flushed:
+		<-flushed
+	case <-p.done:
+	}
+}
+
+func (p *pipeline) stop() {
+	p.stopOnce.Do(func() {
+		p.flush()
+		close(p.done)
+	})
+}
+
+func (p *pipeline) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		payload, err := json.Marshal(encode(p.service, batch))
+		batch = nil
+		if err != nil {
+			return
+		}
+		for _, exporter := range p.exporters {
+			// A collector that is down must not stop the others, the
+			// spans of this batch are lost for it
+			exporter.Export(payload)
+		}
+	}
+	for {
+		select {
+		case span := <-p.queue:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-p.flushes:
+			for drained := false; !drained; {
+				select {
+				case span := <-p.queue:
+					batch = append(batch, span)
+				default:
+					drained = true
+				}
+			}
+			send()
+			close(flushed)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+type OTLPExporter struct {
+	URL        string
+	HTTPClient *http.Client
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		URL:        strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (exporter *OTLPExporter) Export(payload []byte) error {
+	resp, err := exporter.HTTPClient.Post(exporter.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("collector answered " + resp.Status)
+	}
+	return nil
+}
+
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (exporter *FileExporter) Export(payload []byte) error {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	_, err := exporter.file.Write(append(payload, '\n'))
+	return err
+}
+
+// The OTLP JSON encoding: ids in hex, 64 bit integers as strings.
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []attribute `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []spanData `json:"spans"`
+}
+
+type spanData struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              Kind        `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []attribute `json:"attributes,omitempty"`
+	Status            status      `json:"status"`
+}
+
+type status struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type attribute struct {
+	Key   string         `json:"key"`
+	Value attributeValue `json:"value"`
+}
+
+type attributeValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func newAttribute(key string, value interface{}) attribute {
+	var v attributeValue
+	switch typed := value.(type) {
+	case string:
+		v.StringValue = &typed
+	case bool:
+		v.BoolValue = &typed
+	case int:
+		s := strconv.Itoa(typed)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(typed, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &typed
+	default:
+		s := fmt.Sprint(typed)
+		v.StringValue = &s
+	}
+	return attribute{Key: key, Value: v}
+}
+
+func encode(service string, spans []*Span) exportRequest {
+	scope := scopeSpans{Spans: make([]spanData, 0, len(spans))}
+	scope.Scope.Name = "distributed-inmemory-cache"
+	for _, span := range spans {
+		span.mu.Lock()
+		data := spanData{
+			TraceID:           span.context.TraceID.String(),
+			SpanID:            span.context.SpanID.String(),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		}
+		if span.parent != (SpanID{}) {
+			data.ParentSpanID = span.parent.String()
+		}
+		keys := make([]string, 0, len(span.attributes))
+		for key := range span.attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			data.Attributes = append(data.Attributes, newAttribute(key, span.attributes[key]))
+		}
+		if span.err != nil {
+			data.Status = status{Code: 2, Message: span.err.Error()}
+		}
+		span.mu.Unlock()
+		scope.Spans = append(scope.Spans, data)
+	}
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: []attribute{newAttribute("service.name", service)}},
+		ScopeSpans: []scopeSpans{scope},
+	}}}
+}
@@ -0,0 +1,152 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("unexpected span context %+v", sc)
+	}
+	if sc.Traceparent() != header {
+		t.Fatalf("got %s, want %s", sc.Traceparent(), header)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(invalid); err == nil {
+			t.Errorf("%q should be rejected", invalid)
+		}
+	}
+}
+
+func TestSpansAcrossProcessesAreExported(t *testing.T) {
+	var mu sync.Mutex
+	var spans []spanData
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		var request exportRequest
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Errorf("invalid export request: %v", err)
+		}
+		mu.Lock()
+		for _, resource := range request.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans = append(spans, scope.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+	file := filepath.Join(t.TempDir(), "traces.jsonl")
+	if err := Setup(Options{Service: "test", Endpoint: collector.URL, File: file}); err != nil {
+		t.Fatal(err)
+	}
+	defer Setup(Options{})
+
+	// The "node" continues the trace it receives in the header
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(Extract(r.Context(), r.Header), "notify", Server)
+		span.End()
+	}))
+	defer node.Close()
+
+	ctx, set := Start(context.Background(), "set", Server)
+	ctx, notify := Start(ctx, "notify", Client)
+	request, err := NewRequest(ctx, http.MethodPost, node.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	notify.SetError(io.ErrUnexpectedEOF)
+	notify.End()
+	set.End()
+	Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans, want 3: %+v", len(spans), spans)
+	}
+	byID := map[string]spanData{}
+	for _, span := range spans {
+		if span.TraceID != set.Context().TraceID.String() {
+			t.Errorf("span %s is in trace %s, want %s", span.Name, span.TraceID, set.Context().TraceID)
+		}
+		byID[span.SpanID] = span
+	}
+	client := byID[notify.Context().SpanID.String()]
+	if client.ParentSpanID != set.Context().SpanID.String() || client.Kind != Client {
+		t.Errorf("notify is not a client child of set: %+v", client)
+	}
+	if client.Status.Code != 2 {
+		t.Errorf("failed span has status %+v", client.Status)
+	}
+	if root := byID[set.Context().SpanID.String()]; root.ParentSpanID != "" {
+		t.Errorf("set should start the trace: %+v", root)
+	}
+	remote := spans[0]
+	if remote.Name != "notify" || remote.Kind != Server || remote.ParentSpanID != notify.Context().SpanID.String() {
+		t.Errorf("remote span is not a child of the client span: %+v", remote)
+	}
+
+	content, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	lines := 0
+	scanner := bufio.NewScanner(content)
+	for scanner.Scan() {
+		var request exportRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			t.Fatalf("invalid line in trace file: %v", err)
+		}
+		lines++
+	}
+	if lines == 0 {
+		t.Fatal("nothing written to the trace file")
+	}
+}
+
+func TestUnsampledTracesAreNotExported(t *testing.T) {
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	ctx, span := Start(Extract(context.Background(), header), "notify", Server)
+	if span.Context().Sampled {
+		t.Fatal("the sampling decision of the caller must be kept")
+	}
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	if sc, err := ParseTraceparent(outgoing.Get(TraceparentHeader)); err != nil || sc.SpanID != span.Context().SpanID || sc.Sampled {
+		t.Fatalf("unexpected outgoing traceparent %q", outgoing.Get(TraceparentHeader))
+	}
+}
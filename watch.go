@@ -0,0 +1,157 @@
+package main
+
+import (
+	"distributed-inmemory-cache/engine"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const watchKeepAliveInterval = 15 * time.Second
+
+var watchUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// watchHandler streams set, delete and expire events as Server-Sent Events, or
+// over a WebSocket when the request asks for an upgrade. Supported query
+// parameters are `prefix` to filter keys and `from` to resume after an event
+// id or a data version id; SSE clients may resume with the Last-Event-ID
+// header instead.
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from, err := watchFrom(r)
+	if err != nil {
+		http.Error(w, "Invalid event id", http.StatusBadRequest)
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	if caller := principal(r); !caller.CanAccessPrefix(prefix) {
+		http.Error(w, fmt.Sprintf("API key %s may not watch prefix %q", caller.Name, prefix), http.StatusForbidden)
+		return
+	}
+
+	watcher, err := master.Watch(prefix, from)
+	if errors.Is(err, engine.ErrHistoryTruncated) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer watcher.Close()
+
+	if websocket.IsWebSocketUpgrade(r) {
+		serveWatchWebSocket(w, r, watcher)
+		return
+	}
+	serveWatchSSE(w, r, watcher)
+}
+
+func watchFrom(r *http.Request) (engine.EventID, error) {
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = r.Header.Get("Last-Event-ID")
+	}
+	if from == "" {
+		return engine.LiveEvents, nil
+	}
+	return engine.ParseEventID(from)
+}
+
+func serveWatchSSE(w http.ResponseWriter, r *http.Request, watcher *engine.Watcher) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				apiLog.ErrorContext(r.Context(), "could not marshal event", "error", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID(), event.Type, payload)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func serveWatchWebSocket(w http.ResponseWriter, r *http.Request, watcher *engine.Watcher) {
+	conn, err := watchUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		apiLog.WarnContext(r.Context(), "websocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// The client never sends anything meaningful, but reading is needed to
+	// process control frames and notice when the connection goes away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(watchKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return
+			}
+		case event, ok := <-watcher.Events:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "watcher fell behind"))
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		}
+	}
+}
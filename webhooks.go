@@ -0,0 +1,90 @@
+package main
+
+import (
+	"distributed-inmemory-cache/engine"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+type webhookRequest struct {
+	URL    string `json:"url"`
+	Prefix string `json:"prefix"`
+	Secret string `json:"secret"`
+}
+
+// webhooksHandler lists webhooks on GET, registers one on POST and removes
+// the one named by the `id` query parameter on DELETE.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(master.Webhooks())
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Unable to read body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		var request webhookRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if request.Secret == "" {
+			http.Error(w, "A signing secret is required", http.StatusBadRequest)
+			return
+		}
+
+		if caller := principal(r); !caller.CanAccessPrefix(request.Prefix) {
+			http.Error(w, fmt.Sprintf("API key %s may not watch prefix %q", caller.Name, request.Prefix), http.StatusForbidden)
+			return
+		}
+
+		apiLog.InfoContext(r.Context(), "register webhook", "url", request.URL)
+		webhook, err := master.RegisterWebhook(request.URL, request.Prefix, request.Secret)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(webhook)
+	case http.MethodDelete:
+		apiLog.InfoContext(r.Context(), "delete webhook", "id", r.URL.Query().Get("id"))
+		err := master.DeleteWebhook(r.URL.Query().Get("id"))
+		if errors.Is(err, engine.ErrWebhookNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookDeadLettersHandler lists dead letters on GET, queues them again on
+// POST (all of them, or the one named by `id`) and clears them on DELETE.
+func webhookDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(master.WebhookDeadLetters())
+	case http.MethodPost:
+		retried := master.RetryWebhookDeadLetter(r.URL.Query().Get("id"))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]int{"retried": retried})
+	case http.MethodDelete:
+		master.ClearWebhookDeadLetters()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}